@@ -10,15 +10,18 @@ import (
 )
 
 func deviceLogin(oidcTokenURI, oidcDeviceURI, clientId string) (*ssoclient.LoginResult, error) {
-	return ssoclient.LoginWithDeviceAuth(
+	return ssoclient.LoginWithDeviceAuthInfo(
 		ssoclient.DeviceAuthConfig{
 			DeviceAuthURI: oidcDeviceURI,
 			TokenURI:      oidcTokenURI,
 			ClientId:      clientId,
 		},
-		func(verificationURI, userCode string) {
-			fmt.Println("Login at: ", verificationURI)
-			fmt.Println("User code:", userCode)
+		func(info ssoclient.DeviceAuthInfo) {
+			fmt.Println("Login at: ", info.VerificationURI)
+			fmt.Println("User code:", info.UserCode)
+			if info.VerificationURIComplete != "" {
+				fmt.Println("Or open:  ", info.VerificationURIComplete)
+			}
 		},
 	)
 }
@@ -17,16 +17,20 @@ func startHTTPServer(port int) {
 }
 
 func main() {
-	context := ssoproxy.NewContext(ssoproxy.OIDCConfig{
-		BaseURI:          os.Getenv("OIDC_BASE_URI"),
-		RedirectURI:      os.Getenv("OIDC_REDIRECT_URI"),
-		AuthorizationURI: os.Getenv("OIDC_AUTHORIZATION_URI"),
-		ClientId:         os.Getenv("OIDC_CLIENT_ID"),
-		ClientSecret:     os.Getenv("OIDC_CLIENT_SECRET"),
-	})
+	oidcConfig, err := ssoproxy.OIDCConfigFromEnv()
+	if err != nil {
+		slog.Error(fmt.Sprintf("Failed to start HTTP server: %v", err))
+		os.Exit(1)
+	}
+	context := ssoproxy.NewContext(oidcConfig)
 	context.Logger = slog.Default()
-	http.Handle("/cli-login", ssoproxy.OIDCLoginHandler(context))
-	http.Handle("/cli-logged-in", ssoproxy.OIDCRedirectHandler(context))
+	// redirect handler is mounted at path of OIDC_REDIRECT_URI
+	if err := ssoproxy.RegisterHandlers(http.DefaultServeMux, context, "/cli-login"); err != nil {
+		slog.Error(fmt.Sprintf("Failed to start HTTP server: %v", err))
+		os.Exit(1)
+	}
+	http.Handle("/cli-logout", ssoproxy.OIDCLogoutHandler(context))
+	http.Handle("/health", ssoproxy.HealthHandler(context))
 
 	port, err := strconv.Atoi(os.Getenv("HTTP_PORT"))
 	if err != nil {
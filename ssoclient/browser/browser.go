@@ -0,0 +1,87 @@
+// Package browser opens URIs received during login in user's default browser,
+// so users of interactive CLIs don't have to copy them.
+package browser
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	"github.com/mlosinsky/clisso/ssoclient"
+)
+
+// Starts a command without waiting for it to finish, replaced in tests.
+var startCommand = func(name string, args ...string) error {
+	return exec.Command(name, args...).Start()
+}
+
+// Opens uri in user's default browser using xdg-open on Linux and BSDs, open on macOS
+// and rundll32 on Windows. Only absolute http and https URIs are opened, the URI is received from a proxy
+// or IdP and other schemes, e.g. file, would let them run local handlers. Returns error if the URI is rejected
+// or the browser can't be opened, e.g. on other systems or when xdg-open is not installed on a headless server.
+func OpenBrowser(uri string) error {
+	return openBrowser(runtime.GOOS, uri)
+}
+
+func openBrowser(goos, uri string) error {
+	if err := validateBrowserURI(uri); err != nil {
+		return err
+	}
+	var err error
+	switch goos {
+	case "linux", "freebsd", "openbsd", "netbsd":
+		err = startCommand("xdg-open", uri)
+	case "darwin":
+		err = startCommand("open", uri)
+	case "windows":
+		err = startCommand("rundll32", "url.dll,FileProtocolHandler", uri)
+	default:
+		return fmt.Errorf("opening browser is not supported on %s", goos)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open browser: %w", err)
+	}
+	return nil
+}
+
+// Checks that uri is an absolute http or https URI with a host.
+func validateBrowserURI(uri string) error {
+	parsedURI, err := url.Parse(uri)
+	if err != nil {
+		return fmt.Errorf("refusing to open invalid URI in browser: %w", err)
+	}
+	scheme := strings.ToLower(parsedURI.Scheme)
+	if (scheme != "http" && scheme != "https") || parsedURI.Host == "" {
+		return fmt.Errorf("refusing to open URI '%s' in browser, only http and https URIs are allowed", uri)
+	}
+	return nil
+}
+
+// Returns callback for ssoclient.LoginWithSSOProxy that opens login URI in user's browser,
+// the URI is printed to out instead if the browser can't be opened.
+func OpenOrPrint(out io.Writer) func(uri string) {
+	return func(uri string) {
+		if err := OpenBrowser(uri); err != nil {
+			fmt.Fprintf(out, "Open %s in your browser to log in\n", uri)
+		}
+	}
+}
+
+// Returns callback for ssoclient.LoginWithDeviceAuthInfo that opens verification URI in user's browser
+// and prints user code to out, the verification URI is printed as well if the browser can't be opened.
+// Complete verification URI with user code is preferred if IdP returned it.
+func OpenOrPrintDeviceAuth(out io.Writer) func(info ssoclient.DeviceAuthInfo) {
+	return func(info ssoclient.DeviceAuthInfo) {
+		uri := info.VerificationURIComplete
+		if uri == "" {
+			uri = info.VerificationURI
+		}
+		if err := OpenBrowser(uri); err != nil {
+			fmt.Fprintf(out, "Open %s in your browser to log in\n", uri)
+		}
+		fmt.Fprintf(out, "Your code: %s\n", info.UserCode)
+	}
+}
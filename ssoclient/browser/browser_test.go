@@ -0,0 +1,91 @@
+package browser
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mlosinsky/clisso/ssoclient"
+)
+
+// Replaces command execution with recording of commands, returned func restores it.
+func mockStartCommand(err error) (commands *[]string, restore func()) {
+	recorded := []string{}
+	original := startCommand
+	startCommand = func(name string, args ...string) error {
+		recorded = append(recorded, strings.Join(append([]string{name}, args...), " "))
+		return err
+	}
+	return &recorded, func() { startCommand = original }
+}
+
+func TestOpenBrowserRunsCommandOfOS(t *testing.T) {
+	commands, restore := mockStartCommand(nil)
+	defer restore()
+	for goos, expectedCommand := range map[string]string{
+		"linux":   "xdg-open https://sso.example.com/login",
+		"freebsd": "xdg-open https://sso.example.com/login",
+		"darwin":  "open https://sso.example.com/login",
+		"windows": "rundll32 url.dll,FileProtocolHandler https://sso.example.com/login",
+	} {
+		*commands = []string{}
+		assert.NoError(t, openBrowser(goos, "https://sso.example.com/login"), goos)
+		assert.Equal(t, []string{expectedCommand}, *commands, goos)
+	}
+
+	*commands = []string{}
+	assert.Error(t, openBrowser("plan9", "https://sso.example.com/login"))
+	assert.Empty(t, *commands)
+}
+
+func TestOpenBrowserRejectsNonHTTPURIs(t *testing.T) {
+	commands, restore := mockStartCommand(nil)
+	defer restore()
+	for _, uri := range []string{
+		"file:///etc/passwd",
+		"javascript:alert(1)",
+		"smb://attacker.example.com/share",
+		"/relative/login",
+		"https:///no-host",
+		"-flag",
+		"http://[::1",
+	} {
+		assert.Error(t, openBrowser("linux", uri), uri)
+	}
+	assert.Empty(t, *commands)
+
+	assert.NoError(t, openBrowser("linux", "HTTP://sso.example.com/login"))
+	assert.Len(t, *commands, 1)
+}
+
+func TestOpenOrPrintFallsBackToPrintingURI(t *testing.T) {
+	_, restore := mockStartCommand(errors.New("xdg-open not found"))
+	defer restore()
+	out := &bytes.Buffer{}
+	OpenOrPrint(out)("https://sso.example.com/login")
+	assert.Equal(t, "Open https://sso.example.com/login in your browser to log in\n", out.String())
+
+	out.Reset()
+	OpenOrPrintDeviceAuth(out)(ssoclient.DeviceAuthInfo{
+		VerificationURI: "https://sso.example.com/device",
+		UserCode:        "ABCD-EFGH",
+	})
+	assert.Equal(t, "Open https://sso.example.com/device in your browser to log in\nYour code: ABCD-EFGH\n", out.String())
+}
+
+func TestOpenOrPrintDeviceAuthOpensCompleteURI(t *testing.T) {
+	commands, restore := mockStartCommand(nil)
+	defer restore()
+	out := &bytes.Buffer{}
+	OpenOrPrintDeviceAuth(out)(ssoclient.DeviceAuthInfo{
+		VerificationURI:         "https://sso.example.com/device",
+		VerificationURIComplete: "https://sso.example.com/device?user_code=ABCD-EFGH",
+		UserCode:                "ABCD-EFGH",
+	})
+	assert.Len(t, *commands, 1)
+	assert.Contains(t, (*commands)[0], "https://sso.example.com/device?user_code=ABCD-EFGH")
+	assert.Equal(t, "Your code: ABCD-EFGH\n", out.String())
+}
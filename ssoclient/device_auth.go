@@ -1,13 +1,18 @@
 package ssoclient
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
 	"time"
+	"unicode"
 )
 
 type DeviceAuthConfig struct {
@@ -17,10 +22,84 @@ type DeviceAuthConfig struct {
 	TokenURI string
 	// OAuth client id
 	ClientId string
+	// Optional OAuth client secret of confidential clients, sent on Device Authorization and token requests if set
+	ClientSecret string
+	// How client credentials are sent if ClientSecret is set, TokenAuthMethodPost (default) or TokenAuthMethodBasic
+	TokenAuthMethod string
 	// Optional OAuth scope, uses "openid" by default and adds this value to it
 	Scope string
+	// If enabled "openid" is not added to Scope, e.g. for plain OAuth 2.0 providers that reject it,
+	// no scope is sent if Scope is empty
+	OmitOpenIDScope bool
+	// Optional login_hint_token identifying the user, sent on Device Authorization request if set
+	LoginHintToken string
+	// Optional audience of the access token, sent on Device Authorization and token requests if set.
+	// Some IdPs (e.g. Auth0) require it to issue a JWT access token for an API instead of an opaque one.
+	Audience string
+	// Optional extra parameters added to token poll requests, e.g. "resource" (RFC 8707),
+	// parameters of device flow like "grant_type" can't be overridden
+	TokenExtraParams map[string]string
+	// Optional formatter of user code before it is passed to the caller, user code is passed as received by default
+	UserCodeFormatter func(userCode string) string
+	// Optional callback called after each poll of token endpoint that did not finish the login, with poll attempt
+	// starting at 1 and status returned by IdP (authorization_pending or slow_down), e.g. to update a spinner
+	PollProgress func(attempt int, status string)
+	// Optional bounds of interval in which token endpoint is polled, interval requested by IdP
+	// is clamped to them, 1 second and 60 seconds by default
+	MinPollInterval time.Duration
+	MaxPollInterval time.Duration
+	// Optional number of consecutive token requests failed with a network error that are retried with backoff
+	// while polling, 3 by default, negative value disables retries
+	MaxPollRetries int
+	// Optional logger of login lifecycle events, nothing is logged by default
+	Logger *slog.Logger
+	// If enabled the callback receiving verification URI and user code is called in a new goroutine, so polling
+	// starts immediately even if the callback blocks, e.g. while it waits for user to scan a QR code. The callback
+	// may then still run after the login returned. By default it is called before polling starts
+	ConcurrentCallback bool
+	// Optional PEM encoded CA certificates trusted in addition to system roots when connecting to IdP,
+	// e.g. a CA of internal IdP with a self-signed certificate
+	CACertPEM []byte
+
+	// client sending requests to IdP, created from CACertPEM when login starts
+	client *http.Client
 }
 
+// Checks that required fields DeviceAuthURI, TokenURI and ClientId are set, that URIs are absolute URIs
+// and that CACertPEM contains a certificate if set.
+// All found problems are returned joined.
+func (config DeviceAuthConfig) Validate() error {
+	errs := []error{}
+	if config.ClientId == "" {
+		errs = append(errs, errors.New("ClientId is required"))
+	}
+	for _, uri := range []struct{ name, uri string }{
+		{"DeviceAuthURI", config.DeviceAuthURI},
+		{"TokenURI", config.TokenURI},
+	} {
+		if uri.uri == "" {
+			errs = append(errs, fmt.Errorf("%s is required", uri.name))
+		} else if parsedURI, err := url.Parse(uri.uri); err != nil {
+			errs = append(errs, fmt.Errorf("%s is invalid: %w", uri.name, err))
+		} else if parsedURI.Scheme == "" || parsedURI.Host == "" {
+			errs = append(errs, fmt.Errorf("%s is invalid: '%s' is not an absolute URI", uri.name, uri.uri))
+		}
+	}
+	if config.TokenAuthMethod != "" && config.TokenAuthMethod != TokenAuthMethodPost && config.TokenAuthMethod != TokenAuthMethodBasic {
+		errs = append(errs, fmt.Errorf("unknown TokenAuthMethod '%s'", config.TokenAuthMethod))
+	}
+	if _, err := newCAHTTPClient(config.CACertPEM); err != nil {
+		errs = append(errs, fmt.Errorf("CACertPEM is invalid: %w", err))
+	}
+	return errors.Join(errs...)
+}
+
+// Client credentials are sent in request body (client_secret_post).
+const TokenAuthMethodPost = "post"
+
+// Client secret is sent in Authorization header using HTTP Basic auth (client_secret_basic).
+const TokenAuthMethodBasic = "basic"
+
 type deviceAuthResponse struct {
 	DeviceCode              string `json:"device_code"`
 	UserCode                string `json:"user_code"`
@@ -31,19 +110,75 @@ type deviceAuthResponse struct {
 }
 
 type tokenErrorResponse struct {
-	Error string `json:"error"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+	// Optional revised poll interval in seconds, sent by some IdPs with authorization_pending or slow_down
+	Interval int `json:"interval"`
 }
 
 type tokenSuccessResponse struct {
-	AccessToken  string `json:"access_token"`
-	ExpiresIn    int    `json:"expires_in"`
-	RefreshToken string `json:"refresh_token"`
+	AccessToken  string           `json:"access_token"`
+	ExpiresIn    expiresInSeconds `json:"expires_in"`
+	RefreshToken string           `json:"refresh_token"`
+	TokenType    string           `json:"token_type"`
+	Scope        string           `json:"scope"`
+	// whole response body
+	raw json.RawMessage
+}
+
+// Lifetime of tokens in seconds received in expires_in field. Some IdPs send it as a JSON string
+// instead of a number, both are accepted and a missing or null value means unknown lifetime (zero).
+type expiresInSeconds int
+
+func (seconds *expiresInSeconds) UnmarshalJSON(data []byte) error {
+	value := strings.Trim(string(data), `"`)
+	if value == "" || value == "null" {
+		*seconds = 0
+		return nil
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		return fmt.Errorf("invalid expires_in value %s: %w", data, err)
+	}
+	*seconds = expiresInSeconds(parsed)
+	return nil
 }
 
+// Returned by device flow when user or IdP denied the authorization request.
+var ErrAccessDenied = errors.New("access was denied")
+
+// Returned by device flow when its context was cancelled, e.g. by deviceAuthStarted callback
+// of LoginWithDeviceAuthContext after user decided not to log in.
+var ErrCanceled = errors.New("login was canceled")
+
+// Returned by device flow when device code expired before user logged in.
+var ErrAuthorizationExpired = errors.New("authorization attempt expired")
+
+// Duration of one second of poll interval requested by IdP, shortened in tests.
+var pollIntervalUnit = time.Second
+
 const authorizationPendingError = "authorization_pending"
 const slowDownError = "slow_down"
 const accessDeniedError = "access_denied"
 const expiredTokenError = "expired_token"
+const invalidGrantError = "invalid_grant"
+
+// Information about a started device authorization that should be shown to the user.
+type DeviceAuthInfo struct {
+	// URI where user logs in and enters user code
+	VerificationURI string
+	// Optional URI that already contains user code, e.g. for a one-click link or a QR code, empty if IdP does not return it
+	VerificationURIComplete string
+	// User code formatted by DeviceAuthConfig.UserCodeFormatter if set
+	UserCode string
+	// Lifetime of device and user code in seconds
+	ExpiresIn int
+	// Time when device and user code expire computed from ExpiresIn when device authorization started,
+	// zero if IdP did not return ExpiresIn. Polling is pointless afterwards, so callers can show that the code expired
+	ExpiresAt time.Time
+	// Interval in seconds in which IdP is polled for tokens
+	Interval int
+}
 
 // Starts the login process using OAuth 2.0 Device Grant.
 // This login flow doesn't require a proxy, but OAuth 2.0 Device Grant must be enabled on the IdP.
@@ -51,59 +186,175 @@ const expiredTokenError = "expired_token"
 //
 //	The flow performs these steps:
 //	1. Calls Device Authorization Endpoint and receives device code, user code and verification URI
-//	2. The verification URI will be passed to verificationURIReceived func
+//	2. The verification URI will be passed to verificationURIReceived func, polling starts after it returns
+//	   unless DeviceAuthConfig.ConcurrentCallback is enabled
 //	3. While waiting for user to log in, IdP /token endpoint will be polled
 //	4. After user logs in the poll attempt will be successful returning access and refresh token
 //	5. These tokens will be returned to the function caller
 //
 // After successful login OIDC access and refresh tokens are returned.
+// Use LoginWithDeviceAuthInfo to also receive the complete verification URI.
 func LoginWithDeviceAuth(
 	config DeviceAuthConfig,
 	verificationURIReceived func(verificationURI, userCode string),
 ) (*LoginResult, error) {
-	deviceRes, err := callDeviceAuthorizationEndpoint(config.DeviceAuthURI, config.ClientId, config.Scope)
+	return LoginWithDeviceAuthInfo(config, func(info DeviceAuthInfo) {
+		verificationURIReceived(info.VerificationURI, info.UserCode)
+	})
+}
+
+// Starts the login process using OAuth 2.0 Device Grant the same way as LoginWithDeviceAuth,
+// but passes all information about the started device authorization to deviceAuthStarted,
+// including the complete verification URI that can be rendered as a link or a QR code.
+func LoginWithDeviceAuthInfo(
+	config DeviceAuthConfig,
+	deviceAuthStarted func(info DeviceAuthInfo),
+) (*LoginResult, error) {
+	return LoginWithDeviceAuthContext(context.Background(), config, deviceAuthStarted)
+}
+
+// Starts the login process using OAuth 2.0 Device Grant the same way as LoginWithDeviceAuthInfo,
+// but the login is aborted when ctx is done, e.g. when deviceAuthStarted cancels it because user
+// does not want to log in. Requests to IdP and polling stop and an error wrapping ErrCanceled is returned.
+// Errors of a started login are *LoginError, only an invalid config is reported with a plain error.
+func LoginWithDeviceAuthContext(
+	ctx context.Context,
+	config DeviceAuthConfig,
+	deviceAuthStarted func(info DeviceAuthInfo),
+) (*LoginResult, error) {
+	if err := config.Validate(); err != nil {
+		return nil, errors.Join(errors.New("invalid Device Authorization config"), err)
+	}
+	config.client, _ = newCAHTTPClient(config.CACertPEM)
+	logger := loggerOrDiscard(config.Logger)
+	result, err := loginWithDeviceAuth(ctx, config, logger, deviceAuthStarted)
 	if err != nil {
-		return nil, err
+		logger.Error("Device Authorization login failed", "error", err)
+		return nil, newLoginError(err)
+	}
+	logger.Info("Received tokens", "expiresIn", result.Expiration, "scope", result.Scope)
+	return result, nil
+}
+
+// Starts the login process using OAuth 2.0 Device Grant like LoginWithDeviceAuthContext, but when the device code
+// expires before user logs in, a new device code is requested and passed to deviceAuthStarted again, so users
+// who walked away can still log in. At most maxAttempts device codes are requested, values below 1 mean 1.
+// No new device code is requested after ctx is done.
+func LoginWithDeviceAuthRetry(
+	ctx context.Context,
+	config DeviceAuthConfig,
+	deviceAuthStarted func(info DeviceAuthInfo),
+	maxAttempts int,
+) (*LoginResult, error) {
+	logger := loggerOrDiscard(config.Logger)
+	for attempt := 1; ; attempt++ {
+		result, err := LoginWithDeviceAuthContext(ctx, config, deviceAuthStarted)
+		if !errors.Is(err, ErrAuthorizationExpired) || attempt >= maxAttempts {
+			return result, err
+		}
+		logger.Info("Device code expired, requesting a new one", "attempt", attempt, "maxAttempts", maxAttempts)
+	}
+}
+
+func loginWithDeviceAuth(
+	ctx context.Context,
+	config DeviceAuthConfig,
+	logger *slog.Logger,
+	deviceAuthStarted func(info DeviceAuthInfo),
+) (*LoginResult, error) {
+	logger.Debug("Sending Device Authorization request", "uri", config.DeviceAuthURI)
+	deviceRes, err := callDeviceAuthorizationEndpoint(ctx, config)
+	if err != nil {
+		return nil, deviceAuthContextError(ctx, err)
+	}
+	userCode := deviceRes.UserCode
+	if config.UserCodeFormatter != nil {
+		userCode = config.UserCodeFormatter(userCode)
 	}
-	verificationURIReceived(deviceRes.VerificationURI, deviceRes.UserCode)
 	if deviceRes.Interval == 0 {
 		// Poll interval is optional in Device Authorization RFC and if not defined, 5s should be used
 		deviceRes.Interval = 5
 	}
-	tokenRes, err := pollTokensEndpoint(
-		deviceRes.DeviceCode,
-		config.ClientId,
-		config.TokenURI,
-		deviceRes.Interval,
-		deviceRes.ExpiresIn,
+	deviceRes.Interval = config.clampPollInterval(deviceRes.Interval)
+	logger.Info(
+		"Device Authorization started",
+		"verificationURI", deviceRes.VerificationURI,
+		"expiresIn", deviceRes.ExpiresIn,
+		"interval", deviceRes.Interval,
 	)
+	info := DeviceAuthInfo{
+		VerificationURI:         deviceRes.VerificationURI,
+		VerificationURIComplete: deviceRes.VerificationURIComplete,
+		UserCode:                userCode,
+		ExpiresIn:               deviceRes.ExpiresIn,
+		ExpiresAt:               expiresAt(deviceRes.ExpiresIn),
+		Interval:                deviceRes.Interval,
+	}
+	if config.ConcurrentCallback {
+		go deviceAuthStarted(info)
+	} else {
+		deviceAuthStarted(info)
+	}
+	tokenRes, err := pollTokensEndpoint(ctx, config, logger, deviceRes.DeviceCode, deviceRes.Interval, deviceRes.ExpiresIn)
 	if err != nil {
 		return nil, err
 	}
 	return &LoginResult{
 		AccessToken:  tokenRes.AccessToken,
 		RefreshToken: tokenRes.RefreshToken,
-		Expiration:   tokenRes.ExpiresIn,
+		Expiration:   int(tokenRes.ExpiresIn),
+		ExpiresAt:    expiresAt(int(tokenRes.ExpiresIn)),
+		TokenType:    tokenRes.TokenType,
+		Scope:        tokenRes.Scope,
+		RawResponse:  tokenRes.raw,
 	}, nil
 }
 
+// Formats user code into groups of groupSize characters joined by separator, e.g. "ABCD-EFGH".
+// Separators already present in user code (any non-alphanumeric characters) are removed first,
+// so the same format is shown regardless of whether the IdP formats user codes itself.
+// Can be used as DeviceAuthConfig.UserCodeFormatter.
+func FormatUserCode(userCode string, groupSize int, separator string) string {
+	chars := make([]rune, 0, len(userCode))
+	for _, char := range userCode {
+		if unicode.IsLetter(char) || unicode.IsDigit(char) {
+			chars = append(chars, char)
+		}
+	}
+	if groupSize <= 0 {
+		return string(chars)
+	}
+	groups := make([]string, 0, len(chars)/groupSize+1)
+	for start := 0; start < len(chars); start += groupSize {
+		groups = append(groups, string(chars[start:min(start+groupSize, len(chars))]))
+	}
+	return strings.Join(groups, separator)
+}
+
 // Issues an HTTP GET for Device Authorization.
-func callDeviceAuthorizationEndpoint(OAuthDeviceAuthURI, clientId, scope string) (*deviceAuthResponse, error) {
-	res, err := http.PostForm(OAuthDeviceAuthURI, url.Values{
-		"client_id": {clientId},
-		"scope":     {fmt.Sprintf("%s openid", scope)},
-	})
+func callDeviceAuthorizationEndpoint(ctx context.Context, config DeviceAuthConfig) (*deviceAuthResponse, error) {
+	form := url.Values{}
+	if scope := config.scope(); scope != "" {
+		form.Set("scope", scope)
+	}
+	if config.LoginHintToken != "" {
+		form.Set("login_hint_token", config.LoginHintToken)
+	}
+	if config.Audience != "" {
+		form.Set("audience", config.Audience)
+	}
+	res, err := postClientAuthForm(ctx, config, config.DeviceAuthURI, form)
 	if err != nil {
 		return nil, errors.Join(errors.New("failed to execute Device Authorization request"), err)
 	}
-	if res.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("failed to execute Device Authorization request, response status was %d, expected 200", res.StatusCode)
-	}
+	defer res.Body.Close()
 	rawBody, err := io.ReadAll(res.Body)
 	if err != nil {
-		return nil, errors.Join(errors.New("failed to read response body of Device Authorization request"))
+		return nil, errors.Join(errors.New("failed to read response body of Device Authorization request"), err)
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, deviceAuthorizationError(res.StatusCode, rawBody)
 	}
-	defer res.Body.Close()
 
 	var body deviceAuthResponse
 	if err := json.Unmarshal(rawBody, &body); err != nil {
@@ -112,27 +363,121 @@ func callDeviceAuthorizationEndpoint(OAuthDeviceAuthURI, clientId, scope string)
 	return &body, nil
 }
 
+// Sends form in a POST request to an IdP endpoint with client credentials added according to config.
+func postClientAuthForm(ctx context.Context, config DeviceAuthConfig, uri string, form url.Values) (*http.Response, error) {
+	form.Set("client_id", config.ClientId)
+	if config.ClientSecret != "" && config.TokenAuthMethod != TokenAuthMethodBasic {
+		form.Set("client_secret", config.ClientSecret)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, uri, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if config.ClientSecret != "" && config.TokenAuthMethod == TokenAuthMethodBasic {
+		// credentials must be form-urlencoded before used in Basic auth (RFC 6749 section 2.3.1)
+		req.SetBasicAuth(url.QueryEscape(config.ClientId), url.QueryEscape(config.ClientSecret))
+	}
+	client := config.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return client.Do(req)
+}
+
+// Creates login error from a non-200 Device Authorization response, OAuth error and its description are included
+// if the body contains them, otherwise the raw body is included.
+func deviceAuthorizationError(statusCode int, rawBody []byte) error {
+	loginErr := &LoginError{Category: ErrorCategoryIdP, StatusCode: statusCode}
+	var body tokenErrorResponse
+	if err := json.Unmarshal(rawBody, &body); err != nil || body.Error == "" {
+		if len(rawBody) == 0 {
+			loginErr.Err = fmt.Errorf("failed to execute Device Authorization request, response status was %d, expected 200", statusCode)
+		} else {
+			loginErr.Err = fmt.Errorf("failed to execute Device Authorization request, response status was %d, expected 200, body: %s", statusCode, rawBody)
+		}
+		return loginErr
+	}
+	loginErr.Code = body.Error
+	if body.ErrorDescription != "" {
+		loginErr.Err = fmt.Errorf("failed to execute Device Authorization request, response status was %d with error '%s': %s", statusCode, body.Error, body.ErrorDescription)
+	} else {
+		loginErr.Err = fmt.Errorf("failed to execute Device Authorization request, response status was %d with error '%s'", statusCode, body.Error)
+	}
+	return loginErr
+}
+
+// Returns scope sent on Device Authorization request, "openid" is added unless OmitOpenIDScope is enabled.
+func (config DeviceAuthConfig) scope() string {
+	if config.OmitOpenIDScope {
+		return strings.TrimSpace(config.Scope)
+	}
+	return fmt.Sprintf("%s openid", config.Scope)
+}
+
+// Returns poll interval in seconds requested by IdP clamped to DeviceAuthConfig.MinPollInterval
+// and DeviceAuthConfig.MaxPollInterval.
+func (config DeviceAuthConfig) clampPollInterval(interval int) int {
+	minInterval, maxInterval := config.MinPollInterval, config.MaxPollInterval
+	if minInterval <= 0 {
+		minInterval = time.Second
+	}
+	if maxInterval <= 0 {
+		maxInterval = time.Minute
+	}
+	return min(max(interval, int(minInterval/time.Second)), max(int(maxInterval/time.Second), 1))
+}
+
+// Returns DeviceAuthConfig.MaxPollRetries or its default.
+func (config DeviceAuthConfig) maxPollRetries() int {
+	if config.MaxPollRetries == 0 {
+		return 3
+	}
+	return max(config.MaxPollRetries, 0)
+}
+
 // Polls the OAuth 2.0 Token endpoint according to Device Authorization Grant RFC.
+// Token requests that failed with a network error are retried with backoff up to DeviceAuthConfig.MaxPollRetries times in a row.
 func pollTokensEndpoint(
+	ctx context.Context,
+	config DeviceAuthConfig,
+	logger *slog.Logger,
 	deviceCode string,
-	clientId string,
-	OAuthTokenURI string,
 	pollInterval int,
 	maxPollTime int,
 ) (*tokenSuccessResponse, error) {
 	timePassed := 0
-	for timePassed <= maxPollTime {
-		time.Sleep(time.Second * time.Duration(pollInterval))
+	failedRequests := 0
+	for attempt := 1; timePassed <= maxPollTime; attempt++ {
+		if err := sleepContext(ctx, pollIntervalUnit*time.Duration(pollInterval)); err != nil {
+			return nil, deviceAuthContextError(ctx, err)
+		}
 		timePassed += pollInterval
 
-		res, err := http.PostForm(OAuthTokenURI, url.Values{
-			"grant_type":  {"urn:ietf:params:oauth:grant-type:device_code"},
-			"device_code": {deviceCode},
-			"client_id":   {clientId},
-		})
-		if err != nil {
-			return nil, errors.Join(errors.New("an error occurred while after polling /token endpoint"), err)
+		form := url.Values{}
+		for param, value := range config.TokenExtraParams {
+			form.Set(param, value)
+		}
+		form.Set("grant_type", "urn:ietf:params:oauth:grant-type:device_code")
+		form.Set("device_code", deviceCode)
+		if config.Audience != "" {
+			form.Set("audience", config.Audience)
 		}
+		res, err := postClientAuthForm(ctx, config, config.TokenURI, form)
+		if err != nil && ctx.Err() != nil {
+			return nil, deviceAuthContextError(ctx, err)
+		} else if err != nil {
+			failedRequests++
+			if failedRequests > config.maxPollRetries() {
+				return nil, errors.Join(errors.New("an error occurred while after polling /token endpoint"), err)
+			}
+			logger.Warn("Failed to poll token endpoint, retrying", "attempt", attempt, "error", err)
+			if err := sleepContext(ctx, retryBackoff(failedRequests)); err != nil {
+				return nil, deviceAuthContextError(ctx, err)
+			}
+			continue
+		}
+		failedRequests = 0
 
 		rawResBody, err := io.ReadAll(res.Body)
 		if err != nil {
@@ -144,6 +489,7 @@ func pollTokensEndpoint(
 			if err := json.Unmarshal([]byte(rawResBody), &resBody); err != nil {
 				return nil, errors.New("received invalid format of success poll response, could not deserialize JSON body")
 			}
+			resBody.raw = rawResBody
 			return &resBody, nil
 		}
 
@@ -153,15 +499,53 @@ func pollTokensEndpoint(
 		}
 		res.Body.Close() // defer would execute after function return
 
+		logger.Debug("Polled token endpoint", "attempt", attempt, "status", resBody.Error)
 		if resBody.Error == slowDownError {
-			pollInterval += 5 // implemeted according to Device Auth RFC
+			// implemeted according to Device Auth RFC, unless IdP revised the interval to a longer one
+			pollInterval = config.clampPollInterval(max(pollInterval+5, resBody.Interval))
+		} else if resBody.Error == authorizationPendingError && resBody.Interval > 0 {
+			// only a longer interval is adopted, so it can't undo slowing down requested by slow_down
+			pollInterval = max(pollInterval, config.clampPollInterval(resBody.Interval))
 		} else if resBody.Error == accessDeniedError {
-			return nil, errors.New("can't poll /token endpoint, access was denied")
+			return nil, &LoginError{
+				Category:   ErrorCategoryIdP,
+				Code:       resBody.Error,
+				StatusCode: res.StatusCode,
+				Err:        fmt.Errorf("can't poll /token endpoint, %w", ErrAccessDenied),
+			}
 		} else if resBody.Error == expiredTokenError {
-			return nil, errors.New("authorization attempt expired")
+			return nil, &LoginError{Category: ErrorCategoryTimeout, Code: resBody.Error, StatusCode: res.StatusCode, Err: ErrAuthorizationExpired}
 		} else if resBody.Error != authorizationPendingError {
-			return nil, fmt.Errorf("received unknown error code %s while polling for access and refresh token", resBody.Error)
+			return nil, &LoginError{
+				Category:   ErrorCategoryIdP,
+				Code:       resBody.Error,
+				StatusCode: res.StatusCode,
+				Err:        fmt.Errorf("received unknown error code %s while polling for access and refresh token", resBody.Error),
+			}
+		}
+		if config.PollProgress != nil {
+			config.PollProgress(attempt, resBody.Error)
 		}
 	}
-	return nil, errors.New("authorization attempt expired")
+	return nil, ErrAuthorizationExpired
+}
+
+// Waits for duration d, returns ctx error if ctx is done earlier.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Returns error wrapping ErrCanceled and ctx error if device flow failed because ctx is done, otherwise returns err.
+func deviceAuthContextError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return fmt.Errorf("%w: %w", ErrCanceled, ctx.Err())
+	}
+	return err
 }
@@ -1,11 +1,17 @@
 package ssoclient
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
 	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -48,7 +54,728 @@ func TestLoginWithDeviceAuthWithPollingSuccess(t *testing.T) {
 	assert.NoError(t, err)
 }
 
-func createMockOAuthServer(expectedClientId string, pollInterval, neededPollCount int) httptest.Server {
+func TestLoginWithDeviceAuthReportsPollProgress(t *testing.T) {
+	t.Parallel()
+	// client needs to poll 3 times after user login
+	mockOAuthServer := createMockOAuthServer("mock-client-id", 1, 3)
+	attempts := []int{}
+	statuses := []string{}
+	_, err := LoginWithDeviceAuth(
+		DeviceAuthConfig{
+			DeviceAuthURI: fmt.Sprintf("%s/auth/device", mockOAuthServer.URL),
+			TokenURI:      fmt.Sprintf("%s/token", mockOAuthServer.URL),
+			ClientId:      "mock-client-id",
+			PollProgress: func(attempt int, status string) {
+				attempts = append(attempts, attempt)
+				statuses = append(statuses, status)
+			},
+		},
+		func(verificationURI, userCode string) {
+			_, err := http.Get(fmt.Sprintf("%s?user-code=mock-user-code", verificationURI))
+			require.NoError(t, err)
+		})
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1, 2}, attempts)
+	assert.Equal(t, []string{authorizationPendingError, authorizationPendingError}, statuses)
+}
+
+func TestLoginWithDeviceAuthLogsLifecycleEvents(t *testing.T) {
+	t.Parallel()
+	mockOAuthServer := createMockOAuthServer("mock-client-id", 1, 2)
+	logHandler := &recordingLogHandler{}
+	_, err := LoginWithDeviceAuth(
+		DeviceAuthConfig{
+			DeviceAuthURI: fmt.Sprintf("%s/auth/device", mockOAuthServer.URL),
+			TokenURI:      fmt.Sprintf("%s/token", mockOAuthServer.URL),
+			ClientId:      "mock-client-id",
+			Logger:        slog.New(logHandler),
+		},
+		func(verificationURI, userCode string) {
+			_, err := http.Get(fmt.Sprintf("%s?user-code=mock-user-code", verificationURI))
+			require.NoError(t, err)
+		})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"DEBUG Sending Device Authorization request",
+		"INFO Device Authorization started",
+		"DEBUG Polled token endpoint",
+		"INFO Received tokens",
+	}, logHandler.records())
+}
+
+func TestLoginWithDeviceAuthInfoReceivesCompleteVerificationURI(t *testing.T) {
+	t.Parallel()
+	mockOAuthServer := createMockOAuthServer("mock-client-id", 1, 1)
+	var receivedInfo DeviceAuthInfo
+	startedAt := time.Now()
+	loginResult, err := LoginWithDeviceAuthInfo(
+		DeviceAuthConfig{
+			DeviceAuthURI: fmt.Sprintf("%s/auth/device", mockOAuthServer.URL),
+			TokenURI:      fmt.Sprintf("%s/token", mockOAuthServer.URL),
+			ClientId:      "mock-client-id",
+		},
+		func(info DeviceAuthInfo) {
+			receivedInfo = info
+			// log in using only the complete URI
+			_, err := http.Get(info.VerificationURIComplete)
+			require.NoError(t, err)
+		})
+	assert.NoError(t, err)
+	assert.Equal(t, "mock-access-token", loginResult.AccessToken)
+	assert.Equal(t, fmt.Sprintf("%s/mock-auth", mockOAuthServer.URL), receivedInfo.VerificationURI)
+	assert.Equal(t, fmt.Sprintf("%s/mock-auth?user-code=mock-user-code", mockOAuthServer.URL), receivedInfo.VerificationURIComplete)
+	assert.Equal(t, "mock-user-code", receivedInfo.UserCode)
+	assert.Equal(t, 600, receivedInfo.ExpiresIn)
+	assert.WithinDuration(t, startedAt.Add(600*time.Second), receivedInfo.ExpiresAt, time.Second)
+	assert.Equal(t, 1, receivedInfo.Interval)
+}
+
+func TestLoginWithDeviceAuthClampsHugePollInterval(t *testing.T) {
+	t.Parallel()
+	// IdP asks to poll once per hour, which would make the client appear hung
+	mockOAuthServer := createMockOAuthServer("mock-client-id", 3600, 1)
+	var receivedInfo DeviceAuthInfo
+	loginResult, err := LoginWithDeviceAuthInfo(
+		DeviceAuthConfig{
+			DeviceAuthURI:   fmt.Sprintf("%s/auth/device", mockOAuthServer.URL),
+			TokenURI:        fmt.Sprintf("%s/token", mockOAuthServer.URL),
+			ClientId:        "mock-client-id",
+			MaxPollInterval: time.Second,
+		},
+		func(info DeviceAuthInfo) {
+			receivedInfo = info
+			_, err := http.Get(info.VerificationURIComplete)
+			require.NoError(t, err)
+		})
+	assert.NoError(t, err)
+	assert.Equal(t, "mock-access-token", loginResult.AccessToken)
+	assert.Equal(t, 1, receivedInfo.Interval)
+}
+
+func TestLoginWithDeviceAuthAdoptsIntervalOfPendingResponse(t *testing.T) {
+	// not parallel, it shortens poll interval of the whole package
+	shortenPollInterval(t, 20*time.Millisecond)
+	pollTimes := []time.Time{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/auth/device", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"device_code":"mock-device-code","user_code":"mock-user-code","verification_uri":"http://sso.mock","expires_in":600,"interval":1}`))
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		pollTimes = append(pollTimes, time.Now())
+		if len(pollTimes) == 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error":"authorization_pending","interval":2}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"access_token":"mock-access-token","expires_in":600}`))
+	})
+	mockOAuthServer := httptest.NewServer(mux)
+	defer mockOAuthServer.Close()
+
+	loginResult, err := LoginWithDeviceAuth(
+		DeviceAuthConfig{
+			DeviceAuthURI: fmt.Sprintf("%s/auth/device", mockOAuthServer.URL),
+			TokenURI:      fmt.Sprintf("%s/token", mockOAuthServer.URL),
+			ClientId:      "mock-client-id",
+		},
+		func(verificationURI, userCode string) {})
+	assert.NoError(t, err)
+	assert.Equal(t, "mock-access-token", loginResult.AccessToken)
+	if assert.Len(t, pollTimes, 2) {
+		assert.GreaterOrEqual(t, pollTimes[1].Sub(pollTimes[0]), 2*20*time.Millisecond)
+	}
+}
+
+func TestLoginWithDeviceAuthKeepsSlowedDownIntervalOnPendingResponse(t *testing.T) {
+	// not parallel, it shortens poll interval of the whole package
+	shortenPollInterval(t, 20*time.Millisecond)
+	pollTimes := []time.Time{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/auth/device", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"device_code":"mock-device-code","user_code":"mock-user-code","verification_uri":"http://sso.mock","expires_in":600,"interval":1}`))
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		pollTimes = append(pollTimes, time.Now())
+		switch len(pollTimes) {
+		case 1:
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error":"slow_down"}`))
+		case 2:
+			// must not lower the interval raised by slow_down back to 1
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error":"authorization_pending","interval":1}`))
+		default:
+			_, _ = w.Write([]byte(`{"access_token":"mock-access-token","expires_in":600}`))
+		}
+	})
+	mockOAuthServer := httptest.NewServer(mux)
+	defer mockOAuthServer.Close()
+
+	loginResult, err := LoginWithDeviceAuth(
+		DeviceAuthConfig{
+			DeviceAuthURI: fmt.Sprintf("%s/auth/device", mockOAuthServer.URL),
+			TokenURI:      fmt.Sprintf("%s/token", mockOAuthServer.URL),
+			ClientId:      "mock-client-id",
+		},
+		func(verificationURI, userCode string) {})
+	assert.NoError(t, err)
+	assert.Equal(t, "mock-access-token", loginResult.AccessToken)
+	if assert.Len(t, pollTimes, 3) {
+		// slow_down raised interval from 1 to 6
+		assert.GreaterOrEqual(t, pollTimes[2].Sub(pollTimes[1]), 6*20*time.Millisecond)
+	}
+}
+
+func TestLoginWithDeviceAuthContextStopsPollingWhenCancelled(t *testing.T) {
+	t.Parallel()
+	polls := atomic.Int32{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/auth/device", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"device_code":"mock-device-code","user_code":"mock-user-code","verification_uri":"http://sso.mock","expires_in":600,"interval":1}`))
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		polls.Add(1)
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"error":"authorization_pending"}`))
+	})
+	mockOAuthServer := httptest.NewServer(mux)
+	defer mockOAuthServer.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	start := time.Now()
+	loginResult, err := LoginWithDeviceAuthContext(
+		ctx,
+		DeviceAuthConfig{
+			DeviceAuthURI: fmt.Sprintf("%s/auth/device", mockOAuthServer.URL),
+			TokenURI:      fmt.Sprintf("%s/token", mockOAuthServer.URL),
+			ClientId:      "mock-client-id",
+		},
+		func(info DeviceAuthInfo) {
+			cancel() // user decided not to log in
+		})
+	assert.Nil(t, loginResult)
+	assert.ErrorIs(t, err, ErrCanceled)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Less(t, time.Since(start), time.Second)
+	time.Sleep(1500 * time.Millisecond)
+	assert.Equal(t, int32(0), polls.Load())
+}
+
+func TestLoginWithDeviceAuthRetryRequestsNewDeviceCodeAfterExpiration(t *testing.T) {
+	t.Parallel()
+	deviceCodes := 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("/auth/device", func(w http.ResponseWriter, r *http.Request) {
+		deviceCodes++
+		_, _ = w.Write([]byte(fmt.Sprintf(
+			`{"device_code":"mock-device-code-%[1]d","user_code":"mock-user-code-%[1]d","verification_uri":"http://sso.mock","expires_in":600,"interval":1}`,
+			deviceCodes,
+		)))
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		if r.PostForm.Get("device_code") == "mock-device-code-1" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error":"expired_token"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"access_token":"mock-access-token","expires_in":600}`))
+	})
+	mockOAuthServer := httptest.NewServer(mux)
+	defer mockOAuthServer.Close()
+
+	userCodes := []string{}
+	loginResult, err := LoginWithDeviceAuthRetry(
+		context.Background(),
+		DeviceAuthConfig{
+			DeviceAuthURI: fmt.Sprintf("%s/auth/device", mockOAuthServer.URL),
+			TokenURI:      fmt.Sprintf("%s/token", mockOAuthServer.URL),
+			ClientId:      "mock-client-id",
+		},
+		func(info DeviceAuthInfo) { userCodes = append(userCodes, info.UserCode) },
+		2,
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, "mock-access-token", loginResult.AccessToken)
+	assert.Equal(t, []string{"mock-user-code-1", "mock-user-code-2"}, userCodes)
+}
+
+func TestLoginWithDeviceAuthRetryReturnsExpirationAfterMaxAttempts(t *testing.T) {
+	t.Parallel()
+	mockOAuthServer := createMockOAuthErrorServer(expiredTokenError)
+	defer mockOAuthServer.Close()
+	started := 0
+	_, err := LoginWithDeviceAuthRetry(
+		context.Background(),
+		DeviceAuthConfig{
+			DeviceAuthURI: fmt.Sprintf("%s/auth/device", mockOAuthServer.URL),
+			TokenURI:      fmt.Sprintf("%s/token", mockOAuthServer.URL),
+			ClientId:      "mock-client-id",
+		},
+		func(info DeviceAuthInfo) { started++ },
+		2,
+	)
+	assert.ErrorIs(t, err, ErrAuthorizationExpired)
+	assert.Equal(t, 2, started)
+}
+
+func TestLoginWithDeviceAuthRetryStopsWhenCancelled(t *testing.T) {
+	t.Parallel()
+	mockOAuthServer := createMockOAuthErrorServer(authorizationPendingError)
+	defer mockOAuthServer.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	started := 0
+	_, err := LoginWithDeviceAuthRetry(
+		ctx,
+		DeviceAuthConfig{
+			DeviceAuthURI: fmt.Sprintf("%s/auth/device", mockOAuthServer.URL),
+			TokenURI:      fmt.Sprintf("%s/token", mockOAuthServer.URL),
+			ClientId:      "mock-client-id",
+		},
+		func(info DeviceAuthInfo) {
+			started++
+			cancel()
+		},
+		3,
+	)
+	assert.ErrorIs(t, err, ErrCanceled)
+	assert.Equal(t, 1, started)
+}
+
+func TestDeviceAuthConfigClampPollInterval(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		config   DeviceAuthConfig
+		interval int
+		expected int
+	}{
+		{config: DeviceAuthConfig{}, interval: 5, expected: 5},
+		{config: DeviceAuthConfig{}, interval: 3600, expected: 60},
+		{config: DeviceAuthConfig{}, interval: -1, expected: 1},
+		{config: DeviceAuthConfig{MinPollInterval: 3 * time.Second}, interval: 1, expected: 3},
+		{config: DeviceAuthConfig{MaxPollInterval: 10 * time.Second}, interval: 30, expected: 10},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, test.config.clampPollInterval(test.interval), test)
+	}
+}
+
+func TestLoginWithDeviceAuthFormatsUserCode(t *testing.T) {
+	t.Parallel()
+	mockOAuthServer := createMockOAuthServer("mock-client-id", 1, 1)
+	var receivedUserCode string
+	_, err := LoginWithDeviceAuth(
+		DeviceAuthConfig{
+			DeviceAuthURI:     fmt.Sprintf("%s/auth/device", mockOAuthServer.URL),
+			TokenURI:          fmt.Sprintf("%s/token", mockOAuthServer.URL),
+			ClientId:          "mock-client-id",
+			UserCodeFormatter: strings.ToUpper,
+		},
+		func(verificationURI, userCode string) {
+			receivedUserCode = userCode
+			_, err := http.Get(fmt.Sprintf("%s?user-code=mock-user-code", verificationURI))
+			require.NoError(t, err)
+		})
+	assert.NoError(t, err)
+	assert.Equal(t, "MOCK-USER-CODE", receivedUserCode)
+}
+
+func TestLoginWithDeviceAuthSendsLoginHintToken(t *testing.T) {
+	t.Parallel()
+	var receivedLoginHintToken string
+	mockOAuthServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		receivedLoginHintToken = r.Form.Get("login_hint_token")
+		http.Error(w, "", http.StatusBadRequest)
+	}))
+	_, _ = LoginWithDeviceAuth(
+		DeviceAuthConfig{
+			DeviceAuthURI:  fmt.Sprintf("%s/auth/device", mockOAuthServer.URL),
+			TokenURI:       fmt.Sprintf("%s/token", mockOAuthServer.URL),
+			ClientId:       "mock-client-id",
+			LoginHintToken: "mock-login-hint-token",
+		},
+		func(verificationURI, userCode string) {})
+	assert.Equal(t, "mock-login-hint-token", receivedLoginHintToken)
+}
+
+func TestLoginWithDeviceAuthOmitsOpenIDScope(t *testing.T) {
+	t.Parallel()
+	for _, omitOpenIDScope := range []bool{false, true} {
+		var receivedScope string
+		mux := http.NewServeMux()
+		mux.HandleFunc("/auth/device", func(w http.ResponseWriter, r *http.Request) {
+			_ = r.ParseForm()
+			receivedScope = r.Form.Get("scope")
+			_, _ = w.Write([]byte(`{"device_code":"mock-device-code","user_code":"mock-user-code","expires_in":600,"interval":1}`))
+		})
+		mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(`{"access_token":"mock-access-token","expires_in":3600}`))
+		})
+		mockOAuthServer := httptest.NewServer(mux)
+		_, err := LoginWithDeviceAuth(
+			DeviceAuthConfig{
+				DeviceAuthURI:   fmt.Sprintf("%s/auth/device", mockOAuthServer.URL),
+				TokenURI:        fmt.Sprintf("%s/token", mockOAuthServer.URL),
+				ClientId:        "mock-client-id",
+				Scope:           "repo read:org",
+				OmitOpenIDScope: omitOpenIDScope,
+			},
+			func(verificationURI, userCode string) {})
+		require.NoError(t, err)
+		if omitOpenIDScope {
+			assert.Equal(t, "repo read:org", receivedScope)
+		} else {
+			assert.Equal(t, "repo read:org openid", receivedScope)
+		}
+		mockOAuthServer.Close()
+	}
+}
+
+func TestLoginWithDeviceAuthSendsAudience(t *testing.T) {
+	t.Parallel()
+	receivedAudiences := map[string]string{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/auth/device", func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		receivedAudiences[r.URL.Path] = r.Form.Get("audience")
+		_, _ = w.Write([]byte(`{"device_code":"mock-device-code","user_code":"mock-user-code","expires_in":600,"interval":1}`))
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		receivedAudiences[r.URL.Path] = r.Form.Get("audience")
+		_, _ = w.Write([]byte(`{"access_token":"mock-access-token","expires_in":3600}`))
+	})
+	mockOAuthServer := httptest.NewServer(mux)
+	defer mockOAuthServer.Close()
+	_, err := LoginWithDeviceAuth(
+		DeviceAuthConfig{
+			DeviceAuthURI: fmt.Sprintf("%s/auth/device", mockOAuthServer.URL),
+			TokenURI:      fmt.Sprintf("%s/token", mockOAuthServer.URL),
+			ClientId:      "mock-client-id",
+			Audience:      "https://vault.example.com",
+		},
+		func(verificationURI, userCode string) {})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"/auth/device": "https://vault.example.com",
+		"/token":       "https://vault.example.com",
+	}, receivedAudiences)
+}
+
+func TestLoginWithDeviceAuthSendsClientSecret(t *testing.T) {
+	t.Parallel()
+	// rejects requests without client secret sent in body or Basic auth
+	requireClientSecret := func(w http.ResponseWriter, r *http.Request) bool {
+		_ = r.ParseForm()
+		clientId, clientSecret, basicAuth := r.BasicAuth()
+		if !basicAuth {
+			clientId, clientSecret = r.Form.Get("client_id"), r.Form.Get("client_secret")
+		}
+		if clientId != "mock-client-id" || clientSecret != "mock-client-secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"error":"invalid_client"}`))
+			return false
+		}
+		return true
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/auth/device", func(w http.ResponseWriter, r *http.Request) {
+		if requireClientSecret(w, r) {
+			_, _ = w.Write([]byte(`{"device_code":"mock-device-code","user_code":"mock-user-code","expires_in":600,"interval":1}`))
+		}
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if requireClientSecret(w, r) {
+			_, _ = w.Write([]byte(`{"access_token":"mock-access-token","expires_in":3600}`))
+		}
+	})
+	mockOAuthServer := httptest.NewServer(mux)
+	defer mockOAuthServer.Close()
+	config := DeviceAuthConfig{
+		DeviceAuthURI: fmt.Sprintf("%s/auth/device", mockOAuthServer.URL),
+		TokenURI:      fmt.Sprintf("%s/token", mockOAuthServer.URL),
+		ClientId:      "mock-client-id",
+	}
+
+	_, err := LoginWithDeviceAuth(config, func(verificationURI, userCode string) {})
+	assert.ErrorContains(t, err, "invalid_client")
+	config.ClientSecret = "mock-client-secret"
+	for _, authMethod := range []string{"", TokenAuthMethodPost, TokenAuthMethodBasic} {
+		config.TokenAuthMethod = authMethod
+		result, err := LoginWithDeviceAuth(config, func(verificationURI, userCode string) {})
+		require.NoError(t, err, authMethod)
+		assert.Equal(t, "mock-access-token", result.AccessToken)
+	}
+}
+
+func TestLoginWithDeviceAuthSendsTokenExtraParams(t *testing.T) {
+	t.Parallel()
+	var receivedForm url.Values
+	mux := http.NewServeMux()
+	mux.HandleFunc("/auth/device", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"device_code":"mock-device-code","user_code":"mock-user-code","expires_in":600,"interval":1}`))
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		receivedForm = r.PostForm
+		_, _ = w.Write([]byte(`{"access_token":"mock-access-token","expires_in":3600}`))
+	})
+	mockOAuthServer := httptest.NewServer(mux)
+	defer mockOAuthServer.Close()
+	_, err := LoginWithDeviceAuth(
+		DeviceAuthConfig{
+			DeviceAuthURI: fmt.Sprintf("%s/auth/device", mockOAuthServer.URL),
+			TokenURI:      fmt.Sprintf("%s/token", mockOAuthServer.URL),
+			ClientId:      "mock-client-id",
+			TokenExtraParams: map[string]string{
+				"resource":    "https://api.example.com",
+				"device_code": "other-device-code", // can't override parameters of device flow
+			},
+		},
+		func(verificationURI, userCode string) {})
+	require.NoError(t, err)
+	assert.Equal(t, "https://api.example.com", receivedForm.Get("resource"))
+	assert.Equal(t, "mock-device-code", receivedForm.Get("device_code"))
+}
+
+func TestLoginWithDeviceAuthReturnsTypedErrors(t *testing.T) {
+	t.Parallel()
+	for idpError, expectedErr := range map[string]error{
+		accessDeniedError: ErrAccessDenied,
+		expiredTokenError: ErrAuthorizationExpired,
+	} {
+		idpError, expectedErr := idpError, expectedErr
+		t.Run(idpError, func(t *testing.T) {
+			t.Parallel()
+			mockOAuthServer := createMockOAuthErrorServer(idpError)
+			defer mockOAuthServer.Close()
+			_, err := LoginWithDeviceAuth(
+				DeviceAuthConfig{
+					DeviceAuthURI: fmt.Sprintf("%s/auth/device", mockOAuthServer.URL),
+					TokenURI:      fmt.Sprintf("%s/token", mockOAuthServer.URL),
+					ClientId:      "mock-client-id",
+				},
+				func(verificationURI, userCode string) {})
+			assert.ErrorIs(t, err, expectedErr)
+		})
+	}
+}
+
+func TestLoginWithDeviceAuthReturnsGrantedScope(t *testing.T) {
+	t.Parallel()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/auth/device", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"device_code":"mock-device-code","user_code":"mock-user-code","expires_in":600,"interval":1}`))
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		// IdP grants less than requested "profile email openid"
+		_, _ = w.Write([]byte(`{
+			"access_token":"mock-access-token",
+			"token_type":"Bearer",
+			"scope":"openid profile",
+			"expires_in": 3600
+		}`))
+	})
+	mockOAuthServer := httptest.NewServer(mux)
+	defer mockOAuthServer.Close()
+	loginResult, err := LoginWithDeviceAuth(
+		DeviceAuthConfig{
+			DeviceAuthURI: fmt.Sprintf("%s/auth/device", mockOAuthServer.URL),
+			TokenURI:      fmt.Sprintf("%s/token", mockOAuthServer.URL),
+			ClientId:      "mock-client-id",
+			Scope:         "profile email",
+		},
+		func(verificationURI, userCode string) {})
+	require.NoError(t, err)
+	assert.Equal(t, "Bearer", loginResult.TokenType)
+	assert.Equal(t, "openid profile", loginResult.Scope)
+}
+
+func TestTokenSuccessResponseAcceptsExpiresInFormats(t *testing.T) {
+	t.Parallel()
+	for body, expected := range map[string]int{
+		`{"access_token":"mock-access-token","expires_in":3600}`:   3600,
+		`{"access_token":"mock-access-token","expires_in":"3600"}`: 3600,
+		`{"access_token":"mock-access-token"}`:                     0,
+		`{"access_token":"mock-access-token","expires_in":null}`:   0,
+	} {
+		var tokenRes tokenSuccessResponse
+		require.NoError(t, json.Unmarshal([]byte(body), &tokenRes), body)
+		assert.Equal(t, expected, int(tokenRes.ExpiresIn), body)
+	}
+	var tokenRes tokenSuccessResponse
+	assert.Error(t, json.Unmarshal([]byte(`{"expires_in":"an hour"}`), &tokenRes))
+	// missing expires_in means unknown expiration
+	assert.True(t, expiresAt(0).IsZero())
+}
+
+func TestLoginWithDeviceAuthReturnsRawTokenResponse(t *testing.T) {
+	t.Parallel()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/auth/device", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"device_code":"mock-device-code","user_code":"mock-user-code","expires_in":600,"interval":1}`))
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"access_token":"mock-access-token","expires_in":3600,"not-before-policy":1700000000}`))
+	})
+	mockOAuthServer := httptest.NewServer(mux)
+	defer mockOAuthServer.Close()
+	loginResult, err := LoginWithDeviceAuth(
+		DeviceAuthConfig{
+			DeviceAuthURI: fmt.Sprintf("%s/auth/device", mockOAuthServer.URL),
+			TokenURI:      fmt.Sprintf("%s/token", mockOAuthServer.URL),
+			ClientId:      "mock-client-id",
+		},
+		func(verificationURI, userCode string) {})
+	require.NoError(t, err)
+	var rawResponse struct {
+		NotBeforePolicy int `json:"not-before-policy"`
+	}
+	require.NoError(t, json.Unmarshal(loginResult.RawResponse, &rawResponse))
+	assert.Equal(t, 1700000000, rawResponse.NotBeforePolicy)
+}
+
+func TestLoginWithDeviceAuthRetriesFailedPolls(t *testing.T) {
+	t.Parallel()
+	for maxPollRetries, expectSuccess := range map[int]bool{0: true, -1: false} {
+		tokenRequests := atomic.Int32{}
+		mux := http.NewServeMux()
+		mux.HandleFunc("/auth/device", func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(`{"device_code":"mock-device-code","user_code":"mock-user-code","expires_in":600,"interval":1}`))
+		})
+		mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+			if tokenRequests.Add(1) <= 2 {
+				// drop the connection to simulate a network error
+				conn, _, _ := w.(http.Hijacker).Hijack()
+				conn.Close()
+				return
+			}
+			_, _ = w.Write([]byte(`{"access_token":"mock-access-token","expires_in":3600}`))
+		})
+		mockOAuthServer := httptest.NewServer(mux)
+		loginResult, err := LoginWithDeviceAuth(
+			DeviceAuthConfig{
+				DeviceAuthURI:  fmt.Sprintf("%s/auth/device", mockOAuthServer.URL),
+				TokenURI:       fmt.Sprintf("%s/token", mockOAuthServer.URL),
+				ClientId:       "mock-client-id",
+				MaxPollRetries: maxPollRetries,
+			},
+			func(verificationURI, userCode string) {})
+		if expectSuccess {
+			require.NoError(t, err)
+			assert.Equal(t, "mock-access-token", loginResult.AccessToken)
+			assert.Equal(t, int32(3), tokenRequests.Load())
+		} else {
+			assert.Error(t, err)
+			assert.Equal(t, int32(1), tokenRequests.Load())
+		}
+		mockOAuthServer.Close()
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	t.Parallel()
+	for failedRequests, maxDelay := range map[int]time.Duration{
+		1:   retryBaseDelay,
+		3:   4 * retryBaseDelay,
+		100: retryMaxDelay,
+	} {
+		delay := retryBackoff(failedRequests)
+		assert.GreaterOrEqual(t, delay, maxDelay/2)
+		assert.LessOrEqual(t, delay, maxDelay)
+	}
+}
+
+func TestDeviceAuthConfigValidate(t *testing.T) {
+	t.Parallel()
+	assert.NoError(t, DeviceAuthConfig{
+		DeviceAuthURI: "http://localhost:8080/auth/device",
+		TokenURI:      "http://localhost:8080/token",
+		ClientId:      "mock-client-id",
+	}.Validate())
+
+	err := DeviceAuthConfig{TokenURI: "localhost:8080/token", TokenAuthMethod: "jwt"}.Validate()
+	assert.ErrorContains(t, err, "ClientId is required")
+	assert.ErrorContains(t, err, "DeviceAuthURI is required")
+	assert.ErrorContains(t, err, "TokenURI is invalid")
+	assert.ErrorContains(t, err, "unknown TokenAuthMethod 'jwt'")
+
+	_, err = LoginWithDeviceAuth(DeviceAuthConfig{}, func(verificationURI, userCode string) {
+		t.Error("Device authorization must not start with invalid config")
+	})
+	assert.Error(t, err)
+}
+
+func TestLoginWithDeviceAuthReturnsDeviceAuthorizationError(t *testing.T) {
+	t.Parallel()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/auth/device", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"error":"unauthorized_client","error_description":"Client is not allowed to initiate device flow"}`))
+	})
+	mockOAuthServer := httptest.NewServer(mux)
+	defer mockOAuthServer.Close()
+	_, err := LoginWithDeviceAuth(
+		DeviceAuthConfig{
+			DeviceAuthURI: fmt.Sprintf("%s/auth/device", mockOAuthServer.URL),
+			TokenURI:      fmt.Sprintf("%s/token", mockOAuthServer.URL),
+			ClientId:      "mock-client-id",
+		},
+		func(verificationURI, userCode string) {})
+	assert.ErrorContains(t, err, "400")
+	assert.ErrorContains(t, err, "unauthorized_client")
+	assert.ErrorContains(t, err, "Client is not allowed to initiate device flow")
+}
+
+func TestFormatUserCode(t *testing.T) {
+	t.Parallel()
+	assert.Equal(t, "ABCD-EFGH", FormatUserCode("ABCDEFGH", 4, "-"))
+	assert.Equal(t, "ABCD-EFGH", FormatUserCode("ABCD-EFGH", 4, "-"))
+	assert.Equal(t, "ABC DEF GH", FormatUserCode("AB-CD EF-GH", 3, " "))
+	assert.Equal(t, "ABCDEFGH", FormatUserCode("ABCD-EFGH", 0, "-"))
+	assert.Equal(t, "", FormatUserCode("", 4, "-"))
+}
+
+func TestLoginWithDeviceAuthConcurrentCallbackDoesNotBlockPolling(t *testing.T) {
+	t.Parallel()
+	mockOAuthServer := createMockOAuthServer("mock-client-id", 1, 1)
+	defer mockOAuthServer.Close()
+	infos := make(chan DeviceAuthInfo, 1)
+	release := make(chan struct{})
+	defer close(release)
+	results := make(chan error, 1)
+	go func() {
+		_, err := LoginWithDeviceAuthInfo(
+			DeviceAuthConfig{
+				DeviceAuthURI:      fmt.Sprintf("%s/auth/device", mockOAuthServer.URL),
+				TokenURI:           fmt.Sprintf("%s/token", mockOAuthServer.URL),
+				ClientId:           "mock-client-id",
+				ConcurrentCallback: true,
+			},
+			func(info DeviceAuthInfo) {
+				infos <- info
+				<-release // e.g. waits until user scans QR code
+			},
+		)
+		results <- err
+	}()
+
+	info := <-infos
+	_, err := http.Get(info.VerificationURIComplete)
+	require.NoError(t, err)
+	select {
+	case err := <-results:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Polling did not finish login while callback was blocked")
+	}
+}
+
+func createMockOAuthServer(expectedClientId string, pollInterval, neededPollCount int) *httptest.Server {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/auth/device", func(w http.ResponseWriter, r *http.Request) {
 		_ = r.ParseForm()
@@ -102,5 +829,31 @@ func createMockOAuthServer(expectedClientId string, pollInterval, neededPollCoun
 			_, _ = w.Write([]byte(fmt.Sprintf(`{"error":"%s"}`, authorizationPendingError)))
 		}
 	})
-	return *httptest.NewServer(mux)
+	return httptest.NewServer(mux)
+}
+
+// Creates a mock OAuth server whose token endpoint always responds with given OAuth error.
+func createMockOAuthErrorServer(tokenError string) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/auth/device", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(fmt.Sprintf(`{
+			"device_code": "mock-device-code",
+			"user_code": "mock-user-code",
+			"verification_uri": "http://%s/mock-auth",
+			"expires_in": 600,
+			"interval": 1
+		}`, r.Host)))
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(fmt.Sprintf(`{"error":"%s"}`, tokenError)))
+	})
+	return httptest.NewServer(mux)
+}
+
+// Sets duration of one second of poll interval to unit until the test finishes.
+func shortenPollInterval(t *testing.T, unit time.Duration) {
+	original := pollIntervalUnit
+	pollIntervalUnit = unit
+	t.Cleanup(func() { pollIntervalUnit = original })
 }
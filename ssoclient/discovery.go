@@ -0,0 +1,80 @@
+package ssoclient
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// OpenID Provider metadata received from OIDC discovery document.
+type OIDCMetadata struct {
+	Issuer                      string   `json:"issuer"`
+	AuthorizationEndpoint       string   `json:"authorization_endpoint"`
+	TokenEndpoint               string   `json:"token_endpoint"`
+	DeviceAuthorizationEndpoint string   `json:"device_authorization_endpoint"`
+	EndSessionEndpoint          string   `json:"end_session_endpoint"`
+	JWKSURI                     string   `json:"jwks_uri"`
+	UserInfoEndpoint            string   `json:"userinfo_endpoint"`
+	ScopesSupported             []string `json:"scopes_supported"`
+}
+
+// Fetches OIDC discovery document from "{issuerURL}/.well-known/openid-configuration".
+// Uses http.DefaultClient if client is nil.
+func DiscoverOIDC(issuerURL string, client *http.Client) (*OIDCMetadata, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Get(fmt.Sprintf("%s/.well-known/openid-configuration", strings.TrimSuffix(issuerURL, "/")))
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to fetch OIDC discovery document"), err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch OIDC discovery document, response status was %d, expected 200", res.StatusCode)
+	}
+	var metadata OIDCMetadata
+	if err := json.NewDecoder(res.Body).Decode(&metadata); err != nil {
+		return nil, errors.Join(errors.New("received OIDC discovery document in invalid format"), err)
+	}
+	if metadata.AuthorizationEndpoint == "" || metadata.TokenEndpoint == "" {
+		return nil, errors.New("OIDC discovery document does not contain authorization or token endpoint")
+	}
+	return &metadata, nil
+}
+
+// Checks that all requested scopes are advertised by the IdP in "scopes_supported",
+// so that typos in scopes are reported before starting a login. Scopes may also be space-separated.
+// Does nothing if the IdP does not advertise supported scopes.
+func (metadata *OIDCMetadata) ValidateScopes(scopes ...string) error {
+	if len(metadata.ScopesSupported) == 0 {
+		return nil
+	}
+	var unsupported []string
+	for _, scope := range strings.Fields(strings.Join(scopes, " ")) {
+		if !slices.Contains(metadata.ScopesSupported, scope) {
+			unsupported = append(unsupported, scope)
+		}
+	}
+	if len(unsupported) > 0 {
+		return fmt.Errorf("scopes '%s' are not supported by IdP, supported scopes are '%s'",
+			strings.Join(unsupported, " "), strings.Join(metadata.ScopesSupported, " "))
+	}
+	return nil
+}
+
+// Creates DeviceAuthConfig with endpoints from OIDC discovery metadata.
+// Fails if the IdP does not advertise a Device Authorization endpoint.
+func NewDeviceAuthConfigFromMetadata(metadata *OIDCMetadata, clientId, scope string) (DeviceAuthConfig, error) {
+	if metadata.DeviceAuthorizationEndpoint == "" {
+		return DeviceAuthConfig{}, errors.New("OIDC metadata does not contain Device Authorization endpoint, device flow is probably not supported by IdP")
+	}
+	return DeviceAuthConfig{
+		DeviceAuthURI: metadata.DeviceAuthorizationEndpoint,
+		TokenURI:      metadata.TokenEndpoint,
+		ClientId:      clientId,
+		Scope:         scope,
+	}, nil
+}
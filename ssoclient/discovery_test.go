@@ -0,0 +1,70 @@
+package ssoclient
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiscoverOIDCAndCreateDeviceAuthConfig(t *testing.T) {
+	t.Parallel()
+	mockOIDCServer := createMockDiscoveryServer()
+	defer mockOIDCServer.Close()
+
+	metadata, err := DiscoverOIDC(fmt.Sprint(mockOIDCServer.URL, "/realms/test"), nil)
+	require.NoError(t, err)
+	assert.Equal(t, fmt.Sprint(mockOIDCServer.URL, "/realms/test/auth"), metadata.AuthorizationEndpoint)
+	assert.Equal(t, fmt.Sprint(mockOIDCServer.URL, "/realms/test/logout"), metadata.EndSessionEndpoint)
+	assert.Equal(t, fmt.Sprint(mockOIDCServer.URL, "/realms/test/userinfo"), metadata.UserInfoEndpoint)
+
+	config, err := NewDeviceAuthConfigFromMetadata(metadata, "mock-client-id", "profile")
+	require.NoError(t, err)
+	assert.Equal(t, fmt.Sprint(mockOIDCServer.URL, "/realms/test/auth/device"), config.DeviceAuthURI)
+	assert.Equal(t, fmt.Sprint(mockOIDCServer.URL, "/realms/test/token"), config.TokenURI)
+	assert.Equal(t, "mock-client-id", config.ClientId)
+	assert.Equal(t, "profile", config.Scope)
+}
+
+func TestNewDeviceAuthConfigFromMetadataWithoutDeviceEndpoint(t *testing.T) {
+	t.Parallel()
+	_, err := NewDeviceAuthConfigFromMetadata(&OIDCMetadata{
+		AuthorizationEndpoint: "http://localhost:8000/auth",
+		TokenEndpoint:         "http://localhost:8000/token",
+	}, "mock-client-id", "")
+	assert.Error(t, err)
+}
+
+func TestValidateScopesReportsUnsupportedScope(t *testing.T) {
+	t.Parallel()
+	mockOIDCServer := createMockDiscoveryServer()
+	defer mockOIDCServer.Close()
+
+	metadata, err := DiscoverOIDC(fmt.Sprint(mockOIDCServer.URL, "/realms/test"), nil)
+	require.NoError(t, err)
+	assert.NoError(t, metadata.ValidateScopes("openid", "offline_access"))
+	err = metadata.ValidateScopes("openid offline-access")
+	assert.ErrorContains(t, err, "scopes 'offline-access' are not supported")
+	// IdPs that don't advertise supported scopes are not validated
+	assert.NoError(t, (&OIDCMetadata{}).ValidateScopes("offline-access"))
+}
+
+func createMockDiscoveryServer() *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/realms/test/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		issuer := fmt.Sprintf("http://%s/realms/test", r.Host)
+		_, _ = w.Write([]byte(fmt.Sprintf(`{
+			"issuer": "%[1]s",
+			"authorization_endpoint": "%[1]s/auth",
+			"token_endpoint": "%[1]s/token",
+			"device_authorization_endpoint": "%[1]s/auth/device",
+			"end_session_endpoint": "%[1]s/logout",
+			"userinfo_endpoint": "%[1]s/userinfo",
+			"scopes_supported": ["openid", "profile", "offline_access"]
+		}`, issuer)))
+	})
+	return httptest.NewServer(mux)
+}
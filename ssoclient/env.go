@@ -0,0 +1,28 @@
+package ssoclient
+
+import (
+	"errors"
+	"os"
+)
+
+// Reads Device Authorization configuration from standard environment variables, named like in ssoproxy.OIDCConfigFromEnv:
+//
+//	OIDC_DEVICE_AUTH_URI, OIDC_TOKEN_URI, OIDC_CLIENT_ID // required
+//	OIDC_CLIENT_SECRET, OIDC_SCOPE, OIDC_AUDIENCE // optional, see DeviceAuthConfig
+//
+// The config is validated with DeviceAuthConfig.Validate, missing or invalid variables are returned joined.
+// Other fields like UserCodeFormatter can be set on the returned config.
+func DeviceAuthConfigFromEnv() (DeviceAuthConfig, error) {
+	config := DeviceAuthConfig{
+		DeviceAuthURI: os.Getenv("OIDC_DEVICE_AUTH_URI"),
+		TokenURI:      os.Getenv("OIDC_TOKEN_URI"),
+		ClientId:      os.Getenv("OIDC_CLIENT_ID"),
+		ClientSecret:  os.Getenv("OIDC_CLIENT_SECRET"),
+		Scope:         os.Getenv("OIDC_SCOPE"),
+		Audience:      os.Getenv("OIDC_AUDIENCE"),
+	}
+	if err := config.Validate(); err != nil {
+		return DeviceAuthConfig{}, errors.Join(errors.New("invalid Device Authorization config in environment variables"), err)
+	}
+	return config, nil
+}
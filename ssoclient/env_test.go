@@ -0,0 +1,36 @@
+package ssoclient
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeviceAuthConfigFromEnv(t *testing.T) {
+	t.Setenv("OIDC_DEVICE_AUTH_URI", "http://localhost:8000/auth/device")
+	t.Setenv("OIDC_TOKEN_URI", "http://localhost:8000/token")
+	t.Setenv("OIDC_CLIENT_ID", "mock-client-id")
+	t.Setenv("OIDC_CLIENT_SECRET", "")
+	t.Setenv("OIDC_SCOPE", "profile")
+	t.Setenv("OIDC_AUDIENCE", "https://api.example.com")
+
+	config, err := DeviceAuthConfigFromEnv()
+	assert.NoError(t, err)
+	assert.Equal(t, DeviceAuthConfig{
+		DeviceAuthURI: "http://localhost:8000/auth/device",
+		TokenURI:      "http://localhost:8000/token",
+		ClientId:      "mock-client-id",
+		Scope:         "profile",
+		Audience:      "https://api.example.com",
+	}, config)
+}
+
+func TestDeviceAuthConfigFromEnvRejectsIncompleteEnv(t *testing.T) {
+	t.Setenv("OIDC_DEVICE_AUTH_URI", "http://localhost:8000/auth/device")
+	t.Setenv("OIDC_TOKEN_URI", "")
+	t.Setenv("OIDC_CLIENT_ID", "")
+
+	_, err := DeviceAuthConfigFromEnv()
+	assert.ErrorContains(t, err, "TokenURI is required")
+	assert.ErrorContains(t, err, "ClientId is required")
+}
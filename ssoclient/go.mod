@@ -2,7 +2,10 @@ module github.com/mlosinsky/clisso/ssoclient
 
 go 1.21.6
 
-require github.com/stretchr/testify v1.9.0
+require (
+	github.com/stretchr/testify v1.9.0
+	rsc.io/qr v0.2.0
+)
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
@@ -0,0 +1,172 @@
+package ssoclient
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// How long JWKS cached by VerifyIDToken is used before it is fetched again.
+const defaultJWKSCacheTTL = time.Hour
+
+// Default tolerated difference between IdP's and local clock when checking "exp" and "iat" claims.
+const defaultClockSkew = time.Minute
+
+// Options of ID token verification, Issuer and ClientId are required.
+type VerifyOptions struct {
+	// Expected "iss" claim, IdP's issuer URL
+	Issuer string
+	// Client id that must be in "aud" claim
+	ClientId string
+	// Optional expected "nonce" claim, nonce is not checked if empty
+	Nonce string
+	// Optional URI of IdP JWKS, discovered from Issuer's OIDC discovery document if not set
+	JWKSURI string
+	// Optional JWKS cache used to verify signature, a cache shared by all verifications
+	// of the same issuer, client id and JWKS URI refreshing keys every hour is used if not set
+	JWKS *JWKSCache
+	// Optional tolerated clock skew, 1 minute by default
+	ClockSkew time.Duration
+	// HTTP client used to fetch discovery document and JWKS, http.DefaultClient is used if nil
+	HTTPClient *http.Client
+}
+
+// Verified standard claims of an ID token.
+type IDTokenClaims struct {
+	Issuer    string
+	Subject   string
+	Audience  []string
+	ExpiresAt time.Time
+	IssuedAt  time.Time
+	Nonce     string
+	// All claims of the ID token including the standard claims, e.g. "email" or "name"
+	Claims map[string]any
+}
+
+// Key of JWKS cache shared by ID token verifications, caches are not shared between issuers or clients,
+// so a JWKS URI passed by one caller can't be used to verify tokens of another issuer.
+type jwksCacheKey struct {
+	issuer   string
+	clientId string
+	jwksURI  string
+}
+
+// JWKS caches shared by ID token verifications.
+var sharedJWKSCaches = map[jwksCacheKey]*JWKSCache{}
+var sharedJWKSCachesMutex sync.Mutex
+
+// Verifies ID token received after login, so its claims can be trusted. Its RS256/ES256 (or stronger)
+// signature is verified with IdP's JWKS and "iss", "aud", "azp", "exp", "iat" and optionally "nonce"
+// claims are checked according to OpenID Connect Core.
+func VerifyIDToken(idToken string, opts VerifyOptions) (*IDTokenClaims, error) {
+	if opts.Issuer == "" || opts.ClientId == "" {
+		return nil, errors.New("issuer and client id are required to verify ID token")
+	}
+	jwks := opts.JWKS
+	if jwks == nil {
+		var err error
+		if jwks, err = sharedJWKSCache(opts); err != nil {
+			return nil, err
+		}
+	}
+	rawClaims, err := jwks.VerifyToken(idToken)
+	if err != nil {
+		return nil, errors.Join(errors.New("ID token signature is not valid"), err)
+	}
+	claims := newIDTokenClaims(rawClaims)
+	if err := claims.validate(opts); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// Returns shared JWKS cache of issuer, client id and JWKS URI in opts, if JWKS URI is not set
+// it is discovered when the cache is created. Discovery runs without holding the lock,
+// so a slow IdP does not block verifications of other issuers.
+func sharedJWKSCache(opts VerifyOptions) (*JWKSCache, error) {
+	cacheKey := jwksCacheKey{issuer: opts.Issuer, clientId: opts.ClientId, jwksURI: opts.JWKSURI}
+	sharedJWKSCachesMutex.Lock()
+	cache, found := sharedJWKSCaches[cacheKey]
+	sharedJWKSCachesMutex.Unlock()
+	if found {
+		return cache, nil
+	}
+	jwksURI := opts.JWKSURI
+	if jwksURI == "" {
+		metadata, err := DiscoverOIDC(opts.Issuer, opts.HTTPClient)
+		if err != nil {
+			return nil, errors.Join(errors.New("failed to discover JWKS URI of IdP"), err)
+		} else if metadata.JWKSURI == "" {
+			return nil, errors.New("OIDC discovery document does not contain JWKS URI")
+		}
+		jwksURI = metadata.JWKSURI
+	}
+	cache, err := NewJWKSCache(jwksURI, nil)
+	if err != nil {
+		return nil, err
+	}
+	cache.HTTPClient = opts.HTTPClient
+	cache.TTL = defaultJWKSCacheTTL
+
+	sharedJWKSCachesMutex.Lock()
+	defer sharedJWKSCachesMutex.Unlock()
+	// cache may have been created by a concurrent verification during discovery
+	if existingCache, found := sharedJWKSCaches[cacheKey]; found {
+		return existingCache, nil
+	}
+	sharedJWKSCaches[cacheKey] = cache
+	return cache, nil
+}
+
+// Creates ID token claims from claims of a verified JWT, claims of unexpected types are left empty.
+func newIDTokenClaims(rawClaims map[string]any) *IDTokenClaims {
+	claims := &IDTokenClaims{Claims: rawClaims}
+	claims.Issuer, _ = rawClaims["iss"].(string)
+	claims.Subject, _ = rawClaims["sub"].(string)
+	claims.Nonce, _ = rawClaims["nonce"].(string)
+	// "aud" is a single string or an array of strings
+	switch audience := rawClaims["aud"].(type) {
+	case string:
+		claims.Audience = []string{audience}
+	case []any:
+		for _, aud := range audience {
+			if aud, ok := aud.(string); ok {
+				claims.Audience = append(claims.Audience, aud)
+			}
+		}
+	}
+	if exp, ok := rawClaims["exp"].(float64); ok {
+		claims.ExpiresAt = time.Unix(int64(exp), 0)
+	}
+	if iat, ok := rawClaims["iat"].(float64); ok {
+		claims.IssuedAt = time.Unix(int64(iat), 0)
+	}
+	return claims
+}
+
+// Checks standard claims of ID token against expected values.
+func (claims *IDTokenClaims) validate(opts VerifyOptions) error {
+	clockSkew := opts.ClockSkew
+	if clockSkew <= 0 {
+		clockSkew = defaultClockSkew
+	}
+	if claims.Issuer != opts.Issuer {
+		return fmt.Errorf("ID token issuer '%s' does not match expected issuer '%s'", claims.Issuer, opts.Issuer)
+	} else if !slices.Contains(claims.Audience, opts.ClientId) {
+		return fmt.Errorf("ID token audience does not contain client id '%s'", opts.ClientId)
+	} else if azp, _ := claims.Claims["azp"].(string); len(claims.Audience) > 1 && azp != opts.ClientId {
+		return fmt.Errorf("ID token authorized party '%s' does not match client id '%s'", azp, opts.ClientId)
+	} else if claims.ExpiresAt.IsZero() {
+		return errors.New("ID token does not contain expiration claim 'exp'")
+	} else if time.Now().After(claims.ExpiresAt.Add(clockSkew)) {
+		return fmt.Errorf("ID token expired at %s", claims.ExpiresAt)
+	} else if claims.IssuedAt.After(time.Now().Add(clockSkew)) {
+		return fmt.Errorf("ID token was issued in the future at %s", claims.IssuedAt)
+	} else if opts.Nonce != "" && claims.Nonce != opts.Nonce {
+		return errors.New("ID token nonce does not match nonce of login request")
+	}
+	return nil
+}
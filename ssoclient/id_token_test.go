@@ -0,0 +1,114 @@
+package ssoclient
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyIDTokenWithDiscoveredJWKS(t *testing.T) {
+	t.Parallel()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	mux := http.NewServeMux()
+	mockIdP := httptest.NewServer(mux)
+	defer mockIdP.Close()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"issuer":"%[1]s","authorization_endpoint":"%[1]s/auth","token_endpoint":"%[1]s/token","jwks_uri":"%[1]s/certs"}`, mockIdP.URL)
+	})
+	mux.HandleFunc("/certs", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(createJWKS(t, map[string]crypto.PublicKey{"rsa-key": &rsaKey.PublicKey}))
+	})
+
+	idToken := signJWT(t, "RS256", "rsa-key", rsaKey, map[string]any{
+		"iss":   mockIdP.URL,
+		"sub":   "mock-user",
+		"aud":   "mock-client-id",
+		"exp":   time.Now().Add(time.Minute).Unix(),
+		"iat":   time.Now().Unix(),
+		"nonce": "mock-nonce",
+		"email": "mock-user@example.com",
+	})
+	claims, err := VerifyIDToken(idToken, VerifyOptions{Issuer: mockIdP.URL, ClientId: "mock-client-id", Nonce: "mock-nonce"})
+	assert.NoError(t, err)
+	assert.Equal(t, "mock-user", claims.Subject)
+	assert.Equal(t, []string{"mock-client-id"}, claims.Audience)
+	assert.Equal(t, "mock-user@example.com", claims.Claims["email"])
+
+	// use payload of another token with original signature
+	otherToken := signJWT(t, "RS256", "rsa-key", rsaKey, map[string]any{"iss": mockIdP.URL, "sub": "admin", "aud": "mock-client-id"})
+	parts := strings.Split(idToken, ".")
+	tamperedToken := fmt.Sprintf("%s.%s.%s", parts[0], strings.Split(otherToken, ".")[1], parts[2])
+	_, err = VerifyIDToken(tamperedToken, VerifyOptions{Issuer: mockIdP.URL, ClientId: "mock-client-id"})
+	assert.ErrorContains(t, err, "signature is not valid")
+}
+
+func TestSharedJWKSCacheIsKeyedByIssuerAndClient(t *testing.T) {
+	t.Parallel()
+	jwksURI := "https://sso.example.com/shared-cache-test/certs"
+	cache, err := sharedJWKSCache(VerifyOptions{Issuer: "https://sso.example.com", ClientId: "client-a", JWKSURI: jwksURI})
+	require.NoError(t, err)
+	sameCache, err := sharedJWKSCache(VerifyOptions{Issuer: "https://sso.example.com", ClientId: "client-a", JWKSURI: jwksURI})
+	require.NoError(t, err)
+	assert.Same(t, cache, sameCache)
+
+	otherClientCache, err := sharedJWKSCache(VerifyOptions{Issuer: "https://sso.example.com", ClientId: "client-b", JWKSURI: jwksURI})
+	require.NoError(t, err)
+	assert.NotSame(t, cache, otherClientCache)
+	otherIssuerCache, err := sharedJWKSCache(VerifyOptions{Issuer: "https://other-sso.example.com", ClientId: "client-a", JWKSURI: jwksURI})
+	require.NoError(t, err)
+	assert.NotSame(t, cache, otherIssuerCache)
+}
+
+func TestVerifyIDTokenChecksClaims(t *testing.T) {
+	t.Parallel()
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	jwks, err := NewJWKSCache("", createJWKS(t, map[string]crypto.PublicKey{"ec-key": &ecKey.PublicKey}))
+	require.NoError(t, err)
+	opts := VerifyOptions{Issuer: "https://sso.example.com", ClientId: "mock-client-id", Nonce: "mock-nonce", JWKS: jwks}
+	validClaims := map[string]any{
+		"iss":   "https://sso.example.com",
+		"sub":   "mock-user",
+		"aud":   []string{"mock-client-id", "other-client-id"},
+		"azp":   "mock-client-id",
+		"exp":   time.Now().Add(time.Minute).Unix(),
+		"iat":   time.Now().Unix(),
+		"nonce": "mock-nonce",
+	}
+	_, err = VerifyIDToken(signJWT(t, "ES256", "ec-key", ecKey, validClaims), opts)
+	assert.NoError(t, err)
+
+	for claim, expectedErr := range map[string]struct {
+		value any
+		err   string
+	}{
+		"iss":   {"https://evil.example.com", "does not match expected issuer"},
+		"aud":   {"other-client-id", "audience does not contain client id"},
+		"azp":   {"other-client-id", "authorized party"},
+		"exp":   {time.Now().Add(-time.Hour).Unix(), "ID token expired"},
+		"iat":   {time.Now().Add(time.Hour).Unix(), "issued in the future"},
+		"nonce": {"other-nonce", "nonce does not match"},
+	} {
+		claims := map[string]any{}
+		for name, value := range validClaims {
+			claims[name] = value
+		}
+		claims[claim] = expectedErr.value
+		_, err := VerifyIDToken(signJWT(t, "ES256", "ec-key", ecKey, claims), opts)
+		assert.ErrorContains(t, err, expectedErr.err, claim)
+	}
+	_, err = VerifyIDToken(signJWT(t, "ES256", "ec-key", ecKey, validClaims), VerifyOptions{JWKS: jwks})
+	assert.ErrorContains(t, err, "issuer and client id are required")
+}
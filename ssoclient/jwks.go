@@ -0,0 +1,298 @@
+package ssoclient
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cache of IdP JSON Web Key Set used to verify token signatures without a network round-trip.
+// The cached key set can be stored alongside cached tokens (see JWKS) and loaded again with NewJWKSCache.
+// Keys are refreshed from JWKSURI only if a token is signed by a key that is not cached,
+// at most once per MinRefreshInterval, so tokens with made-up key ids can't flood the IdP with requests.
+type JWKSCache struct {
+	// URI of IdP JWKS endpoint, keys are not refreshed if empty
+	JWKSURI string
+	// HTTP client used to refresh keys, http.DefaultClient is used if nil
+	HTTPClient *http.Client
+	// Optional maximum age of cached keys, older keys are refreshed before verifying a token,
+	// so keys removed from JWKS (e.g. compromised) stop being trusted. Keys never expire by default.
+	TTL time.Duration
+	// Optional minimum interval between refreshes caused by unknown key ids, 10 seconds by default
+	MinRefreshInterval    time.Duration
+	rawJWKS               []byte
+	keys                  map[string]crypto.PublicKey
+	loadedAt              time.Time
+	unknownKeyRefreshedAt time.Time
+	mutex                 sync.RWMutex
+}
+
+// Default minimum interval between JWKS refreshes caused by tokens signed by unknown keys.
+const defaultMinJWKSRefreshInterval = 10 * time.Second
+
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// Creates a JWKS cache, cachedJWKS is a previously stored JWKS JSON document and can be nil.
+func NewJWKSCache(jwksURI string, cachedJWKS []byte) (*JWKSCache, error) {
+	cache := &JWKSCache{JWKSURI: jwksURI, keys: map[string]crypto.PublicKey{}}
+	if cachedJWKS != nil {
+		if err := cache.load(cachedJWKS); err != nil {
+			return nil, err
+		}
+	}
+	return cache, nil
+}
+
+// Returns the currently cached JWKS JSON document, it can be stored and later passed to NewJWKSCache.
+func (cache *JWKSCache) JWKS() []byte {
+	cache.mutex.RLock()
+	defer cache.mutex.RUnlock()
+	return cache.rawJWKS
+}
+
+// Fetches the key set from JWKSURI and replaces cached keys.
+func (cache *JWKSCache) Refresh() error {
+	if cache.JWKSURI == "" {
+		return errors.New("can't refresh JWKS, JWKS URI is not set")
+	}
+	client := cache.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Get(cache.JWKSURI)
+	if err != nil {
+		return errors.Join(errors.New("failed to fetch JWKS"), err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to fetch JWKS, response status was %d, expected 200", res.StatusCode)
+	}
+	rawJWKS, err := io.ReadAll(res.Body)
+	if err != nil {
+		return errors.Join(errors.New("failed to read JWKS response body"), err)
+	}
+	return cache.load(rawJWKS)
+}
+
+// Verifies signature of a JWT using cached keys and returns its claims.
+// If the token's key id is not cached, keys are refreshed from JWKSURI once, unless they were
+// refreshed because of an unknown key id less than MinRefreshInterval ago.
+// Only the signature is verified, claims like "exp" must be checked by the caller.
+func (cache *JWKSCache) VerifyToken(token string) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("token is not a JWT, it must consist of 3 parts")
+	}
+	var header jwtHeader
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, errors.Join(errors.New("invalid JWT header"), err)
+	}
+	if cache.expired() {
+		// stale keys are still used if the refresh fails, unknown key id is refreshed again below
+		_ = cache.Refresh()
+	}
+	key, found := cache.key(header.Kid)
+	if !found && cache.JWKSURI != "" && cache.allowUnknownKeyRefresh() {
+		if err := cache.Refresh(); err != nil {
+			return nil, err
+		}
+		key, found = cache.key(header.Kid)
+	}
+	if !found {
+		return nil, fmt.Errorf("JWT signing key '%s' was not found in JWKS", header.Kid)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.Join(errors.New("invalid JWT signature encoding"), err)
+	}
+	if err := verifyJWTSignature(header.Alg, key, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+	var claims map[string]any
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, errors.Join(errors.New("invalid JWT claims"), err)
+	}
+	return claims, nil
+}
+
+// Reports whether cached keys are older than TTL and can be refreshed from JWKSURI.
+func (cache *JWKSCache) expired() bool {
+	cache.mutex.RLock()
+	defer cache.mutex.RUnlock()
+	return cache.TTL > 0 && cache.JWKSURI != "" && time.Since(cache.loadedAt) > cache.TTL
+}
+
+// Reports whether keys can be refreshed because of an unknown key id and records the refresh,
+// so concurrent verifications of tokens with unknown key ids refresh keys only once.
+func (cache *JWKSCache) allowUnknownKeyRefresh() bool {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	interval := cache.MinRefreshInterval
+	if interval <= 0 {
+		interval = defaultMinJWKSRefreshInterval
+	}
+	if !cache.unknownKeyRefreshedAt.IsZero() && time.Since(cache.unknownKeyRefreshedAt) < interval {
+		return false
+	}
+	cache.unknownKeyRefreshedAt = time.Now()
+	return true
+}
+
+// Returns cached key by key id, if kid is empty and there is exactly one key it is returned.
+func (cache *JWKSCache) key(kid string) (crypto.PublicKey, bool) {
+	cache.mutex.RLock()
+	defer cache.mutex.RUnlock()
+	if kid == "" && len(cache.keys) == 1 {
+		for _, key := range cache.keys {
+			return key, true
+		}
+	}
+	key, found := cache.keys[kid]
+	return key, found
+}
+
+// Parses JWKS JSON document and replaces cached keys, keys of unsupported types are skipped.
+func (cache *JWKSCache) load(rawJWKS []byte) error {
+	var jwks jsonWebKeySet
+	if err := json.Unmarshal(rawJWKS, &jwks); err != nil {
+		return errors.Join(errors.New("received JWKS in invalid format"), err)
+	}
+	keys := make(map[string]crypto.PublicKey, len(jwks.Keys))
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		if key, err := jwk.publicKey(); err == nil {
+			keys[jwk.Kid] = key
+		}
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.rawJWKS = rawJWKS
+	cache.keys = keys
+	cache.loadedAt = time.Now()
+	return nil
+}
+
+// Converts JWK to RSA or ECDSA public key.
+func (jwk jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported JWK curve '%s'", jwk.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	default:
+		return nil, fmt.Errorf("unsupported JWK key type '%s'", jwk.Kty)
+	}
+}
+
+// Verifies JWT signature of signed content ("{header}.{payload}") according to JWS algorithm.
+func verifyJWTSignature(alg string, key crypto.PublicKey, signedContent string, signature []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "ES512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported JWT signing algorithm '%s'", alg)
+	}
+	hasher := hash.New()
+	hasher.Write([]byte(signedContent))
+	digest := hasher.Sum(nil)
+
+	invalidSignatureErr := errors.New("JWT signature is invalid")
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") {
+			return fmt.Errorf("JWT signing algorithm '%s' does not match RSA key", alg)
+		}
+		if err := rsa.VerifyPKCS1v15(key, hash, digest, signature); err != nil {
+			return invalidSignatureErr
+		}
+	case *ecdsa.PublicKey:
+		if !strings.HasPrefix(alg, "ES") {
+			return fmt.Errorf("JWT signing algorithm '%s' does not match EC key", alg)
+		}
+		// ECDSA JWS signature is R and S concatenated, each padded to the curve size
+		keySize := (key.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*keySize {
+			return invalidSignatureErr
+		}
+		r := new(big.Int).SetBytes(signature[:keySize])
+		s := new(big.Int).SetBytes(signature[keySize:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return invalidSignatureErr
+		}
+	default:
+		return errors.New("unsupported JWT signing key type")
+	}
+	return nil
+}
+
+// Decodes base64url encoded JSON part of a JWT.
+func decodeJWTPart(part string, v any) error {
+	rawPart, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(rawPart, v)
+}
@@ -0,0 +1,189 @@
+package ssoclient
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoginResultVerifyTokenSignatureWithCachedJWKS(t *testing.T) {
+	t.Parallel()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	jwks := createJWKS(t, map[string]crypto.PublicKey{"rsa-key": &rsaKey.PublicKey})
+	// cache without JWKS URI must work offline
+	cache, err := NewJWKSCache("", jwks)
+	require.NoError(t, err)
+
+	result := &LoginResult{
+		AccessToken: signJWT(t, "RS256", "rsa-key", rsaKey, map[string]any{"sub": "mock-user"}),
+		ExpiresAt:   time.Now().Add(time.Minute),
+	}
+	assert.NoError(t, result.VerifyTokenSignature(cache))
+	assert.False(t, result.IsExpired())
+	assert.Equal(t, jwks, cache.JWKS())
+}
+
+func TestJWKSCacheRefreshesOnUnknownKeyId(t *testing.T) {
+	t.Parallel()
+	oldKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	newKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	jwksRequests := atomic.Int32{}
+	mockJWKSServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		jwksRequests.Add(1)
+		_, _ = w.Write(createJWKS(t, map[string]crypto.PublicKey{"new-key": &newKey.PublicKey}))
+	}))
+	defer mockJWKSServer.Close()
+	cache, err := NewJWKSCache(mockJWKSServer.URL, createJWKS(t, map[string]crypto.PublicKey{"old-key": &oldKey.PublicKey}))
+	require.NoError(t, err)
+
+	claims, err := cache.VerifyToken(signJWT(t, "ES256", "new-key", newKey, map[string]any{"sub": "mock-user"}))
+	assert.NoError(t, err)
+	assert.Equal(t, "mock-user", claims["sub"])
+	assert.Equal(t, int32(1), jwksRequests.Load())
+	// new key is cached now
+	_, err = cache.VerifyToken(signJWT(t, "ES256", "new-key", newKey, map[string]any{"sub": "mock-user"}))
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), jwksRequests.Load())
+}
+
+func TestJWKSCacheLimitsRefreshesOnUnknownKeyId(t *testing.T) {
+	t.Parallel()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	jwksRequests := atomic.Int32{}
+	mockJWKSServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		jwksRequests.Add(1)
+		_, _ = w.Write(createJWKS(t, map[string]crypto.PublicKey{"rsa-key": &rsaKey.PublicKey}))
+	}))
+	defer mockJWKSServer.Close()
+	cache, err := NewJWKSCache(mockJWKSServer.URL, nil)
+	require.NoError(t, err)
+	cache.MinRefreshInterval = 50 * time.Millisecond
+
+	for _, kid := range []string{"unknown-key-1", "unknown-key-2", "unknown-key-3"} {
+		_, err = cache.VerifyToken(signJWT(t, "RS256", kid, rsaKey, map[string]any{}))
+		assert.ErrorContains(t, err, "was not found in JWKS")
+	}
+	assert.Equal(t, int32(1), jwksRequests.Load())
+	time.Sleep(100 * time.Millisecond)
+	_, err = cache.VerifyToken(signJWT(t, "RS256", "unknown-key-4", rsaKey, map[string]any{}))
+	assert.Error(t, err)
+	assert.Equal(t, int32(2), jwksRequests.Load())
+}
+
+func TestJWKSCacheRejectsTamperedToken(t *testing.T) {
+	t.Parallel()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	cache, err := NewJWKSCache("", createJWKS(t, map[string]crypto.PublicKey{"rsa-key": &rsaKey.PublicKey}))
+	require.NoError(t, err)
+
+	token := signJWT(t, "RS256", "rsa-key", rsaKey, map[string]any{"sub": "mock-user"})
+	otherToken := signJWT(t, "RS256", "rsa-key", rsaKey, map[string]any{"sub": "admin"})
+	// use payload of another token with original signature
+	tamperedToken := fmt.Sprintf("%s.%s.%s", strings.Split(token, ".")[0], strings.Split(otherToken, ".")[1], strings.Split(token, ".")[2])
+	_, err = cache.VerifyToken(tamperedToken)
+	assert.Error(t, err)
+	_, err = cache.VerifyToken(signJWT(t, "RS256", "unknown-key", rsaKey, map[string]any{}))
+	assert.Error(t, err)
+}
+
+func TestJWKSCacheRefreshesKeysOlderThanTTL(t *testing.T) {
+	t.Parallel()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	jwksRequests := atomic.Int32{}
+	mockJWKSServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		jwksRequests.Add(1)
+		_, _ = w.Write(createJWKS(t, map[string]crypto.PublicKey{"rsa-key": &rsaKey.PublicKey}))
+	}))
+	defer mockJWKSServer.Close()
+	cache, err := NewJWKSCache(mockJWKSServer.URL, nil)
+	require.NoError(t, err)
+	cache.TTL = 50 * time.Millisecond
+
+	token := signJWT(t, "RS256", "rsa-key", rsaKey, map[string]any{"sub": "mock-user"})
+	_, err = cache.VerifyToken(token)
+	assert.NoError(t, err)
+	_, err = cache.VerifyToken(token)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), jwksRequests.Load())
+	time.Sleep(100 * time.Millisecond)
+	_, err = cache.VerifyToken(token)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), jwksRequests.Load())
+}
+
+func TestLoginResultIsExpired(t *testing.T) {
+	t.Parallel()
+	assert.True(t, (&LoginResult{ExpiresAt: time.Now().Add(-time.Second)}).IsExpired())
+	assert.False(t, (&LoginResult{ExpiresAt: time.Now().Add(time.Minute)}).IsExpired())
+	assert.False(t, (&LoginResult{}).IsExpired())
+}
+
+// Creates JWKS JSON document from public keys by key id.
+func createJWKS(t *testing.T, keys map[string]crypto.PublicKey) []byte {
+	jwks := jsonWebKeySet{}
+	for kid, key := range keys {
+		switch key := key.(type) {
+		case *rsa.PublicKey:
+			jwks.Keys = append(jwks.Keys, jsonWebKey{
+				Kid: kid,
+				Kty: "RSA",
+				N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			})
+		case *ecdsa.PublicKey:
+			jwks.Keys = append(jwks.Keys, jsonWebKey{
+				Kid: kid,
+				Kty: "EC",
+				Crv: key.Curve.Params().Name,
+				X:   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+				Y:   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+			})
+		}
+	}
+	rawJWKS, err := json.Marshal(jwks)
+	require.NoError(t, err)
+	return rawJWKS
+}
+
+// Creates a JWT signed by RSA (RS256) or ECDSA P-256 (ES256) key.
+func signJWT(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]any) string {
+	header, err := json.Marshal(jwtHeader{Alg: alg, Kid: kid})
+	require.NoError(t, err)
+	payload, err := json.Marshal(claims)
+	require.NoError(t, err)
+	signedContent := fmt.Sprintf("%s.%s", base64.RawURLEncoding.EncodeToString(header), base64.RawURLEncoding.EncodeToString(payload))
+	digest := sha256.Sum256([]byte(signedContent))
+	var signature []byte
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		require.NoError(t, err)
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		require.NoError(t, err)
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return fmt.Sprintf("%s.%s", signedContent, base64.RawURLEncoding.EncodeToString(signature))
+}
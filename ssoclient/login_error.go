@@ -0,0 +1,99 @@
+package ssoclient
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+)
+
+// Category of a failed login, e.g. to map login errors to exit codes of a CLI.
+type ErrorCategory string
+
+// Proxy or IdP could not be reached or the connection dropped.
+const ErrorCategoryNetwork ErrorCategory = "network"
+
+// IdP or proxy rejected the login or reported an error, e.g. user denied access.
+const ErrorCategoryIdP ErrorCategory = "idp"
+
+// User did not log in in time, device code expired or login timeout elapsed.
+const ErrorCategoryTimeout ErrorCategory = "timeout"
+
+// Login was cancelled by its context, e.g. when user pressed Ctrl+C.
+const ErrorCategoryCanceled ErrorCategory = "canceled"
+
+// Proxy or IdP responded in an unexpected format.
+const ErrorCategoryProtocol ErrorCategory = "protocol"
+
+// Proxy rejected the login, e.g. client exceeded its rate limit, proxy is overloaded or the login request was invalid.
+const ErrorCategoryProxy ErrorCategory = "proxy"
+
+// Error returned by device and proxy login functions when a started login failed.
+// Use errors.As to get it from returned errors, the underlying error is still matched
+// by errors.Is and errors.As, e.g. ErrAccessDenied or *ProxyLoginError.
+type LoginError struct {
+	Category ErrorCategory
+	// OAuth error code returned by IdP, e.g. "access_denied", or error code of proxy, one of ErrorCode* constants,
+	// empty if no error code was received
+	Code string
+	// HTTP status of the failed response, 0 if the login did not fail on a response
+	StatusCode int
+	Err        error
+}
+
+func (err *LoginError) Error() string {
+	return err.Err.Error()
+}
+
+func (err *LoginError) Unwrap() error {
+	return err.Err
+}
+
+// Returns err as *LoginError, errors that are not login errors yet are categorized by their cause.
+func newLoginError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var loginErr *LoginError
+	if errors.As(err, &loginErr) {
+		return err
+	}
+	loginErr = &LoginError{Category: ErrorCategoryProtocol, Err: err}
+	var proxyErr *ProxyLoginError
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, ErrAuthorizationExpired) {
+		loginErr.Category = ErrorCategoryTimeout
+	} else if errors.Is(err, context.Canceled) || errors.Is(err, ErrCanceled) {
+		loginErr.Category = ErrorCategoryCanceled
+	} else if errors.As(err, &proxyErr) {
+		loginErr.Code = proxyErr.Code
+		loginErr.Category = proxyErrorCategory(proxyErr.Code)
+	} else if errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF) {
+		loginErr.Category = ErrorCategoryNetwork
+	}
+	return loginErr
+}
+
+// Returns category of login that failed with proxy error code.
+func proxyErrorCategory(code string) ErrorCategory {
+	switch code {
+	case ErrorCodeTimeout:
+		return ErrorCategoryTimeout
+	case ErrorCodeRateLimited, ErrorCodeUnavailable, ErrorCodeInvalidRequest, ErrorCodeInternalError:
+		return ErrorCategoryProxy
+	default:
+		return ErrorCategoryIdP
+	}
+}
+
+// Returns category of proxy response with status code, but without error code of the proxy, e.g. from a gateway
+// in front of the proxy. Gateway errors mean the proxy could not be reached, other statuses are proxy errors.
+func proxyStatusCategory(statusCode int) ErrorCategory {
+	switch statusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return ErrorCategoryNetwork
+	default:
+		return ErrorCategoryProxy
+	}
+}
@@ -0,0 +1,145 @@
+package ssoclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoginWithDeviceAuthReturnsLoginError(t *testing.T) {
+	t.Parallel()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/auth/device", func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		if r.PostForm.Get("client_id") != "mock-client-id" {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"error":"invalid_client"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"device_code":"mock-device-code","user_code":"mock-user-code","verification_uri":"http://sso.mock","expires_in":10,"interval":1}`))
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"error":"access_denied"}`))
+	})
+	mockOAuthServer := httptest.NewServer(mux)
+	defer mockOAuthServer.Close()
+	config := DeviceAuthConfig{
+		DeviceAuthURI:   fmt.Sprintf("%s/auth/device", mockOAuthServer.URL),
+		TokenURI:        fmt.Sprintf("%s/token", mockOAuthServer.URL),
+		ClientId:        "mock-client-id",
+		MinPollInterval: time.Millisecond,
+	}
+
+	_, err := LoginWithDeviceAuth(config, func(verificationURI, userCode string) {})
+	var loginErr *LoginError
+	require.ErrorAs(t, err, &loginErr)
+	assert.Equal(t, ErrorCategoryIdP, loginErr.Category)
+	assert.Equal(t, "access_denied", loginErr.Code)
+	assert.Equal(t, http.StatusBadRequest, loginErr.StatusCode)
+	assert.ErrorIs(t, err, ErrAccessDenied)
+
+	config.ClientId = "unknown-client-id"
+	_, err = LoginWithDeviceAuth(config, func(verificationURI, userCode string) {})
+	require.ErrorAs(t, err, &loginErr)
+	assert.Equal(t, ErrorCategoryIdP, loginErr.Category)
+	assert.Equal(t, "invalid_client", loginErr.Code)
+	assert.Equal(t, http.StatusUnauthorized, loginErr.StatusCode)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	_, err = LoginWithDeviceAuthContext(ctx, DeviceAuthConfig{
+		DeviceAuthURI: config.DeviceAuthURI,
+		TokenURI:      config.TokenURI,
+		ClientId:      "mock-client-id",
+	}, func(info DeviceAuthInfo) { cancel() })
+	require.ErrorAs(t, err, &loginErr)
+	assert.Equal(t, ErrorCategoryCanceled, loginErr.Category)
+	assert.ErrorIs(t, err, ErrCanceled)
+}
+
+func TestLoginWithSSOProxyReturnsLoginError(t *testing.T) {
+	t.Parallel()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cli-login-unavailable", func(w http.ResponseWriter, r *http.Request) {
+		writeProxyErrorResponse(w, http.StatusServiceUnavailable, `{"code":"unavailable","message":"too many pending logins"}`)
+	})
+	mux.HandleFunc("/cli-login-rate-limited", func(w http.ResponseWriter, r *http.Request) {
+		writeProxyErrorResponse(w, http.StatusTooManyRequests, `{"code":"rate_limited","message":"Too many logins, try again later"}`)
+	})
+	mux.HandleFunc("/cli-login-bad-request", func(w http.ResponseWriter, r *http.Request) {
+		writeProxyErrorResponse(w, http.StatusBadRequest, `{"code":"invalid_request","message":"invalid login timeout"}`)
+	})
+	mux.HandleFunc("/cli-login-bad-gateway", func(w http.ResponseWriter, r *http.Request) {
+		// e.g. from a reverse proxy in front of the proxy
+		http.Error(w, "bad gateway", http.StatusBadGateway)
+	})
+	mux.HandleFunc("/cli-login-not-found", func(w http.ResponseWriter, r *http.Request) {
+		// e.g. proxy login URI with a wrong path
+		http.NotFound(w, r)
+	})
+	mux.HandleFunc("/cli-login-timeout", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", eventError, `{"code":"timeout","message":"user's login session timed out"}`)
+	})
+	mux.HandleFunc("/cli-login-invalid", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", eventLoggedIn, `{"refresh_token":"mock-refresh-token"}`)
+	})
+	mockProxy := httptest.NewServer(mux)
+	defer mockProxy.Close()
+
+	for _, test := range []struct {
+		path       string
+		category   ErrorCategory
+		code       string
+		statusCode int
+	}{
+		{"/cli-login-unavailable", ErrorCategoryProxy, ErrorCodeUnavailable, http.StatusServiceUnavailable},
+		{"/cli-login-rate-limited", ErrorCategoryProxy, ErrorCodeRateLimited, http.StatusTooManyRequests},
+		{"/cli-login-bad-request", ErrorCategoryProxy, ErrorCodeInvalidRequest, http.StatusBadRequest},
+		{"/cli-login-bad-gateway", ErrorCategoryNetwork, "", http.StatusBadGateway},
+		{"/cli-login-not-found", ErrorCategoryProxy, "", http.StatusNotFound},
+		{"/cli-login-timeout", ErrorCategoryTimeout, ErrorCodeTimeout, 0},
+		{"/cli-login-invalid", ErrorCategoryProtocol, "", 0},
+	} {
+		_, err := LoginWithSSOProxy(mockProxy.URL+test.path, func(loginURI string) {})
+		var loginErr *LoginError
+		require.ErrorAs(t, err, &loginErr, test.path)
+		assert.Equal(t, test.category, loginErr.Category, test.path)
+		assert.Equal(t, test.code, loginErr.Code, test.path)
+		assert.Equal(t, test.statusCode, loginErr.StatusCode, test.path)
+	}
+
+	var proxyErr *ProxyLoginError
+	_, err := LoginWithSSOProxy(mockProxy.URL+"/cli-login-timeout", func(loginURI string) {})
+	assert.ErrorAs(t, err, &proxyErr, "proxy error is still available")
+
+	unreachableProxy := httptest.NewServer(http.NotFoundHandler())
+	unreachableProxy.Close()
+	_, err = LoginWithSSOProxy(unreachableProxy.URL, func(loginURI string) {})
+	var loginErr *LoginError
+	require.ErrorAs(t, err, &loginErr)
+	assert.Equal(t, ErrorCategoryNetwork, loginErr.Category)
+}
+
+// Writes error response of proxy with status and "error" event with data like ssoproxy.
+func writeProxyErrorResponse(w http.ResponseWriter, status int, data string) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", eventError, data)
+}
+
+func TestNewLoginErrorKeepsLoginError(t *testing.T) {
+	t.Parallel()
+	original := &LoginError{Category: ErrorCategoryIdP, Code: "invalid_grant", StatusCode: http.StatusBadRequest, Err: errors.New("invalid grant")}
+	err := newLoginError(fmt.Errorf("login failed: %w", original))
+	var loginErr *LoginError
+	require.ErrorAs(t, err, &loginErr)
+	assert.Same(t, original, loginErr)
+	assert.Nil(t, newLoginError(nil))
+}
@@ -0,0 +1,51 @@
+package ssoclient
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+// JSON object written by WriteDeviceAuthJSON, all fields are always present.
+type deviceAuthOutput struct {
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	UserCode                string `json:"user_code"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+// JSON object written by WriteLoginURIJSON.
+type loginURIOutput struct {
+	LoginURI string `json:"login_uri"`
+}
+
+// Writes information about a started device authorization to w as a single line JSON object
+// `{"verification_uri": "...", "verification_uri_complete": "...", "user_code": "...", "expires_in": 600, "interval": 5}`,
+// e.g. from deviceAuthStarted callback of CLIs with machine-readable output. Field names match
+// the Device Authorization Response, verification_uri_complete is empty if IdP did not return it.
+func WriteDeviceAuthJSON(w io.Writer, info DeviceAuthInfo) error {
+	return writeJSONOutput(w, deviceAuthOutput{
+		VerificationURI:         info.VerificationURI,
+		VerificationURIComplete: info.VerificationURIComplete,
+		UserCode:                info.UserCode,
+		ExpiresIn:               info.ExpiresIn,
+		Interval:                info.Interval,
+	})
+}
+
+// Writes login URI received from proxy to w as a single line JSON object `{"login_uri": "..."}`,
+// e.g. from onLoginURIReceived callback of CLIs with machine-readable output.
+func WriteLoginURIJSON(w io.Writer, loginURI string) error {
+	return writeJSONOutput(w, loginURIOutput{LoginURI: loginURI})
+}
+
+func writeJSONOutput(w io.Writer, output any) error {
+	encoder := json.NewEncoder(w)
+	// URIs are printed for people and tools, not embedded in HTML, so '&' in query is kept readable
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(output); err != nil {
+		return errors.Join(errors.New("failed to write JSON output"), err)
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package ssoclient
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteDeviceAuthJSON(t *testing.T) {
+	t.Parallel()
+	var output bytes.Buffer
+	err := WriteDeviceAuthJSON(&output, DeviceAuthInfo{
+		VerificationURI:         "https://idp.example.com/device",
+		VerificationURIComplete: "https://idp.example.com/device?user_code=ABCD-EFGH",
+		UserCode:                "ABCD-EFGH",
+		ExpiresIn:               600,
+		ExpiresAt:               time.Now().Add(10 * time.Minute),
+		Interval:                5,
+	})
+	require.NoError(t, err)
+
+	var fields map[string]any
+	require.NoError(t, json.Unmarshal(output.Bytes(), &fields))
+	assert.Equal(t, map[string]any{
+		"verification_uri":          "https://idp.example.com/device",
+		"verification_uri_complete": "https://idp.example.com/device?user_code=ABCD-EFGH",
+		"user_code":                 "ABCD-EFGH",
+		"expires_in":                float64(600),
+		"interval":                  float64(5),
+	}, fields)
+	assert.Equal(t, 1, bytes.Count(output.Bytes(), []byte("\n")))
+}
+
+func TestWriteDeviceAuthJSONKeepsMissingFields(t *testing.T) {
+	t.Parallel()
+	var output bytes.Buffer
+	require.NoError(t, WriteDeviceAuthJSON(&output, DeviceAuthInfo{VerificationURI: "https://idp.example.com/device"}))
+
+	var fields map[string]any
+	require.NoError(t, json.Unmarshal(output.Bytes(), &fields))
+	assert.Equal(t, "", fields["verification_uri_complete"])
+	assert.Equal(t, float64(0), fields["expires_in"])
+	assert.Len(t, fields, 5)
+}
+
+func TestWriteLoginURIJSON(t *testing.T) {
+	t.Parallel()
+	var output bytes.Buffer
+	require.NoError(t, WriteLoginURIJSON(&output, "https://idp.example.com/auth?state=abc&nonce=def"))
+
+	assert.Equal(t, `{"login_uri":"https://idp.example.com/auth?state=abc&nonce=def"}`+"\n", output.String())
+}
@@ -3,71 +3,626 @@ package ssoclient
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
+	"math"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 )
 
 type proxyTokensEvent struct {
-	AccessToken  string `json:"access_token"`
-	RefreshToken string `json:"refresh_token"`
-	Expiration   int    `json:"expiration"`
+	AccessToken  string          `json:"access_token"`
+	RefreshToken string          `json:"refresh_token"`
+	Expiration   int             `json:"expiration"`
+	TokenType    string          `json:"token_type"`
+	Scope        string          `json:"scope"`
+	RawResponse  json.RawMessage `json:"raw_response"`
 }
 
 const eventAuthURI = "auth-uri"
 const eventLoggedIn = "logged-in"
+const eventTokensRefreshed = "oidc-tokens"
 const eventError = "error"
 
+// User did not log in within proxy's login timeout.
+const ErrorCodeTimeout = "timeout"
+
+// User denied consent or access at IdP.
+const ErrorCodeAccessDenied = "access_denied"
+
+// IdP returned an error other than denied access.
+const ErrorCodeIdPError = "idp_error"
+
+// Proxy could not retrieve tokens from IdP.
+const ErrorCodeTokenExchangeFailed = "token_exchange_failed"
+
+// Proxy could not refresh tokens in token stream, user has to log in again.
+const ErrorCodeExpiredSession = "expired_session"
+
+// Proxy has too many pending logins or is shutting down, login can be retried later.
+const ErrorCodeUnavailable = "unavailable"
+
+// Client started too many logins, login can be retried later.
+const ErrorCodeRateLimited = "rate_limited"
+
+// Proxy rejected the login request.
+const ErrorCodeInvalidRequest = "invalid_request"
+
+// Unexpected error of the proxy.
+const ErrorCodeInternalError = "internal_error"
+
+type proxyErrorEvent struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Error received from proxy when login failed. Use errors.As to get it from returned errors.
+type ProxyLoginError struct {
+	// Machine-readable error code, one of ErrorCode* constants, empty if proxy does not send error codes
+	Code string
+	// Human readable error description
+	Message string
+}
+
+func (err *ProxyLoginError) Error() string {
+	if err.Code == "" {
+		return fmt.Sprintf("received error '%s'", err.Message)
+	}
+	return fmt.Sprintf("received error '%s' (code: %s)", err.Message, err.Code)
+}
+
+// Configuration of login using a proxy server with handlers from ssoproxy.
+type ProxyLoginConfig struct {
+	// URI of proxy's OIDCLoginHandler
+	LoginURI string
+	// Optional maximum duration of the whole login including waiting for user to log in, no timeout by default.
+	// The timeout is also sent to proxy, so it ends the login session at the same time (proxy may shorten it).
+	Timeout time.Duration
+	// Optional hint about user's login identifier, e.g. username or email, proxy forwards it to IdP
+	// so the user does not have to type it again
+	LoginHint string
+	// Optional logger of login lifecycle events, nothing is logged by default
+	Logger *slog.Logger
+	// Optional headers added to login request, e.g. an API key of a gateway in front of the proxy
+	Header http.Header
+	// Optional HTTP method of login request, GET by default
+	Method string
+	// Optional body of login request, e.g. with POST method
+	Body []byte
+	// Optional maximum size of a login event in bytes, 1 MiB by default
+	MaxEventSize int
+	// Optional number of retries of login request with backoff if the proxy is not reachable or responds
+	// with status 5xx, e.g. while it restarts. Errors after the login stream was opened are never retried,
+	// but a stream that drops before the login finished is resumed up to Retries times with "Last-Event-ID"
+	// header if the proxy sent event ids, so the same login continues. The login request is not retried by default.
+	Retries int
+	// Optional maximum time without receiving any data from the proxy after the login stream was opened,
+	// a stalled stream then fails with an error wrapping context.DeadlineExceeded instead of blocking forever.
+	// It must be longer than the time users need to log in, because no events are sent meanwhile. Disabled by default.
+	IdleTimeout time.Duration
+}
+
 // Starts the login process using a proxy server with handlers from ssoproxy.
 // The proxy first returns a configured login URI that has to be used in order for the login to succeed.
-// After successful login OIDC access and refresh tokens are returned.
+// After successful login OIDC access and refresh tokens are returned, a failed login returns *LoginError.
 func LoginWithSSOProxy(
 	proxyLoginURI string,
 	onLoginURIReceived func(loginURI string),
 ) (*LoginResult, error) {
-	res, err := http.Get(proxyLoginURI)
+	return LoginWithSSOProxyContext(context.Background(), proxyLoginURI, onLoginURIReceived)
+}
+
+// Returns HTTP method of login request, GET by default.
+func (config ProxyLoginConfig) method() string {
+	if config.Method == "" {
+		return http.MethodGet
+	}
+	return config.Method
+}
+
+// Starts the login process using a proxy server the same way as LoginWithSSOProxy, but the login
+// is cancelled when ctx is done, e.g. when user presses Ctrl+C while waiting for the login.
+// The login request is aborted and an error wrapping ctx.Err() is returned.
+func LoginWithSSOProxyContext(
+	ctx context.Context,
+	proxyLoginURI string,
+	onLoginURIReceived func(loginURI string),
+) (*LoginResult, error) {
+	return LoginWithSSOProxyConfig(ctx, ProxyLoginConfig{LoginURI: proxyLoginURI}, onLoginURIReceived)
+}
+
+// Starts the login process using a proxy server the same way as LoginWithSSOProxyContext, configured by config.
+// If the login does not finish within config.Timeout, the login request is cancelled and
+// an error wrapping context.DeadlineExceeded is returned.
+func LoginWithSSOProxyConfig(
+	ctx context.Context,
+	config ProxyLoginConfig,
+	onLoginURIReceived func(loginURI string),
+) (*LoginResult, error) {
+	logger := loggerOrDiscard(config.Logger)
+	result, err := loginWithSSOProxy(ctx, config, logger, onLoginURIReceived)
 	if err != nil {
-		return nil, errors.Join(errors.New("failed to execute HTTP login request"), err)
+		logger.Error("Proxy login failed", "error", err)
+		return nil, newLoginError(err)
 	}
-	if res.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("HTTP login response status was %d, expected 200", res.StatusCode)
+	logger.Info("Received tokens", "expiresIn", result.Expiration, "scope", result.Scope)
+	return result, nil
+}
+
+// Proxy login started by StartSSOProxyLogin, the user logs in at LoginURI while the login waits for tokens.
+type ProxyLogin struct {
+	// URI received from proxy that the user has to log in at
+	LoginURI string
+	done     chan struct{}
+	result   *LoginResult
+	err      error
+}
+
+// Starts the login process using a proxy server like LoginWithSSOProxyConfig, but returns as soon as the proxy
+// sent login URI, so the caller decides when and how to present it, e.g. in its own UI loop.
+// The login continues in background until ctx is done, call ProxyLogin.Wait to receive its tokens.
+// If the login fails before login URI is received, its error is returned.
+func StartSSOProxyLogin(ctx context.Context, config ProxyLoginConfig) (*ProxyLogin, error) {
+	login := &ProxyLogin{done: make(chan struct{})}
+	loginURIs := make(chan string, 1)
+	go func() {
+		defer close(login.done)
+		login.result, login.err = LoginWithSSOProxyConfig(ctx, config, func(loginURI string) {
+			select {
+			case loginURIs <- loginURI:
+			default: // only the first login URI is returned
+			}
+		})
+	}()
+	select {
+	case login.LoginURI = <-loginURIs:
+		return login, nil
+	case <-login.done:
+		select {
+		case login.LoginURI = <-loginURIs: // login finished right after login URI was received
+		default:
+		}
+		if login.LoginURI == "" && login.err != nil {
+			return nil, login.err
+		}
+		return login, nil
+	}
+}
+
+// Waits until the login finishes and returns its tokens or error, can be called repeatedly.
+func (login *ProxyLogin) Wait() (*LoginResult, error) {
+	<-login.done
+	return login.result, login.err
+}
+
+func loginWithSSOProxy(
+	ctx context.Context,
+	config ProxyLoginConfig,
+	logger *slog.Logger,
+	onLoginURIReceived func(loginURI string),
+) (*LoginResult, error) {
+	if config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.Timeout)
+		defer cancel()
+	}
+	ctx, cancelIdle := context.WithCancelCause(ctx)
+	defer cancelIdle(nil)
+	params := url.Values{}
+	if config.LoginHint != "" {
+		params.Set("login_hint", config.LoginHint)
+	}
+	if config.Timeout > 0 {
+		params.Set("login-timeout", strconv.Itoa(int(math.Ceil(config.Timeout.Seconds()))))
+	}
+	loginURI, err := addQueryParams(config.LoginURI, params)
+	if err != nil {
+		return nil, err
+	}
+	logger.Debug("Sending login request to proxy", "uri", loginURI)
+	method := config.method()
+	res, err := sendProxyLoginRequest(ctx, method, loginURI, config.Header, config.Body)
+	for retry := 1; err != nil && retry <= config.Retries && isRetryableLoginError(ctx, err); retry++ {
+		delay := retryBackoff(retry)
+		logger.Warn("Proxy login request failed, retrying", "retry", retry, "delay", delay, "error", err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+		}
+		res, err = sendProxyLoginRequest(ctx, method, loginURI, config.Header, config.Body)
+	}
+	if err != nil {
+		return nil, loginContextError(ctx, config.Timeout, err)
+	}
+	var tokenEvent *proxyTokensEvent
+	var eventErr error
+	onEventReceived := func(event, data string) error {
+		logger.Debug("Received login event", "event", event)
+		if event == eventAuthURI {
+			// query contains OIDC state of the login, it must not end up in shared logs
+			logger.Debug("Received login URI", "uri", uriWithoutQuery(data))
+			onLoginURIReceived(data)
+		} else if event == eventLoggedIn {
+			tokenEvent = &proxyTokensEvent{}
+			if err := json.Unmarshal([]byte(data), tokenEvent); err != nil {
+				eventErr = errors.New("received access and refresh token in invalid format")
+			} else {
+				eventErr = tokenEvent.validate()
+			}
+		} else if event == eventError {
+			eventErr = parseProxyError(data)
+		} else {
+			eventErr = fmt.Errorf("encountered unknown login event '%s'", event)
+		}
+		return eventErr
+	}
+	lastEventId := ""
+	for resume := 1; ; resume++ {
+		id, streamErr := readLoginStream(res, config, cancelIdle, onEventReceived)
+		if id != "" {
+			lastEventId = id
+		}
+		err = streamErr
+		// only dropped streams of logins the proxy assigned an event id to can be resumed
+		if tokenEvent != nil || eventErr != nil || lastEventId == "" || resume > config.Retries || ctx.Err() != nil {
+			break
+		}
+		delay := retryBackoff(resume)
+		logger.Warn("Login stream dropped, resuming login", "resume", resume, "delay", delay, "error", err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+		}
+		header := config.Header.Clone()
+		if header == nil {
+			header = http.Header{}
+		}
+		header.Set("Last-Event-ID", lastEventId)
+		res, err = sendProxyLoginRequest(ctx, method, loginURI, header, config.Body)
+		if err != nil {
+			return nil, loginContextError(ctx, config.Timeout, errors.Join(errors.New("failed to resume dropped login stream"), err))
+		}
+	}
+	if err != nil {
+		return nil, loginContextError(ctx, config.Timeout, err)
+	} else if tokenEvent == nil {
+		// e.g. proxy crashed while user was logging in
+		return nil, &LoginError{
+			Category: ErrorCategoryNetwork,
+			Err:      errors.New("login stream closed before completion, proxy did not send tokens or an error"),
+		}
+	}
+	return tokenEvent.loginResult(), nil
+}
+
+// Reads events of login stream res until it ends and passes them to onEventReceived, returns id of the last
+// received event, empty if the proxy did not send any. If config.IdleTimeout elapses without data, cancelIdle is called.
+func readLoginStream(
+	res *http.Response,
+	config ProxyLoginConfig,
+	cancelIdle context.CancelCauseFunc,
+	onEventReceived func(event, data string) error,
+) (string, error) {
+	body := res.Body
+	if config.IdleTimeout > 0 {
+		// cancelling the request context aborts blocked read of response body
+		body = newIdleTimeoutReader(res.Body, config.IdleTimeout, func() {
+			cancelIdle(fmt.Errorf("proxy did not send any data within %s: %w", config.IdleTimeout, context.DeadlineExceeded))
+		})
+	}
+	defer body.Close()
+	return consumeSSEFromHTTPEventStream(body, config.MaxEventSize, onEventReceived)
+}
+
+// Starts the login process using a proxy server like LoginWithSSOProxy, but asks the proxy to keep
+// the login stream open after login. The proxy then refreshes tokens on user's behalf before they expire,
+// so the caller always has valid tokens without polling. Token stream must be enabled on the proxy.
+// Tokens received after login and after each refresh are passed to onTokensReceived.
+// The login request is sent with LoginURI, LoginHint, Header, Method, Body and MaxEventSize of config,
+// Timeout, Retries and IdleTimeout are not used because the stream stays open as long as the caller needs tokens.
+// Blocks until ctx is cancelled (returns nil), the proxy closes the stream or an error occurs (*LoginError).
+func LoginWithSSOProxyTokenStream(
+	ctx context.Context,
+	config ProxyLoginConfig,
+	onLoginURIReceived func(loginURI string),
+	onTokensReceived func(result *LoginResult),
+) error {
+	params := url.Values{"token-stream": {"true"}}
+	if config.LoginHint != "" {
+		params.Set("login_hint", config.LoginHint)
+	}
+	loginURI, err := addQueryParams(config.LoginURI, params)
+	if err != nil {
+		return err
+	}
+	res, err := sendProxyLoginRequest(ctx, config.method(), loginURI, config.Header, config.Body)
+	if err != nil {
+		return newLoginError(err)
 	}
 	defer res.Body.Close()
-	var tokenEvent proxyTokensEvent
-	err = consumeSSEFromHTTPEventStream(
+	_, err = consumeSSEFromHTTPEventStream(
 		res.Body,
+		config.MaxEventSize,
 		func(event, data string) error {
 			if event == eventAuthURI {
 				onLoginURIReceived(data)
-			} else if event == eventLoggedIn {
+			} else if event == eventLoggedIn || event == eventTokensRefreshed {
+				var tokenEvent proxyTokensEvent
 				if err := json.Unmarshal([]byte(data), &tokenEvent); err != nil {
 					return errors.New("received access and refresh token in invalid format")
 				}
+				if err := tokenEvent.validate(); err != nil {
+					return err
+				}
+				onTokensReceived(tokenEvent.loginResult())
 			} else if event == eventError {
-				return fmt.Errorf("received error '%s'", data)
+				return parseProxyError(data)
 			} else {
 				return fmt.Errorf("encountered unknown login event '%s'", event)
 			}
 			return nil
 		},
 	)
+	if ctx.Err() != nil {
+		return nil
+	}
+	return newLoginError(err)
+}
+
+// Exchanges one-time code the user received after a login started at proxy's OIDCLoginOneTimeCodeHandler
+// for tokens at proxy's OIDCTokenHandler served on proxyTokenURI. The code can be exchanged only once,
+// a used, expired or invalid code returns *LoginError with Code ErrorCodeInvalidRequest and status 404.
+func ExchangeSSOProxyOneTimeCode(ctx context.Context, proxyTokenURI, oneTimeCode string) (*LoginResult, error) {
+	form := url.Values{"code": {oneTimeCode}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, proxyTokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to create one-time code exchange request"), err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, newLoginError(errors.Join(errors.New("failed to execute one-time code exchange request"), err))
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		loginErr := &LoginError{
+			Category:   proxyStatusCategory(res.StatusCode),
+			StatusCode: res.StatusCode,
+			Err:        fmt.Errorf("one-time code exchange response status was %d, expected 200", res.StatusCode),
+		}
+		var event proxyErrorEvent
+		if err := json.NewDecoder(io.LimitReader(res.Body, maxErrorResponseSize)).Decode(&event); err == nil && event.Code != "" {
+			loginErr.Category = proxyErrorCategory(event.Code)
+			loginErr.Code = event.Code
+			loginErr.Err = fmt.Errorf("one-time code exchange response status was %d: %w", res.StatusCode,
+				&ProxyLoginError{Code: event.Code, Message: event.Message})
+		}
+		return nil, loginErr
+	}
+	var tokenEvent proxyTokensEvent
+	if err := json.NewDecoder(res.Body).Decode(&tokenEvent); err != nil {
+		return nil, newLoginError(errors.Join(errors.New("received access and refresh token in invalid format"), err))
+	}
+	if err := tokenEvent.validate(); err != nil {
+		return nil, newLoginError(err)
+	}
+	return tokenEvent.loginResult(), nil
+}
+
+// Adds query parameters to proxy login URI, values are escaped.
+func addQueryParams(uri string, params url.Values) (string, error) {
+	loginURI, err := url.Parse(uri)
+	if err != nil {
+		return "", errors.Join(errors.New("invalid proxy login URI"), err)
+	}
+	if len(params) == 0 {
+		return uri, nil
+	}
+	query := loginURI.Query()
+	for param, values := range params {
+		query[param] = values
+	}
+	loginURI.RawQuery = query.Encode()
+	return loginURI.String(), nil
+}
+
+// Sends HTTP login request with optional headers and body to proxy and checks that the login stream was opened.
+func sendProxyLoginRequest(
+	ctx context.Context,
+	method string,
+	proxyLoginURI string,
+	header http.Header,
+	body []byte,
+) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, proxyLoginURI, bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to create HTTP login request"), err)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to execute HTTP login request"), err)
+	}
+	// http.Client decompresses gzip itself only if it added Accept-Encoding, e.g. not if it was set in config.Header
+	if strings.EqualFold(res.Header.Get("Content-Encoding"), "gzip") {
+		res.Body = &gzipReader{reader: res.Body}
+		res.Header.Del("Content-Encoding")
+		res.Uncompressed = true
+	}
+	if res.StatusCode != http.StatusOK {
+		defer res.Body.Close()
+		return nil, proxyResponseError(res)
+	}
+	return res, nil
+}
+
+// Maximum size of a read body of a proxy response with error status.
+const maxErrorResponseSize = 64 * 1024
+
+// Returns login error of proxy response with other status than 200. Proxy sends the reason as "error" event
+// in event stream body, its error code is kept in the login error and the login is categorized by it.
+// Responses without it, e.g. from a gateway in front of the proxy, are categorized by status code.
+func proxyResponseError(res *http.Response) *LoginError {
+	loginErr := &LoginError{
+		Category:   proxyStatusCategory(res.StatusCode),
+		StatusCode: res.StatusCode,
+		Err:        fmt.Errorf("HTTP login response status was %d, expected 200", res.StatusCode),
+	}
+	if !strings.HasPrefix(res.Header.Get("Content-Type"), "text/event-stream") {
+		return loginErr
+	}
+	var proxyErr *ProxyLoginError
+	body := io.NopCloser(io.LimitReader(res.Body, maxErrorResponseSize))
+	_, _ = consumeSSEFromHTTPEventStream(body, 0, func(event, data string) error {
+		if event != eventError {
+			return nil
+		}
+		proxyErr = parseProxyError(data)
+		return proxyErr
+	})
+	if proxyErr != nil {
+		loginErr.Category = proxyErrorCategory(proxyErr.Code)
+		loginErr.Code = proxyErr.Code
+		loginErr.Err = fmt.Errorf("HTTP login response status was %d: %w", res.StatusCode, proxyErr)
+	}
+	return loginErr
+}
+
+// Reports whether login request can be retried, it timed out, the connection was refused or reset
+// or the proxy responded with status 5xx. Requests rejected by the proxy (4xx), requests cancelled by ctx
+// and errors that won't go away by retrying, e.g. invalid certificate or malformed URI, are not retried.
+func isRetryableLoginError(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var loginErr *LoginError
+	if errors.As(err, &loginErr) && loginErr.StatusCode != 0 {
+		return loginErr.StatusCode >= http.StatusInternalServerError
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET)
+}
+
+// Returns a clear timeout or cancellation error if login failed because ctx is done, otherwise returns err.
+func loginContextError(ctx context.Context, timeout time.Duration, err error) error {
+	if cause := context.Cause(ctx); cause != nil && cause != ctx.Err() {
+		return cause
+	} else if errors.Is(ctx.Err(), context.DeadlineExceeded) && timeout > 0 {
+		return fmt.Errorf("login did not finish within %s: %w", timeout, context.DeadlineExceeded)
+	} else if ctx.Err() != nil {
+		return fmt.Errorf("login was cancelled: %w", ctx.Err())
+	}
+	return err
+}
+
+// Reader of login stream that calls onIdle if no data is read within timeout, e.g. to cancel a stalled login.
+type idleTimeoutReader struct {
+	reader  io.ReadCloser
+	timeout time.Duration
+	timer   *time.Timer
+}
+
+func newIdleTimeoutReader(reader io.ReadCloser, timeout time.Duration, onIdle func()) *idleTimeoutReader {
+	return &idleTimeoutReader{reader: reader, timeout: timeout, timer: time.AfterFunc(timeout, onIdle)}
+}
+
+func (reader *idleTimeoutReader) Read(p []byte) (int, error) {
+	n, err := reader.reader.Read(p)
+	if n > 0 {
+		reader.timer.Reset(reader.timeout)
+	}
+	return n, err
+}
+
+func (reader *idleTimeoutReader) Close() error {
+	reader.timer.Stop()
+	return reader.reader.Close()
+}
+
+// Reader of gzip compressed login stream, gzip header is read on first Read, so it does not block
+// until the proxy sends the first event.
+type gzipReader struct {
+	reader       io.ReadCloser
+	decompressor *gzip.Reader
+}
+
+func (reader *gzipReader) Read(p []byte) (int, error) {
+	if reader.decompressor == nil {
+		decompressor, err := gzip.NewReader(reader.reader)
+		if err != nil {
+			return 0, errors.Join(errors.New("invalid gzip compressed login stream"), err)
+		}
+		reader.decompressor = decompressor
+	}
+	return reader.decompressor.Read(p)
+}
+
+func (reader *gzipReader) Close() error {
+	return reader.reader.Close()
+}
+
+// Parses data of "error" event, proxies without error codes send only an error description.
+func parseProxyError(data string) *ProxyLoginError {
+	var event proxyErrorEvent
+	if err := json.Unmarshal([]byte(data), &event); err != nil || event.Code == "" {
+		return &ProxyLoginError{Message: data}
+	}
+	return &ProxyLoginError{Code: event.Code, Message: event.Message}
+}
+
+// Checks that received tokens event contains an access token, a login without it is not successful.
+func (tokenEvent proxyTokensEvent) validate() error {
+	if tokenEvent.AccessToken == "" {
+		return errors.New("received tokens event without access token")
+	}
+	return nil
+}
+
+// Converts received tokens event to login result.
+func (tokenEvent proxyTokensEvent) loginResult() *LoginResult {
 	return &LoginResult{
 		AccessToken:  tokenEvent.AccessToken,
 		RefreshToken: tokenEvent.RefreshToken,
 		Expiration:   tokenEvent.Expiration,
-	}, err
+		ExpiresAt:    expiresAt(tokenEvent.Expiration),
+		TokenType:    tokenEvent.TokenType,
+		Scope:        tokenEvent.Scope,
+		RawResponse:  tokenEvent.RawResponse,
+	}
 }
 
+// Default maximum size of a received login event, large enough for tokens with many claims.
+const defaultMaxEventSize = 1024 * 1024
+
 // Takes an HTTP response body of a response with text/event-stream Content-Type
 // and consumes Server-Sent Events (SSE) that were sent through the HTTP connection.
+// Events larger than maxEventSize bytes (defaultMaxEventSize if not positive) are rejected with an error.
+// Returns id of the last received event, so the stream can be resumed with "Last-Event-ID" header.
 func consumeSSEFromHTTPEventStream(
 	httpBody io.ReadCloser,
+	maxEventSize int,
 	onEventReceived func(event, data string) error,
-) error {
+) (lastEventId string, err error) {
+	if maxEventSize <= 0 {
+		maxEventSize = defaultMaxEventSize
+	}
 	scanner := bufio.NewScanner(httpBody)
+	scanner.Buffer(make([]byte, 0, min(64*1024, maxEventSize)), maxEventSize)
 	scanner.Split(func(data []byte, atEOF bool) (advance int, token []byte, err error) {
 		// if scanner has nothing to scan, continue scanning
 		if atEOF && len(data) == 0 {
@@ -83,36 +638,53 @@ func consumeSSEFromHTTPEventStream(
 	for {
 		if scanner.Scan() {
 			rawEvent := scanner.Text()
-			event, data, err := parseSSEEvent(rawEvent)
+			event, data, id, err := parseSSEEvent(rawEvent)
 			if err != nil {
-				return errors.Join(errors.New("received invalid login event from proxy"), err)
+				return lastEventId, errors.Join(errors.New("received invalid login event from proxy"), err)
+			}
+			if id != "" {
+				lastEventId = id
 			}
 			if err = onEventReceived(event, data); err != nil {
-				return errors.Join(errors.New("an error occurred during consuming a login event"), err)
+				return lastEventId, errors.Join(errors.New("an error occurred during consuming a login event"), err)
 			}
 		} else {
-			if err := scanner.Err(); err != nil {
-				return errors.Join(errors.New("an error occurred while reading login events"), err)
+			if err := scanner.Err(); errors.Is(err, bufio.ErrTooLong) {
+				return lastEventId, fmt.Errorf("received login event exceeds maximum size of %d bytes", maxEventSize)
+			} else if err != nil {
+				return lastEventId, errors.Join(errors.New("an error occurred while reading login events"), err)
 			} else {
-				return nil
+				return lastEventId, nil
 			}
 		}
 	}
 }
 
 // Parses Server-Sent Events (SSE) event and validates its structure.
-func parseSSEEvent(rawEvent string) (event, data string, err error) {
-	parts := strings.Split(rawEvent, "\n")
-	if len(parts) != 2 {
-		return "", "", errors.New("event does not contain one or both fields 'event' and 'data' or has more fields")
-	}
-	event, valid := strings.CutPrefix(parts[0], "event: ")
-	if !valid {
-		return "", "", errors.New("SSE event field 'event' must start with 'event: '")
+// Fields can be in any order, multiple "data" fields are joined with a new line and
+// other fields like "retry" as well as comments are ignored. Id is empty if the event does not have field "id".
+// Event type defaults to "message" as defined by SSE specification.
+func parseSSEEvent(rawEvent string) (event, data, id string, err error) {
+	event = "message"
+	dataLines := []string{}
+	for _, line := range strings.Split(rawEvent, "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if line == "" || strings.HasPrefix(line, ":") {
+			continue
+		}
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "event":
+			event = value
+		case "data":
+			dataLines = append(dataLines, value)
+		case "id":
+			id = value
+		}
 	}
-	data, valid = strings.CutPrefix(parts[1], "data: ")
-	if !valid {
-		return "", "", errors.New("SSE event field 'data' must start with 'data: '")
+	if len(dataLines) == 0 {
+		return "", "", "", errors.New("event does not contain field 'data'")
 	}
-	return event, data, nil
+	return event, strings.Join(dataLines, "\n"), id, nil
 }
@@ -1,14 +1,23 @@
 package ssoclient
 
 import (
+	"compress/gzip"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestLoginWithOIDCProxySuccessWithoutWaiting(t *testing.T) {
@@ -19,6 +28,92 @@ func TestLoginWithOIDCProxySuccessWithoutWaiting(t *testing.T) {
 	assert.Equal(t, "mock-access-token", result.AccessToken)
 	assert.Equal(t, "mock-refresh-token", result.RefreshToken)
 	assert.Equal(t, 3600, result.Expiration)
+	assert.Equal(t, "Bearer", result.TokenType)
+	assert.Equal(t, "openid profile", result.Scope)
+}
+
+func TestLoginWithSSOProxyConfigLogsLifecycleEvents(t *testing.T) {
+	t.Parallel()
+	for loginSuccess, expectedRecords := range map[bool][]string{
+		true: {
+			"DEBUG Sending login request to proxy",
+			"DEBUG Received login event",
+			"DEBUG Received login URI",
+			"DEBUG Received login event",
+			"INFO Received tokens",
+		},
+		false: {
+			"DEBUG Sending login request to proxy",
+			"DEBUG Received login event",
+			"DEBUG Received login URI",
+			"DEBUG Received login event",
+			"ERROR Proxy login failed",
+		},
+	} {
+		mockProxy := createMockProxy(loginSuccess, time.Millisecond*5)
+		logHandler := &recordingLogHandler{}
+		_, _ = LoginWithSSOProxyConfig(context.Background(), ProxyLoginConfig{
+			LoginURI: fmt.Sprintf("%s/cli-login", mockProxy.URL),
+			Logger:   slog.New(logHandler),
+		}, func(loginURI string) {})
+		assert.Equal(t, expectedRecords, logHandler.records())
+		mockProxy.Close()
+	}
+}
+
+func TestLoginWithOIDCProxyReturnsRawTokenResponse(t *testing.T) {
+	t.Parallel()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cli-login", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", eventLoggedIn,
+			`{"access_token":"mock-access-token","expiration":3600,"raw_response":{"session_state":"mock-session-state"}}`)
+	})
+	mockProxy := httptest.NewServer(mux)
+	defer mockProxy.Close()
+	result, err := LoginWithSSOProxy(fmt.Sprintf("%s/cli-login", mockProxy.URL), func(loginURI string) {})
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"session_state":"mock-session-state"}`, string(result.RawResponse))
+}
+
+func TestLoginWithOIDCProxyFailsOnEmptyAccessToken(t *testing.T) {
+	t.Parallel()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cli-login", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", eventLoggedIn, `{"access_token":"","refresh_token":"","expiration":0}`)
+	})
+	mockProxy := httptest.NewServer(mux)
+	defer mockProxy.Close()
+	result, err := LoginWithSSOProxy(fmt.Sprintf("%s/cli-login", mockProxy.URL), func(loginURI string) {})
+	assert.Nil(t, result)
+	assert.ErrorContains(t, err, "without access token")
+
+	err = LoginWithSSOProxyTokenStream(context.Background(), ProxyLoginConfig{LoginURI: fmt.Sprintf("%s/cli-login", mockProxy.URL)}, func(loginURI string) {}, func(result *LoginResult) {
+		t.Error("Tokens without access token were passed to callback")
+	})
+	assert.ErrorContains(t, err, "without access token")
+}
+
+func TestLoginWithOIDCProxyReceivesLargeTokensEvent(t *testing.T) {
+	t.Parallel()
+	// token with many claims doesn't fit into default 64KB buffer of bufio.Scanner
+	largeAccessToken := strings.Repeat("a", 100*1024)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cli-login", func(w http.ResponseWriter, r *http.Request) {
+		tokens, _ := json.Marshal(proxyTokensEvent{AccessToken: largeAccessToken, Expiration: 3600})
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", eventLoggedIn, tokens)
+	})
+	mockProxy := httptest.NewServer(mux)
+	defer mockProxy.Close()
+
+	result, err := LoginWithSSOProxy(fmt.Sprintf("%s/cli-login", mockProxy.URL), func(loginURI string) {})
+	assert.NoError(t, err)
+	assert.Equal(t, largeAccessToken, result.AccessToken)
+
+	_, err = LoginWithSSOProxyConfig(context.Background(), ProxyLoginConfig{
+		LoginURI:     fmt.Sprintf("%s/cli-login", mockProxy.URL),
+		MaxEventSize: 64 * 1024,
+	}, func(loginURI string) {})
+	assert.ErrorContains(t, err, "exceeds maximum size of 65536 bytes")
 }
 
 func TestLoginWithOIDCProxySuccessWithWaiting(t *testing.T) {
@@ -38,7 +133,403 @@ func TestLoginWithOIDCProxyFail(t *testing.T) {
 	assert.Error(t, err)
 }
 
-func createMockProxy(loginSuccess bool, loginAfter time.Duration) httptest.Server {
+func TestLoginWithOIDCProxyReturnsProxyLoginError(t *testing.T) {
+	t.Parallel()
+	for data, expectedErr := range map[string]ProxyLoginError{
+		`{"code":"timeout","message":"OIDC login failed"}`:       {Code: ErrorCodeTimeout, Message: "OIDC login failed"},
+		`{"code":"access_denied","message":"OIDC login failed"}`: {Code: ErrorCodeAccessDenied, Message: "OIDC login failed"},
+		"mock sso proxy error":                                   {Message: "mock sso proxy error"},
+	} {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/cli-login", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", eventError, data)
+		})
+		mockProxy := httptest.NewServer(mux)
+		_, err := LoginWithSSOProxy(fmt.Sprintf("%s/cli-login", mockProxy.URL), func(loginURI string) {})
+		var proxyErr *ProxyLoginError
+		if assert.ErrorAs(t, err, &proxyErr) {
+			assert.Equal(t, expectedErr, *proxyErr)
+		}
+		mockProxy.Close()
+	}
+}
+
+func TestLoginWithOIDCProxyConfigTimesOut(t *testing.T) {
+	t.Parallel()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cli-login", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", eventAuthURI, "http://sso.mock")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done() // never send tokens
+	})
+	mockProxy := httptest.NewServer(mux)
+	defer mockProxy.Close()
+
+	start := time.Now()
+	result, err := LoginWithSSOProxyConfig(context.Background(), ProxyLoginConfig{
+		LoginURI: fmt.Sprintf("%s/cli-login", mockProxy.URL),
+		Timeout:  100 * time.Millisecond,
+	}, func(loginURI string) {})
+	assert.Nil(t, result)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestLoginWithOIDCProxyFailsIfStreamClosesBeforeTokens(t *testing.T) {
+	t.Parallel()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cli-login", func(w http.ResponseWriter, r *http.Request) {
+		// proxy closes the stream after login URI, e.g. because it crashed
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", eventAuthURI, "http://sso.mock")
+	})
+	mockProxy := httptest.NewServer(mux)
+	defer mockProxy.Close()
+
+	loginURIReceived := false
+	result, err := LoginWithSSOProxy(fmt.Sprintf("%s/cli-login", mockProxy.URL), func(loginURI string) { loginURIReceived = true })
+	assert.Nil(t, result)
+	assert.True(t, loginURIReceived)
+	assert.ErrorContains(t, err, "login stream closed before completion")
+}
+
+func TestLoginWithSSOProxyConfigFailsOnStalledStream(t *testing.T) {
+	t.Parallel()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cli-login", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", eventAuthURI, "http://sso.mock")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done() // stall without closing the stream
+	})
+	mockProxy := httptest.NewServer(mux)
+	defer mockProxy.Close()
+
+	start := time.Now()
+	loginURIReceived := false
+	result, err := LoginWithSSOProxyConfig(context.Background(), ProxyLoginConfig{
+		LoginURI:    fmt.Sprintf("%s/cli-login", mockProxy.URL),
+		IdleTimeout: 100 * time.Millisecond,
+	}, func(loginURI string) { loginURIReceived = true })
+	assert.Nil(t, result)
+	assert.True(t, loginURIReceived)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.ErrorContains(t, err, "did not send any data within 100ms")
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestLoginWithSSOProxyContextReturnsWhenCancelled(t *testing.T) {
+	t.Parallel()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cli-login", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", eventAuthURI, "http://sso.mock")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done() // never send tokens
+	})
+	mockProxy := httptest.NewServer(mux)
+	defer mockProxy.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var cancelledAt time.Time
+	result, err := LoginWithSSOProxyContext(ctx, fmt.Sprintf("%s/cli-login", mockProxy.URL), func(loginURI string) {
+		// user cancels the login while it waits for the login
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			cancelledAt = time.Now()
+			cancel()
+		}()
+	})
+	assert.Nil(t, result)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Less(t, time.Since(cancelledAt), 500*time.Millisecond)
+}
+
+func TestLoginWithSSOProxyConfigRetriesUnavailableProxy(t *testing.T) {
+	t.Parallel()
+	loginRequests := atomic.Int32{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cli-login", func(w http.ResponseWriter, r *http.Request) {
+		if loginRequests.Add(1) == 1 {
+			http.Error(w, "proxy is restarting", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", eventLoggedIn, `{"access_token":"mock-access-token","expiration":3600}`)
+	})
+	mux.HandleFunc("/cli-login-rejected", func(w http.ResponseWriter, r *http.Request) {
+		loginRequests.Add(1)
+		http.Error(w, "unknown provider", http.StatusBadRequest)
+	})
+	mockProxy := httptest.NewServer(mux)
+	defer mockProxy.Close()
+
+	result, err := LoginWithSSOProxyConfig(context.Background(), ProxyLoginConfig{LoginURI: fmt.Sprintf("%s/cli-login", mockProxy.URL), Retries: 2}, func(loginURI string) {})
+	assert.NoError(t, err)
+	assert.Equal(t, "mock-access-token", result.AccessToken)
+	assert.Equal(t, int32(2), loginRequests.Load())
+
+	// 4xx responses are not retried
+	loginRequests.Store(0)
+	_, err = LoginWithSSOProxyConfig(context.Background(), ProxyLoginConfig{LoginURI: fmt.Sprintf("%s/cli-login-rejected", mockProxy.URL), Retries: 2}, func(loginURI string) {})
+	assert.ErrorContains(t, err, "status was 400")
+	assert.Equal(t, int32(1), loginRequests.Load())
+}
+
+func TestIsRetryableLoginError(t *testing.T) {
+	t.Parallel()
+	closedServer := httptest.NewServer(http.NotFoundHandler())
+	closedServer.Close()
+	_, refusedErr := http.Get(closedServer.URL)
+	assert.True(t, isRetryableLoginError(context.Background(), refusedErr))
+
+	tlsServer := httptest.NewTLSServer(http.NotFoundHandler())
+	defer tlsServer.Close()
+	_, certErr := http.Get(tlsServer.URL)
+	assert.False(t, isRetryableLoginError(context.Background(), certErr))
+
+	_, uriErr := http.Get("http://[::1")
+	assert.False(t, isRetryableLoginError(context.Background(), uriErr))
+
+	assert.True(t, isRetryableLoginError(context.Background(), &LoginError{StatusCode: http.StatusBadGateway}))
+	assert.False(t, isRetryableLoginError(context.Background(), &LoginError{StatusCode: http.StatusBadRequest}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.False(t, isRetryableLoginError(ctx, refusedErr))
+}
+
+func TestLoginWithSSOProxyConfigResumesDroppedLoginStream(t *testing.T) {
+	t.Parallel()
+	var receivedLastEventIds []string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cli-login", func(w http.ResponseWriter, r *http.Request) {
+		receivedLastEventIds = append(receivedLastEventIds, r.Header.Get("Last-Event-ID"))
+		if r.Header.Get("Last-Event-ID") == "" {
+			// stream drops after login URI was sent
+			fmt.Fprintf(w, "id: mock-req-id\nevent: %s\ndata: %s\n\n", eventAuthURI, "http://sso.mock/auth")
+			return
+		}
+		fmt.Fprintf(w, "id: mock-req-id\nevent: %s\ndata: %s\n\n", eventLoggedIn, `{"access_token":"mock-access-token","expiration":3600}`)
+	})
+	mux.HandleFunc("/cli-login-without-id", func(w http.ResponseWriter, r *http.Request) {
+		receivedLastEventIds = append(receivedLastEventIds, r.Header.Get("Last-Event-ID"))
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", eventAuthURI, "http://sso.mock/auth")
+	})
+	mockProxy := httptest.NewServer(mux)
+	defer mockProxy.Close()
+
+	loginURIs := 0
+	result, err := LoginWithSSOProxyConfig(context.Background(), ProxyLoginConfig{LoginURI: fmt.Sprintf("%s/cli-login", mockProxy.URL), Retries: 2}, func(loginURI string) {
+		loginURIs++
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "mock-access-token", result.AccessToken)
+	assert.Equal(t, []string{"", "mock-req-id"}, receivedLastEventIds)
+	assert.Equal(t, 1, loginURIs)
+
+	// stream without event ids can't be resumed
+	receivedLastEventIds = nil
+	_, err = LoginWithSSOProxyConfig(context.Background(), ProxyLoginConfig{LoginURI: fmt.Sprintf("%s/cli-login-without-id", mockProxy.URL), Retries: 2}, func(loginURI string) {})
+	assert.ErrorContains(t, err, "login stream closed before completion")
+	assert.Equal(t, []string{""}, receivedLastEventIds)
+}
+
+func TestStartSSOProxyLogin(t *testing.T) {
+	t.Parallel()
+	loggedIn := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cli-login", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", eventAuthURI, "http://sso.mock/auth")
+		w.(http.Flusher).Flush()
+		<-loggedIn
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", eventLoggedIn, `{"access_token":"mock-access-token","expiration":3600}`)
+	})
+	mux.HandleFunc("/cli-login-rejected", func(w http.ResponseWriter, r *http.Request) {
+		writeProxyErrorResponse(w, http.StatusServiceUnavailable, `{"code":"unavailable","message":"too many pending logins"}`)
+	})
+	mockProxy := httptest.NewServer(mux)
+	defer mockProxy.Close()
+
+	login, err := StartSSOProxyLogin(context.Background(), ProxyLoginConfig{LoginURI: fmt.Sprintf("%s/cli-login", mockProxy.URL)})
+	require.NoError(t, err)
+	assert.Equal(t, "http://sso.mock/auth", login.LoginURI)
+	close(loggedIn) // user logs in after caller presented login URI
+	result, err := login.Wait()
+	assert.NoError(t, err)
+	assert.Equal(t, "mock-access-token", result.AccessToken)
+
+	// login that fails before login URI was received returns its error right away
+	_, err = StartSSOProxyLogin(context.Background(), ProxyLoginConfig{LoginURI: fmt.Sprintf("%s/cli-login-rejected", mockProxy.URL)})
+	var proxyErr *ProxyLoginError
+	require.ErrorAs(t, err, &proxyErr)
+	assert.Equal(t, ErrorCodeUnavailable, proxyErr.Code)
+}
+
+func TestLoginWithSSOProxyConfigSendsLoginHint(t *testing.T) {
+	t.Parallel()
+	var receivedLoginHint string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cli-login", func(w http.ResponseWriter, r *http.Request) {
+		receivedLoginHint = r.URL.Query().Get("login_hint")
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", eventError, "mock sso proxy error")
+	})
+	mockProxy := httptest.NewServer(mux)
+	defer mockProxy.Close()
+
+	_, _ = LoginWithSSOProxyConfig(context.Background(), ProxyLoginConfig{
+		LoginURI:  fmt.Sprintf("%s/cli-login?lang=en", mockProxy.URL),
+		LoginHint: "user+cli@example.com",
+	}, func(loginURI string) {})
+	assert.Equal(t, "user+cli@example.com", receivedLoginHint)
+}
+
+func TestLoginWithSSOProxyConfigSendsHeadersAndBody(t *testing.T) {
+	t.Parallel()
+	var receivedMethod, receivedAPIKey, receivedBody string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cli-login", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		receivedMethod, receivedAPIKey, receivedBody = r.Method, r.Header.Get("X-Api-Key"), string(body)
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", eventError, "mock sso proxy error")
+	})
+	mockProxy := httptest.NewServer(mux)
+	defer mockProxy.Close()
+	_, _ = LoginWithSSOProxyConfig(context.Background(), ProxyLoginConfig{
+		LoginURI: fmt.Sprintf("%s/cli-login", mockProxy.URL),
+		Header:   http.Header{"X-Api-Key": {"mock-api-key"}},
+		Method:   http.MethodPost,
+		Body:     []byte(`{"context":"mock"}`),
+	}, func(loginURI string) {})
+	assert.Equal(t, http.MethodPost, receivedMethod)
+	assert.Equal(t, "mock-api-key", receivedAPIKey)
+	assert.Equal(t, `{"context":"mock"}`, receivedBody)
+}
+
+func TestLoginWithSSOProxyTokenStreamSendsConfiguredRequest(t *testing.T) {
+	t.Parallel()
+	var receivedMethod, receivedAPIKey, receivedBody string
+	var receivedQuery url.Values
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cli-login", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		receivedMethod, receivedAPIKey, receivedBody = r.Method, r.Header.Get("X-Api-Key"), string(body)
+		receivedQuery = r.URL.Query()
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", eventError, "mock sso proxy error")
+	})
+	mockProxy := httptest.NewServer(mux)
+	defer mockProxy.Close()
+	_ = LoginWithSSOProxyTokenStream(context.Background(), ProxyLoginConfig{
+		LoginURI:  fmt.Sprintf("%s/cli-login", mockProxy.URL),
+		LoginHint: "mock-user@example.com",
+		Header:    http.Header{"X-Api-Key": {"mock-api-key"}},
+		Method:    http.MethodPost,
+		Body:      []byte(`{"context":"mock"}`),
+	}, func(loginURI string) {}, func(result *LoginResult) {})
+	assert.Equal(t, http.MethodPost, receivedMethod)
+	assert.Equal(t, "mock-api-key", receivedAPIKey)
+	assert.Equal(t, `{"context":"mock"}`, receivedBody)
+	assert.Equal(t, "true", receivedQuery.Get("token-stream"))
+	assert.Equal(t, "mock-user@example.com", receivedQuery.Get("login_hint"))
+}
+
+func TestLoginWithSSOProxyConfigSendsLoginTimeout(t *testing.T) {
+	t.Parallel()
+	var receivedLoginTimeout string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cli-login", func(w http.ResponseWriter, r *http.Request) {
+		receivedLoginTimeout = r.URL.Query().Get("login-timeout")
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", eventError, "mock sso proxy error")
+	})
+	mockProxy := httptest.NewServer(mux)
+	defer mockProxy.Close()
+
+	_, _ = LoginWithSSOProxyConfig(context.Background(), ProxyLoginConfig{
+		LoginURI: fmt.Sprintf("%s/cli-login", mockProxy.URL),
+		Timeout:  1500 * time.Millisecond,
+	}, func(loginURI string) {})
+	assert.Equal(t, "2", receivedLoginTimeout)
+}
+
+func TestLoginWithSSOProxyTokenStreamReceivesRefreshedTokens(t *testing.T) {
+	t.Parallel()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cli-login", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "true", r.URL.Query().Get("token-stream"))
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", eventAuthURI, "http://sso.mock")
+		for i, event := range []string{eventLoggedIn, eventTokensRefreshed, eventTokensRefreshed} {
+			tokens, _ := json.Marshal(proxyTokensEvent{
+				AccessToken:  fmt.Sprintf("mock-access-token-%d", i),
+				RefreshToken: fmt.Sprintf("mock-refresh-token-%d", i),
+				Expiration:   60,
+			})
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, tokens)
+		}
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	})
+	mockProxy := httptest.NewServer(mux)
+	defer mockProxy.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	accessTokens := []string{}
+	err := LoginWithSSOProxyTokenStream(ctx, ProxyLoginConfig{LoginURI: fmt.Sprintf("%s/cli-login", mockProxy.URL)}, func(loginURI string) {}, func(result *LoginResult) {
+		accessTokens = append(accessTokens, result.AccessToken)
+		assert.False(t, result.IsExpired())
+		if len(accessTokens) == 3 {
+			cancel()
+		}
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"mock-access-token-0", "mock-access-token-1", "mock-access-token-2"}, accessTokens)
+}
+
+func TestParseSSEEvent(t *testing.T) {
+	t.Parallel()
+	event, data, _, err := parseSSEEvent("event: logged-in\ndata: {\"access_token\": \"access\"}")
+	assert.NoError(t, err)
+	assert.Equal(t, eventLoggedIn, event)
+	assert.Equal(t, `{"access_token": "access"}`, data)
+
+	event, data, _, err = parseSSEEvent("data: {\ndata:   \"access_token\": \"access\"\nevent: logged-in\ndata: }")
+	assert.NoError(t, err)
+	assert.Equal(t, eventLoggedIn, event)
+	assert.Equal(t, "{\n  \"access_token\": \"access\"\n}", data)
+
+	event, data, id, err := parseSSEEvent(": comment\nid: 1\nretry: 1000\nevent: auth-uri\ndata: http://sso.mock")
+	assert.NoError(t, err)
+	assert.Equal(t, eventAuthURI, event)
+	assert.Equal(t, "http://sso.mock", data)
+	assert.Equal(t, "1", id)
+
+	event, data, _, err = parseSSEEvent("data: no event type")
+	assert.NoError(t, err)
+	assert.Equal(t, "message", event)
+	assert.Equal(t, "no event type", data)
+
+	_, _, _, err = parseSSEEvent("event: logged-in")
+	assert.Error(t, err)
+}
+
+func TestLoginWithOIDCProxyMultiLineTokensEvent(t *testing.T) {
+	t.Parallel()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cli-login", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "data: %s\nevent: %s\n\n", "http://sso.mock", eventAuthURI)
+		tokens, _ := json.MarshalIndent(proxyTokensEvent{
+			AccessToken:  "mock-access-token",
+			RefreshToken: "mock-refresh-token",
+			Expiration:   3600,
+		}, "", "  ")
+		fmt.Fprintf(w, "id: 2\nevent: %s\ndata: %s\n\n", eventLoggedIn, strings.ReplaceAll(string(tokens), "\n", "\ndata: "))
+	})
+	mockProxy := httptest.NewServer(mux)
+	defer mockProxy.Close()
+	result, err := LoginWithSSOProxy(fmt.Sprintf("%s/cli-login", mockProxy.URL), func(loginURI string) {})
+	assert.NoError(t, err)
+	assert.Equal(t, "mock-access-token", result.AccessToken)
+	assert.Equal(t, "mock-refresh-token", result.RefreshToken)
+	assert.Equal(t, 3600, result.Expiration)
+}
+
+func createMockProxy(loginSuccess bool, loginAfter time.Duration) *httptest.Server {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/cli-login", func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", eventAuthURI, "http://sso.mock")
@@ -49,6 +540,8 @@ func createMockProxy(loginSuccess bool, loginAfter time.Duration) httptest.Serve
 				AccessToken:  "mock-access-token",
 				RefreshToken: "mock-refresh-token",
 				Expiration:   3600,
+				TokenType:    "Bearer",
+				Scope:        "openid profile",
 			})
 			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", eventLoggedIn, tokens)
 		} else {
@@ -56,5 +549,123 @@ func createMockProxy(loginSuccess bool, loginAfter time.Duration) httptest.Serve
 		}
 		w.(http.Flusher).Flush()
 	})
-	return *httptest.NewServer(mux)
+	return httptest.NewServer(mux)
+}
+
+// Records level and message of log records.
+type recordingLogHandler struct {
+	mutex    sync.Mutex
+	recorded []string
+}
+
+func (handler *recordingLogHandler) Enabled(context.Context, slog.Level) bool {
+	return true
+}
+
+func (handler *recordingLogHandler) Handle(_ context.Context, record slog.Record) error {
+	handler.mutex.Lock()
+	defer handler.mutex.Unlock()
+	handler.recorded = append(handler.recorded, fmt.Sprint(record.Level, " ", record.Message))
+	return nil
+}
+
+func (handler *recordingLogHandler) WithAttrs([]slog.Attr) slog.Handler {
+	return handler
+}
+
+func (handler *recordingLogHandler) WithGroup(string) slog.Handler {
+	return handler
+}
+
+func (handler *recordingLogHandler) records() []string {
+	handler.mutex.Lock()
+	defer handler.mutex.Unlock()
+	return handler.recorded
+}
+
+func TestLoginWithSSOProxyConsumesGzipStream(t *testing.T) {
+	t.Parallel()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cli-login", func(w http.ResponseWriter, r *http.Request) {
+		// gateway compressing the stream even if Accept-Encoding was not sent
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Content-Encoding", "gzip")
+		gw := gzip.NewWriter(w)
+		defer gw.Close()
+		fmt.Fprintf(gw, "event: %s\ndata: %s\n\n", eventAuthURI, "http://sso.mock/auth")
+		_ = gw.Flush()
+		w.(http.Flusher).Flush()
+		time.Sleep(5 * time.Millisecond)
+		fmt.Fprintf(gw, "event: %s\ndata: %s\n\n", eventLoggedIn, `{"access_token":"mock-access-token","refresh_token":"mock-refresh-token"}`)
+	})
+	mockProxy := httptest.NewServer(mux)
+	defer mockProxy.Close()
+
+	for _, header := range []http.Header{nil, {"Accept-Encoding": {"gzip"}}} {
+		var receivedLoginURI string
+		result, err := LoginWithSSOProxyConfig(context.Background(), ProxyLoginConfig{
+			LoginURI: fmt.Sprintf("%s/cli-login", mockProxy.URL),
+			Header:   header,
+		}, func(loginURI string) { receivedLoginURI = loginURI })
+		require.NoError(t, err)
+		assert.Equal(t, "http://sso.mock/auth", receivedLoginURI)
+		assert.Equal(t, "mock-access-token", result.AccessToken)
+	}
+}
+
+func TestURIWithoutQueryHidesOIDCState(t *testing.T) {
+	t.Parallel()
+	assert.Equal(t, "https://sso.example.com/auth?...", uriWithoutQuery("https://sso.example.com/auth?client_id=cli&state=secret-state"))
+	assert.Equal(t, "https://sso.example.com/auth?...", uriWithoutQuery("https://sso.example.com/auth#state=secret-state"))
+	assert.Equal(t, "https://sso.example.com/auth", uriWithoutQuery("https://sso.example.com/auth"))
+	assert.Equal(t, "[invalid URI]", uriWithoutQuery("http://[::1?state=secret-state"))
+}
+
+func TestExchangeSSOProxyOneTimeCode(t *testing.T) {
+	t.Parallel()
+	exchanged := false
+	mockProxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		if r.PostFormValue("code") != "mock-one-time-code" || exchanged {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"code":"invalid_request","message":"Unknown one-time code, it was already used or expired"}`)
+			return
+		}
+		exchanged = true
+		fmt.Fprint(w, `{"access_token":"mock-access-token","refresh_token":"mock-refresh-token","expiration":3600}`)
+	}))
+	defer mockProxy.Close()
+
+	result, err := ExchangeSSOProxyOneTimeCode(context.Background(), mockProxy.URL, "mock-one-time-code")
+	require.NoError(t, err)
+	assert.Equal(t, "mock-access-token", result.AccessToken)
+	assert.Equal(t, "mock-refresh-token", result.RefreshToken)
+	assert.Equal(t, 3600, result.Expiration)
+
+	// the code is single-use
+	_, err = ExchangeSSOProxyOneTimeCode(context.Background(), mockProxy.URL, "mock-one-time-code")
+	var loginErr *LoginError
+	require.ErrorAs(t, err, &loginErr)
+	assert.Equal(t, ErrorCategoryProxy, loginErr.Category)
+	assert.Equal(t, ErrorCodeInvalidRequest, loginErr.Code)
+	assert.Equal(t, http.StatusNotFound, loginErr.StatusCode)
+	var proxyErr *ProxyLoginError
+	assert.ErrorAs(t, err, &proxyErr)
+}
+
+func TestExchangeSSOProxyOneTimeCodeCategorizesGatewayErrorAsNetwork(t *testing.T) {
+	t.Parallel()
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// e.g. load balancer in front of the proxy without a healthy proxy instance
+		http.Error(w, "service unavailable", http.StatusServiceUnavailable)
+	}))
+	defer gateway.Close()
+
+	_, err := ExchangeSSOProxyOneTimeCode(context.Background(), gateway.URL, "mock-one-time-code")
+	var loginErr *LoginError
+	require.ErrorAs(t, err, &loginErr)
+	assert.Equal(t, ErrorCategoryNetwork, loginErr.Category)
+	assert.Empty(t, loginErr.Code)
+	assert.Equal(t, http.StatusServiceUnavailable, loginErr.StatusCode)
 }
@@ -0,0 +1,56 @@
+// Package qrcode renders QR codes of device flow verification URIs in terminal, so users
+// can scan them with a phone instead of typing the URI. It is a separate package,
+// so applications that don't show QR codes don't depend on a QR encoder.
+package qrcode
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"rsc.io/qr"
+)
+
+// Number of light modules around the code, QR specification requires 4.
+const quietZone = 4
+
+// Writes QR code of complete verification URI (DeviceAuthInfo.VerificationURIComplete) to w
+// as lines of Unicode block characters, each line contains two rows of QR modules.
+// Light modules are drawn as blocks, so the code is displayed correctly in terminals
+// with dark background.
+func RenderDeviceQR(w io.Writer, verificationURIComplete string) error {
+	if verificationURIComplete == "" {
+		return errors.New("verification URI is empty, IdP probably did not return complete verification URI")
+	}
+	code, err := qr.Encode(verificationURIComplete, qr.L)
+	if err != nil {
+		return errors.Join(errors.New("failed to encode verification URI as QR code"), err)
+	}
+	var rendered strings.Builder
+	for y := -quietZone; y < code.Size+quietZone; y += 2 {
+		for x := -quietZone; x < code.Size+quietZone; x++ {
+			// Black reports false outside of the code, so quiet zone is light
+			rendered.WriteRune(halfBlock(!code.Black(x, y), !code.Black(x, y+1)))
+		}
+		rendered.WriteRune('\n')
+	}
+	if _, err := fmt.Fprint(w, rendered.String()); err != nil {
+		return errors.Join(errors.New("failed to write QR code"), err)
+	}
+	return nil
+}
+
+// Returns character filled in its upper and lower half according to upper and lower module.
+func halfBlock(upper, lower bool) rune {
+	switch {
+	case upper && lower:
+		return '█'
+	case upper:
+		return '▀'
+	case lower:
+		return '▄'
+	default:
+		return ' '
+	}
+}
@@ -0,0 +1,40 @@
+package qrcode
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"rsc.io/qr"
+)
+
+func TestRenderDeviceQREncodesVerificationURI(t *testing.T) {
+	uri := "https://sso.example.com/device?user_code=ABCD-EFGH"
+	out := &bytes.Buffer{}
+	assert.NoError(t, RenderDeviceQR(out, uri))
+	assert.NotEmpty(t, out.String())
+
+	// decode rendered half blocks back to modules and compare them with QR code of the URI
+	code, err := qr.Encode(uri, qr.L)
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	assert.Len(t, lines, (code.Size+2*quietZone+1)/2)
+	for row, line := range lines {
+		blocks := []rune(line)
+		assert.Len(t, blocks, code.Size+2*quietZone)
+		for column, block := range blocks {
+			x, y := column-quietZone, 2*row-quietZone
+			upperLight := block == '█' || block == '▀'
+			lowerLight := block == '█' || block == '▄'
+			assert.Equal(t, !code.Black(x, y), upperLight, "module %d,%d", x, y)
+			assert.Equal(t, !code.Black(x, y+1), lowerLight, "module %d,%d", x, y+1)
+		}
+	}
+}
+
+func TestRenderDeviceQRFailsOnEmptyURI(t *testing.T) {
+	out := &bytes.Buffer{}
+	assert.Error(t, RenderDeviceQR(out, ""))
+	assert.Empty(t, out.String())
+}
@@ -0,0 +1,52 @@
+package ssoclient
+
+import (
+	"encoding/pem"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoginWithDeviceAuthTrustsCACertPEM(t *testing.T) {
+	t.Parallel()
+	mockOAuthServer := createMockOAuthServer("mock-client-id", 1, 1)
+	defer mockOAuthServer.Close()
+	// same IdP served over TLS with a self-signed certificate
+	tlsServer := httptest.NewTLSServer(mockOAuthServer.Config.Handler)
+	defer tlsServer.Close()
+	config := DeviceAuthConfig{
+		DeviceAuthURI:   fmt.Sprintf("%s/auth/device", tlsServer.URL),
+		TokenURI:        fmt.Sprintf("%s/token", tlsServer.URL),
+		ClientId:        "mock-client-id",
+		MinPollInterval: time.Millisecond,
+	}
+	userLogin := func(verificationURI, userCode string) {
+		uri := strings.Replace(verificationURI, "http://", "https://", 1)
+		_, err := tlsServer.Client().Get(fmt.Sprintf("%s?user-code=mock-user-code", uri))
+		require.NoError(t, err)
+	}
+
+	_, err := LoginWithDeviceAuth(config, userLogin)
+	assert.ErrorContains(t, err, "certificate", "self-signed certificate is not trusted without CA")
+
+	config.CACertPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tlsServer.Certificate().Raw})
+	loginResult, err := LoginWithDeviceAuth(config, userLogin)
+	require.NoError(t, err)
+	assert.Equal(t, "mock-access-token", loginResult.AccessToken)
+}
+
+func TestDeviceAuthConfigValidateRejectsInvalidCACertPEM(t *testing.T) {
+	t.Parallel()
+	config := DeviceAuthConfig{
+		DeviceAuthURI: "https://idp.example.com/auth/device",
+		TokenURI:      "https://idp.example.com/token",
+		ClientId:      "mock-client-id",
+		CACertPEM:     []byte("not a certificate"),
+	}
+	assert.ErrorContains(t, config.Validate(), "CACertPEM is invalid")
+}
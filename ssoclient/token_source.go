@@ -0,0 +1,157 @@
+package ssoclient
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Configuration of token refresh used by TokenSource.
+type TokenSourceConfig struct {
+	// URI to OAuth token endpoint
+	TokenURI string
+	// OAuth client id
+	ClientId string
+	// Optional OAuth client secret, only needed for confidential clients
+	ClientSecret string
+	// How long before access token expiration tokens are refreshed, default 30 seconds
+	Leeway time.Duration
+	// Optional HTTP client used for token requests, http.DefaultClient is used if nil
+	HTTPClient *http.Client
+}
+
+// Source of a valid access token over a long session. Caches tokens of a login result and
+// refreshes them using the refresh token when the access token is about to expire.
+// Safe for concurrent use.
+type TokenSource struct {
+	config TokenSourceConfig
+	mutex  sync.Mutex
+	result *LoginResult
+}
+
+// Creates a token source from tokens received after login.
+func NewTokenSource(result *LoginResult, config TokenSourceConfig) *TokenSource {
+	if config.Leeway == 0 {
+		config.Leeway = 30 * time.Second
+	}
+	if config.HTTPClient == nil {
+		config.HTTPClient = http.DefaultClient
+	}
+	return &TokenSource{config: config, result: result}
+}
+
+// Returns a valid access token, tokens are refreshed first if the access token expires within leeway.
+// Access token with unknown expiration is never refreshed.
+func (source *TokenSource) Token() (string, error) {
+	source.mutex.Lock()
+	defer source.mutex.Unlock()
+	if source.result.ExpiresAt.IsZero() || time.Now().Add(source.config.Leeway).Before(source.result.ExpiresAt) {
+		return source.result.AccessToken, nil
+	}
+	if source.result.RefreshToken == "" {
+		return "", errors.New("access token expired and there is no refresh token to refresh it")
+	}
+	result, err := refreshTokens(source.config, source.result.RefreshToken)
+	if err != nil {
+		return "", err
+	}
+	source.result = result
+	return result.AccessToken, nil
+}
+
+// Returns current tokens, e.g. to persist the latest refresh token.
+func (source *TokenSource) LoginResult() LoginResult {
+	source.mutex.Lock()
+	defer source.mutex.Unlock()
+	return *source.result
+}
+
+// Refreshes tokens with cachedRefreshToken of a previous login and runs interactive fallback login (device or proxy)
+// only if there is no cached refresh token or IdP rejected it with "invalid_grant", e.g. because it expired.
+// Other refresh errors, e.g. network errors, are returned without running fallback, so user is not prompted to log in
+// when the login would not help. Use LoginOrRefreshConfig to send a client secret or use another HTTP client.
+func LoginOrRefresh(
+	cachedRefreshToken string,
+	tokenURI string,
+	clientId string,
+	fallback func() (*LoginResult, error),
+) (*LoginResult, error) {
+	return LoginOrRefreshConfig(cachedRefreshToken, TokenSourceConfig{TokenURI: tokenURI, ClientId: clientId}, fallback)
+}
+
+// Refreshes tokens with cachedRefreshToken the same way as LoginOrRefresh, but sends the refresh request
+// configured by config, e.g. with ClientSecret of a confidential client or HTTPClient trusting IdP's CA.
+// Leeway of config is not used.
+func LoginOrRefreshConfig(
+	cachedRefreshToken string,
+	config TokenSourceConfig,
+	fallback func() (*LoginResult, error),
+) (*LoginResult, error) {
+	if config.HTTPClient == nil {
+		config.HTTPClient = http.DefaultClient
+	}
+	if cachedRefreshToken != "" {
+		result, err := refreshTokens(config, cachedRefreshToken)
+		var loginErr *LoginError
+		if err == nil {
+			return result, nil
+		} else if !errors.As(err, &loginErr) || loginErr.Code != invalidGrantError {
+			return nil, err
+		}
+	}
+	return fallback()
+}
+
+// Refreshes tokens at token endpoint, refresh token is kept if IdP does not rotate it.
+func refreshTokens(config TokenSourceConfig, refreshToken string) (*LoginResult, error) {
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshToken},
+		"client_id":     {config.ClientId},
+	}
+	if config.ClientSecret != "" {
+		form.Set("client_secret", config.ClientSecret)
+	}
+	res, err := config.HTTPClient.PostForm(config.TokenURI, form)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to execute token refresh request"), err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		var errRes tokenErrorResponse
+		if err := json.NewDecoder(res.Body).Decode(&errRes); err != nil || errRes.Error == "" {
+			return nil, fmt.Errorf("failed to refresh tokens, response status was %d, expected 200", res.StatusCode)
+		}
+		return nil, &LoginError{
+			Category:   ErrorCategoryIdP,
+			Code:       errRes.Error,
+			StatusCode: res.StatusCode,
+			Err:        fmt.Errorf("failed to refresh tokens, response status was %d with error '%s'", res.StatusCode, errRes.Error),
+		}
+	}
+	rawBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to read token refresh response body"), err)
+	}
+	var tokenRes tokenSuccessResponse
+	if err := json.Unmarshal(rawBody, &tokenRes); err != nil {
+		return nil, errors.New("received token refresh response body in invalid format")
+	}
+	if tokenRes.RefreshToken == "" {
+		tokenRes.RefreshToken = refreshToken
+	}
+	return &LoginResult{
+		AccessToken:  tokenRes.AccessToken,
+		RefreshToken: tokenRes.RefreshToken,
+		Expiration:   int(tokenRes.ExpiresIn),
+		ExpiresAt:    expiresAt(int(tokenRes.ExpiresIn)),
+		TokenType:    tokenRes.TokenType,
+		Scope:        tokenRes.Scope,
+		RawResponse:  rawBody,
+	}, nil
+}
@@ -0,0 +1,160 @@
+package ssoclient
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenSourceRefreshesExpiringToken(t *testing.T) {
+	t.Parallel()
+	refreshCount := atomic.Int32{}
+	mockOAuthServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		if r.Form.Get("grant_type") != "refresh_token" || r.Form.Get("client_id") != "mock-client-id" {
+			http.Error(w, `{"error":"invalid_request"}`, http.StatusBadRequest)
+			return
+		}
+		count := refreshCount.Add(1)
+		if r.Form.Get("refresh_token") != fmt.Sprintf("mock-refresh-token-%d", count-1) {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, `{"access_token":"mock-access-token-%[1]d","refresh_token":"mock-refresh-token-%[1]d","expires_in":3600}`, count)
+	}))
+	defer mockOAuthServer.Close()
+
+	source := NewTokenSource(&LoginResult{
+		AccessToken:  "mock-access-token-0",
+		RefreshToken: "mock-refresh-token-0",
+		Expiration:   10,
+		ExpiresAt:    time.Now().Add(10 * time.Second), // expires within default leeway
+	}, TokenSourceConfig{
+		TokenURI: mockOAuthServer.URL,
+		ClientId: "mock-client-id",
+	})
+	token, err := source.Token()
+	require.NoError(t, err)
+	assert.Equal(t, "mock-access-token-1", token)
+
+	// refreshed token is valid for an hour, so it is cached
+	token, err = source.Token()
+	require.NoError(t, err)
+	assert.Equal(t, "mock-access-token-1", token)
+	assert.Equal(t, int32(1), refreshCount.Load())
+	assert.Equal(t, "mock-refresh-token-1", source.LoginResult().RefreshToken)
+}
+
+func TestTokenSourceReturnsRefreshError(t *testing.T) {
+	t.Parallel()
+	mockOAuthServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+	}))
+	defer mockOAuthServer.Close()
+
+	source := NewTokenSource(&LoginResult{
+		AccessToken:  "mock-access-token",
+		RefreshToken: "mock-refresh-token",
+		ExpiresAt:    time.Now().Add(-time.Second),
+	}, TokenSourceConfig{
+		TokenURI: mockOAuthServer.URL,
+		ClientId: "mock-client-id",
+	})
+	_, err := source.Token()
+	assert.ErrorContains(t, err, "invalid_grant")
+}
+
+func TestLoginOrRefreshReturnsRefreshedTokens(t *testing.T) {
+	t.Parallel()
+	mockOAuthServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		if r.Form.Get("refresh_token") != "mock-refresh-token" || r.Form.Get("client_id") != "mock-client-id" {
+			http.Error(w, `{"error":"invalid_request"}`, http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, `{"access_token":"mock-access-token","expires_in":3600}`)
+	}))
+	defer mockOAuthServer.Close()
+
+	result, err := LoginOrRefresh("mock-refresh-token", mockOAuthServer.URL, "mock-client-id", func() (*LoginResult, error) {
+		t.Error("Fallback login was run although refresh succeeded")
+		return nil, nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "mock-access-token", result.AccessToken)
+	assert.Equal(t, "mock-refresh-token", result.RefreshToken, "refresh token is kept if not rotated")
+}
+
+func TestLoginOrRefreshConfigSendsClientSecret(t *testing.T) {
+	t.Parallel()
+	mockOAuthServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		if r.Form.Get("client_secret") != "mock-client-secret" {
+			http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, `{"access_token":"mock-access-token","expires_in":3600}`)
+	}))
+	defer mockOAuthServer.Close()
+
+	// TLS server is trusted only by its own client
+	result, err := LoginOrRefreshConfig("mock-refresh-token", TokenSourceConfig{
+		TokenURI:     mockOAuthServer.URL,
+		ClientId:     "mock-client-id",
+		ClientSecret: "mock-client-secret",
+		HTTPClient:   mockOAuthServer.Client(),
+	}, func() (*LoginResult, error) {
+		t.Error("Fallback login was run although refresh succeeded")
+		return nil, nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "mock-access-token", result.AccessToken)
+}
+
+func TestLoginOrRefreshRunsFallbackIfRefreshTokenExpired(t *testing.T) {
+	t.Parallel()
+	mockOAuthServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+	}))
+	defer mockOAuthServer.Close()
+	fallback := func() (*LoginResult, error) {
+		return &LoginResult{AccessToken: "mock-login-access-token"}, nil
+	}
+
+	result, err := LoginOrRefresh("expired-refresh-token", mockOAuthServer.URL, "mock-client-id", fallback)
+	require.NoError(t, err)
+	assert.Equal(t, "mock-login-access-token", result.AccessToken)
+
+	// no cached refresh token
+	result, err = LoginOrRefresh("", mockOAuthServer.URL, "mock-client-id", fallback)
+	require.NoError(t, err)
+	assert.Equal(t, "mock-login-access-token", result.AccessToken)
+}
+
+func TestLoginOrRefreshReturnsOtherRefreshErrors(t *testing.T) {
+	t.Parallel()
+	unreachableServer := httptest.NewServer(http.NotFoundHandler())
+	unreachableServer.Close()
+	mockOAuthServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+	}))
+	defer mockOAuthServer.Close()
+	fallback := func() (*LoginResult, error) {
+		t.Error("Fallback login was run although refresh token was not rejected")
+		return nil, nil
+	}
+
+	_, err := LoginOrRefresh("mock-refresh-token", unreachableServer.URL, "mock-client-id", fallback)
+	assert.ErrorContains(t, err, "failed to execute token refresh request")
+
+	_, err = LoginOrRefresh("mock-refresh-token", mockOAuthServer.URL, "mock-client-id", fallback)
+	var loginErr *LoginError
+	require.ErrorAs(t, err, &loginErr)
+	assert.Equal(t, "invalid_client", loginErr.Code)
+}
@@ -0,0 +1,38 @@
+package ssoclient
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Fetches claims about the user from IdP's UserInfo endpoint (OIDCMetadata.UserInfoEndpoint) using access token
+// as bearer token. Useful when the access token is opaque and its claims can't be read.
+// Uses http.DefaultClient if client is nil.
+func FetchUserInfo(accessToken, userInfoURI string, client *http.Client) (map[string]any, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequest(http.MethodGet, userInfoURI, nil)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to create UserInfo request"), err)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", accessToken))
+	req.Header.Set("Accept", "application/json")
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to fetch UserInfo"), err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusUnauthorized {
+		return nil, errors.New("UserInfo endpoint responded with status 401, access token is invalid or expired")
+	} else if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch UserInfo, response status was %d, expected 200", res.StatusCode)
+	}
+	var claims map[string]any
+	if err := json.NewDecoder(res.Body).Decode(&claims); err != nil {
+		return nil, errors.Join(errors.New("received UserInfo in invalid format, signed UserInfo responses are not supported"), err)
+	}
+	return claims, nil
+}
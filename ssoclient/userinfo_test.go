@@ -0,0 +1,30 @@
+package ssoclient
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFetchUserInfo(t *testing.T) {
+	t.Parallel()
+	mockUserInfoServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer mock-access-token" {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte(`{"sub":"mock-user","email":"mock-user@example.com"}`))
+	}))
+	defer mockUserInfoServer.Close()
+
+	claims, err := FetchUserInfo("mock-access-token", mockUserInfoServer.URL, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]any{"sub": "mock-user", "email": "mock-user@example.com"}, claims)
+
+	claims, err = FetchUserInfo("expired-access-token", mockUserInfoServer.URL, mockUserInfoServer.Client())
+	assert.Nil(t, claims)
+	assert.ErrorContains(t, err, "status 401")
+}
@@ -1,9 +1,80 @@
 package ssoclient
 
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/url"
+	"time"
+)
+
 // Simple login result type returned from all login functions.
 type LoginResult struct {
 	AccessToken  string
 	RefreshToken string
 	// expires_in field from /token endpoint
 	Expiration int
+	// time when access token expires computed from Expiration when tokens were received, zero if unknown
+	ExpiresAt time.Time
+	// token_type field from /token endpoint, usually "Bearer", empty if not returned
+	TokenType string
+	// granted scope from /token endpoint, may differ from requested scope, empty if not returned
+	Scope string
+	// original JSON body of /token endpoint response, e.g. to read provider-specific fields,
+	// in proxy login it is nil unless the proxy forwards it with Context.ForwardRawResponse
+	RawResponse json.RawMessage
+}
+
+// Reports whether access token is expired, token with unknown expiration is never considered expired.
+func (result *LoginResult) IsExpired() bool {
+	return !result.ExpiresAt.IsZero() && !time.Now().Before(result.ExpiresAt)
+}
+
+// Verifies signature of access token using keys cached in JWKS cache, keys are fetched only if
+// the signing key is not cached. Combined with IsExpired, this checks whether cached tokens
+// can still be trusted without a network round-trip.
+func (result *LoginResult) VerifyTokenSignature(jwksCache *JWKSCache) error {
+	_, err := jwksCache.VerifyToken(result.AccessToken)
+	return err
+}
+
+// Computes absolute expiration time from expires_in seconds, zero expires_in means unknown expiration.
+func expiresAt(expiresIn int) time.Time {
+	if expiresIn <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(time.Duration(expiresIn) * time.Second)
+}
+
+// Returns logger, or a logger discarding all records if logger is nil.
+func loggerOrDiscard(logger *slog.Logger) *slog.Logger {
+	if logger == nil {
+		return slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	return logger
+}
+
+// Base and maximum delay of backoff after a failed request, e.g. a token poll or a proxy login request.
+const retryBaseDelay = 250 * time.Millisecond
+const retryMaxDelay = 10 * time.Second
+
+// Returns jittered exponential backoff after failedRequests consecutive failed requests,
+// a random delay between half and full of the exponential delay.
+func retryBackoff(failedRequests int) time.Duration {
+	delay := min(retryBaseDelay*time.Duration(1<<min(failedRequests-1, 16)), retryMaxDelay)
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// Returns uri with query and fragment replaced by "...", e.g. to log URIs with secrets in their query.
+// Unparsable URIs are replaced entirely.
+func uriWithoutQuery(uri string) string {
+	parsedURI, err := url.Parse(uri)
+	if err != nil {
+		return "[invalid URI]"
+	} else if parsedURI.RawQuery == "" && parsedURI.Fragment == "" {
+		return uri
+	}
+	parsedURI.RawQuery, parsedURI.Fragment, parsedURI.RawFragment = "", "", ""
+	return parsedURI.String() + "?..."
 }
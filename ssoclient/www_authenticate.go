@@ -0,0 +1,117 @@
+package ssoclient
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Parameters of Bearer challenge in WWW-Authenticate header of resource server response (RFC 6750 section 3).
+type ChallengeParams struct {
+	Realm string
+	// OAuth error code, e.g. "invalid_token" or "insufficient_scope"
+	Error            string
+	ErrorDescription string
+	// Space-separated scopes required to access the resource, user has to log in again with them
+	// if Error is "insufficient_scope"
+	Scope string
+}
+
+// Parses Bearer challenge from WWW-Authenticate header of a 401 or 403 resource server response, e.g.
+// `Bearer realm="api", error="insufficient_scope", scope="openid profile"`. Challenges of other schemes
+// in the same header are skipped. Returns error if the header is malformed or contains no Bearer challenge.
+func ParseWWWAuthenticate(header string) (ChallengeParams, error) {
+	rest := header
+	for {
+		rest = strings.TrimLeft(rest, " \t,")
+		if rest == "" {
+			return ChallengeParams{}, errors.New("WWW-Authenticate header does not contain Bearer challenge")
+		}
+		var scheme string
+		scheme, rest = readToken(rest)
+		if scheme == "" {
+			return ChallengeParams{}, fmt.Errorf("malformed WWW-Authenticate header, expected auth scheme at '%s'", rest)
+		}
+		params, remaining, err := readAuthParams(rest)
+		if err != nil {
+			return ChallengeParams{}, fmt.Errorf("malformed WWW-Authenticate header: %w", err)
+		}
+		if strings.EqualFold(scheme, "Bearer") {
+			return ChallengeParams{
+				Realm:            params["realm"],
+				Error:            params["error"],
+				ErrorDescription: params["error_description"],
+				Scope:            params["scope"],
+			}, nil
+		}
+		rest = remaining
+	}
+}
+
+// Reads comma-separated auth params (name=value) of a challenge until the next challenge or end of header.
+// Parameter names are lowercased, values may be tokens or quoted strings.
+func readAuthParams(header string) (map[string]string, string, error) {
+	params := map[string]string{}
+	rest := header
+	for {
+		rest = strings.TrimLeft(rest, " \t")
+		name, afterName := readToken(rest)
+		afterName = strings.TrimLeft(afterName, " \t")
+		if name == "" || !strings.HasPrefix(afterName, "=") {
+			if name == "" && rest != "" && rest[0] != ',' {
+				return nil, "", fmt.Errorf("expected auth param at '%s'", rest)
+			}
+			// next challenge starts with its scheme
+			return params, rest, nil
+		}
+		value, afterValue, err := readParamValue(strings.TrimLeft(afterName[1:], " \t"))
+		if err != nil {
+			return nil, "", err
+		}
+		params[strings.ToLower(name)] = value
+		rest = strings.TrimLeft(afterValue, " \t")
+		if strings.HasPrefix(rest, ",") {
+			rest = rest[1:]
+		} else if rest != "" {
+			return nil, "", fmt.Errorf("expected ',' after auth param '%s'", name)
+		}
+	}
+}
+
+// Reads auth param value, which is a token or a quoted string with backslash escapes.
+func readParamValue(header string) (string, string, error) {
+	if !strings.HasPrefix(header, `"`) {
+		value, rest := readToken(header)
+		if value == "" {
+			return "", "", errors.New("auth param value is missing")
+		}
+		return value, rest, nil
+	}
+	var value strings.Builder
+	for i := 1; i < len(header); i++ {
+		switch header[i] {
+		case '"':
+			return value.String(), header[i+1:], nil
+		case '\\':
+			if i+1 < len(header) {
+				i++
+			}
+		}
+		value.WriteByte(header[i])
+	}
+	return "", "", errors.New("quoted auth param value is not terminated")
+}
+
+// Splits header after its leading token (RFC 9110 section 5.6.2).
+func readToken(header string) (string, string) {
+	end := 0
+	for end < len(header) && isTokenChar(header[end]) {
+		end++
+	}
+	return header[:end], header[end:]
+}
+
+func isTokenChar(char byte) bool {
+	return char >= 'a' && char <= 'z' || char >= 'A' && char <= 'Z' || char >= '0' && char <= '9' ||
+		strings.IndexByte("!#$%&'*+-.^_`|~", char) >= 0
+}
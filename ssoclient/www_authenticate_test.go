@@ -0,0 +1,44 @@
+package ssoclient
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseWWWAuthenticate(t *testing.T) {
+	t.Parallel()
+	tests := map[string]ChallengeParams{
+		`Bearer realm="api", error="insufficient_scope", error_description="Scope \"admin\" is required", scope="openid admin"`: {
+			Realm:            "api",
+			Error:            "insufficient_scope",
+			ErrorDescription: `Scope "admin" is required`,
+			Scope:            "openid admin",
+		},
+		`bearer error=invalid_token`: {Error: "invalid_token"},
+		`Bearer`:                     {},
+		`Basic realm="legacy", Bearer realm="api" , Scope=x`: {Realm: "api", Scope: "x"},
+		`Bearer realm="api", DPoP algs="ES256"`:              {Realm: "api"},
+	}
+	for header, expected := range tests {
+		params, err := ParseWWWAuthenticate(header)
+		assert.NoError(t, err, header)
+		assert.Equal(t, expected, params, header)
+	}
+}
+
+func TestParseWWWAuthenticateRejectsMalformedHeader(t *testing.T) {
+	t.Parallel()
+	for _, header := range []string{
+		``,
+		`Basic realm="legacy"`,
+		`Bearer realm="api`,
+		`Bearer realm=`,
+		`Bearer realm="api" error="invalid_token"`,
+		`"Bearer" realm="api"`,
+		`Bearer realm="api", "error"`,
+	} {
+		_, err := ParseWWWAuthenticate(header)
+		assert.Error(t, err, header)
+	}
+}
@@ -2,9 +2,16 @@ package ssoproxy
 
 import (
 	"context"
+	"crypto/subtle"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -16,20 +23,287 @@ type OIDCConfig struct {
 	AuthorizationURI string
 	ClientId         string
 	ClientSecret     string
+	// Optional provider of current client secret called on every request authenticated with client credentials,
+	// e.g. to rotate the secret without restarting the proxy, ClientSecret is used if not set
+	ClientSecretProvider func() string
+	// Optional URI of token endpoint, "{BaseURI}/token" is used by default
+	TokenURI string
+	// Optional login_hint_token identifying the user, added to authorization URI if set
+	LoginHintToken string
+	// Optional scopes that override 'scope' parameter of authorization URI, "openid" is always included
+	Scopes []string
+	// Optional response mode added to authorization URI, e.g. ResponseModeFormPost, IdP's default (query) is used if not set.
+	// OIDCRedirectHandler accepts both query and form_post responses regardless of this setting.
+	ResponseMode string
+	// Optional extra parameters added to authorization URI, e.g. "audience", "prompt" or "acr_values",
+	// parameters set by the proxy like "state" can't be overridden
+	ExtraAuthParams map[string]string
+	// Optional extra parameters added to token requests, e.g. "resource" (RFC 8707) or "audience",
+	// parameters set by the proxy like "grant_type" can't be overridden
+	TokenExtraParams map[string]string
+	// Optional grant_type of token request exchanging authorization code, e.g. for providers with nonstandard
+	// requirements, "authorization_code" is used by default. Token refreshes always use "refresh_token"
+	TokenGrantType string
+	// Optional parameters overriding base parameters of token request exchanging authorization code
+	// ("code", "redirect_uri" and "grant_type"), a parameter with empty value is not sent
+	TokenGrantParams map[string]string
+	// How client credentials are sent to token endpoint, TokenAuthMethodPost (default) or TokenAuthMethodBasic
+	TokenAuthMethod string
+	// Optional URI of pushed authorization request endpoint (RFC 9126), if set authorization parameters
+	// including "state" and "scope" are pushed to it and authorization URI only references them with "request_uri"
+	PARURI string
+	// Optional URI of token revocation endpoint (RFC 7009), preferred by OIDCLogoutHandler if set
+	RevocationURI string
+	// Optional URI of end session endpoint, used by OIDCLogoutHandler only if KeycloakEndSessionLogout is enabled
+	EndSessionURI string
+	// If enabled and RevocationURI is not set, OIDCLogoutHandler POSTs refresh token with client credentials
+	// to EndSessionURI. This back-channel logout is Keycloak specific, OIDC RP-Initiated Logout is a browser
+	// redirect with id_token_hint, other IdPs reject the request; disabled by default
+	KeycloakEndSessionLogout bool
+	// If enabled a random nonce is added to authorization URI and 'nonce' claim of received ID token
+	// must match it, otherwise the login fails
+	ValidateNonce bool
+	// Optional additional redirect URIs registered at IdP, e.g. when the proxy serves clients on several hostnames.
+	// Login selects the URI requested with "redirect-uri" query parameter if it is allowed, otherwise the URI
+	// with host of the login request, RedirectURI is used by default. The selected URI is sent as "redirect_uri"
+	// on both authorization and token request.
+	AllowedRedirectURIs []string
 }
 
+// Checks that required fields BaseURI, AuthorizationURI, RedirectURI and ClientId are set
+// and that all configured URIs are absolute URIs. All found problems are returned joined.
+func (config OIDCConfig) Validate() error {
+	errs := []error{}
+	if config.ClientId == "" {
+		errs = append(errs, errors.New("ClientId is required"))
+	}
+	uris := []struct {
+		name     string
+		uri      string
+		required bool
+	}{
+		{"BaseURI", config.BaseURI, true},
+		{"AuthorizationURI", config.AuthorizationURI, true},
+		{"RedirectURI", config.RedirectURI, true},
+		{"TokenURI", config.TokenURI, false},
+		{"PARURI", config.PARURI, false},
+		{"RevocationURI", config.RevocationURI, false},
+		{"EndSessionURI", config.EndSessionURI, false},
+	}
+	for _, uri := range uris {
+		if uri.uri == "" {
+			if uri.required {
+				errs = append(errs, fmt.Errorf("%s is required", uri.name))
+			}
+		} else if err := validateURI(uri.uri); err != nil {
+			errs = append(errs, fmt.Errorf("%s is invalid: %w", uri.name, err))
+		}
+	}
+	for i, uri := range config.AllowedRedirectURIs {
+		if err := validateURI(uri); err != nil {
+			errs = append(errs, fmt.Errorf("AllowedRedirectURIs[%d] is invalid: %w", i, err))
+		}
+	}
+	if config.TokenAuthMethod != "" && config.TokenAuthMethod != TokenAuthMethodPost && config.TokenAuthMethod != TokenAuthMethodBasic {
+		errs = append(errs, fmt.Errorf("unknown TokenAuthMethod '%s'", config.TokenAuthMethod))
+	}
+	return errors.Join(errs...)
+}
+
+// Returns current client secret from ClientSecretProvider, or ClientSecret if the provider is not set.
+func (config OIDCConfig) clientSecret() string {
+	if config.ClientSecretProvider != nil {
+		return config.ClientSecretProvider()
+	}
+	return config.ClientSecret
+}
+
+// Returns URI of IdP token endpoint, "{BaseURI}/token" if TokenURI is not set.
+func (config OIDCConfig) tokenEndpoint() string {
+	if config.TokenURI == "" {
+		return fmt.Sprintf("%s/token", config.BaseURI)
+	}
+	return config.TokenURI
+}
+
+// Checks that uri is an absolute URI with scheme and host.
+func validateURI(uri string) error {
+	parsedURI, err := url.Parse(uri)
+	if err != nil {
+		return err
+	} else if parsedURI.Scheme == "" || parsedURI.Host == "" {
+		return fmt.Errorf("'%s' is not an absolute URI", uri)
+	}
+	return nil
+}
+
+// IdP sends authorization response to redirect URI as form fields in a POST request.
+const ResponseModeFormPost = "form_post"
+
+// Client credentials are sent in token request body (client_secret_post).
+const TokenAuthMethodPost = "post"
+
+// Client credentials are sent in Authorization header using HTTP Basic auth (client_secret_basic).
+const TokenAuthMethodBasic = "basic"
+
 type Context struct {
 	config        OIDCConfig
-	requests      map[string]chan *loginResult
+	requests      map[string]*loginSession
 	requestsMutex *sync.RWMutex
+	// creation times of recently ended login sessions, kept to diagnose late redirects
+	endedRequests map[string]time.Time
+	// set by Shutdown, no new logins are accepted afterwards
+	shuttingDown bool
+	// closed by Shutdown to stop token streams
+	shutdown chan struct{}
+	// login handlers with a created login session, waited for by Shutdown
+	activeLogins *sync.WaitGroup
+	// logins started by OIDCLoginPollHandler by poll token, guarded by requestsMutex
+	polledLogins map[string]*polledLogin
+	// logins started by OIDCLoginOneTimeCodeHandler by one-time code, guarded by requestsMutex
+	oneTimeCodes map[string]*polledLogin
+	// counts of logins since the context was created, guarded by requestsMutex
+	stats LoginStats
+	// cached result of IdP health check
+	idpHealth *idpHealth
+	// login rate of client IPs, used if LoginRateLimit is set
+	loginRateLimiter *loginRateLimiter
+	// client trusting CACertPEM, created on first request to IdP
+	caHTTPClient *caHTTPClient
+	// warning about redirect handler served on other path than path of redirect URI is logged only once
+	redirectPathWarning *sync.Once
+	// warning about response writer that can't be flushed is logged only once
+	flushWarning *sync.Once
 	// logger for HTTP handlers, does not log any messages by default
 	Logger *slog.Logger
+	// if enabled values of access, refresh and ID tokens and authorization codes are replaced by a short hash
+	// in logged data, e.g. in debug logs of sent events; enabled by default
+	RedactSecrets bool
 	// if set users will be redirected to it after login to IdP if the redirect processing was successful, won't redirect by default
 	SuccessRedirectURI string
 	// if set users will be redirected to it after login to IdP if the redirect processing failed, won't redirect by default
 	FailedRedirectURI string
+	// if set the state (request id) will be added to SuccessRedirectURI as a query parameter with this name, not added by default
+	SuccessRedirectStateParam string
+	// if enabled "status=success" is added to SuccessRedirectURI and "error" (one of ErrorCode* constants)
+	// and "error_description" are added to FailedRedirectURI, so the landing page can show what happened, disabled by default
+	RedirectResultParams bool
+	// path prefix under which a reverse proxy exposes the handlers and which it strips from request paths, e.g. "/sso",
+	// it is added to handled paths when they are compared with redirect URI and to relative redirect URIs; empty by default
+	PathPrefix string
 	// time for user to login to IdP after login was initiated, default 5 minutes
 	LoginTimeout time.Duration
+	// maximum login timeout clients can request with "login-timeout" query parameter, longer requested
+	// timeouts are clamped to it, LoginTimeout is the maximum if not set
+	MaxLoginTimeout time.Duration
+	// number of random bytes of request id, default 8 (64 bits of entropy), lower values are raised to 8.
+	// The request id is sent to IdP as OIDC state, it protects against CSRF and only the holder
+	// of the login stream knows it, so it must not be guessable.
+	ReqIdLength int
+	// if enabled clients can ask to keep login stream open after login, the proxy then refreshes
+	// tokens on user's behalf before they expire and sends them to the client, disabled by default
+	TokenStream bool
+	// how long before access token expiration tokens are refreshed in token stream, default 30 seconds
+	TokenRefreshLeeway time.Duration
+	// if enabled tokens events contain whole token endpoint response as "raw_response", e.g. with provider-specific
+	// fields, it can contain an ID token or other data clients don't need otherwise; disabled by default
+	ForwardRawResponse bool
+	// HTTP client used for all requests to IdP, e.g. to set timeouts, custom CAs or an outbound proxy,
+	// http.DefaultClient is used if nil
+	HTTPClient *http.Client
+	// optional PEM encoded CA certificates trusted in addition to system roots when connecting to IdP, e.g. a CA
+	// of internal IdP with a self-signed certificate, ignored if HTTPClient is set; not set by default
+	CACertPEM []byte
+	// if enabled login streams are gzip compressed for clients sending "Accept-Encoding: gzip", e.g. to reduce
+	// size of token events, each event is still flushed to the client immediately; disabled by default
+	CompressStream bool
+	// maximum number of logins waiting for user to log in, new logins are rejected when reached, unlimited if 0
+	MaxPendingLogins int
+	// maximum number of logins per minute from one client IP, further logins are rejected with status 429
+	// until the client's token bucket refills, unlimited if 0
+	LoginRateLimit int
+	// if enabled client IP used by LoginRateLimit is the last address of X-Forwarded-For header and host used
+	// to select one of OIDCConfig.AllowedRedirectURIs is the last host of X-Forwarded-Host header,
+	// enable it only behind a trusted reverse proxy that sets the headers, otherwise clients can spoof them
+	TrustForwardedFor bool
+	// optional hook called after tokens of a successful login were sent to the client, e.g. for auditing
+	OnLoginComplete func(reqId string, result *LoginResult)
+	// optional hook called after a login failed or timed out and the error was sent to the client
+	OnLoginFailed func(reqId string, err error)
+	// records login metrics, records nothing by default
+	Metrics MetricsRecorder
+	// origins of browser based clients allowed to open login stream using CORS, "*" allows any origin,
+	// no CORS headers are sent by default
+	AllowedOrigins []string
+	// optional named IdP configurations selected by "provider" query parameter of login request,
+	// the configuration passed to NewContext is used if no provider is requested
+	Providers map[string]OIDCConfig
+	// HealthHandler also checks that IdP token endpoint of the configuration passed to NewContext is reachable,
+	// only the proxy itself is checked by default
+	HealthCheckIdP bool
+	// if enabled a redirect with authorization code, but without OIDC state, e.g. from a misconfigured IdP that drops it,
+	// is correlated to the only pending login instead of being rejected. It disables CSRF protection of state,
+	// so enable it only as a workaround with a single user at a time; disabled by default
+	AllowStatelessCorrelation bool
+	// optional generator of request ids sent to IdP as OIDC state, e.g. to reference a session in an external store,
+	// generated ids must be unguessable and unique among pending logins; random ids of ReqIdLength bytes are used by default
+	StateGenerator func() (string, error)
+	// names of login events sent to clients, "auth-uri", "logged-in" and "error" by default,
+	// can be changed to match event names expected by an existing client
+	AuthURIEvent string
+	TokensEvent  string
+	ErrorEvent   string
+}
+
+// Tokens of a successful login passed to Context.OnLoginComplete.
+type LoginResult struct {
+	AccessToken  string
+	RefreshToken string
+	// Access token lifetime in seconds
+	Expiration int
+	// Token type and granted scope returned by IdP, empty if not returned
+	TokenType string
+	Scope     string
+	// Original JSON body of token endpoint response
+	RawResponse json.RawMessage
+}
+
+// Counts of logins since the context was created returned by Context.Stats.
+type LoginStats struct {
+	// logins whose login session was created
+	Initiated int
+	Succeeded int
+	// logins that failed for other reason than a timeout
+	Failed   int
+	TimedOut int
+}
+
+// Pending login of a request id waiting for its login result.
+type loginSession struct {
+	// buffered, so writing a login result never blocks even if nobody waits for it anymore
+	result chan *loginResult
+	// set when a login result was written, only the first login result is accepted
+	completed bool
+	// set when authorization code of the session was received, so it is exchanged for tokens only once
+	redeemed  bool
+	createdAt time.Time
+	// time for user to login after session was created
+	timeout time.Duration
+	// nonce sent on authorization request, empty if nonce is not validated
+	nonce string
+	// configuration of IdP the user logs in at
+	config OIDCConfig
+	// receives login result instead of the original login stream if a client resumed the login, guarded by requestsMutex
+	resumed chan *loginResult
+	// set when login handler took the login result, the login can't be resumed afterwards, guarded by requestsMutex
+	resultTaken bool
+	// random token sent as SSE id of login events, a client that lost the login stream resumes the login with it,
+	// empty if the login has no login stream; guarded by requestsMutex
+	resumeToken string
+	// closed when the current login stream of the login ends, guarded by requestsMutex
+	streamDone <-chan struct{}
+	// code shown to user after login to exchange it for tokens, empty if the login was not started by OIDCLoginOneTimeCodeHandler
+	oneTimeCode string
 }
 
 // Internal type returned to functions after user login. Err must be checked before using other attributes.
@@ -37,64 +311,518 @@ type loginResult struct {
 	accessToken  string
 	refreshToken string
 	expiration   int
+	tokenType    string
+	scope        string
+	rawResponse  json.RawMessage
 	err          error
 }
 
+// Creates successful login result from token endpoint response.
+func newLoginResult(tokens *tokenResponse) *loginResult {
+	return &loginResult{
+		accessToken:  tokens.AccessToken,
+		refreshToken: tokens.RefreshToken,
+		expiration:   int(tokens.ExpiresIn),
+		tokenType:    tokens.TokenType,
+		scope:        tokens.Scope,
+		rawResponse:  tokens.raw,
+	}
+}
+
 // Creates a new context, this context needs to be shared between the login and redirect handlers.
 func NewContext(oidcConfig OIDCConfig) *Context {
 	return &Context{
-		oidcConfig,
-		make(map[string]chan *loginResult),
-		&sync.RWMutex{},
-		slog.New(slog.NewTextHandler(io.Discard, nil)),
-		"",
-		"",
-		time.Minute * 5,
+		config:              oidcConfig,
+		requests:            make(map[string]*loginSession),
+		endedRequests:       make(map[string]time.Time),
+		polledLogins:        make(map[string]*polledLogin),
+		oneTimeCodes:        make(map[string]*polledLogin),
+		requestsMutex:       &sync.RWMutex{},
+		shutdown:            make(chan struct{}),
+		activeLogins:        &sync.WaitGroup{},
+		idpHealth:           &idpHealth{},
+		loginRateLimiter:    &loginRateLimiter{buckets: make(map[string]*tokenBucket)},
+		caHTTPClient:        &caHTTPClient{once: &sync.Once{}},
+		redirectPathWarning: &sync.Once{},
+		flushWarning:        &sync.Once{},
+		Logger:              slog.New(slog.NewTextHandler(io.Discard, nil)),
+		RedactSecrets:       true,
+		LoginTimeout:        time.Minute * 5,
+		ReqIdLength:         minReqIdLength,
+		TokenRefreshLeeway:  time.Second * 30,
+		Metrics:             NoopMetricsRecorder{},
+		AuthURIEvent:        eventAuthURI,
+		TokensEvent:         eventLoggedIn,
+		ErrorEvent:          eventError,
+	}
+}
+
+// Calls Context.OnLoginComplete hook if set.
+func (ctx *Context) loginCompleted(reqId string, result *loginResult) {
+	if ctx.OnLoginComplete != nil {
+		ctx.OnLoginComplete(reqId, &LoginResult{
+			AccessToken:  result.accessToken,
+			RefreshToken: result.refreshToken,
+			Expiration:   result.expiration,
+			TokenType:    result.tokenType,
+			Scope:        result.scope,
+			RawResponse:  result.rawResponse,
+		})
+	}
+}
+
+// Calls Context.OnLoginFailed hook if set.
+func (ctx *Context) loginFailed(reqId string, err error) {
+	if ctx.OnLoginFailed != nil {
+		ctx.OnLoginFailed(reqId, err)
+	}
+}
+
+// Returns request id of a new login generated by Context.StateGenerator, or a random request id if it is not set.
+func (ctx *Context) newReqId() (string, error) {
+	if ctx.StateGenerator == nil {
+		return generateReqId(ctx.ReqIdLength)
+	}
+	reqId, err := ctx.StateGenerator()
+	if err != nil {
+		return "", err
+	} else if reqId == "" {
+		return "", errors.New("state generator returned empty request id")
+	}
+	return reqId, nil
+}
+
+// Returns path of request as seen by users, i.e. with Context.PathPrefix stripped by a reverse proxy.
+func (ctx *Context) externalPath(path string) string {
+	return strings.TrimSuffix(ctx.PathPrefix, "/") + path
+}
+
+// Returns path of handler mounted behind reverse proxy for external path, i.e. with Context.PathPrefix stripped.
+// Returns false if the path is not under the prefix.
+func (ctx *Context) internalPath(path string) (string, bool) {
+	prefix := strings.TrimSuffix(ctx.PathPrefix, "/")
+	if prefix == "" {
+		return path, true
+	} else if path == prefix {
+		return "/", true
+	} else if !strings.HasPrefix(path, prefix+"/") {
+		return "", false
+	}
+	return strings.TrimPrefix(path, prefix), true
+}
+
+// Returns HTTP client used for requests to IdP.
+func (ctx *Context) httpClient() *http.Client {
+	if ctx.HTTPClient != nil {
+		return ctx.HTTPClient
+	}
+	if len(ctx.CACertPEM) == 0 {
+		return http.DefaultClient
 	}
+	ctx.caHTTPClient.once.Do(func() {
+		client, err := newCAHTTPClient(ctx.CACertPEM)
+		if err != nil {
+			ctx.Logger.Error(fmt.Sprintf("Invalid CACertPEM, only system CAs are trusted: %v", err))
+			client = http.DefaultClient
+		}
+		ctx.caHTTPClient.client = client
+	})
+	return ctx.caHTTPClient.client
 }
 
-// Initiates login flow for request id, waits for its login result and returns it.
-func (ctx *Context) initiateLogin(reqId string, handler func(*loginResult)) {
+// Returned when a login can't be created, because Context.MaxPendingLogins logins are already pending.
+var errTooManyPendingLogins = errors.New("maximum number of pending logins was reached")
+
+// Returned when a login can't be created, because a pending login already has the same request id.
+var errDuplicateReqId = errors.New("a pending login with the same request id already exists")
+
+// Returned when a login can't be created or is ended, because the proxy is shutting down.
+var errShuttingDown = newLoginError(ErrorCodeUnavailable, errors.New("proxy is shutting down"))
+
+// Stops accepting new logins and ends all pending logins with an error, so their clients fail fast
+// instead of waiting for login timeout. Token streams are closed as well.
+// Waits until all login handlers finish or ctx is done, in which case ctx's error is returned.
+func (ctx *Context) Shutdown(shutdownCtx context.Context) error {
 	ctx.requestsMutex.Lock()
-	ctx.requests[reqId] = make(chan *loginResult)
+	ctx.stopLogins()
 	ctx.requestsMutex.Unlock()
-	timeoutCtx, cancel := context.WithTimeout(context.Background(), ctx.LoginTimeout)
+	ctx.Logger.Info("Shutting down, waiting for pending logins to finish")
+
+	drained := make(chan struct{})
+	go func() {
+		ctx.activeLogins.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		return nil
+	case <-shutdownCtx.Done():
+		return shutdownCtx.Err()
+	}
+}
+
+// Releases resources of the context, e.g. in tests or when the embedding application stops.
+// Rejects new logins and ends pending logins and token streams like Shutdown, but does not wait
+// for login handlers to finish, and removes all stored login sessions.
+func (ctx *Context) Close() {
+	ctx.requestsMutex.Lock()
+	defer ctx.requestsMutex.Unlock()
+	ctx.stopLogins()
+	clear(ctx.requests)
+	clear(ctx.endedRequests)
+	clear(ctx.polledLogins)
+	clear(ctx.oneTimeCodes)
+	ctx.Logger.Info("Closed context, all login sessions were removed")
+}
+
+// Stops accepting new logins and ends pending logins with an error, requestsMutex must be locked.
+func (ctx *Context) stopLogins() {
+	if !ctx.shuttingDown {
+		ctx.shuttingDown = true
+		close(ctx.shutdown)
+	}
+	for _, session := range ctx.requests {
+		if !session.completed {
+			session.completed = true
+			session.result <- &loginResult{err: errShuttingDown}
+		}
+	}
+}
+
+// Creates a new context like NewContext, but validates OIDC config first, see OIDCConfig.Validate.
+func NewContextWithValidation(oidcConfig OIDCConfig) (*Context, error) {
+	if err := oidcConfig.Validate(); err != nil {
+		return nil, errors.Join(errors.New("invalid OIDC config"), err)
+	}
+	return NewContext(oidcConfig), nil
+}
+
+// Returns login timeout requested by client in seconds clamped to Context.MaxLoginTimeout,
+// Context.LoginTimeout is returned if no valid timeout was requested.
+func (ctx *Context) requestedLoginTimeout(requestedTimeout string) time.Duration {
+	if requestedTimeout == "" {
+		return ctx.LoginTimeout
+	}
+	seconds, err := strconv.Atoi(requestedTimeout)
+	if err != nil || seconds <= 0 {
+		ctx.Logger.Warn(fmt.Sprintf("Ignoring invalid requested login timeout '%s'", requestedTimeout))
+		return ctx.LoginTimeout
+	}
+	maxTimeout := ctx.MaxLoginTimeout
+	if maxTimeout <= 0 {
+		maxTimeout = ctx.LoginTimeout
+	}
+	// compared in seconds, multiplying a huge requested timeout would overflow into a short or negative one
+	if int64(seconds) >= int64(maxTimeout/time.Second) {
+		return maxTimeout
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// Initiates login flow for request id, waits for its login result and returns it. A pending login with
+// the same request id is never replaced, errDuplicateReqId is returned instead.
+func (ctx *Context) initiateLogin(reqId string, handler func(*loginResult)) error {
+	session, err := ctx.createLogin(reqId, ctx.config, "", ctx.LoginTimeout)
+	if err != nil {
+		return err
+	}
+	defer ctx.activeLogins.Done()
+	ctx.waitForLogin(reqId, session, handler)
+	return nil
+}
+
+// Creates login session for request id at IdP of config with nonce sent to IdP and login timeout, fails if
+// Context.MaxPendingLogins was reached or the proxy is shutting down.
+// Context.activeLogins.Done must be called after the login handler finishes.
+func (ctx *Context) createLogin(reqId string, config OIDCConfig, nonce string, timeout time.Duration) (*loginSession, error) {
+	session := &loginSession{
+		result:    make(chan *loginResult, 1),
+		createdAt: time.Now(),
+		timeout:   timeout,
+		nonce:     nonce,
+		config:    config,
+	}
+	ctx.requestsMutex.Lock()
+	if ctx.shuttingDown {
+		ctx.requestsMutex.Unlock()
+		return nil, errShuttingDown
+	} else if ctx.MaxPendingLogins > 0 && len(ctx.requests) >= ctx.MaxPendingLogins {
+		ctx.requestsMutex.Unlock()
+		return nil, errTooManyPendingLogins
+	} else if _, exists := ctx.requests[reqId]; exists {
+		// never replace session of another login, its redirect would be delivered to this login
+		ctx.requestsMutex.Unlock()
+		return nil, errDuplicateReqId
+	}
+	ctx.requests[reqId] = session
+	ctx.stats.Initiated++
+	ctx.activeLogins.Add(1)
+	ctx.requestsMutex.Unlock()
+	ctx.Logger.Info("Created login session", reqIdLogArg, reqId, sessionCreatedLogArg, session.createdAt)
+	ctx.Metrics.IncLoginInitiated()
+	return session, nil
+}
+
+// Removes created login session that could not be started, e.g. because its authorization request
+// could not be pushed to IdP, the login is counted as failed. Context.activeLogins.Done must still be called.
+func (ctx *Context) abortLogin(reqId string, err error) {
+	ctx.Metrics.IncLoginFailed(LoginFailedReasonError)
+	ctx.requestsMutex.Lock()
+	ctx.stats.Failed++
+	delete(ctx.requests, reqId)
+	ctx.requestsMutex.Unlock()
+	ctx.loginFailed(reqId, err)
+}
+
+// Waits for login result of created login session and passes it to handler, the session is removed afterwards.
+func (ctx *Context) waitForLogin(reqId string, session *loginSession, handler func(*loginResult)) {
+	timeoutCtx, cancel := context.WithTimeout(context.Background(), session.timeout)
 	defer cancel()
+	var stat *int
 	select {
-	case loginResult := <-ctx.requests[reqId]:
+	case loginResult := <-session.result:
+		if loginResult.err != nil {
+			ctx.Metrics.IncLoginFailed(LoginFailedReasonError)
+			stat = &ctx.stats.Failed
+		} else {
+			ctx.Metrics.IncLoginSucceeded()
+			ctx.Metrics.ObserveLoginDuration(time.Since(session.createdAt))
+			stat = &ctx.stats.Succeeded
+		}
 		handler(loginResult)
 	case <-timeoutCtx.Done():
-		ctx.Logger.Warn("User's login session timed out")
-		handler(&loginResult{err: errors.New("user's login session timed out")})
+		ctx.Logger.Warn("User's login session timed out", reqIdLogArg, reqId)
+		ctx.Metrics.IncLoginFailed(LoginFailedReasonTimeout)
+		stat = &ctx.stats.TimedOut
+		handler(&loginResult{err: newLoginError(ErrorCodeTimeout, errors.New("user's login session timed out"))})
 	}
 	ctx.requestsMutex.Lock()
+	*stat++
 	delete(ctx.requests, reqId)
+	if session.resumed != nil { // login result was already passed to it by handler, if it was taken
+		close(session.resumed)
+	}
+	if !ctx.shuttingDown { // ended sessions are kept only for diagnostics of running proxy
+		ctx.endedRequests[reqId] = session.createdAt
+	}
+	for endedReqId, createdAt := range ctx.endedRequests {
+		if time.Since(createdAt) > 2*max(ctx.LoginTimeout, ctx.MaxLoginTimeout) {
+			delete(ctx.endedRequests, endedReqId)
+		}
+	}
+	// results of detached logins that clients never fetched would otherwise be kept until they try
+	ctx.removeExpiredPolledLogins()
+	ctx.removeExpiredOneTimeCodes()
 	ctx.requestsMutex.Unlock()
 }
 
-// Writes tokens to session of request id, if there is no such session returns error.
-func (ctx *Context) onLoginSuccess(reqId, accessToken, refreshToken string, expiration int) error {
-	if _, contains := ctx.requests[reqId]; !contains {
-		return errors.New("user's session id does not exist in OIDC context")
+// Logs why login session of request id could not be found, if the session ended recently
+// on this proxy its creation time and age are logged, otherwise it was probably created
+// on another proxy instance or the state was not issued by the proxy at all.
+func (ctx *Context) logMissingLogin(reqId string) {
+	ctx.requestsMutex.RLock()
+	session, pending := ctx.requests[reqId]
+	createdAt, ended := ctx.endedRequests[reqId]
+	ctx.requestsMutex.RUnlock()
+	if pending {
+		ctx.Logger.Warn(
+			"Login session already received its login result",
+			reqIdLogArg, reqId, sessionCreatedLogArg, session.createdAt, sessionAgeLogArg, time.Since(session.createdAt),
+		)
+	} else if ended {
+		ctx.Logger.Warn(
+			"Login session not found, it already ended (timed out or completed)",
+			reqIdLogArg, reqId, sessionCreatedLogArg, createdAt, sessionAgeLogArg, time.Since(createdAt),
+		)
+	} else {
+		ctx.Logger.Warn("Login session not found, it was not created by this proxy instance", reqIdLogArg, reqId)
+	}
+}
+
+// Returns nonce of login session for request id, empty if there is no such session.
+func (ctx *Context) loginNonce(reqId string) string {
+	ctx.requestsMutex.RLock()
+	defer ctx.requestsMutex.RUnlock()
+	if session, contains := ctx.requests[reqId]; contains {
+		return session.nonce
+	}
+	return ""
+}
+
+// Returns IdP configuration of login session for request id, the default configuration if there is no such session.
+func (ctx *Context) loginConfig(reqId string) OIDCConfig {
+	ctx.requestsMutex.RLock()
+	defer ctx.requestsMutex.RUnlock()
+	if session, contains := ctx.requests[reqId]; contains {
+		return session.config
+	}
+	return ctx.config
+}
+
+// Returns IdP configuration of provider, the configuration passed to NewContext if provider is empty.
+// Reports false if there is no such provider in Context.Providers.
+func (ctx *Context) providerConfig(provider string) (OIDCConfig, bool) {
+	if provider == "" {
+		return ctx.config, true
 	}
+	config, ok := ctx.Providers[provider]
+	return config, ok
+}
+
+// Returns number of logins waiting for user to log in, e.g. for monitoring.
+func (ctx *Context) PendingLogins() int {
+	ctx.requestsMutex.RLock()
+	defer ctx.requestsMutex.RUnlock()
+	pending := 0
+	for _, session := range ctx.requests {
+		if !session.completed {
+			pending++
+		}
+	}
+	return pending
+}
+
+// Returns counts of initiated, succeeded, failed and timed out logins since the context was created.
+// Pending logins are counted only as initiated.
+func (ctx *Context) Stats() LoginStats {
+	ctx.requestsMutex.RLock()
+	defer ctx.requestsMutex.RUnlock()
+	return ctx.stats
+}
+
+// Returned when a login is resumed while its login stream is still open.
+var errLoginStreamActive = errors.New("login stream of the login is still open")
+
+// Returned when a resume token does not belong to a pending login.
+var errLoginNotResumable = errors.New("login session does not exist or already received its login result")
+
+// Attaches login stream to session, the login can be resumed with resumeToken after streamDone is closed.
+func (ctx *Context) attachLoginStream(session *loginSession, resumeToken string, streamDone <-chan struct{}) {
 	ctx.requestsMutex.Lock()
-	ctx.requests[reqId] <- &loginResult{
-		accessToken:  accessToken,
-		refreshToken: refreshToken,
-		expiration:   expiration,
+	defer ctx.requestsMutex.Unlock()
+	session.resumeToken = resumeToken
+	session.streamDone = streamDone
+}
+
+// Resumes pending login with resumeToken in a new login stream that ends when streamDone is closed,
+// returns its request id, channel the login result is passed to and configuration of its IdP.
+// The login can't be resumed while its current login stream is open, so only a client that lost
+// the stream can resume it. A previously resumed stream of the login is closed.
+// Context.activeLogins.Done must be called after the resumed stream ends.
+func (ctx *Context) resumeLogin(resumeToken string, streamDone <-chan struct{}) (string, <-chan *loginResult, OIDCConfig, error) {
+	ctx.requestsMutex.Lock()
+	defer ctx.requestsMutex.Unlock()
+	if ctx.shuttingDown {
+		return "", nil, OIDCConfig{}, errShuttingDown
 	}
-	ctx.requestsMutex.Unlock()
-	return nil
+	reqId, session := "", (*loginSession)(nil)
+	for id, candidate := range ctx.requests {
+		// resume token is the only secret of the client, it must not be revealed by timing
+		if candidate.resumeToken != "" && subtle.ConstantTimeCompare([]byte(candidate.resumeToken), []byte(resumeToken)) == 1 {
+			reqId, session = id, candidate
+		}
+	}
+	if session == nil || session.resultTaken {
+		return "", nil, OIDCConfig{}, errLoginNotResumable
+	}
+	select {
+	case <-session.streamDone:
+	default:
+		return reqId, nil, OIDCConfig{}, errLoginStreamActive
+	}
+	if session.resumed != nil {
+		close(session.resumed)
+	}
+	session.resumed = make(chan *loginResult, 1)
+	session.streamDone = streamDone
+	ctx.activeLogins.Add(1)
+	return reqId, session.resumed, session.config, nil
 }
 
-// Writes given error to session of request id, if there is no such session does nothing.
-func (ctx *Context) onLoginError(reqId string, err error) {
-	if _, contains := ctx.requests[reqId]; !contains {
-		return
+// Marks login result of session as taken by login handler and returns channel of resumed login stream
+// the result must be passed to, nil if the login was not resumed and the original stream sends it.
+func (ctx *Context) takeLoginResultStream(session *loginSession) chan<- *loginResult {
+	ctx.requestsMutex.Lock()
+	defer ctx.requestsMutex.Unlock()
+	session.resultTaken = true
+	return session.resumed
+}
+
+// Stops passing login result of request id to resumed stream that was closed by client,
+// unless the login was resumed again meanwhile.
+func (ctx *Context) abandonResumedLogin(reqId string, resumed <-chan *loginResult) {
+	ctx.requestsMutex.Lock()
+	defer ctx.requestsMutex.Unlock()
+	if session, contains := ctx.requests[reqId]; contains && !session.resultTaken && session.resumed == resumed {
+		session.resumed = nil
 	}
+}
+
+// Returns request id of the only login waiting for redirect from IdP, reports false
+// if no login or more than one login is waiting.
+func (ctx *Context) singlePendingLogin() (string, bool) {
+	ctx.requestsMutex.RLock()
+	defer ctx.requestsMutex.RUnlock()
+	pendingReqId, pending := "", 0
+	for reqId, session := range ctx.requests {
+		if !session.completed && !session.redeemed {
+			pendingReqId = reqId
+			pending++
+		}
+	}
+	return pendingReqId, pending == 1
+}
+
+// Reports whether a login session for request id is waiting for its login result.
+func (ctx *Context) hasLogin(reqId string) bool {
+	ctx.requestsMutex.RLock()
+	defer ctx.requestsMutex.RUnlock()
+	session, contains := ctx.requests[reqId]
+	return contains && !session.completed
+}
+
+// Marks login session of request id as redeemed, so its authorization code is exchanged for tokens only once,
+// e.g. when user's browser sends the redirect twice. Reports whether the session was redeemed by this call
+// and whether the session is pending, a session that already received its login result without
+// being redeemed is not pending.
+func (ctx *Context) redeemLogin(reqId string) (redeemed, pending bool) {
 	ctx.requestsMutex.Lock()
-	ctx.requests[reqId] <- &loginResult{
+	defer ctx.requestsMutex.Unlock()
+	session, contains := ctx.requests[reqId]
+	if !contains || (session.completed && !session.redeemed) {
+		return false, false
+	} else if session.redeemed {
+		return false, true
+	}
+	session.redeemed = true
+	return true, true
+}
+
+// Writes tokens to session of request id, if there is no such session or it already
+// received its login result returns error.
+func (ctx *Context) onLoginSuccess(reqId string, tokens *tokenResponse) error {
+	return ctx.completeLogin(reqId, newLoginResult(tokens))
+}
+
+// Writes given error to session of request id, if there is no such session or it already
+// received its login result does nothing.
+func (ctx *Context) onLoginError(reqId string, err error) {
+	_ = ctx.completeLogin(reqId, &loginResult{
 		err: err,
+	})
+}
+
+// Writes login result to session of request id, only the first login result of a session is accepted.
+func (ctx *Context) completeLogin(reqId string, result *loginResult) error {
+	ctx.requestsMutex.Lock()
+	defer ctx.requestsMutex.Unlock()
+	session, contains := ctx.requests[reqId]
+	if !contains {
+		return errors.New("user's session id does not exist in OIDC context")
+	} else if session.completed {
+		return errors.New("user's session already received its login result")
 	}
-	ctx.requestsMutex.Unlock()
+	session.completed = true
+	session.result <- result
+	return nil
 }
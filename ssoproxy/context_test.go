@@ -0,0 +1,387 @@
+package ssoproxy
+
+import (
+	"bytes"
+	stdcontext "context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContextOnLoginSuccessTwiceForSameReqId(t *testing.T) {
+	t.Parallel()
+	context := NewContext(OIDCConfig{})
+	results := make(chan *loginResult, 2)
+	loginDone := make(chan struct{})
+	go func() {
+		context.initiateLogin("12345678", func(loginResult *loginResult) { results <- loginResult })
+		close(loginDone)
+	}()
+	for !context.hasLogin("12345678") {
+		time.Sleep(time.Millisecond)
+	}
+
+	secondCallDone := make(chan error)
+	go func() {
+		assert.NoError(t, context.onLoginSuccess("12345678", &tokenResponse{AccessToken: "first-access-token", RefreshToken: "first-refresh-token", ExpiresIn: 600}))
+		secondCallDone <- context.onLoginSuccess("12345678", &tokenResponse{AccessToken: "second-access-token", RefreshToken: "second-refresh-token", ExpiresIn: 600})
+		context.onLoginError("12345678", errors.New("late error"))
+	}()
+	select {
+	case err := <-secondCallDone:
+		assert.Error(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Second onLoginSuccess call blocked")
+	}
+	<-loginDone
+	assert.Len(t, results, 1)
+	assert.Equal(t, "first-access-token", (<-results).accessToken)
+	assert.Empty(t, context.requests)
+}
+
+func TestContextLogsReqIdConsistentlyForMissingLogin(t *testing.T) {
+	t.Parallel()
+	logs := &logRecorder{}
+	context := NewContext(OIDCConfig{
+		BaseURI:          "http://localhost:8000/mock-idp",
+		RedirectURI:      "http://localhost:8001/cli-oidc-redirect",
+		AuthorizationURI: "http://localhost:8000/mock-idp/auth",
+	})
+	context.Logger = slog.New(slog.NewJSONHandler(logs, nil))
+	context.LoginTimeout = 10 * time.Millisecond
+	server := httptest.NewServer(OIDCRedirectHandler(context))
+	defer server.Close()
+	context.initiateLogin("12345678", func(loginResult *loginResult) {}) // times out
+
+	_, _ = http.Get(fmt.Sprint(server.URL, "?state=12345678&code=mock-auth-code"))
+	_, _ = http.Get(fmt.Sprint(server.URL, "?state=87654321&code=mock-auth-code"))
+
+	created := logs.find("Created login session")
+	assert.Equal(t, "12345678", created[reqIdLogArg])
+	timedOut := logs.find("Login session not found, it already ended (timed out or completed)")
+	assert.Equal(t, "12345678", timedOut[reqIdLogArg])
+	assert.Equal(t, created[sessionCreatedLogArg], timedOut[sessionCreatedLogArg])
+	assert.NotEmpty(t, timedOut[sessionAgeLogArg])
+	unknown := logs.find("Login session not found, it was not created by this proxy instance")
+	assert.Equal(t, "87654321", unknown[reqIdLogArg])
+}
+
+func TestOIDCConfigValidate(t *testing.T) {
+	t.Parallel()
+	validConfig := OIDCConfig{
+		BaseURI:          "http://localhost:8000/mock-idp",
+		RedirectURI:      "http://localhost:8001/cli-oidc-redirect",
+		AuthorizationURI: "http://localhost:8000/mock-idp/auth",
+		ClientId:         "client-id",
+	}
+	assert.NoError(t, validConfig.Validate())
+	context, err := NewContextWithValidation(validConfig)
+	assert.NoError(t, err)
+	assert.NotNil(t, context)
+
+	err = OIDCConfig{BaseURI: "http://localhost:8000/mock-idp"}.Validate()
+	assert.ErrorContains(t, err, "ClientId is required")
+	assert.ErrorContains(t, err, "AuthorizationURI is required")
+	assert.ErrorContains(t, err, "RedirectURI is required")
+	assert.NotContains(t, err.Error(), "BaseURI")
+
+	invalidConfig := validConfig
+	invalidConfig.AuthorizationURI = "/mock-idp/auth"
+	invalidConfig.TokenURI = "http://local host:8000/token"
+	invalidConfig.TokenAuthMethod = "jwt"
+	err = invalidConfig.Validate()
+	assert.ErrorContains(t, err, "AuthorizationURI is invalid")
+	assert.ErrorContains(t, err, "TokenURI is invalid")
+	assert.ErrorContains(t, err, "unknown TokenAuthMethod 'jwt'")
+	context, err = NewContextWithValidation(invalidConfig)
+	assert.Error(t, err)
+	assert.Nil(t, context)
+}
+
+func TestContextRequestedLoginTimeout(t *testing.T) {
+	t.Parallel()
+	context := NewContext(OIDCConfig{})
+	context.LoginTimeout = 5 * time.Minute
+	for requestedTimeout, expectedTimeout := range map[string]time.Duration{
+		"":     5 * time.Minute,
+		"60":   time.Minute,
+		"3600": 5 * time.Minute, // clamped to LoginTimeout without MaxLoginTimeout
+		"0":    5 * time.Minute,
+		"-5":   5 * time.Minute,
+		"1m":   5 * time.Minute,
+		// would overflow time.Duration when converted to nanoseconds
+		"9223372037":          5 * time.Minute,
+		"9223372036854775807": 5 * time.Minute,
+	} {
+		assert.Equal(t, expectedTimeout, context.requestedLoginTimeout(requestedTimeout), requestedTimeout)
+	}
+	context.MaxLoginTimeout = 10 * time.Minute
+	assert.Equal(t, 8*time.Minute, context.requestedLoginTimeout("480"))
+	assert.Equal(t, 10*time.Minute, context.requestedLoginTimeout("3600"))
+}
+
+func TestOIDCLoginHandlerUsesRequestedLoginTimeout(t *testing.T) {
+	t.Parallel()
+	context := NewContext(OIDCConfig{
+		BaseURI:          "http://localhost:8000/mock-idp",
+		RedirectURI:      "http://localhost:8001/cli-oidc-redirect",
+		AuthorizationURI: "http://localhost:8000/mock-idp/auth",
+		ClientId:         "client-id",
+		ClientSecret:     "client-secret",
+	})
+	server := httptest.NewServer(OIDCLoginHandler(context))
+	defer server.Close()
+
+	start := time.Now()
+	res, err := http.Get(fmt.Sprint(server.URL, "?login-timeout=1"))
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	event := receiveErrorEvent(t, res.Body, func(authURI string) {})
+	assert.Equal(t, ErrorCodeTimeout, event.Code)
+	assert.Less(t, time.Since(start), 3*time.Second)
+}
+
+func TestContextShutdownFailsPendingLogins(t *testing.T) {
+	t.Parallel()
+	context := NewContext(OIDCConfig{
+		BaseURI:          "http://localhost:8000/mock-idp",
+		RedirectURI:      "http://localhost:8001/cli-oidc-redirect",
+		AuthorizationURI: "http://localhost:8000/mock-idp/auth",
+		ClientId:         "client-id",
+		ClientSecret:     "client-secret",
+	})
+	server := httptest.NewServer(OIDCLoginHandler(context))
+	defer server.Close()
+
+	responses := []*http.Response{}
+	for i := 0; i < 3; i++ {
+		res, err := http.Get(server.URL)
+		assert.NoError(t, err)
+		defer res.Body.Close()
+		receiveAuthURI(t, res.Body)
+		responses = append(responses, res)
+	}
+
+	shutdownCtx, cancel := stdcontext.WithTimeout(stdcontext.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, context.Shutdown(shutdownCtx))
+	for _, res := range responses {
+		var events []string
+		_ = consumeSSEFromHTTPEventStream(res.Body, func(event, data string) error {
+			events = append(events, event)
+			assert.Contains(t, data, "proxy is shutting down")
+			return nil
+		})
+		assert.Equal(t, []string{eventError}, events)
+	}
+
+	res, err := http.Get(server.URL)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+}
+
+// Concurrency safe writer of JSON log records.
+type logRecorder struct {
+	buffer bytes.Buffer
+	mutex  sync.Mutex
+}
+
+func (recorder *logRecorder) Write(p []byte) (int, error) {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	return recorder.buffer.Write(p)
+}
+
+// Returns all recorded log records.
+func (recorder *logRecorder) records() []map[string]any {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	records := []map[string]any{}
+	for _, line := range strings.Split(strings.TrimSpace(recorder.buffer.String()), "\n") {
+		var record map[string]any
+		if err := json.Unmarshal([]byte(line), &record); err == nil {
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+// Returns the first log record with given message or an empty record.
+func (recorder *logRecorder) find(msg string) map[string]any {
+	for _, record := range recorder.records() {
+		if record["msg"] == msg {
+			return record
+		}
+	}
+	return map[string]any{}
+}
+
+func TestContextCloseRemovesLoginsAndRejectsNewLogins(t *testing.T) {
+	t.Parallel()
+	context := NewContext(OIDCConfig{
+		BaseURI:          "http://localhost:8000/mock-idp",
+		RedirectURI:      "http://localhost:8001/cli-oidc-redirect",
+		AuthorizationURI: "http://localhost:8000/mock-idp/auth",
+		ClientId:         "client-id",
+	})
+	results := make(chan *loginResult, 1)
+	go context.initiateLogin("12345678", func(loginResult *loginResult) { results <- loginResult })
+	for !context.hasLogin("12345678") {
+		time.Sleep(time.Millisecond)
+	}
+	// session without login handler waiting for it
+	_, err := context.createLogin("87654321", context.config, "", context.LoginTimeout)
+	assert.NoError(t, err)
+
+	context.Close()
+	assert.ErrorIs(t, (<-results).err, errShuttingDown)
+	context.requestsMutex.RLock()
+	assert.Empty(t, context.requests)
+	assert.Empty(t, context.endedRequests)
+	context.requestsMutex.RUnlock()
+
+	_, err = context.createLogin("11111111", context.config, "", context.LoginTimeout)
+	assert.ErrorIs(t, err, errShuttingDown)
+	server := httptest.NewServer(OIDCLoginHandler(context))
+	defer server.Close()
+	res, err := http.Get(server.URL)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+}
+
+func TestContextPendingLoginsAndStats(t *testing.T) {
+	t.Parallel()
+	context := NewContext(OIDCConfig{})
+	context.LoginTimeout = 50 * time.Millisecond
+	assert.Equal(t, 0, context.PendingLogins())
+	loginsDone := &sync.WaitGroup{}
+	for _, reqId := range []string{"11111111", "22222222", "33333333"} {
+		loginsDone.Add(1)
+		go func(reqId string) {
+			defer loginsDone.Done()
+			_ = context.initiateLogin(reqId, func(loginResult *loginResult) {})
+		}(reqId)
+		for !context.hasLogin(reqId) {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	assert.Equal(t, 3, context.PendingLogins())
+	assert.Equal(t, LoginStats{Initiated: 3}, context.Stats())
+
+	assert.NoError(t, context.onLoginSuccess("11111111", &tokenResponse{AccessToken: "mock-access-token"}))
+	context.onLoginError("22222222", errors.New("mock error"))
+	assert.Equal(t, 1, context.PendingLogins())
+	loginsDone.Wait() // the third login times out
+	assert.Equal(t, 0, context.PendingLogins())
+	assert.Equal(t, LoginStats{Initiated: 3, Succeeded: 1, Failed: 1, TimedOut: 1}, context.Stats())
+}
+
+func TestOIDCLoginHandlerUsesStateGenerator(t *testing.T) {
+	t.Parallel()
+	oidcConfig := OIDCConfig{
+		RedirectURI:      "http://localhost:8001/cli-oidc-redirect",
+		AuthorizationURI: "http://localhost:8000/mock-idp/auth",
+		ClientId:         "mock-client-id",
+		ClientSecret:     "mock-client-secret",
+	}
+	mockOIDCServer := createMockOIDCServer("mock-auth-code", oidcConfig.ClientId, oidcConfig.ClientSecret, oidcConfig.RedirectURI)
+	defer mockOIDCServer.Close()
+	oidcConfig.BaseURI = mockOIDCServer.URL
+	context := NewContext(oidcConfig)
+	generated := 0
+	context.StateGenerator = func() (string, error) {
+		generated++
+		return fmt.Sprintf("external-session-%d", generated), nil
+	}
+	loginServer := httptest.NewServer(OIDCLoginHandler(context))
+	defer loginServer.Close()
+	redirectServer := httptest.NewServer(OIDCRedirectHandler(context))
+	defer redirectServer.Close()
+
+	res, err := http.Get(loginServer.URL)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	events := []string{}
+	_ = consumeSSEFromHTTPEventStream(res.Body, func(event, data string) error {
+		events = append(events, event)
+		if event == eventAuthURI {
+			assert.Equal(t, "external-session-1", receivedState(t, data))
+			_, err := http.Get(fmt.Sprint(redirectServer.URL, "?state=external-session-1&code=mock-auth-code"))
+			assert.NoError(t, err)
+		} else if event == eventLoggedIn {
+			assert.Contains(t, data, "mock-access-token")
+		}
+		return nil
+	})
+	assert.Equal(t, []string{eventAuthURI, eventLoggedIn}, events)
+}
+
+func TestOIDCLoginHandlerRejectsDuplicateGeneratedState(t *testing.T) {
+	t.Parallel()
+	context := NewContext(OIDCConfig{
+		BaseURI:          "http://localhost:8000/mock-idp",
+		RedirectURI:      "http://localhost:8001/cli-oidc-redirect",
+		AuthorizationURI: "http://localhost:8000/mock-idp/auth",
+		ClientId:         "mock-client-id",
+	})
+	context.StateGenerator = func() (string, error) { return "fixed-session", nil }
+	server := httptest.NewServer(OIDCLoginHandler(context))
+	defer server.Close()
+	defer context.Close()
+
+	pendingRes, err := http.Get(server.URL)
+	assert.NoError(t, err)
+	defer pendingRes.Body.Close()
+	assert.Equal(t, "fixed-session", receiveAuthURI(t, pendingRes.Body).Query().Get("state"))
+
+	res, err := http.Get(server.URL)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusInternalServerError, res.StatusCode)
+	event := receiveErrorEvent(t, res.Body, func(authURI string) {
+		t.Error("Authorization URI of duplicate login was sent")
+	})
+	assert.Equal(t, ErrorCodeInternalError, event.Code)
+	assert.Equal(t, 1, context.PendingLogins())
+}
+
+func TestInitiateLoginDoesNotReplaceLoginWithCollidingReqId(t *testing.T) {
+	t.Parallel()
+	context := NewContext(OIDCConfig{})
+	context.StateGenerator = func() (string, error) { return "colliding-state", nil }
+	firstReqId, err := context.newReqId()
+	assert.NoError(t, err)
+	results := make(chan *loginResult, 1)
+	go func() {
+		_ = context.initiateLogin(firstReqId, func(loginResult *loginResult) { results <- loginResult })
+	}()
+	for !context.hasLogin(firstReqId) {
+		time.Sleep(time.Millisecond)
+	}
+
+	secondReqId, err := context.newReqId()
+	assert.NoError(t, err)
+	err = context.initiateLogin(secondReqId, func(loginResult *loginResult) {
+		t.Error("Login with colliding request id received a result")
+	})
+	assert.ErrorIs(t, err, errDuplicateReqId)
+	assert.Equal(t, 1, context.PendingLogins())
+
+	// redirect of the first login is still delivered to it
+	assert.NoError(t, context.onLoginSuccess(firstReqId, &tokenResponse{AccessToken: "mock-access-token"}))
+	result := <-results
+	assert.NoError(t, result.err)
+	assert.Equal(t, "mock-access-token", result.accessToken)
+	assert.Equal(t, LoginStats{Initiated: 1, Succeeded: 1}, context.Stats())
+}
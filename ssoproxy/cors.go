@@ -0,0 +1,35 @@
+package ssoproxy
+
+import (
+	"net/http"
+	"slices"
+)
+
+// Adds CORS headers to response if request's origin is in Context.AllowedOrigins and handles
+// preflight requests. Returns true if the request was a preflight request and was already responded.
+// Does nothing if Context.AllowedOrigins is empty.
+func handleCORS(w http.ResponseWriter, r *http.Request, ctx *Context) bool {
+	if len(ctx.AllowedOrigins) == 0 {
+		return false
+	}
+	origin := r.Header.Get("Origin")
+	allowed := origin != "" && (slices.Contains(ctx.AllowedOrigins, origin) || slices.Contains(ctx.AllowedOrigins, "*"))
+	w.Header().Add("Vary", "Origin")
+	if allowed {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+	}
+	if r.Method != http.MethodOptions || r.Header.Get("Access-Control-Request-Method") == "" {
+		return false
+	}
+	if !allowed {
+		ctx.Logger.Warn("Rejected CORS preflight request from not allowed origin", "origin", origin)
+		w.WriteHeader(http.StatusForbidden)
+		return true
+	}
+	w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+	if requestHeaders := r.Header.Get("Access-Control-Request-Headers"); requestHeaders != "" {
+		w.Header().Set("Access-Control-Allow-Headers", requestHeaders)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
@@ -0,0 +1,76 @@
+package ssoproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOIDCLoginHandlerCORS(t *testing.T) {
+	t.Parallel()
+	context := NewContext(OIDCConfig{
+		BaseURI:          "http://localhost:8000/mock-idp",
+		RedirectURI:      "http://localhost:8001/cli-oidc-redirect",
+		AuthorizationURI: "http://localhost:8000/mock-idp/auth",
+		ClientId:         "client-id",
+		ClientSecret:     "client-secret",
+	})
+	context.LoginTimeout = 10 * time.Millisecond
+	context.AllowedOrigins = []string{"https://tool.example.com"}
+	server := httptest.NewServer(OIDCLoginHandler(context))
+	defer server.Close()
+
+	tests := []struct {
+		name          string
+		method        string
+		origin        string
+		statusCode    int
+		allowedOrigin string
+	}{
+		{name: "allowed origin", method: http.MethodGet, origin: "https://tool.example.com", statusCode: http.StatusOK, allowedOrigin: "https://tool.example.com"},
+		{name: "disallowed origin", method: http.MethodGet, origin: "https://evil.example.com", statusCode: http.StatusOK},
+		{name: "preflight", method: http.MethodOptions, origin: "https://tool.example.com", statusCode: http.StatusNoContent, allowedOrigin: "https://tool.example.com"},
+		{name: "disallowed preflight", method: http.MethodOptions, origin: "https://evil.example.com", statusCode: http.StatusForbidden},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req, _ := http.NewRequest(test.method, server.URL, nil)
+			req.Header.Set("Origin", test.origin)
+			if test.method == http.MethodOptions {
+				req.Header.Set("Access-Control-Request-Method", http.MethodGet)
+			}
+			res, err := http.DefaultClient.Do(req)
+			assert.NoError(t, err)
+			defer res.Body.Close()
+			assert.Equal(t, test.statusCode, res.StatusCode)
+			assert.Equal(t, test.allowedOrigin, res.Header.Get("Access-Control-Allow-Origin"))
+			if test.statusCode == http.StatusNoContent {
+				assert.Contains(t, res.Header.Get("Access-Control-Allow-Methods"), http.MethodGet)
+			}
+		})
+	}
+}
+
+func TestOIDCLoginHandlerWontSendCORSHeadersByDefault(t *testing.T) {
+	t.Parallel()
+	context := NewContext(OIDCConfig{
+		BaseURI:          "http://localhost:8000/mock-idp",
+		RedirectURI:      "http://localhost:8001/cli-oidc-redirect",
+		AuthorizationURI: "http://localhost:8000/mock-idp/auth",
+		ClientId:         "client-id",
+		ClientSecret:     "client-secret",
+	})
+	context.LoginTimeout = 10 * time.Millisecond
+	server := httptest.NewServer(OIDCLoginHandler(context))
+	defer server.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	req.Header.Set("Origin", "https://tool.example.com")
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Empty(t, res.Header.Get("Access-Control-Allow-Origin"))
+}
@@ -0,0 +1,76 @@
+package ssoproxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiscoverOIDCAndCreateConfig(t *testing.T) {
+	t.Parallel()
+	mockOIDCServer := createMockDiscoveryServer()
+	defer mockOIDCServer.Close()
+
+	metadata, err := DiscoverOIDC(fmt.Sprint(mockOIDCServer.URL, "/realms/test/"), nil)
+	require.NoError(t, err)
+	assert.Equal(t, fmt.Sprint(mockOIDCServer.URL, "/realms/test"), metadata.Issuer)
+	assert.Equal(t, fmt.Sprint(mockOIDCServer.URL, "/realms/test/auth"), metadata.AuthorizationEndpoint)
+	assert.Equal(t, fmt.Sprint(mockOIDCServer.URL, "/realms/test/token"), metadata.TokenEndpoint)
+	assert.Equal(t, fmt.Sprint(mockOIDCServer.URL, "/realms/test/auth/device"), metadata.DeviceAuthorizationEndpoint)
+	assert.Equal(t, fmt.Sprint(mockOIDCServer.URL, "/realms/test/logout"), metadata.EndSessionEndpoint)
+
+	config, err := NewOIDCConfigFromMetadata(metadata, "http://localhost:8001/cli-oidc-redirect", "mock-client-id", "mock-client-secret")
+	require.NoError(t, err)
+	assert.Equal(t, metadata.TokenEndpoint, config.TokenURI)
+	assert.Equal(t, metadata.EndSessionEndpoint, config.EndSessionURI)
+	authURI, err := url.Parse(config.AuthorizationURI)
+	require.NoError(t, err)
+	assert.Equal(t, "/realms/test/auth", authURI.Path)
+	assert.Equal(t, "code", authURI.Query().Get("response_type"))
+	assert.Equal(t, "mock-client-id", authURI.Query().Get("client_id"))
+	assert.Equal(t, "http://localhost:8001/cli-oidc-redirect", authURI.Query().Get("redirect_uri"))
+}
+
+func TestDiscoverOIDCFailsOnMissingDocument(t *testing.T) {
+	t.Parallel()
+	mockOIDCServer := createMockDiscoveryServer()
+	defer mockOIDCServer.Close()
+
+	_, err := DiscoverOIDC(fmt.Sprint(mockOIDCServer.URL, "/realms/unknown"), nil)
+	assert.Error(t, err)
+}
+
+func TestValidateScopesReportsUnsupportedScope(t *testing.T) {
+	t.Parallel()
+	mockOIDCServer := createMockDiscoveryServer()
+	defer mockOIDCServer.Close()
+
+	metadata, err := DiscoverOIDC(fmt.Sprint(mockOIDCServer.URL, "/realms/test"), nil)
+	require.NoError(t, err)
+	assert.NoError(t, metadata.ValidateScopes("openid", "offline_access"))
+	err = metadata.ValidateScopes("openid", "offline-access")
+	assert.ErrorContains(t, err, "scopes 'offline-access' are not supported")
+	// IdPs that don't advertise supported scopes are not validated
+	assert.NoError(t, (&OIDCMetadata{}).ValidateScopes("offline-access"))
+}
+
+func createMockDiscoveryServer() *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/realms/test/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		issuer := fmt.Sprintf("http://%s/realms/test", r.Host)
+		_, _ = w.Write([]byte(fmt.Sprintf(`{
+			"issuer": "%[1]s",
+			"authorization_endpoint": "%[1]s/auth",
+			"token_endpoint": "%[1]s/token",
+			"device_authorization_endpoint": "%[1]s/auth/device",
+			"end_session_endpoint": "%[1]s/logout",
+			"scopes_supported": ["openid", "profile", "offline_access"]
+		}`, issuer)))
+	})
+	return httptest.NewServer(mux)
+}
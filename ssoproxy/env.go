@@ -0,0 +1,32 @@
+package ssoproxy
+
+import (
+	"errors"
+	"os"
+	"strings"
+)
+
+// Reads OIDC configuration from standard environment variables, so deployments name them the same way:
+//
+//	OIDC_BASE_URI, OIDC_REDIRECT_URI, OIDC_AUTHORIZATION_URI, OIDC_CLIENT_ID // required
+//	OIDC_CLIENT_SECRET, OIDC_TOKEN_URI, OIDC_END_SESSION_URI, OIDC_REVOCATION_URI // optional
+//	OIDC_SCOPES // optional space separated scopes, see OIDCConfig.Scopes
+//
+// The config is validated with OIDCConfig.Validate, missing or invalid variables are returned joined.
+func OIDCConfigFromEnv() (OIDCConfig, error) {
+	config := OIDCConfig{
+		BaseURI:          os.Getenv("OIDC_BASE_URI"),
+		RedirectURI:      os.Getenv("OIDC_REDIRECT_URI"),
+		AuthorizationURI: os.Getenv("OIDC_AUTHORIZATION_URI"),
+		ClientId:         os.Getenv("OIDC_CLIENT_ID"),
+		ClientSecret:     os.Getenv("OIDC_CLIENT_SECRET"),
+		TokenURI:         os.Getenv("OIDC_TOKEN_URI"),
+		EndSessionURI:    os.Getenv("OIDC_END_SESSION_URI"),
+		RevocationURI:    os.Getenv("OIDC_REVOCATION_URI"),
+		Scopes:           strings.Fields(os.Getenv("OIDC_SCOPES")),
+	}
+	if err := config.Validate(); err != nil {
+		return OIDCConfig{}, errors.Join(errors.New("invalid OIDC config in environment variables"), err)
+	}
+	return config, nil
+}
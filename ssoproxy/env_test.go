@@ -0,0 +1,45 @@
+package ssoproxy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOIDCConfigFromEnv(t *testing.T) {
+	t.Setenv("OIDC_BASE_URI", "http://localhost:8000/mock-idp")
+	t.Setenv("OIDC_REDIRECT_URI", "http://localhost:8001/cli-oidc-redirect")
+	t.Setenv("OIDC_AUTHORIZATION_URI", "http://localhost:8000/mock-idp/auth")
+	t.Setenv("OIDC_CLIENT_ID", "client-id")
+	t.Setenv("OIDC_CLIENT_SECRET", "client-secret")
+	t.Setenv("OIDC_END_SESSION_URI", "http://localhost:8000/mock-idp/logout")
+	t.Setenv("OIDC_SCOPES", "profile  email")
+	t.Setenv("OIDC_TOKEN_URI", "")
+	t.Setenv("OIDC_REVOCATION_URI", "")
+
+	config, err := OIDCConfigFromEnv()
+	assert.NoError(t, err)
+	assert.Equal(t, OIDCConfig{
+		BaseURI:          "http://localhost:8000/mock-idp",
+		RedirectURI:      "http://localhost:8001/cli-oidc-redirect",
+		AuthorizationURI: "http://localhost:8000/mock-idp/auth",
+		ClientId:         "client-id",
+		ClientSecret:     "client-secret",
+		EndSessionURI:    "http://localhost:8000/mock-idp/logout",
+		Scopes:           []string{"profile", "email"},
+	}, config)
+}
+
+func TestOIDCConfigFromEnvRejectsIncompleteEnv(t *testing.T) {
+	t.Setenv("OIDC_BASE_URI", "http://localhost:8000/mock-idp")
+	t.Setenv("OIDC_REDIRECT_URI", "")
+	t.Setenv("OIDC_AUTHORIZATION_URI", "")
+	t.Setenv("OIDC_CLIENT_ID", "")
+	t.Setenv("OIDC_TOKEN_URI", "/token")
+
+	_, err := OIDCConfigFromEnv()
+	assert.ErrorContains(t, err, "ClientId is required")
+	assert.ErrorContains(t, err, "RedirectURI is required")
+	assert.ErrorContains(t, err, "AuthorizationURI is required")
+	assert.ErrorContains(t, err, "TokenURI is invalid")
+}
@@ -0,0 +1,103 @@
+package ssoproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// User did not log in within Context.LoginTimeout.
+const ErrorCodeTimeout = "timeout"
+
+// User denied consent or access at IdP, IdP redirected with error "access_denied".
+const ErrorCodeAccessDenied = "access_denied"
+
+// IdP redirected with an error other than "access_denied".
+const ErrorCodeIdPError = "idp_error"
+
+// Tokens could not be retrieved from IdP or are not valid for the login.
+const ErrorCodeTokenExchangeFailed = "token_exchange_failed"
+
+// Tokens could not be refreshed in token stream or a resumed login is not pending anymore, user has to log in again.
+const ErrorCodeExpiredSession = "expired_session"
+
+// Login was rejected, because proxy has too many pending logins or is shutting down.
+const ErrorCodeUnavailable = "unavailable"
+
+// Client exceeded Context.LoginRateLimit.
+const ErrorCodeRateLimited = "rate_limited"
+
+// Login request is not valid.
+const ErrorCodeInvalidRequest = "invalid_request"
+
+// Unexpected error of the proxy.
+const ErrorCodeInternalError = "internal_error"
+
+// Fixed descriptions of error codes shown to users, e.g. on the failed redirect landing page.
+var errorCodeDescriptions = map[string]string{
+	ErrorCodeTimeout:             "Login timed out, start a new login",
+	ErrorCodeAccessDenied:        "Access was denied by the identity provider",
+	ErrorCodeIdPError:            "Identity provider reported an error",
+	ErrorCodeTokenExchangeFailed: "Tokens could not be retrieved from the identity provider",
+	ErrorCodeExpiredSession:      "Login session expired, start a new login",
+	ErrorCodeUnavailable:         "Login service is temporarily unavailable",
+	ErrorCodeRateLimited:         "Too many logins, try again later",
+	ErrorCodeInvalidRequest:      "Login request is not valid",
+	ErrorCodeInternalError:       "An error was encountered while serving the request",
+}
+
+// Returns fixed description of error code, unknown codes are described as internal errors.
+func errorCodeDescription(code string) string {
+	if description, found := errorCodeDescriptions[code]; found {
+		return description
+	}
+	return errorCodeDescriptions[ErrorCodeInternalError]
+}
+
+// Data of "error" login event.
+type errorEvent struct {
+	// Machine-readable error code, one of ErrorCode* constants
+	Code string `json:"code"`
+	// Human readable error description
+	Message string `json:"message"`
+}
+
+// Error of a login with error code sent to client.
+type loginError struct {
+	code string
+	err  error
+}
+
+func (err *loginError) Error() string {
+	return err.err.Error()
+}
+
+func (err *loginError) Unwrap() error {
+	return err.err
+}
+
+// Creates login error with error code sent to client.
+func newLoginError(code string, err error) error {
+	return &loginError{code: code, err: err}
+}
+
+// Returns error code of a login error, errors without code are internal errors.
+func loginErrorCode(err error) string {
+	var loginErr *loginError
+	if errors.As(err, &loginErr) {
+		return loginErr.code
+	}
+	return ErrorCodeInternalError
+}
+
+// Sends "error" login event with error code and message as JSON, id is resume token of the login or empty
+// if the error occurred before a login was created. Request id is sent to IdP as state, so it is never an event id.
+func sendErrorEvent(w http.ResponseWriter, ctx *Context, id, code, message string) {
+	eventData, err := json.Marshal(errorEvent{Code: code, Message: message})
+	if err != nil {
+		ctx.Logger.Error(fmt.Sprintf("Could not marshal error event to JSON: %v", err))
+		eventData = []byte(fmt.Sprintf(`{"code":"%s","message":"Failed to generate error event"}`, ErrorCodeInternalError))
+	}
+	sendSSEEvent(w, ctx, id, string(eventData), ctx.ErrorEvent)
+}
@@ -0,0 +1,102 @@
+package ssoproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOIDCLoginHandlerSendsErrorCodes(t *testing.T) {
+	t.Parallel()
+	mockOIDCServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+	}))
+	defer mockOIDCServer.Close()
+	tests := []struct {
+		name          string
+		loginQuery    string
+		redirectQuery string
+		tokens        *tokenResponse
+		code          string
+	}{
+		{name: "timeout", code: ErrorCodeTimeout},
+		{name: "access denied", redirectQuery: "error=access_denied", code: ErrorCodeAccessDenied},
+		{name: "IdP error", redirectQuery: "error=server_error", code: ErrorCodeIdPError},
+		{name: "token exchange failed", redirectQuery: "code=mock-auth-code", code: ErrorCodeTokenExchangeFailed},
+		{
+			name:       "expired session",
+			loginQuery: "token-stream=true",
+			tokens:     &tokenResponse{AccessToken: "mock-access-token", ExpiresIn: 600},
+			code:       ErrorCodeExpiredSession,
+		},
+		{name: "invalid request", loginQuery: "login_hint=%00", code: ErrorCodeInvalidRequest},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			context := NewContext(OIDCConfig{
+				BaseURI:          mockOIDCServer.URL,
+				RedirectURI:      "http://localhost:8001/cli-oidc-redirect",
+				AuthorizationURI: "http://localhost:8000/mock-idp/auth",
+				ClientId:         "client-id",
+				ClientSecret:     "client-secret",
+			})
+			context.LoginTimeout = 100 * time.Millisecond
+			context.TokenStream = true
+			loginServer := httptest.NewServer(OIDCLoginHandler(context))
+			defer loginServer.Close()
+			redirectServer := httptest.NewServer(OIDCRedirectHandler(context))
+			defer redirectServer.Close()
+
+			res, err := http.Get(fmt.Sprint(loginServer.URL, "?", test.loginQuery))
+			assert.NoError(t, err)
+			defer res.Body.Close()
+			event := receiveErrorEvent(t, res.Body, func(authURI string) {
+				reqId := receivedState(t, authURI)
+				if test.redirectQuery != "" {
+					_, err := http.Get(fmt.Sprint(redirectServer.URL, "?state=", reqId, "&", test.redirectQuery))
+					assert.NoError(t, err)
+				} else if test.tokens != nil {
+					assert.NoError(t, context.onLoginSuccess(reqId, test.tokens))
+				}
+			})
+			assert.Equal(t, test.code, event.Code)
+			assert.NotEmpty(t, event.Message)
+		})
+	}
+}
+
+func TestLoginErrorCode(t *testing.T) {
+	t.Parallel()
+	err := fmt.Errorf("login failed: %w", newLoginError(ErrorCodeTimeout, errors.New("timed out")))
+	assert.Equal(t, ErrorCodeTimeout, loginErrorCode(err))
+	assert.Equal(t, ErrorCodeInternalError, loginErrorCode(errors.New("unknown error")))
+}
+
+// Reads login events until an "error" event is received and returns its data,
+// onAuthURI is called with data of "auth-uri" event.
+func receiveErrorEvent(t *testing.T, httpBody io.ReadCloser, onAuthURI func(authURI string)) errorEvent {
+	var received *errorEvent
+	_ = consumeSSEFromHTTPEventStream(httpBody, func(event, data string) error {
+		if event == eventAuthURI {
+			onAuthURI(data)
+		} else if event == eventError {
+			received = &errorEvent{}
+			assert.NoError(t, json.Unmarshal([]byte(data), received))
+			return errors.New("stop consuming events")
+		}
+		return nil
+	})
+	if received == nil {
+		t.Fatal("Error event was not received")
+	}
+	return *received
+}
@@ -0,0 +1,51 @@
+package ssoproxy
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strings"
+)
+
+// Reports whether client accepts gzip encoded responses according to its Accept-Encoding header.
+func acceptsGzip(r *http.Request) bool {
+	for _, encoding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(encoding), ";")
+		if strings.EqualFold(strings.TrimSpace(name), "gzip") && strings.ReplaceAll(params, " ", "") != "q=0" {
+			return true
+		}
+	}
+	return false
+}
+
+// Response writer compressing login event stream with gzip, Flush sends events written so far to client.
+// Close must be called after the handler finishes writing to end the gzip stream.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	writer *gzip.Writer
+}
+
+func newGzipResponseWriter(w http.ResponseWriter) *gzipResponseWriter {
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Add("Vary", "Accept-Encoding")
+	w.Header().Del("Content-Length")
+	return &gzipResponseWriter{ResponseWriter: w, writer: gzip.NewWriter(w)}
+}
+
+func (gw *gzipResponseWriter) Write(data []byte) (int, error) {
+	return gw.writer.Write(data)
+}
+
+func (gw *gzipResponseWriter) Flush() {
+	// errors of writing to client are reported by the next write
+	_ = gw.writer.Flush()
+	_ = http.NewResponseController(gw.ResponseWriter).Flush()
+}
+
+func (gw *gzipResponseWriter) Close() error {
+	return gw.writer.Close()
+}
+
+// Returns wrapped response writer, so http.ResponseController can reach it.
+func (gw *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return gw.ResponseWriter
+}
@@ -0,0 +1,90 @@
+package ssoproxy
+
+import (
+	"compress/gzip"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOIDCLoginHandlerCompressesStream(t *testing.T) {
+	t.Parallel()
+	context := NewContext(OIDCConfig{
+		BaseURI:          "http://localhost:8000/mock-idp",
+		RedirectURI:      "http://localhost:8001/cli-oidc-redirect",
+		AuthorizationURI: "http://localhost:8000/mock-idp/auth",
+		ClientId:         "client-id",
+	})
+	context.CompressStream = true
+	server := httptest.NewServer(OIDCLoginHandler(context))
+	defer server.Close()
+
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	require.NoError(t, err)
+	// header set explicitly, so the client does not decompress the response itself
+	req.Header.Set("Accept-Encoding", "gzip")
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, "gzip", res.Header.Get("Content-Encoding"))
+	body, err := gzip.NewReader(res.Body)
+	require.NoError(t, err)
+
+	events := []string{}
+	_ = consumeSSEFromHTTPEventStream(body, func(event, data string) error {
+		events = append(events, event)
+		if event == eventAuthURI {
+			// auth URI must be flushed through gzip writer while the login is pending
+			_ = context.onLoginSuccess(receivedState(t, data), &tokenResponse{AccessToken: "mock-access-token"})
+		} else if event == eventLoggedIn {
+			assert.Contains(t, data, "mock-access-token")
+		}
+		return nil
+	})
+	assert.Equal(t, []string{eventAuthURI, eventLoggedIn}, events)
+}
+
+func TestOIDCLoginHandlerDoesNotCompressStreamByDefault(t *testing.T) {
+	t.Parallel()
+	context := NewContext(OIDCConfig{
+		BaseURI:          "http://localhost:8000/mock-idp",
+		RedirectURI:      "http://localhost:8001/cli-oidc-redirect",
+		AuthorizationURI: "http://localhost:8000/mock-idp/auth",
+		ClientId:         "client-id",
+	})
+	server := httptest.NewServer(OIDCLoginHandler(context))
+	defer server.Close()
+	defer context.Close()
+
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept-Encoding", "gzip")
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	assert.Empty(t, res.Header.Get("Content-Encoding"))
+	_ = consumeSSEFromHTTPEventStream(res.Body, func(event, data string) error {
+		assert.Equal(t, eventAuthURI, event)
+		return errors.New("stop consuming events")
+	})
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	t.Parallel()
+	for acceptEncoding, expected := range map[string]bool{
+		"":                     false,
+		"gzip":                 true,
+		"deflate, GZIP":        true,
+		"br;q=1.0, gzip;q=0.5": true,
+		"gzip;q=0":             false,
+		"identity":             false,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/cli-login", nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		assert.Equal(t, expected, acceptsGzip(req), acceptEncoding)
+	}
+}
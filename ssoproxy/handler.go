@@ -2,116 +2,433 @@ package ssoproxy
 
 import (
 	"crypto/rand"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
 )
 
 type tokensEvent struct {
-	AccessToken  string `json:"access_token"`
-	RefreshToken string `json:"refresh_token"`
-	Expiration   int    `json:"expiration"`
+	AccessToken  string          `json:"access_token"`
+	RefreshToken string          `json:"refresh_token"`
+	Expiration   int             `json:"expiration"`
+	TokenType    string          `json:"token_type,omitempty"`
+	Scope        string          `json:"scope,omitempty"`
+	RawResponse  json.RawMessage `json:"raw_response,omitempty"`
 }
 
 type tokenResponse struct {
-	RefreshToken string `json:"refresh_token"`
-	AccessToken  string `json:"access_token"`
-	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string           `json:"refresh_token"`
+	AccessToken  string           `json:"access_token"`
+	ExpiresIn    expiresInSeconds `json:"expires_in"`
+	IDToken      string           `json:"id_token"`
+	TokenType    string           `json:"token_type"`
+	Scope        string           `json:"scope"`
+	// whole response body
+	raw json.RawMessage
 }
 
-const reqIdLength = 8
+// Lifetime of tokens in seconds received in expires_in field. Some IdPs send it as a JSON string
+// instead of a number, both are accepted and a missing or null value means unknown lifetime (zero).
+type expiresInSeconds int
+
+func (seconds *expiresInSeconds) UnmarshalJSON(data []byte) error {
+	value := strings.Trim(string(data), `"`)
+	if value == "" || value == "null" {
+		*seconds = 0
+		return nil
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		return fmt.Errorf("invalid expires_in value %s: %w", data, err)
+	}
+	*seconds = expiresInSeconds(parsed)
+	return nil
+}
+
+type tokenErrorResponse struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+const minReqIdLength = 8
 const reqIdLogArg = "req-id"
+const sessionCreatedLogArg = "session-created-at"
+const sessionAgeLogArg = "session-age"
 
 const eventAuthURI = "auth-uri"
 const eventLoggedIn = "logged-in"
+const eventTokensRefreshed = "oidc-tokens"
 const eventError = "error"
 
+// header of login request with id of the last event the client received, it resumes the login with this request id
+const lastEventIdHeader = "Last-Event-ID"
+
+// query parameter of login request that asks the proxy to keep refreshing tokens after login
+const tokenStreamParam = "token-stream"
+
+// query parameter of login request with login timeout in seconds requested by client
+const loginTimeoutParam = "login-timeout"
+
+// query parameter of login request with login hint forwarded to IdP in authorization URI
+const loginHintParam = "login_hint"
+
+// query parameter of login and logout request with name of provider in Context.Providers
+const providerParam = "provider"
+
+// query parameter of login request with redirect URI requested by client, one of OIDCConfig.AllowedRedirectURIs
+const redirectURIParam = "redirect-uri"
+
+// maximum length of login hint accepted from client
+const maxLoginHintLength = 256
+
+// query parameters of redirect URIs with result of handled IdP redirect, added if Context.RedirectResultParams is enabled
+const redirectStatusParam = "status"
+const redirectStatusSuccess = "success"
+const redirectErrorParam = "error"
+const redirectErrorDescriptionParam = "error_description"
+
+// OAuth error of IdP redirect when user denied consent or access (RFC 6749 section 4.1.2.1)
+const idpErrorAccessDenied = "access_denied"
+
 // Handles login process from an application. Sends text/event-stream response and
 // writes Server-Sent Events to it during the login process.
 // OIDCRedirectHandler must be used with this handler.
 //
-// Events can be of 3 types:
+// Events can be of 4 types:
 //
 //	"auth-uri" // data = "https://some-sso.com/auth"
-//	"logged-in" // data = `{"access_token": "access", "refresh_token": "refresh", "expires_in": 3600}` as JSON
-//	"error" // data = "Error description"
+//	"logged-in" // data = `{"access_token": "access", "refresh_token": "refresh", "expiration": 3600}` as JSON,
+//	            // "token_type" and "scope" are added if returned by IdP, "raw_response" contains
+//	            // the whole token endpoint response if Context.ForwardRawResponse is enabled
+//	"oidc-tokens" // data = same as "logged-in", sent after each token refresh in token stream mode
+//	"error" // data = `{"code": "timeout", "message": "Error description"}` as JSON, code is one of ErrorCode* constants
+//
+// Names of "auth-uri", "logged-in" and "error" events can be changed with Context.AuthURIEvent,
+// Context.TokensEvent and Context.ErrorEvent to match an existing client.
+// If the login request has query parameter "login_hint", e.g. user's username or email,
+// it is forwarded to IdP as "login_hint" parameter of the authorization URI.
+// Query parameter "login-timeout" can shorten login timeout to given number of seconds, or prolong it
+// up to Context.MaxLoginTimeout.
+// Query parameter "provider" selects IdP configuration from Context.Providers, unknown provider is rejected
+// with status 400 and an "error" event.
+// If Context.TokenStream is enabled and the login request has query parameter "token-stream=true",
+// the stream is kept open after login and the proxy refreshes tokens before they expire.
+// If Context.AllowedOrigins is set, CORS headers are added for allowed origins and preflight requests are answered.
+// If Context.MaxPendingLogins logins are already pending or the proxy is shutting down,
+// responds with status 503 and an "error" event.
+// If client IP exceeded Context.LoginRateLimit, responds with status 429 and an "error" event.
+// If Context.CompressStream is enabled and the client sends "Accept-Encoding: gzip", the stream is gzip compressed.
+// Events of a login have SSE "id" set to a random resume token known only to the client. If the login stream
+// drops while the login is pending, the client can reconnect with header "Last-Event-ID" to resume the login,
+// events that were not sent yet are then sent to the new stream instead of starting a new login. Resuming a login
+// that is not pending is rejected with status 404, resuming a login whose stream is still open with status 409,
+// both with an "error" event. Resumes count towards Context.LoginRateLimit.
 func OIDCLoginHandler(ctx *Context) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if handleCORS(w, r, ctx) {
+			return
+		}
+		if ctx.CompressStream && acceptsGzip(r) {
+			gw := newGzipResponseWriter(w)
+			defer gw.Close()
+			w = gw
+		}
 		// Set proper SSE headers
 		w.Header().Set("Content-Type", "text/event-stream")
 		w.Header().Set("Cache-Control", "no-cache")
 		w.Header().Set("Connection", "keep-alive")
 
-		reqId, err := generateReqId()
+		// resumes are rate limited too, so resume tokens can't be guessed by flooding the proxy
+		if !ctx.allowLogin(r) {
+			ctx.Logger.Warn("Rejected login exceeding rate limit", "client-ip", ctx.clientIP(r))
+			w.WriteHeader(http.StatusTooManyRequests)
+			sendErrorEvent(w, ctx, "", ErrorCodeRateLimited, "Too many logins, try again later")
+			return
+		}
+		if lastEventId := r.Header.Get(lastEventIdHeader); lastEventId != "" {
+			resumeLoginStream(w, r, ctx, lastEventId)
+			return
+		}
+		reqId, err := ctx.newReqId()
 		if err != nil {
 			ctx.Logger.Error(fmt.Sprintf("Failed to generate request id: %v", err))
-			sendSSEEvent(w, ctx, "Failed to generate random request id", eventError)
+			sendErrorEvent(w, ctx, "", ErrorCodeInternalError, "Failed to generate random request id")
 			return
 		}
 
-		authURI, err := url.Parse(ctx.config.AuthorizationURI)
+		config, ok := ctx.providerConfig(r.URL.Query().Get(providerParam))
+		if !ok {
+			ctx.Logger.Warn(fmt.Sprintf("Rejected login of unknown provider '%s'", r.URL.Query().Get(providerParam)), reqIdLogArg, reqId)
+			w.WriteHeader(http.StatusBadRequest)
+			sendErrorEvent(w, ctx, "", ErrorCodeInvalidRequest, "Unknown provider")
+			return
+		}
+		if config, err = ctx.selectRedirectURI(r, config, reqId); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			sendErrorEvent(w, ctx, "", ErrorCodeInvalidRequest, err.Error())
+			return
+		}
+		timeout := ctx.requestedLoginTimeout(r.URL.Query().Get(loginTimeoutParam))
+		authURI, nonce, err := ctx.authorizationURI(r, config, reqId)
+		if err != nil {
+			if loginErrorCode(err) == ErrorCodeInvalidRequest {
+				w.WriteHeader(http.StatusBadRequest)
+			}
+			sendErrorEvent(w, ctx, "", loginErrorCode(err), err.Error())
+			return
+		}
+		// request id is sent to IdP as state and can leak, e.g. in browser history, so a separate secret resumes the login
+		resumeToken, err := generateReqId(ctx.ReqIdLength)
 		if err != nil {
-			ctx.Logger.Warn(fmt.Sprintf("Invalid OIDC authorization URI: %s", ctx.config.AuthorizationURI))
-			sendSSEEvent(w, ctx, "Invalid authorization URI", eventError)
+			ctx.Logger.Error(fmt.Sprintf("Failed to generate resume token: %v", err), reqIdLogArg, reqId)
+			sendErrorEvent(w, ctx, "", ErrorCodeInternalError, "Failed to generate random resume token")
+			return
+		}
+
+		session, err := ctx.createLogin(reqId, config, nonce, timeout)
+		if errors.Is(err, errDuplicateReqId) {
+			ctx.Logger.Error(fmt.Sprintf("Rejected login: %v", err), reqIdLogArg, reqId)
+			w.WriteHeader(http.StatusInternalServerError)
+			sendErrorEvent(w, ctx, "", ErrorCodeInternalError, "Failed to generate unique request id")
+			return
+		} else if err != nil {
+			ctx.Logger.Warn(fmt.Sprintf("Rejected login: %v", err), reqIdLogArg, reqId)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			if errors.Is(err, errShuttingDown) {
+				sendErrorEvent(w, ctx, "", ErrorCodeUnavailable, "Proxy is shutting down, try again later")
+			} else {
+				sendErrorEvent(w, ctx, "", ErrorCodeUnavailable, "Too many pending logins, try again later")
+			}
+			return
+		}
+		defer ctx.activeLogins.Done()
+		if authURI, err = ctx.pushedAuthorizationURI(authURI, config, reqId); err != nil {
+			ctx.abortLogin(reqId, err)
+			sendErrorEvent(w, ctx, "", loginErrorCode(err), err.Error())
 			return
 		}
-		query := authURI.Query()
-		query.Set("state", reqId)
-		authURI.RawQuery = query.Encode()
+		ctx.attachLoginStream(session, resumeToken, r.Context().Done())
 		ctx.Logger.Info("Sending OIDC authorization URI to client", reqIdLogArg, reqId)
-		sendSSEEvent(w, ctx, authURI.String(), eventAuthURI)
+		sendSSEEvent(w, ctx, resumeToken, authURI, ctx.AuthURIEvent)
 
 		// Wait for redirect from Identity Provider
-		ctx.initiateLogin(reqId, func(loginResult *loginResult) {
+		var tokens *loginResult
+		ctx.waitForLogin(reqId, session, func(loginResult *loginResult) {
 			ctx.Logger.Info("Received login result from OIDC redirect handler", reqIdLogArg, reqId)
-			if loginResult.err != nil {
-				ctx.Logger.Warn(fmt.Sprintf("OIDC login failed: %v", err), reqIdLogArg, reqId)
-				sendSSEEvent(w, ctx, fmt.Sprintf("OIDC login failed, reason: %v", loginResult.err), eventError)
-				return
-			}
-			eventData, err := json.Marshal(tokensEvent{
-				AccessToken:  loginResult.accessToken,
-				RefreshToken: loginResult.refreshToken,
-				Expiration:   loginResult.expiration,
-			})
-			if err != nil {
-				ctx.Logger.Error(fmt.Sprintf("Could not marshal login result event to JSON: %v", err), reqIdLogArg, reqId)
-				sendSSEEvent(w, ctx, "Failed to generate token event", eventError)
+			if resumed := ctx.takeLoginResultStream(session); resumed != nil {
+				ctx.Logger.Info("Passing login result to resumed login stream", reqIdLogArg, reqId)
+				resumed <- loginResult
 				return
 			}
-			ctx.Logger.Info("Sending successful login result to client", reqIdLogArg, reqId)
-			sendSSEEvent(w, ctx, string(eventData), eventLoggedIn)
+			tokens = sendLoginResult(w, ctx, reqId, resumeToken, loginResult)
 		})
+		if tokens != nil && ctx.TokenStream && r.URL.Query().Get(tokenStreamParam) == "true" {
+			streamRefreshedTokens(w, r, ctx, config, reqId, tokens)
+		}
 	})
 }
 
+// Resumes pending login with resume token (SSE id of its events) in login stream of a client that reconnected
+// with "Last-Event-ID" header. The login result is sent to this stream instead of the dropped one, a login that
+// is not pending can't be resumed and a login whose stream is still open can't be taken over by another request.
+func resumeLoginStream(w http.ResponseWriter, r *http.Request, ctx *Context, resumeToken string) {
+	reqId, resumed, config, err := ctx.resumeLogin(resumeToken, r.Context().Done())
+	if errors.Is(err, errLoginStreamActive) {
+		ctx.Logger.Warn(fmt.Sprintf("Rejected resuming login: %v", err), reqIdLogArg, reqId)
+		w.WriteHeader(http.StatusConflict)
+		sendErrorEvent(w, ctx, "", ErrorCodeInvalidRequest, "Login stream is still open, it can't be resumed")
+		return
+	} else if err != nil {
+		ctx.Logger.Warn(fmt.Sprintf("Rejected resuming login: %v", err))
+		w.WriteHeader(http.StatusNotFound)
+		sendErrorEvent(w, ctx, "", ErrorCodeExpiredSession, "Login is not pending anymore, start a new login")
+		return
+	}
+	defer ctx.activeLogins.Done()
+	ctx.Logger.Info("Resumed login stream", reqIdLogArg, reqId)
+	w.WriteHeader(http.StatusOK)
+	flushResponse(w, ctx)
+
+	var tokens *loginResult
+	select {
+	case loginResult, ok := <-resumed:
+		if !ok {
+			ctx.Logger.Warn("Login result was not passed to resumed login stream, login was resumed again or ended", reqIdLogArg, reqId)
+			sendErrorEvent(w, ctx, resumeToken, ErrorCodeExpiredSession, "Login was resumed by another request or ended, start a new login")
+			return
+		}
+		tokens = sendLoginResult(w, ctx, reqId, resumeToken, loginResult)
+	case <-r.Context().Done():
+		ctx.Logger.Info("Client closed resumed login stream", reqIdLogArg, reqId)
+		ctx.abandonResumedLogin(reqId, resumed)
+		return
+	}
+	if tokens != nil && ctx.TokenStream && r.URL.Query().Get(tokenStreamParam) == "true" {
+		streamRefreshedTokens(w, r, ctx, config, reqId, tokens)
+	}
+}
+
+// Sends login result of request id to client as tokens or error event with SSE id eventId and calls login hooks.
+// Returns tokens if they were sent.
+func sendLoginResult(w http.ResponseWriter, ctx *Context, reqId, eventId string, loginResult *loginResult) *loginResult {
+	if loginResult.err != nil {
+		ctx.Logger.Warn(fmt.Sprintf("OIDC login failed: %v", loginResult.err), reqIdLogArg, reqId)
+		sendErrorEvent(w, ctx, eventId, loginErrorCode(loginResult.err), fmt.Sprintf("OIDC login failed, reason: %v", loginResult.err))
+		ctx.loginFailed(reqId, loginResult.err)
+		return nil
+	}
+	eventData, err := json.Marshal(ctx.newTokensEvent(loginResult))
+	if err != nil {
+		ctx.Logger.Error(fmt.Sprintf("Could not marshal login result event to JSON: %v", err), reqIdLogArg, reqId)
+		sendErrorEvent(w, ctx, eventId, ErrorCodeInternalError, "Failed to generate token event")
+		ctx.loginFailed(reqId, err)
+		return nil
+	}
+	ctx.Logger.Info("Sending successful login result to client", reqIdLogArg, reqId)
+	sendSSEEvent(w, ctx, eventId, string(eventData), ctx.TokensEvent)
+	ctx.loginCompleted(reqId, loginResult)
+	return loginResult
+}
+
+// Returns authorization URI the user logs in at for request id and nonce added to it, the nonce is empty
+// if config does not validate it. Login hint and other parameters are taken from login request r.
+// Parameters are pushed to IdP by pushedAuthorizationURI only after the login session was created.
+// Returned errors are login errors with a message for the client, the cause is logged.
+func (ctx *Context) authorizationURI(r *http.Request, config OIDCConfig, reqId string) (string, string, error) {
+	authURI, err := url.Parse(config.AuthorizationURI)
+	if err != nil {
+		ctx.Logger.Warn(fmt.Sprintf("Invalid OIDC authorization URI: %s", config.AuthorizationURI), reqIdLogArg, reqId)
+		return "", "", newLoginError(ErrorCodeInternalError, errors.New("invalid authorization URI"))
+	}
+	query := authURI.Query()
+	for param, value := range config.ExtraAuthParams {
+		query.Set(param, value)
+	}
+	query.Set("state", reqId)
+	if len(config.Scopes) > 0 {
+		query.Set("scope", joinScopes(config.Scopes))
+	}
+	if config.LoginHintToken != "" {
+		query.Set("login_hint_token", config.LoginHintToken)
+	}
+	if config.ResponseMode != "" {
+		query.Set("response_mode", config.ResponseMode)
+	}
+	if len(config.AllowedRedirectURIs) > 0 {
+		// authorization URI may contain the default redirect URI, the selected one must be used instead
+		query.Set("redirect_uri", config.RedirectURI)
+	}
+	if loginHint := r.URL.Query().Get(loginHintParam); loginHint != "" {
+		if err := validateLoginHint(loginHint); err != nil {
+			ctx.Logger.Warn(fmt.Sprintf("Rejected login: %v", err), reqIdLogArg, reqId)
+			return "", "", newLoginError(ErrorCodeInvalidRequest, errors.New("invalid login hint"))
+		}
+		query.Set("login_hint", loginHint)
+	}
+	var nonce string
+	if config.ValidateNonce {
+		if nonce, err = generateReqId(ctx.ReqIdLength); err != nil {
+			ctx.Logger.Error(fmt.Sprintf("Failed to generate nonce: %v", err), reqIdLogArg, reqId)
+			return "", "", newLoginError(ErrorCodeInternalError, errors.New("failed to generate random nonce"))
+		}
+		query.Set("nonce", nonce)
+	}
+	authURI.RawQuery = query.Encode()
+	return authURI.String(), nonce, nil
+}
+
+// Pushes parameters of authorization URI to IdP if config.PARURI is set and returns authorization URI
+// referencing them, otherwise authURI is returned unchanged. It is called after the login session was created,
+// so logins rejected by the proxy, e.g. over Context.MaxPendingLogins, don't send requests to IdP.
+func (ctx *Context) pushedAuthorizationURI(authURI string, config OIDCConfig, reqId string) (string, error) {
+	if config.PARURI == "" {
+		return authURI, nil
+	}
+	parsedURI, err := url.Parse(authURI)
+	if err != nil {
+		return "", newLoginError(ErrorCodeInternalError, errors.New("invalid authorization URI"))
+	}
+	requestURI, err := pushAuthorizationRequest(ctx.httpClient(), parsedURI.Query(), config)
+	if err != nil {
+		ctx.Logger.Error(fmt.Sprintf("Failed to push authorization request: %v", err), reqIdLogArg, reqId)
+		return "", newLoginError(ErrorCodeIdPError, errors.New("failed to push authorization request to IdP"))
+	}
+	// pushed params are referenced by request_uri, only client_id must be sent along (RFC 9126 section 4)
+	parsedURI.RawQuery = url.Values{"client_id": {config.ClientId}, "request_uri": {requestURI}}.Encode()
+	return parsedURI.String(), nil
+}
+
 // Handles redirect from OIDC Identity Provider.
 // Must serve on OIDC Redirect URI, uses OIDC authorization code flow.
+// Authorization response is accepted as query parameters of GET request (response_mode=query)
+// or as form fields of POST request (response_mode=form_post).
+// Redirect without "state" is rejected, unless Context.AllowStatelessCorrelation is enabled, it contains "code"
+// and exactly one login is pending, then the code is exchanged for tokens of that login.
+// After a successful login started by OIDCLoginOneTimeCodeHandler the user is shown its one-time code.
 func OIDCRedirectHandler(ctx *Context) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// uses a small middleware for error handling and redirecting
-		reqId := r.URL.Query().Get("state")
+		params := r.URL.Query()
+		if r.Method == http.MethodPost {
+			if err := r.ParseForm(); err == nil {
+				params = r.PostForm
+			}
+		}
+		reqId, stateErr := ctx.redirectRequestId(params)
 		ctx.Logger.Info("Received OIDC login redirect", reqIdLogArg, reqId)
+		// read before the login result is delivered, the session is removed afterwards
+		oneTimeCode := ctx.loginOneTimeCode(reqId)
 		statusCode, err := func(w http.ResponseWriter, r *http.Request) (int, error) {
-			if r.Method != http.MethodGet {
-				return http.StatusMethodNotAllowed, fmt.Errorf("HTTP method %s is not allowed", r.Method)
-			} else if !r.URL.Query().Has("state") { // Request id has to be in state, because it was sent to IdP
-				return http.StatusBadRequest, errors.New("OIDC URL query parameter 'state' was expected, but is missing")
-			} else if !r.URL.Query().Has("code") {
-				return http.StatusBadRequest, errors.New("OIDC URL query parameter 'code' was expected, but is missing")
+			if r.Method != http.MethodGet && r.Method != http.MethodPost {
+				return http.StatusMethodNotAllowed, newLoginError(ErrorCodeInvalidRequest, fmt.Errorf("HTTP method %s is not allowed", r.Method))
+			} else if stateErr != nil { // reject missing and forged states before looking up the login or contacting IdP
+				return http.StatusBadRequest, newLoginError(ErrorCodeInvalidRequest, stateErr)
+			} else if params.Has("error") { // IdP redirects with error instead of code, e.g. when user denies consent
+				idpErr := newLoginError(idpRedirectErrorCode(params), idpRedirectError(params))
+				ctx.onLoginError(reqId, idpErr)
+				return http.StatusBadRequest, idpErr
+			} else if !params.Has("code") {
+				return http.StatusBadRequest, newLoginError(ErrorCodeInvalidRequest, errors.New("OIDC parameter 'code' was expected, but is missing"))
+			}
+			// reject unknown states and replayed redirects before contacting IdP
+			if redeemed, pending := ctx.redeemLogin(reqId); !pending {
+				ctx.logMissingLogin(reqId)
+				return http.StatusBadRequest, newLoginError(ErrorCodeTimeout, errors.New("received request id does not exist in context, user's login attempt probably timed out"))
+			} else if !redeemed {
+				ctx.Logger.Warn("Rejected replayed login redirect", reqIdLogArg, reqId)
+				return http.StatusConflict, newLoginError(ErrorCodeInvalidRequest, errors.New("authorization code of this login was already received"))
+			}
+			authorizationCode := params.Get("code")
+			config := ctx.loginConfig(reqId)
+			if err := checkRedirectPath(config, ctx.externalPath(r.URL.Path)); err != nil {
+				ctx.redirectPathWarning.Do(func() {
+					ctx.Logger.Warn(fmt.Sprintf("Token exchange will probably fail: %v", err), reqIdLogArg, reqId)
+				})
 			}
-			reqId := r.URL.Query().Get("state")
-			authorizationCode := r.URL.Query().Get("code")
-			tokenRes, err := oidcGetTokens(authorizationCode, ctx.config)
+			tokenRes, err := oidcGetTokens(ctx.httpClient(), authorizationCode, config)
 			if err != nil {
-				ctx.onLoginError(reqId, errors.New("failed to retrieve tokens from authorization code"))
-				return http.StatusInternalServerError, errors.Join(errors.New("failed to retrieve tokens from authorization code"), err)
+				ctx.onLoginError(reqId, newLoginError(ErrorCodeTokenExchangeFailed, errors.New("failed to retrieve tokens from authorization code")))
+				return http.StatusInternalServerError, newLoginError(ErrorCodeTokenExchangeFailed, errors.Join(errors.New("failed to retrieve tokens from authorization code"), err))
 			}
-			if err = ctx.onLoginSuccess(reqId, tokenRes.AccessToken, tokenRes.RefreshToken, tokenRes.ExpiresIn); err != nil {
-				return http.StatusBadRequest, errors.New("received request id does not exist in context, user's login attempt probably timed out")
+			if config.ValidateNonce && tokenRes.IDToken != "" {
+				if err := validateIDTokenNonce(tokenRes.IDToken, ctx.loginNonce(reqId)); err != nil {
+					ctx.onLoginError(reqId, newLoginError(ErrorCodeTokenExchangeFailed, errors.New("received ID token is not valid for this login")))
+					return http.StatusBadRequest, newLoginError(ErrorCodeTokenExchangeFailed, err)
+				}
+			}
+			ctx.deriveUnknownExpiration(reqId, tokenRes)
+			if err = ctx.onLoginSuccess(reqId, tokenRes); err != nil {
+				return http.StatusBadRequest, newLoginError(ErrorCodeTimeout, errors.New("received request id does not exist in context, user's login attempt probably timed out"))
 			}
 			return http.StatusOK, nil
 		}(w, r)
@@ -123,7 +440,7 @@ func OIDCRedirectHandler(ctx *Context) http.Handler {
 				ctx.Logger.Warn(fmt.Sprintf("OIDC redirect ended with error (status: %d): %v", statusCode, err), reqIdLogArg, reqId)
 			}
 			if ctx.FailedRedirectURI != "" {
-				http.Redirect(w, r, ctx.FailedRedirectURI, http.StatusPermanentRedirect)
+				http.Redirect(w, r, failedRedirectURI(ctx, reqId, err), redirectStatus(r))
 			} else if statusCode >= http.StatusInternalServerError {
 				http.Error(w, "An error was encountered while serving the request", statusCode)
 			} else {
@@ -132,41 +449,374 @@ func OIDCRedirectHandler(ctx *Context) http.Handler {
 		} else if statusCode == http.StatusOK {
 			ctx.Logger.Info("Successfully finished handling OIDC login redirect", reqIdLogArg, reqId)
 			if ctx.SuccessRedirectURI != "" {
-				http.Redirect(w, r, ctx.SuccessRedirectURI, http.StatusPermanentRedirect)
+				http.Redirect(w, r, successRedirectURI(ctx, reqId, oneTimeCode), redirectStatus(r))
+			} else if oneTimeCode != "" {
+				w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+				w.Header().Set("Cache-Control", "no-store")
+				fmt.Fprintf(w, "Login was successful, enter this one-time code in your application: %s\n", oneTimeCode)
 			}
 		}
 	})
 }
 
+// Returns request id of login the redirect with authorization response params belongs to.
+// Request id is read from "state", which was sent to IdP. If a misconfigured IdP drops "state" and
+// Context.AllowStatelessCorrelation is enabled, the redirect with "code" is correlated to the only pending login.
+func (ctx *Context) redirectRequestId(params url.Values) (string, error) {
+	if params.Has("state") {
+		return params.Get("state"), nil
+	}
+	errMissingState := errors.New("OIDC parameter 'state' was expected, but is missing")
+	if !params.Has("code") {
+		return "", errMissingState
+	}
+	if !ctx.AllowStatelessCorrelation {
+		ctx.Logger.Warn("Received OIDC redirect with authorization code, but without state, IdP probably drops state; " +
+			"the waiting client won't receive tokens until its login times out")
+		return "", errMissingState
+	}
+	reqId, found := ctx.singlePendingLogin()
+	if !found {
+		ctx.Logger.Warn("Received OIDC redirect without state, but it can't be correlated, because not exactly one login is pending")
+		return "", errMissingState
+	}
+	ctx.Logger.Warn("Received OIDC redirect without state, correlated it to the only pending login", reqIdLogArg, reqId)
+	return reqId, nil
+}
+
+// Returns config with RedirectURI selected for login request from RedirectURI and OIDCConfig.AllowedRedirectURIs.
+// Redirect URI requested with "redirect-uri" query parameter must be one of them, otherwise an error is returned.
+// Without it the first URI with host of the login request is selected, RedirectURI if none matches.
+// The host is taken from Host header, or from X-Forwarded-Host header if Context.TrustForwardedFor is enabled.
+func (ctx *Context) selectRedirectURI(r *http.Request, config OIDCConfig, reqId string) (OIDCConfig, error) {
+	allowedURIs := append([]string{config.RedirectURI}, config.AllowedRedirectURIs...)
+	if requestedURI := r.URL.Query().Get(redirectURIParam); requestedURI != "" {
+		if !slices.Contains(allowedURIs, requestedURI) {
+			ctx.Logger.Warn(fmt.Sprintf("Rejected login with redirect URI '%s' that is not allowed", requestedURI), reqIdLogArg, reqId)
+			return config, errors.New("redirect URI is not allowed")
+		}
+		config.RedirectURI = requestedURI
+		return config, nil
+	}
+	host := ctx.requestHost(r)
+	for _, uri := range allowedURIs {
+		if parsedURI, err := url.Parse(uri); err == nil && strings.EqualFold(parsedURI.Host, host) {
+			config.RedirectURI = uri
+			return config, nil
+		}
+	}
+	return config, nil
+}
+
+// Returns host the client sent request r to, it is the last host of X-Forwarded-Host header
+// set by a trusted reverse proxy if Context.TrustForwardedFor is enabled, Host header otherwise.
+func (ctx *Context) requestHost(r *http.Request) string {
+	if ctx.TrustForwardedFor {
+		forwardedHosts := strings.Split(strings.Join(r.Header.Values("X-Forwarded-Host"), ","), ",")
+		if host := strings.TrimSpace(forwardedHosts[len(forwardedHosts)-1]); host != "" {
+			return host
+		}
+	}
+	return r.Host
+}
+
+// Checks that the redirect handler serves path of configured redirect URI. The redirect URI is sent
+// on token request and IdP rejects it if it differs from the URI the user was redirected to.
+// Paths may differ legitimately if a reverse proxy rewrites them.
+func checkRedirectPath(config OIDCConfig, requestPath string) error {
+	redirectURI, err := url.Parse(config.RedirectURI)
+	if err != nil {
+		return errors.Join(fmt.Errorf("invalid redirect URI '%s'", config.RedirectURI), err)
+	}
+	if strings.TrimSuffix(redirectURI.Path, "/") != strings.TrimSuffix(requestPath, "/") {
+		return fmt.Errorf(
+			"redirect handler received request on path '%s', but path of configured redirect URI '%s' is '%s'",
+			requestPath, config.RedirectURI, redirectURI.Path,
+		)
+	}
+	return nil
+}
+
+// Returns status of redirect after handling IdP redirect, POST requests of form_post response mode
+// are redirected with 303, so the browser does not send the form again to the redirect target.
+func redirectStatus(r *http.Request) int {
+	if r.Method == http.MethodPost {
+		return http.StatusSeeOther
+	}
+	return http.StatusPermanentRedirect
+}
+
+// Checks that login hint received from client is not too long and does not contain control characters.
+func validateLoginHint(loginHint string) error {
+	if len(loginHint) > maxLoginHintLength {
+		return fmt.Errorf("login hint is longer than %d bytes", maxLoginHintLength)
+	} else if strings.ContainsFunc(loginHint, unicode.IsControl) {
+		return errors.New("login hint contains control characters")
+	}
+	return nil
+}
+
+// Creates tokens event sent to client from successful login result, raw token endpoint response
+// is added only if Context.ForwardRawResponse is enabled.
+func (ctx *Context) newTokensEvent(result *loginResult) tokensEvent {
+	event := tokensEvent{
+		AccessToken:  result.accessToken,
+		RefreshToken: result.refreshToken,
+		Expiration:   result.expiration,
+		TokenType:    result.tokenType,
+		Scope:        result.scope,
+	}
+	if ctx.ForwardRawResponse {
+		event.RawResponse = result.rawResponse
+	}
+	return event
+}
+
+// Joins scopes into a space separated OAuth scope, "openid" is always first and duplicates are removed.
+func joinScopes(scopes []string) string {
+	joined := []string{"openid"}
+	for _, scope := range scopes {
+		if scope != "" && !slices.Contains(joined, scope) {
+			joined = append(joined, scope)
+		}
+	}
+	return strings.Join(joined, " ")
+}
+
+// Claims of ID token used by the proxy.
+type idTokenClaims struct {
+	Nonce     string `json:"nonce"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// Decodes claims of ID token. Its signature is not verified, because the token was received
+// directly from IdP's token endpoint.
+func decodeIDTokenClaims(idToken string) (*idTokenClaims, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("received ID token is not a valid JWT")
+	}
+	rawClaims, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.Join(errors.New("received ID token payload is not base64url encoded"), err)
+	}
+	var claims idTokenClaims
+	if err := json.Unmarshal(rawClaims, &claims); err != nil {
+		return nil, errors.Join(errors.New("received ID token payload is not a valid JSON"), err)
+	}
+	return &claims, nil
+}
+
+// Sets lifetime of tokens derived from 'exp' claim of ID token if IdP did not return 'expires_in',
+// so clients don't cache tokens as if they never expired. Logs a warning if the lifetime stays unknown.
+func (ctx *Context) deriveUnknownExpiration(reqId string, tokens *tokenResponse) {
+	if tokens.ExpiresIn > 0 {
+		return
+	}
+	if tokens.IDToken != "" {
+		if claims, err := decodeIDTokenClaims(tokens.IDToken); err == nil && claims.ExpiresAt > 0 {
+			if expiresIn := time.Until(time.Unix(claims.ExpiresAt, 0)); expiresIn > 0 {
+				tokens.ExpiresIn = expiresInSeconds(expiresIn / time.Second)
+				ctx.Logger.Info("IdP did not return token lifetime, using expiration of ID token", reqIdLogArg, reqId)
+				return
+			}
+		}
+	}
+	ctx.Logger.Warn("IdP did not return token lifetime and it can't be derived from ID token, expiration is unknown", reqIdLogArg, reqId)
+}
+
+// Checks that 'nonce' claim of ID token matches nonce sent on authorization request.
+// ID token signature is not verified, because the token was received directly from IdP's token endpoint.
+func validateIDTokenNonce(idToken, nonce string) error {
+	claims, err := decodeIDTokenClaims(idToken)
+	if err != nil {
+		return err
+	}
+	if nonce == "" || claims.Nonce != nonce {
+		return errors.New("received ID token nonce does not match nonce of login request")
+	}
+	return nil
+}
+
+// Creates an error from 'error' and optional 'error_description' parameters of an IdP redirect.
+func idpRedirectError(query url.Values) error {
+	if description := query.Get("error_description"); description != "" {
+		return fmt.Errorf("IdP returned error '%s': %s", query.Get("error"), description)
+	}
+	return fmt.Errorf("IdP returned error '%s'", query.Get("error"))
+}
+
+// Returns error code of IdP redirect error, denied consent is distinguished from other IdP errors.
+func idpRedirectErrorCode(query url.Values) string {
+	if query.Get("error") == idpErrorAccessDenied {
+		return ErrorCodeAccessDenied
+	}
+	return ErrorCodeIdPError
+}
+
+// Returns SuccessRedirectURI, optionally with state (request id), "status=success" and one-time code
+// of the login added to its query. Tokens must never be part of the redirect URI.
+func successRedirectURI(ctx *Context, reqId, oneTimeCode string) string {
+	params := url.Values{}
+	if oneTimeCode != "" {
+		params.Set(oneTimeCodeRedirectParam, oneTimeCode)
+	}
+	if ctx.SuccessRedirectStateParam != "" {
+		params.Set(ctx.SuccessRedirectStateParam, reqId)
+	}
+	if ctx.RedirectResultParams {
+		params.Set(redirectStatusParam, redirectStatusSuccess)
+	}
+	return addRedirectParams(ctx, ctx.prefixedRedirectURI(ctx.SuccessRedirectURI), reqId, params)
+}
+
+// Returns FailedRedirectURI, if Context.RedirectResultParams is enabled with error code and fixed description
+// of the code added to its query. Text of err is never added, it may contain details about the proxy
+// and its IdP communication or text from the redirect request itself.
+func failedRedirectURI(ctx *Context, reqId string, err error) string {
+	params := url.Values{}
+	if ctx.RedirectResultParams {
+		code := loginErrorCode(err)
+		params.Set(redirectErrorParam, code)
+		params.Set(redirectErrorDescriptionParam, errorCodeDescription(code))
+	}
+	return addRedirectParams(ctx, ctx.prefixedRedirectURI(ctx.FailedRedirectURI), reqId, params)
+}
+
+// Adds Context.PathPrefix to redirect URI that is an absolute path, so the browser is redirected under the prefix.
+func (ctx *Context) prefixedRedirectURI(uri string) string {
+	if strings.HasPrefix(uri, "/") && !strings.HasPrefix(uri, "//") {
+		return ctx.externalPath(uri)
+	}
+	return uri
+}
+
+// Adds query parameters to redirect URI, the URI is returned unchanged if it is invalid.
+func addRedirectParams(ctx *Context, uri, reqId string, params url.Values) string {
+	if len(params) == 0 {
+		return uri
+	}
+	redirectURI, err := url.Parse(uri)
+	if err != nil {
+		ctx.Logger.Warn(fmt.Sprintf("Invalid redirect URI: %s", uri), reqIdLogArg, reqId)
+		return uri
+	}
+	query := redirectURI.Query()
+	for param, values := range params {
+		query[param] = values
+	}
+	redirectURI.RawQuery = query.Encode()
+	return redirectURI.String()
+}
+
 // Gets access and refresh tokens from OIDC provider.
-func oidcGetTokens(authorizationCode string, config OIDCConfig) (*tokenResponse, error) {
-	res, err := http.DefaultClient.PostForm(fmt.Sprintf("%s/token", config.BaseURI), url.Values{
-		"code":          {authorizationCode},
-		"client_id":     {config.ClientId},
-		"client_secret": {config.ClientSecret},
-		"redirect_uri":  {config.RedirectURI},
-		"grant_type":    {"authorization_code"},
-	})
+func oidcGetTokens(client *http.Client, authorizationCode string, config OIDCConfig) (*tokenResponse, error) {
+	form := url.Values{
+		"code":         {authorizationCode},
+		"redirect_uri": {config.RedirectURI},
+		"grant_type":   {"authorization_code"},
+	}
+	if config.TokenGrantType != "" {
+		form.Set("grant_type", config.TokenGrantType)
+	}
+	for param, value := range config.TokenGrantParams {
+		if value == "" {
+			form.Del(param)
+		} else {
+			form.Set(param, value)
+		}
+	}
+	return oidcTokenRequest(client, form, config)
+}
+
+// Sends a token request with given form to OIDC provider, client credentials are added according to config.
+func oidcTokenRequest(client *http.Client, form url.Values, config OIDCConfig) (*tokenResponse, error) {
+	for param, value := range config.TokenExtraParams {
+		if !form.Has(param) {
+			form.Set(param, value)
+		}
+	}
+	req, err := newClientAuthRequest(config.tokenEndpoint(), form, config)
+	if err != nil {
+		return nil, err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return nil, tokenEndpointError(res)
+	}
+	rawBody, err := io.ReadAll(res.Body)
 	if err != nil {
 		return nil, err
 	}
-	tokens := &tokenResponse{}
-	if err := json.NewDecoder(res.Body).Decode(tokens); err != nil {
+	tokens := &tokenResponse{raw: rawBody}
+	if err := json.Unmarshal(rawBody, tokens); err != nil {
 		return nil, err
 	}
 	return tokens, nil
 }
 
-// Writes Server-Sent Event to response body and sends it to client.
-func sendSSEEvent(w http.ResponseWriter, ctx *Context, data string, event string) {
-	ctx.Logger.Debug(fmt.Sprintf("Sending SSE event '%s' with data '%s'", event, data))
+// Creates a form POST request to an IdP endpoint authenticated with client credentials according to config.
+func newClientAuthRequest(uri string, form url.Values, config OIDCConfig) (*http.Request, error) {
+	if config.TokenAuthMethod == "" || config.TokenAuthMethod == TokenAuthMethodPost {
+		form.Set("client_id", config.ClientId)
+		form.Set("client_secret", config.clientSecret())
+	} else if config.TokenAuthMethod != TokenAuthMethodBasic {
+		return nil, fmt.Errorf("unknown token endpoint auth method '%s'", config.TokenAuthMethod)
+	}
+	req, err := http.NewRequest(http.MethodPost, uri, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if config.TokenAuthMethod == TokenAuthMethodBasic {
+		// credentials must be form-urlencoded before used in Basic auth (RFC 6749 section 2.3.1)
+		req.SetBasicAuth(url.QueryEscape(config.ClientId), url.QueryEscape(config.clientSecret()))
+	}
+	return req, nil
+}
+
+// Creates error from a non-2xx token endpoint response, OAuth error and its description are included if present.
+func tokenEndpointError(res *http.Response) error {
+	var errRes tokenErrorResponse
+	if err := json.NewDecoder(res.Body).Decode(&errRes); err != nil || errRes.Error == "" {
+		return fmt.Errorf("token endpoint responded with status %d", res.StatusCode)
+	}
+	if errRes.ErrorDescription != "" {
+		return fmt.Errorf("token endpoint responded with status %d and error '%s': %s", res.StatusCode, errRes.Error, errRes.ErrorDescription)
+	}
+	return fmt.Errorf("token endpoint responded with status %d and error '%s'", res.StatusCode, errRes.Error)
+}
+
+// Writes Server-Sent Event to response body and sends it to client, "id" field is omitted if id is empty.
+func sendSSEEvent(w http.ResponseWriter, ctx *Context, id, data, event string) {
+	ctx.Logger.Debug(fmt.Sprintf("Sending SSE event '%s' with data '%s'", event, ctx.redactSecrets(data)))
+	if id != "" {
+		fmt.Fprintf(w, "id: %s\n", id)
+	}
 	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
-	w.(http.Flusher).Flush()
+	flushResponse(w, ctx)
+}
+
+// Sends buffered response to client. If w can't be flushed, e.g. because a middleware wraps it without
+// implementing http.Flusher, a warning is logged once and events reach the client only after the handler returns.
+func flushResponse(w http.ResponseWriter, ctx *Context) {
+	if err := http.NewResponseController(w).Flush(); err != nil {
+		ctx.flushWarning.Do(func() {
+			ctx.Logger.Warn(fmt.Sprintf(
+				"Login events can't be flushed, clients won't receive them until login ends: %v; "+
+					"response writer is probably wrapped by a middleware that does not implement http.Flusher", err,
+			))
+		})
+	}
 }
 
-// Generates a random request id.
-func generateReqId() (string, error) {
-	randBytes := make([]byte, reqIdLength)
+// Generates a random hex encoded request id from length random bytes, at least minReqIdLength bytes are used.
+func generateReqId(length int) (string, error) {
+	randBytes := make([]byte, max(length, minReqIdLength))
 	if _, err := rand.Read(randBytes); err != nil {
 		return "", err
 	}
@@ -5,7 +5,9 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -14,6 +16,7 @@ import (
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestOIDCLoginHandlerSuccessfulLogin(t *testing.T) {
@@ -40,7 +43,13 @@ func TestOIDCLoginHandlerSuccessfulLogin(t *testing.T) {
 				reqId := loginURI.Query().Get("state")
 				assert.NotEmpty(t, reqId)
 				// mock a redirect from IdP
-				_ = context.onLoginSuccess(reqId, "mock-access-token", "mock-refresh-token", 600)
+				_ = context.onLoginSuccess(reqId, &tokenResponse{
+					AccessToken:  "mock-access-token",
+					RefreshToken: "mock-refresh-token",
+					ExpiresIn:    600,
+					TokenType:    "Bearer",
+					Scope:        "openid profile",
+				})
 			} else if event == eventLoggedIn && eventCounter == 1 {
 				var tokensEvent tokensEvent
 				err := json.Unmarshal([]byte(data), &tokensEvent)
@@ -48,6 +57,8 @@ func TestOIDCLoginHandlerSuccessfulLogin(t *testing.T) {
 				assert.Equal(t, "mock-access-token", tokensEvent.AccessToken)
 				assert.Equal(t, "mock-refresh-token", tokensEvent.RefreshToken)
 				assert.Equal(t, 600, tokensEvent.Expiration)
+				assert.Equal(t, "Bearer", tokensEvent.TokenType)
+				assert.Equal(t, "openid profile", tokensEvent.Scope)
 			} else {
 				t.Errorf("Received unexpected event type '%s' as %d. event", event, eventCounter)
 			}
@@ -137,6 +148,605 @@ func TestOIDCLoginHandlerTimeout(t *testing.T) {
 	assert.Empty(t, context.requests)
 }
 
+func TestOIDCLoginHandlerRoutesLoginToRequestedProvider(t *testing.T) {
+	t.Parallel()
+	redirectURI := "http://localhost:8001/cli-oidc-redirect"
+	mockOIDCServerA := createMockOIDCServer("mock-auth-code", "client-a", "secret-a", redirectURI)
+	defer mockOIDCServerA.Close()
+	mockOIDCServerB := createMockOIDCServer("mock-auth-code", "client-b", "secret-b", redirectURI)
+	defer mockOIDCServerB.Close()
+	context := NewContext(OIDCConfig{
+		BaseURI:          "http://localhost:8000/default-idp",
+		RedirectURI:      redirectURI,
+		AuthorizationURI: "http://localhost:8000/default-idp/auth",
+		ClientId:         "default-client",
+	})
+	context.Providers = map[string]OIDCConfig{
+		"a": {
+			BaseURI:          mockOIDCServerA.URL,
+			RedirectURI:      redirectURI,
+			AuthorizationURI: fmt.Sprint(mockOIDCServerA.URL, "/auth"),
+			ClientId:         "client-a",
+			ClientSecret:     "secret-a",
+		},
+		"b": {
+			BaseURI:          mockOIDCServerB.URL,
+			RedirectURI:      redirectURI,
+			AuthorizationURI: fmt.Sprint(mockOIDCServerB.URL, "/auth"),
+			ClientId:         "client-b",
+			ClientSecret:     "secret-b",
+		},
+	}
+	loginServer := httptest.NewServer(OIDCLoginHandler(context))
+	defer loginServer.Close()
+	redirectServer := httptest.NewServer(OIDCRedirectHandler(context))
+	defer redirectServer.Close()
+
+	for provider, mockOIDCServer := range map[string]*httptest.Server{"a": mockOIDCServerA, "b": mockOIDCServerB} {
+		res, err := http.Get(fmt.Sprint(loginServer.URL, "?provider=", provider))
+		assert.NoError(t, err)
+		var loggedIn bool
+		err = consumeSSEFromHTTPEventStream(res.Body, func(event, data string) error {
+			if event == eventAuthURI {
+				assert.True(t, strings.HasPrefix(data, mockOIDCServer.URL), data)
+				// redirect handler exchanges the code at the same provider, mock server rejects other client ids
+				redirectRes, err := http.Get(fmt.Sprint(redirectServer.URL, "?code=mock-auth-code&state=", receivedState(t, data)))
+				assert.NoError(t, err)
+				assert.Equal(t, http.StatusOK, redirectRes.StatusCode)
+			} else if event == eventLoggedIn {
+				loggedIn = true
+			} else {
+				return fmt.Errorf("unexpected event %s: %s", event, data)
+			}
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.True(t, loggedIn, provider)
+		res.Body.Close()
+	}
+
+	res, err := http.Get(fmt.Sprint(loginServer.URL, "?provider=unknown"))
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+}
+
+func TestOIDCLoginHandlerSendsConfiguredEventNames(t *testing.T) {
+	t.Parallel()
+	context := NewContext(OIDCConfig{
+		BaseURI:          "http://localhost:8000/mock-idp",
+		RedirectURI:      "http://localhost:8001/cli-oidc-redirect",
+		AuthorizationURI: "http://localhost:8000/mock-idp/auth",
+		ClientId:         "client-id",
+	})
+	context.AuthURIEvent = "login-url"
+	context.TokensEvent = "tokens"
+	context.ErrorEvent = "login-error"
+	server := httptest.NewServer(OIDCLoginHandler(context))
+	defer server.Close()
+
+	for _, loginSucceeds := range []bool{true, false} {
+		res, err := http.Get(server.URL)
+		assert.NoError(t, err)
+		defer res.Body.Close()
+		events := []string{}
+		_ = consumeSSEFromHTTPEventStream(res.Body, func(event, data string) error {
+			events = append(events, event)
+			if event == "login-url" && loginSucceeds {
+				assert.NoError(t, context.onLoginSuccess(receivedState(t, data), &tokenResponse{AccessToken: "mock-access-token"}))
+			} else if event == "login-url" {
+				context.onLoginError(receivedState(t, data), newLoginError(ErrorCodeIdPError, errors.New("IdP returned error 'access_denied'")))
+			}
+			return nil
+		})
+		if loginSucceeds {
+			assert.Equal(t, []string{"login-url", "tokens"}, events)
+		} else {
+			assert.Equal(t, []string{"login-url", "login-error"}, events)
+		}
+	}
+}
+
+func TestOIDCLoginHandlerAddsLoginHintToken(t *testing.T) {
+	t.Parallel()
+	context := NewContext(OIDCConfig{
+		BaseURI:          "http://localhost:8000/mock-idp",
+		RedirectURI:      "http://localhost:8001/cli-oidc-redirect",
+		AuthorizationURI: "http://localhost:8000/mock-idp/auth",
+		ClientId:         "client-id",
+		ClientSecret:     "client-secret",
+		LoginHintToken:   "mock-login-hint-token",
+	})
+	context.LoginTimeout = 10 * time.Millisecond
+	server := httptest.NewServer(OIDCLoginHandler(context))
+	defer server.Close()
+	res, err := http.Get(server.URL)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+
+	authURI := receiveAuthURI(t, res.Body)
+	assert.Equal(t, "mock-login-hint-token", authURI.Query().Get("login_hint_token"))
+}
+
+func TestOIDCLoginHandlerAddsResponseMode(t *testing.T) {
+	t.Parallel()
+	context := NewContext(OIDCConfig{
+		BaseURI:          "http://localhost:8000/mock-idp",
+		RedirectURI:      "http://localhost:8001/cli-oidc-redirect",
+		AuthorizationURI: "http://localhost:8000/mock-idp/auth",
+		ClientId:         "client-id",
+		ResponseMode:     ResponseModeFormPost,
+	})
+	context.LoginTimeout = 10 * time.Millisecond
+	server := httptest.NewServer(OIDCLoginHandler(context))
+	defer server.Close()
+	res, err := http.Get(server.URL)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+
+	authURI := receiveAuthURI(t, res.Body)
+	assert.Equal(t, "form_post", authURI.Query().Get("response_mode"))
+}
+
+func TestOIDCLoginHandlerSetsConfiguredScopes(t *testing.T) {
+	t.Parallel()
+	context := NewContext(OIDCConfig{
+		BaseURI:          "http://localhost:8000/mock-idp",
+		RedirectURI:      "http://localhost:8001/cli-oidc-redirect",
+		AuthorizationURI: "http://localhost:8000/mock-idp/auth?scope=email&client_id=client-id",
+		ClientId:         "client-id",
+		ClientSecret:     "client-secret",
+		Scopes:           []string{"profile", "offline_access", "openid", "profile"},
+	})
+	context.LoginTimeout = 10 * time.Millisecond
+	server := httptest.NewServer(OIDCLoginHandler(context))
+	defer server.Close()
+	res, err := http.Get(server.URL)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+
+	authURI := receiveAuthURI(t, res.Body)
+	assert.Equal(t, "openid profile offline_access", authURI.Query().Get("scope"))
+	assert.Equal(t, "client-id", authURI.Query().Get("client_id"))
+}
+
+func TestOIDCLoginHandlerAddsExtraAuthParams(t *testing.T) {
+	t.Parallel()
+	context := NewContext(OIDCConfig{
+		BaseURI:          "http://localhost:8000/mock-idp",
+		RedirectURI:      "http://localhost:8001/cli-oidc-redirect",
+		AuthorizationURI: "http://localhost:8000/mock-idp/auth?client_id=client-id",
+		ClientId:         "client-id",
+		ClientSecret:     "client-secret",
+		ExtraAuthParams:  map[string]string{"audience": "https://api.example.com", "prompt": "login", "state": "fixed-state"},
+	})
+	context.LoginTimeout = 10 * time.Millisecond
+	server := httptest.NewServer(OIDCLoginHandler(context))
+	defer server.Close()
+	res, err := http.Get(server.URL)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+
+	authURI := receiveAuthURI(t, res.Body)
+	assert.Equal(t, "https://api.example.com", authURI.Query().Get("audience"))
+	assert.Equal(t, "login", authURI.Query().Get("prompt"))
+	assert.Equal(t, "client-id", authURI.Query().Get("client_id"))
+	assert.NotEqual(t, "fixed-state", authURI.Query().Get("state"))
+}
+
+func TestOIDCLoginHandlerForwardsLoginHint(t *testing.T) {
+	t.Parallel()
+	context := NewContext(OIDCConfig{
+		BaseURI:          "http://localhost:8000/mock-idp",
+		RedirectURI:      "http://localhost:8001/cli-oidc-redirect",
+		AuthorizationURI: "http://localhost:8000/mock-idp/auth",
+		ClientId:         "client-id",
+		ClientSecret:     "client-secret",
+	})
+	context.LoginTimeout = 10 * time.Millisecond
+	server := httptest.NewServer(OIDCLoginHandler(context))
+	defer server.Close()
+
+	res, err := http.Get(fmt.Sprint(server.URL, "?login_hint=", url.QueryEscape("user+cli@example.com&prompt=none")))
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	authURI := receiveAuthURI(t, res.Body)
+	assert.Equal(t, "user+cli@example.com&prompt=none", authURI.Query().Get("login_hint"))
+	assert.False(t, authURI.Query().Has("prompt"))
+
+	res, err = http.Get(fmt.Sprint(server.URL, "?login_hint=", url.QueryEscape("user\nname")))
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+}
+
+func TestOIDCLoginHandlerUsesConfiguredReqIdLength(t *testing.T) {
+	t.Parallel()
+	for reqIdLength, expectedHexLength := range map[int]int{0: 16, 4: 16, 8: 16, 32: 64} {
+		context := NewContext(OIDCConfig{
+			BaseURI:          "http://localhost:8000/mock-idp",
+			RedirectURI:      "http://localhost:8001/cli-oidc-redirect",
+			AuthorizationURI: "http://localhost:8000/mock-idp/auth",
+			ClientId:         "client-id",
+			ClientSecret:     "client-secret",
+		})
+		context.LoginTimeout = 10 * time.Millisecond
+		context.ReqIdLength = reqIdLength
+		server := httptest.NewServer(OIDCLoginHandler(context))
+		res, err := http.Get(server.URL)
+		assert.NoError(t, err)
+
+		authURI := receiveAuthURI(t, res.Body)
+		assert.Len(t, authURI.Query().Get("state"), expectedHexLength)
+		res.Body.Close()
+		server.Close()
+	}
+}
+
+func TestOIDCLoginHandlerCallsLoginHooks(t *testing.T) {
+	t.Parallel()
+	for _, success := range []bool{true, false} {
+		context := NewContext(OIDCConfig{
+			BaseURI:          "http://localhost:8000/mock-idp",
+			RedirectURI:      "http://localhost:8001/cli-oidc-redirect",
+			AuthorizationURI: "http://localhost:8000/mock-idp/auth",
+			ClientId:         "client-id",
+			ClientSecret:     "client-secret",
+		})
+		var completedReqId, failedReqId string
+		var completedResult *LoginResult
+		var failedErr error
+		context.OnLoginComplete = func(reqId string, result *LoginResult) {
+			completedReqId, completedResult = reqId, result
+		}
+		context.OnLoginFailed = func(reqId string, err error) {
+			failedReqId, failedErr = reqId, err
+		}
+		server := httptest.NewServer(OIDCLoginHandler(context))
+		res, err := http.Get(server.URL)
+		assert.NoError(t, err)
+
+		reqId := receiveAuthURI(t, res.Body).Query().Get("state")
+		if success {
+			_ = context.onLoginSuccess(reqId, &tokenResponse{AccessToken: "mock-access-token", RefreshToken: "mock-refresh-token", ExpiresIn: 600})
+		} else {
+			context.onLoginError(reqId, errors.New("mock login error"))
+		}
+		_ = consumeSSEFromHTTPEventStream(res.Body, func(event, data string) error { return nil })
+		if success {
+			assert.Equal(t, reqId, completedReqId)
+			assert.Equal(t, &LoginResult{AccessToken: "mock-access-token", RefreshToken: "mock-refresh-token", Expiration: 600}, completedResult)
+			assert.Empty(t, failedReqId)
+		} else {
+			assert.Equal(t, reqId, failedReqId)
+			assert.EqualError(t, failedErr, "mock login error")
+			assert.Empty(t, completedReqId)
+		}
+		res.Body.Close()
+		server.Close()
+	}
+}
+
+func TestOIDCLoginHandlerAddsNonceIfValidated(t *testing.T) {
+	t.Parallel()
+	for _, validateNonce := range []bool{false, true} {
+		context := NewContext(OIDCConfig{
+			BaseURI:          "http://localhost:8000/mock-idp",
+			RedirectURI:      "http://localhost:8001/cli-oidc-redirect",
+			AuthorizationURI: "http://localhost:8000/mock-idp/auth",
+			ClientId:         "client-id",
+			ClientSecret:     "client-secret",
+			ValidateNonce:    validateNonce,
+		})
+		context.LoginTimeout = 10 * time.Millisecond
+		server := httptest.NewServer(OIDCLoginHandler(context))
+		res, err := http.Get(server.URL)
+		assert.NoError(t, err)
+
+		authURI := receiveAuthURI(t, res.Body)
+		nonce := authURI.Query().Get("nonce")
+		if validateNonce {
+			assert.NotEmpty(t, nonce)
+			assert.Equal(t, nonce, context.loginNonce(authURI.Query().Get("state")))
+		} else {
+			assert.False(t, authURI.Query().Has("nonce"))
+		}
+		res.Body.Close()
+		server.Close()
+	}
+}
+
+func TestOIDCLoginHandlerRejectsLoginsOverMaxPendingLogins(t *testing.T) {
+	t.Parallel()
+	context := NewContext(OIDCConfig{
+		BaseURI:          "http://localhost:8000/mock-idp",
+		RedirectURI:      "http://localhost:8001/cli-oidc-redirect",
+		AuthorizationURI: "http://localhost:8000/mock-idp/auth",
+		ClientId:         "client-id",
+		ClientSecret:     "client-secret",
+	})
+	context.MaxPendingLogins = 2
+	server := httptest.NewServer(OIDCLoginHandler(context))
+	defer server.Close()
+
+	for i := 0; i < context.MaxPendingLogins; i++ {
+		res, err := http.Get(server.URL)
+		assert.NoError(t, err)
+		defer res.Body.Close()
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		reqId := receiveAuthURI(t, res.Body).Query().Get("state")
+		defer context.onLoginError(reqId, errors.New("test finished"))
+	}
+
+	res, err := http.Get(server.URL)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+	events := []string{}
+	_ = consumeSSEFromHTTPEventStream(res.Body, func(event, data string) error {
+		events = append(events, event)
+		return nil
+	})
+	assert.Equal(t, []string{eventError}, events)
+}
+
+func TestOIDCLoginHandlerSetsResumeTokenAsEventId(t *testing.T) {
+	t.Parallel()
+	context := NewContext(OIDCConfig{
+		BaseURI:          "http://localhost:8000/mock-idp",
+		RedirectURI:      "http://localhost:8001/cli-oidc-redirect",
+		AuthorizationURI: "http://localhost:8000/mock-idp/auth",
+		ClientId:         "client-id",
+		ClientSecret:     "client-secret",
+	})
+	server := httptest.NewServer(OIDCLoginHandler(context))
+	defer server.Close()
+
+	res, err := http.Get(server.URL)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	body := bufio.NewReader(res.Body)
+	resumeToken, authURI := readAuthURIWithEventId(t, body)
+	reqId := authURI.Query().Get("state")
+	assert.NotEmpty(t, resumeToken)
+	assert.NotEqual(t, reqId, resumeToken, "state sent to IdP must not resume the login")
+	assert.NoError(t, context.onLoginSuccess(reqId, &tokenResponse{AccessToken: "mock-access-token"}))
+	assert.True(t, strings.HasPrefix(readRawSSEEvent(t, body), fmt.Sprintf("id: %s\nevent: %s\n", resumeToken, eventLoggedIn)))
+}
+
+func TestOIDCLoginHandlerResumesPendingLoginWithLastEventId(t *testing.T) {
+	t.Parallel()
+	context := NewContext(OIDCConfig{
+		BaseURI:          "http://localhost:8000/mock-idp",
+		RedirectURI:      "http://localhost:8001/cli-oidc-redirect",
+		AuthorizationURI: "http://localhost:8000/mock-idp/auth",
+		ClientId:         "client-id",
+		ClientSecret:     "client-secret",
+	})
+	server := httptest.NewServer(OIDCLoginHandler(context))
+	defer server.Close()
+
+	res, err := http.Get(server.URL)
+	assert.NoError(t, err)
+	resumeToken, authURI := readAuthURIWithEventId(t, bufio.NewReader(res.Body))
+	reqId := authURI.Query().Get("state")
+	res.Body.Close() // connection dropped while user logs in
+
+	// proxy notices the dropped connection asynchronously
+	var resumedRes *http.Response
+	assert.Eventually(t, func() bool {
+		resumedRes = sendResumeRequest(t, server.URL, resumeToken)
+		if resumedRes.StatusCode != http.StatusConflict {
+			return true
+		}
+		resumedRes.Body.Close()
+		return false
+	}, time.Second, 10*time.Millisecond)
+	defer resumedRes.Body.Close()
+	assert.Equal(t, http.StatusOK, resumedRes.StatusCode)
+	assert.NoError(t, context.onLoginSuccess(reqId, &tokenResponse{AccessToken: "mock-access-token"}))
+
+	events := map[string]string{}
+	_ = consumeSSEFromHTTPEventStream(resumedRes.Body, func(event, data string) error {
+		events[event] = data
+		return nil
+	})
+	assert.NotContains(t, events, eventAuthURI)
+	assert.Contains(t, events[eventLoggedIn], "mock-access-token")
+	assert.Equal(t, 1, context.Stats().Initiated, "resumed login must not start a new login")
+}
+
+func TestOIDCLoginHandlerRejectsResumingLoginWithState(t *testing.T) {
+	t.Parallel()
+	context := NewContext(OIDCConfig{
+		BaseURI:          "http://localhost:8000/mock-idp",
+		RedirectURI:      "http://localhost:8001/cli-oidc-redirect",
+		AuthorizationURI: "http://localhost:8000/mock-idp/auth",
+		ClientId:         "client-id",
+		ClientSecret:     "client-secret",
+	})
+	server := httptest.NewServer(OIDCLoginHandler(context))
+	defer server.Close()
+
+	res, err := http.Get(server.URL)
+	assert.NoError(t, err)
+	reqId := receiveAuthURI(t, res.Body).Query().Get("state")
+	res.Body.Close()
+	defer context.onLoginError(reqId, errors.New("test finished"))
+
+	resumedRes := sendResumeRequest(t, server.URL, reqId)
+	defer resumedRes.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resumedRes.StatusCode)
+	event := receiveErrorEvent(t, resumedRes.Body, func(authURI string) {})
+	assert.Equal(t, ErrorCodeExpiredSession, event.Code)
+}
+
+func TestOIDCLoginHandlerRejectsResumingLoginWithOpenStream(t *testing.T) {
+	t.Parallel()
+	context := NewContext(OIDCConfig{
+		BaseURI:          "http://localhost:8000/mock-idp",
+		RedirectURI:      "http://localhost:8001/cli-oidc-redirect",
+		AuthorizationURI: "http://localhost:8000/mock-idp/auth",
+		ClientId:         "client-id",
+		ClientSecret:     "client-secret",
+	})
+	server := httptest.NewServer(OIDCLoginHandler(context))
+	defer server.Close()
+
+	res, err := http.Get(server.URL)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	body := bufio.NewReader(res.Body)
+	resumeToken, authURI := readAuthURIWithEventId(t, body)
+	reqId := authURI.Query().Get("state")
+
+	resumedRes := sendResumeRequest(t, server.URL, resumeToken)
+	defer resumedRes.Body.Close()
+	assert.Equal(t, http.StatusConflict, resumedRes.StatusCode)
+	event := receiveErrorEvent(t, resumedRes.Body, func(authURI string) {})
+	assert.Equal(t, ErrorCodeInvalidRequest, event.Code)
+
+	// original stream still receives the login result
+	assert.NoError(t, context.onLoginSuccess(reqId, &tokenResponse{AccessToken: "mock-access-token"}))
+	assert.True(t, strings.HasPrefix(readRawSSEEvent(t, body), fmt.Sprintf("id: %s\nevent: %s\n", resumeToken, eventLoggedIn)))
+}
+
+func TestOIDCLoginHandlerRejectsResumesOverRateLimit(t *testing.T) {
+	t.Parallel()
+	context := NewContext(OIDCConfig{
+		BaseURI:          "http://localhost:8000/mock-idp",
+		RedirectURI:      "http://localhost:8001/cli-oidc-redirect",
+		AuthorizationURI: "http://localhost:8000/mock-idp/auth",
+		ClientId:         "client-id",
+		ClientSecret:     "client-secret",
+	})
+	context.LoginRateLimit = 1
+	server := httptest.NewServer(OIDCLoginHandler(context))
+	defer server.Close()
+
+	res := sendResumeRequest(t, server.URL, "12345678")
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+
+	res = sendResumeRequest(t, server.URL, "87654321")
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusTooManyRequests, res.StatusCode)
+	event := receiveErrorEvent(t, res.Body, func(authURI string) {})
+	assert.Equal(t, ErrorCodeRateLimited, event.Code)
+}
+
+// Sends request resuming login with resumeToken to login handler at serverURI.
+func sendResumeRequest(t *testing.T, serverURI, resumeToken string) *http.Response {
+	req, err := http.NewRequest(http.MethodGet, serverURI, nil)
+	require.NoError(t, err)
+	req.Header.Set("Last-Event-ID", resumeToken)
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	return res
+}
+
+// Reads auth URI event from login stream, returns its SSE id and the auth URI.
+func readAuthURIWithEventId(t *testing.T, reader *bufio.Reader) (string, *url.URL) {
+	lines := strings.Split(readRawSSEEvent(t, reader), "\n")
+	require.Len(t, lines, 3)
+	eventId, found := strings.CutPrefix(lines[0], "id: ")
+	require.True(t, found)
+	require.Equal(t, "event: "+eventAuthURI, lines[1])
+	authURI, err := url.Parse(strings.TrimPrefix(lines[2], "data: "))
+	require.NoError(t, err)
+	return eventId, authURI
+}
+
+func TestOIDCLoginHandlerRejectsResumingUnknownLogin(t *testing.T) {
+	t.Parallel()
+	context := NewContext(OIDCConfig{
+		BaseURI:          "http://localhost:8000/mock-idp",
+		RedirectURI:      "http://localhost:8001/cli-oidc-redirect",
+		AuthorizationURI: "http://localhost:8000/mock-idp/auth",
+		ClientId:         "client-id",
+		ClientSecret:     "client-secret",
+	})
+	server := httptest.NewServer(OIDCLoginHandler(context))
+	defer server.Close()
+
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	assert.NoError(t, err)
+	req.Header.Set("Last-Event-ID", "12345678")
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+	event := receiveErrorEvent(t, res.Body, func(authURI string) {})
+	assert.Equal(t, ErrorCodeExpiredSession, event.Code)
+	assert.Equal(t, 0, context.Stats().Initiated)
+}
+
+// Reads one raw SSE event with all its fields from login stream.
+func readRawSSEEvent(t *testing.T, reader *bufio.Reader) string {
+	var rawEvent strings.Builder
+	for {
+		line, err := reader.ReadString('\n')
+		if !assert.NoError(t, err) || line == "\n" {
+			return strings.TrimSuffix(rawEvent.String(), "\n")
+		}
+		rawEvent.WriteString(line)
+	}
+}
+
+func TestOIDCLoginHandlerDoesNotPanicWithoutFlusher(t *testing.T) {
+	t.Parallel()
+	var logs strings.Builder
+	context := NewContext(OIDCConfig{
+		BaseURI:          "http://localhost:8000/mock-idp",
+		RedirectURI:      "http://localhost:8001/cli-oidc-redirect",
+		AuthorizationURI: "http://localhost:8000/mock-idp/auth",
+		ClientId:         "client-id",
+		ClientSecret:     "client-secret",
+	})
+	context.Logger = slog.New(slog.NewTextHandler(&logs, nil))
+	handler := OIDCLoginHandler(context)
+	recorder := httptest.NewRecorder()
+	// middleware wrapping response writer without implementing http.Flusher
+	nonFlushingWriter := struct{ http.ResponseWriter }{recorder}
+
+	assert.NotPanics(t, func() {
+		handler.ServeHTTP(nonFlushingWriter, httptest.NewRequest(http.MethodGet, "/cli-login?provider=unknown", nil))
+	})
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "event: error")
+	assert.Contains(t, logs.String(), "can't be flushed")
+}
+
+// Reads login events until the authorization URI event is received and returns the parsed URI.
+func receiveAuthURI(t *testing.T, httpBody io.ReadCloser) *url.URL {
+	var authURI *url.URL
+	_ = consumeSSEFromHTTPEventStream(
+		httpBody,
+		func(event, data string) error {
+			if event == eventAuthURI {
+				var err error
+				authURI, err = url.Parse(data)
+				assert.NoError(t, err)
+				return errors.New("stop consuming events")
+			}
+			return nil
+		},
+	)
+	if authURI == nil {
+		t.Fatal("Authorization URI event was not received")
+	}
+	return authURI
+}
+
+// Returns state (request id) of received authorization URI.
+func receivedState(t *testing.T, authURI string) string {
+	loginURI, err := url.Parse(authURI)
+	assert.NoError(t, err)
+	reqId := loginURI.Query().Get("state")
+	assert.NotEmpty(t, reqId)
+	return reqId
+}
+
 func consumeSSEFromHTTPEventStream(
 	httpBody io.ReadCloser,
 	onEventReceived func(event, data string) error,
@@ -176,7 +786,11 @@ func consumeSSEFromHTTPEventStream(
 }
 
 func parseSSEEvent(rawEvent string) (event, data string, err error) {
+	// id of login events is checked by tests of resumed logins
 	parts := strings.Split(rawEvent, "\n")
+	if strings.HasPrefix(parts[0], "id: ") {
+		parts = parts[1:]
+	}
 	if len(parts) != 2 {
 		return "", "", errors.New("event does not contain one or both fields 'event' and 'data' or has more fields")
 	}
@@ -190,3 +804,108 @@ func parseSSEEvent(rawEvent string) (event, data string, err error) {
 	}
 	return event, data, nil
 }
+
+func TestOIDCLoginHandlerUsesRequestedAllowedRedirectURI(t *testing.T) {
+	t.Parallel()
+	oidcConfig := OIDCConfig{
+		RedirectURI:         "http://localhost:8001/cli-oidc-redirect",
+		AllowedRedirectURIs: []string{"https://cli.example.com/cli-oidc-redirect"},
+		AuthorizationURI:    "http://localhost:8000/mock-idp/auth?redirect_uri=http%3A%2F%2Flocalhost%3A8001%2Fcli-oidc-redirect",
+		ClientId:            "mock-client-id",
+		ClientSecret:        "mock-client-secret",
+	}
+	// token exchange fails unless it is sent with the selected redirect URI
+	mockOIDCServer := createMockOIDCServer("mock-auth-code", oidcConfig.ClientId, oidcConfig.ClientSecret, "https://cli.example.com/cli-oidc-redirect")
+	defer mockOIDCServer.Close()
+	oidcConfig.BaseURI = mockOIDCServer.URL
+	context := NewContext(oidcConfig)
+	loginServer := httptest.NewServer(OIDCLoginHandler(context))
+	defer loginServer.Close()
+	redirectServer := httptest.NewServer(OIDCRedirectHandler(context))
+	defer redirectServer.Close()
+
+	res, err := http.Get(loginServer.URL + "?redirect-uri=" + url.QueryEscape("https://cli.example.com/cli-oidc-redirect"))
+	require.NoError(t, err)
+	defer res.Body.Close()
+	events := []string{}
+	_ = consumeSSEFromHTTPEventStream(res.Body, func(event, data string) error {
+		events = append(events, event)
+		if event == eventAuthURI {
+			authURI, err := url.Parse(data)
+			require.NoError(t, err)
+			assert.Equal(t, "https://cli.example.com/cli-oidc-redirect", authURI.Query().Get("redirect_uri"))
+			redirectRes, err := http.Get(fmt.Sprintf("%s/cli-oidc-redirect?state=%s&code=mock-auth-code", redirectServer.URL, authURI.Query().Get("state")))
+			if assert.NoError(t, err) {
+				redirectRes.Body.Close()
+			}
+		}
+		return nil
+	})
+	assert.Equal(t, []string{eventAuthURI, eventLoggedIn}, events)
+}
+
+func TestOIDCLoginHandlerRejectsUnlistedRedirectURI(t *testing.T) {
+	t.Parallel()
+	context := NewContext(OIDCConfig{
+		BaseURI:             "http://localhost:8000/mock-idp",
+		RedirectURI:         "http://localhost:8001/cli-oidc-redirect",
+		AllowedRedirectURIs: []string{"https://cli.example.com/cli-oidc-redirect"},
+		AuthorizationURI:    "http://localhost:8000/mock-idp/auth",
+		ClientId:            "mock-client-id",
+	})
+	server := httptest.NewServer(OIDCLoginHandler(context))
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "?redirect-uri=" + url.QueryEscape("https://attacker.example.com/steal"))
+	require.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	event := receiveErrorEvent(t, res.Body, func(authURI string) {
+		t.Error("Authorization URI with unlisted redirect URI was sent")
+	})
+	assert.Equal(t, ErrorCodeInvalidRequest, event.Code)
+	assert.Equal(t, 0, context.PendingLogins())
+}
+
+func TestSelectRedirectURIByRequestHost(t *testing.T) {
+	t.Parallel()
+	context := NewContext(OIDCConfig{})
+	config := OIDCConfig{
+		RedirectURI:         "http://localhost:8001/cli-oidc-redirect",
+		AllowedRedirectURIs: []string{"https://cli.example.com/cli-oidc-redirect", "https://cli.example.org/cli-oidc-redirect"},
+	}
+	for host, expected := range map[string]string{
+		"cli.example.org": "https://cli.example.org/cli-oidc-redirect",
+		"CLI.example.com": "https://cli.example.com/cli-oidc-redirect",
+		"localhost:8001":  "http://localhost:8001/cli-oidc-redirect",
+		"unknown.example": "http://localhost:8001/cli-oidc-redirect",
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/cli-login", nil)
+		req.Host = host
+		selected, err := context.selectRedirectURI(req, config, "12345678")
+		assert.NoError(t, err)
+		assert.Equal(t, expected, selected.RedirectURI, host)
+	}
+}
+
+func TestSelectRedirectURIByForwardedHost(t *testing.T) {
+	t.Parallel()
+	config := OIDCConfig{
+		RedirectURI:         "http://localhost:8001/cli-oidc-redirect",
+		AllowedRedirectURIs: []string{"https://cli.example.com/cli-oidc-redirect"},
+	}
+	req := httptest.NewRequest(http.MethodGet, "/cli-login", nil)
+	req.Host = "localhost:8001"
+	req.Header.Add("X-Forwarded-Host", "spoofed.example.com, cli.example.com")
+
+	// forwarded host is ignored unless the reverse proxy is trusted
+	selected, err := NewContext(OIDCConfig{}).selectRedirectURI(req, config, "12345678")
+	assert.NoError(t, err)
+	assert.Equal(t, "http://localhost:8001/cli-oidc-redirect", selected.RedirectURI)
+
+	context := NewContext(OIDCConfig{})
+	context.TrustForwardedFor = true
+	selected, err = context.selectRedirectURI(req, config, "12345678")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://cli.example.com/cli-oidc-redirect", selected.RedirectURI)
+}
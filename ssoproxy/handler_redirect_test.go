@@ -1,9 +1,16 @@
 package ssoproxy
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -25,7 +32,7 @@ func TestOIDCRedirectHandlerRedirectAfterSuccessfulLogin(t *testing.T) {
 	context := NewContext(oidcConfig)
 	context.SuccessRedirectURI = "http://localhost:8001/logged-in"
 	server := httptest.NewServer(OIDCRedirectHandler(context))
-	go context.initiateLogin("12345678", func(loginResult *loginResult) {})
+	startLogin(context, "12345678")
 
 	// don't follow redirects
 	client := &http.Client{
@@ -38,6 +45,106 @@ func TestOIDCRedirectHandlerRedirectAfterSuccessfulLogin(t *testing.T) {
 	assert.Equal(t, "http://localhost:8001/logged-in", res.Header.Get("Location"))
 }
 
+func TestOIDCRedirectHandlerAcceptsFormPostResponse(t *testing.T) {
+	t.Parallel()
+	oidcConfig := OIDCConfig{
+		BaseURI:          "http://localhost:8000/mock-idp",
+		RedirectURI:      "http://localhost:8001/cli-oidc-redirect",
+		AuthorizationURI: "http://localhost:8000/mock-idp/auth",
+		ClientId:         "mock-client-id",
+		ClientSecret:     "mock-client-secret",
+		ResponseMode:     ResponseModeFormPost,
+	}
+	mockOIDCServer := createMockOIDCServer("mock-auth-code", oidcConfig.ClientId, oidcConfig.ClientSecret, oidcConfig.RedirectURI)
+	oidcConfig.BaseURI = mockOIDCServer.URL
+
+	context := NewContext(oidcConfig)
+	context.SuccessRedirectURI = "http://localhost:8001/logged-in"
+	server := httptest.NewServer(OIDCRedirectHandler(context))
+	results := make(chan *loginResult, 1)
+	go context.initiateLogin("12345678", func(loginResult *loginResult) { results <- loginResult })
+	for !context.hasLogin("12345678") {
+		time.Sleep(time.Millisecond)
+	}
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	res, err := client.PostForm(server.URL, url.Values{"state": {"12345678"}, "code": {"mock-auth-code"}})
+	assert.NoError(t, err)
+	// 303 makes browser follow the redirect with GET instead of resending the form
+	assert.Equal(t, http.StatusSeeOther, res.StatusCode)
+	assert.Equal(t, "http://localhost:8001/logged-in", res.Header.Get("Location"))
+	result := <-results
+	assert.NoError(t, result.err)
+	assert.NotEmpty(t, result.accessToken)
+}
+
+func TestOIDCRedirectHandlerForwardsFormPostIdPError(t *testing.T) {
+	t.Parallel()
+	context := NewContext(OIDCConfig{
+		BaseURI:          "http://localhost:8000/mock-idp",
+		RedirectURI:      "http://localhost:8001/cli-oidc-redirect",
+		AuthorizationURI: "http://localhost:8000/mock-idp/auth",
+		ClientId:         "mock-client-id",
+	})
+	server := httptest.NewServer(OIDCRedirectHandler(context))
+	results := make(chan *loginResult, 1)
+	go context.initiateLogin("12345678", func(loginResult *loginResult) { results <- loginResult })
+	for !context.hasLogin("12345678") {
+		time.Sleep(time.Millisecond)
+	}
+
+	res, err := http.PostForm(server.URL, url.Values{"state": {"12345678"}, "error": {"access_denied"}})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	result := <-results
+	assert.ErrorContains(t, result.err, "access_denied")
+	assert.Equal(t, ErrorCodeAccessDenied, loginErrorCode(result.err))
+}
+
+func TestOIDCRedirectHandlerRejectsUnsupportedMethod(t *testing.T) {
+	t.Parallel()
+	context := NewContext(OIDCConfig{ClientId: "mock-client-id"})
+	server := httptest.NewServer(OIDCRedirectHandler(context))
+	req, _ := http.NewRequest(http.MethodPut, fmt.Sprint(server.URL, "?state=12345678&code=mock-auth-code"), nil)
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusMethodNotAllowed, res.StatusCode)
+}
+
+func TestOIDCRedirectHandlerRedirectWithStateAfterSuccessfulLogin(t *testing.T) {
+	t.Parallel()
+	oidcConfig := OIDCConfig{
+		BaseURI:          "http://localhost:8000/mock-idp",
+		RedirectURI:      "http://localhost:8001/cli-oidc-redirect",
+		AuthorizationURI: "http://localhost:8000/mock-idp/auth",
+		ClientId:         "mock-client-id",
+		ClientSecret:     "mock-client-secret",
+	}
+	mockOIDCServer := createMockOIDCServer("mock-auth-code", oidcConfig.ClientId, oidcConfig.ClientSecret, oidcConfig.RedirectURI)
+	oidcConfig.BaseURI = mockOIDCServer.URL
+
+	context := NewContext(oidcConfig)
+	context.SuccessRedirectURI = "http://localhost:8001/logged-in?lang=en"
+	context.SuccessRedirectStateParam = "session"
+	server := httptest.NewServer(OIDCRedirectHandler(context))
+	startLogin(context, "12345678")
+
+	// don't follow redirects
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	res, _ := client.Get(fmt.Sprint(server.URL, "?state=12345678&code=mock-auth-code"))
+	assert.Equal(t, http.StatusPermanentRedirect, res.StatusCode)
+	assert.Equal(t, "http://localhost:8001/logged-in?lang=en&session=12345678", res.Header.Get("Location"))
+	assert.NotContains(t, res.Header.Get("Location"), "mock-access-token")
+}
+
 func TestOIDCRedirectHandlerRedirectAfterFailedLogin(t *testing.T) {
 	t.Parallel()
 	oidcConfig := OIDCConfig{
@@ -53,7 +160,7 @@ func TestOIDCRedirectHandlerRedirectAfterFailedLogin(t *testing.T) {
 	context := NewContext(oidcConfig)
 	context.FailedRedirectURI = "http://localhost:8001/logged-in"
 	server := httptest.NewServer(OIDCRedirectHandler(context))
-	go context.initiateLogin("12345678", func(loginResult *loginResult) {})
+	startLogin(context, "12345678")
 
 	// don't follow redirects
 	client := &http.Client{
@@ -67,6 +174,53 @@ func TestOIDCRedirectHandlerRedirectAfterFailedLogin(t *testing.T) {
 	assert.Equal(t, "http://localhost:8001/logged-in", res.Header.Get("Location"))
 }
 
+func TestOIDCRedirectHandlerAddsResultParamsToRedirects(t *testing.T) {
+	t.Parallel()
+	oidcConfig := OIDCConfig{
+		BaseURI:          "http://localhost:8000/mock-idp",
+		RedirectURI:      "http://localhost:8001/cli-oidc-redirect",
+		AuthorizationURI: "http://localhost:8000/mock-idp/auth",
+		ClientId:         "mock-client-id",
+		ClientSecret:     "mock-client-secret",
+	}
+	mockOIDCServer := createMockOIDCServer("mock-auth-code", oidcConfig.ClientId, oidcConfig.ClientSecret, oidcConfig.RedirectURI)
+	oidcConfig.BaseURI = mockOIDCServer.URL
+
+	context := NewContext(oidcConfig)
+	context.SuccessRedirectURI = "http://localhost:8001/logged-in"
+	context.FailedRedirectURI = "http://localhost:8001/login-failed?lang=en"
+	context.RedirectResultParams = true
+	server := httptest.NewServer(OIDCRedirectHandler(context))
+	// don't follow redirects
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	startLogin(context, "12345678")
+	res, _ := client.Get(fmt.Sprint(server.URL, "?state=12345678&code=mock-auth-code"))
+	assert.Equal(t, "http://localhost:8001/logged-in?status=success", res.Header.Get("Location"))
+
+	startLogin(context, "87654321")
+	res, _ = client.Get(fmt.Sprint(server.URL, "?state=87654321&error=access_denied&error_description=User+denied+consent"))
+	location, err := url.Parse(res.Header.Get("Location"))
+	assert.NoError(t, err)
+	assert.Equal(t, "/login-failed", location.Path)
+	assert.Equal(t, "en", location.Query().Get("lang"))
+	assert.Equal(t, ErrorCodeAccessDenied, location.Query().Get("error"))
+	// text received from IdP is not reflected to the landing page
+	assert.Equal(t, errorCodeDescription(ErrorCodeAccessDenied), location.Query().Get("error_description"))
+
+	// details of internal errors are not exposed
+	startLogin(context, "11111111")
+	res, _ = client.Get(fmt.Sprint(server.URL, "?state=11111111&code=wrong-auth-code"))
+	location, err = url.Parse(res.Header.Get("Location"))
+	assert.NoError(t, err)
+	assert.Equal(t, ErrorCodeTokenExchangeFailed, location.Query().Get("error"))
+	assert.Equal(t, errorCodeDescription(ErrorCodeTokenExchangeFailed), location.Query().Get("error_description"))
+}
+
 func TestOIDCRedirectHandlerWontRedirectByDefault(t *testing.T) {
 	t.Parallel()
 	oidcConfig := OIDCConfig{
@@ -81,7 +235,7 @@ func TestOIDCRedirectHandlerWontRedirectByDefault(t *testing.T) {
 
 	context := NewContext(oidcConfig)
 	server := httptest.NewServer(OIDCRedirectHandler(context))
-	go context.initiateLogin("12345678", func(loginResult *loginResult) {})
+	startLogin(context, "12345678")
 
 	// don't follow redirects
 	client := &http.Client{
@@ -110,14 +264,536 @@ func TestOIDCRedirectHandlerReturnsErrorOnExpiredRequestId(t *testing.T) {
 	context := NewContext(oidcConfig)
 	context.LoginTimeout = time.Millisecond * 100
 	server := httptest.NewServer(OIDCRedirectHandler(context))
-	go context.initiateLogin("11111111", func(loginResult *loginResult) {})
+	startLogin(context, "11111111")
 
 	time.Sleep(time.Millisecond * 150) // wait for login session to time out
 	res, _ := http.Get(fmt.Sprint(server.URL, "?state=11111111&code=mock-auth-code"))
 	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
 }
 
-func createMockOIDCServer(expectedAuthCode, expectedClientId, expectedClientSecret, expectedRedirectURI string) httptest.Server {
+func TestOIDCRedirectHandlerRejectsUnknownStateWithoutTokenRequest(t *testing.T) {
+	t.Parallel()
+	tokenRequests := atomic.Int32{}
+	mockOIDCServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokenRequests.Add(1)
+	}))
+	context := NewContext(OIDCConfig{
+		BaseURI:          mockOIDCServer.URL,
+		RedirectURI:      "http://localhost:8001/cli-oidc-redirect",
+		AuthorizationURI: "http://localhost:8000/mock-idp/auth",
+		ClientId:         "mock-client-id",
+		ClientSecret:     "mock-client-secret",
+	})
+	server := httptest.NewServer(OIDCRedirectHandler(context))
+	startLogin(context, "12345678")
+
+	res, _ := http.Get(fmt.Sprint(server.URL, "?state=87654321&code=mock-auth-code"))
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	assert.Equal(t, int32(0), tokenRequests.Load())
+}
+
+func TestOIDCRedirectHandlerCorrelatesStatelessRedirectToSinglePendingLogin(t *testing.T) {
+	t.Parallel()
+	oidcConfig := OIDCConfig{
+		BaseURI:          "http://localhost:8000/mock-idp",
+		RedirectURI:      "http://localhost:8001/cli-oidc-redirect",
+		AuthorizationURI: "http://localhost:8000/mock-idp/auth",
+		ClientId:         "mock-client-id",
+		ClientSecret:     "mock-client-secret",
+	}
+	mockOIDCServer := createMockOIDCServer("mock-auth-code", oidcConfig.ClientId, oidcConfig.ClientSecret, oidcConfig.RedirectURI)
+	oidcConfig.BaseURI = mockOIDCServer.URL
+
+	context := NewContext(oidcConfig)
+	context.AllowStatelessCorrelation = true
+	server := httptest.NewServer(OIDCRedirectHandler(context))
+	results := make(chan *loginResult, 1)
+	go context.initiateLogin("12345678", func(loginResult *loginResult) { results <- loginResult })
+	for !context.hasLogin("12345678") {
+		time.Sleep(time.Millisecond)
+	}
+
+	res, err := http.Get(fmt.Sprint(server.URL, "?code=mock-auth-code"))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	result := <-results
+	assert.NoError(t, result.err)
+	assert.NotEmpty(t, result.accessToken)
+}
+
+func TestOIDCRedirectHandlerRejectsStatelessRedirect(t *testing.T) {
+	t.Parallel()
+	tokenRequests := atomic.Int32{}
+	mockOIDCServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokenRequests.Add(1)
+	}))
+	for _, test := range []struct {
+		name                      string
+		allowStatelessCorrelation bool
+		pendingLogins             []string
+	}{
+		{"correlation disabled", false, []string{"12345678"}},
+		{"no pending login", true, nil},
+		{"multiple pending logins", true, []string{"12345678", "87654321"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var logs strings.Builder
+			context := NewContext(OIDCConfig{
+				BaseURI:          mockOIDCServer.URL,
+				RedirectURI:      "http://localhost:8001/cli-oidc-redirect",
+				AuthorizationURI: "http://localhost:8000/mock-idp/auth",
+				ClientId:         "mock-client-id",
+				ClientSecret:     "mock-client-secret",
+			})
+			context.Logger = slog.New(slog.NewTextHandler(&logs, nil))
+			context.AllowStatelessCorrelation = test.allowStatelessCorrelation
+			server := httptest.NewServer(OIDCRedirectHandler(context))
+			defer server.Close()
+			for _, reqId := range test.pendingLogins {
+				startLogin(context, reqId)
+			}
+
+			res, err := http.Get(fmt.Sprint(server.URL, "?code=mock-auth-code"))
+			assert.NoError(t, err)
+			assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+			assert.Contains(t, logs.String(), "without state")
+			assert.Equal(t, len(test.pendingLogins), context.PendingLogins())
+		})
+	}
+	assert.Equal(t, int32(0), tokenRequests.Load())
+}
+
+func TestOIDCRedirectHandlerForwardsIdPErrorToClient(t *testing.T) {
+	t.Parallel()
+	context := NewContext(OIDCConfig{
+		BaseURI:          "http://localhost:8000/mock-idp",
+		RedirectURI:      "http://localhost:8001/cli-oidc-redirect",
+		AuthorizationURI: "http://localhost:8000/mock-idp/auth",
+		ClientId:         "mock-client-id",
+		ClientSecret:     "mock-client-secret",
+	})
+	loginServer := httptest.NewServer(OIDCLoginHandler(context))
+	redirectServer := httptest.NewServer(OIDCRedirectHandler(context))
+	res, err := http.Get(loginServer.URL)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+
+	eventCounter := 0
+	_ = consumeSSEFromHTTPEventStream(
+		res.Body,
+		func(event, data string) error {
+			if event == eventAuthURI && eventCounter == 0 {
+				loginURI, err := url.Parse(data)
+				assert.NoError(t, err)
+				reqId := loginURI.Query().Get("state")
+				// mock a redirect from IdP after user denied consent
+				redirectRes, err := http.Get(fmt.Sprintf(
+					"%s?state=%s&error=access_denied&error_description=%s",
+					redirectServer.URL, reqId, url.QueryEscape("User denied consent"),
+				))
+				assert.NoError(t, err)
+				assert.Equal(t, http.StatusBadRequest, redirectRes.StatusCode)
+			} else if event == eventError && eventCounter == 1 {
+				assert.Contains(t, data, "access_denied")
+				assert.Contains(t, data, "User denied consent")
+			} else {
+				t.Errorf("Received unexpected event type '%s' as %d. event", event, eventCounter)
+			}
+			eventCounter++
+			return nil
+		},
+	)
+	assert.Equal(t, 2, eventCounter)
+}
+
+func TestOIDCGetTokensSendsClientCredentialsByAuthMethod(t *testing.T) {
+	t.Parallel()
+	for _, authMethod := range []string{"", TokenAuthMethodPost, TokenAuthMethodBasic} {
+		var bodyClientId, bodyClientSecret, basicClientId, basicClientSecret string
+		mockOIDCServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_ = r.ParseForm()
+			bodyClientId, bodyClientSecret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+			basicClientId, basicClientSecret, _ = r.BasicAuth()
+			_, _ = w.Write([]byte(`{"access_token":"mock-access-token","refresh_token":"mock-refresh-token","expires_in":3600}`))
+		}))
+		_, err := oidcGetTokens(http.DefaultClient, "mock-auth-code", OIDCConfig{
+			BaseURI:         mockOIDCServer.URL,
+			RedirectURI:     "http://localhost:8001/cli-oidc-redirect",
+			ClientId:        "mock-client-id",
+			ClientSecret:    "mock:secret",
+			TokenAuthMethod: authMethod,
+		})
+		assert.NoError(t, err)
+		if authMethod == TokenAuthMethodBasic {
+			assert.Empty(t, bodyClientId)
+			assert.Empty(t, bodyClientSecret)
+			assert.Equal(t, "mock-client-id", basicClientId)
+			assert.Equal(t, "mock%3Asecret", basicClientSecret)
+		} else {
+			assert.Equal(t, "mock-client-id", bodyClientId)
+			assert.Equal(t, "mock:secret", bodyClientSecret)
+			assert.Empty(t, basicClientId)
+			assert.Empty(t, basicClientSecret)
+		}
+		mockOIDCServer.Close()
+	}
+}
+
+func TestOIDCRedirectHandlerUsesRotatedClientSecret(t *testing.T) {
+	t.Parallel()
+	receivedSecrets := make(chan string, 2)
+	mockOIDCServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		receivedSecrets <- r.PostForm.Get("client_secret")
+		_, _ = w.Write([]byte(`{"access_token":"mock-access-token","refresh_token":"mock-refresh-token","expires_in":3600}`))
+	}))
+	defer mockOIDCServer.Close()
+	currentSecret := atomic.Value{}
+	currentSecret.Store("mock-secret-1")
+	context := NewContext(OIDCConfig{
+		BaseURI:              mockOIDCServer.URL,
+		RedirectURI:          "http://localhost:8001/cli-oidc-redirect",
+		ClientId:             "mock-client-id",
+		ClientSecret:         "mock-static-secret",
+		ClientSecretProvider: func() string { return currentSecret.Load().(string) },
+	})
+	server := httptest.NewServer(OIDCRedirectHandler(context))
+	defer server.Close()
+
+	startLogin(context, "12345678")
+	_, err := http.Get(fmt.Sprint(server.URL, "?state=12345678&code=mock-auth-code"))
+	assert.NoError(t, err)
+	assert.Equal(t, "mock-secret-1", <-receivedSecrets)
+
+	currentSecret.Store("mock-secret-2")
+	startLogin(context, "87654321")
+	_, err = http.Get(fmt.Sprint(server.URL, "?state=87654321&code=mock-auth-code"))
+	assert.NoError(t, err)
+	assert.Equal(t, "mock-secret-2", <-receivedSecrets)
+}
+
+func TestOIDCGetTokensSendsTokenExtraParams(t *testing.T) {
+	t.Parallel()
+	var receivedForm url.Values
+	mockOIDCServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		receivedForm = r.PostForm
+		_, _ = w.Write([]byte(`{"access_token":"mock-access-token","expires_in":3600}`))
+	}))
+	defer mockOIDCServer.Close()
+	_, err := oidcGetTokens(http.DefaultClient, "mock-auth-code", OIDCConfig{
+		BaseURI:     mockOIDCServer.URL,
+		RedirectURI: "http://localhost:8001/cli-oidc-redirect",
+		ClientId:    "mock-client-id",
+		TokenExtraParams: map[string]string{
+			"resource":   "https://api.example.com",
+			"grant_type": "password", // can't override parameters of the proxy
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "https://api.example.com", receivedForm.Get("resource"))
+	assert.Equal(t, "authorization_code", receivedForm.Get("grant_type"))
+	assert.Equal(t, "mock-auth-code", receivedForm.Get("code"))
+}
+
+func TestOIDCGetTokensSendsOverriddenGrantParams(t *testing.T) {
+	t.Parallel()
+	var receivedForm url.Values
+	mockOIDCServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		receivedForm = r.PostForm
+		_, _ = w.Write([]byte(`{"access_token":"mock-access-token","expires_in":3600}`))
+	}))
+	defer mockOIDCServer.Close()
+	_, err := oidcGetTokens(http.DefaultClient, "mock-auth-code", OIDCConfig{
+		BaseURI:        mockOIDCServer.URL,
+		RedirectURI:    "http://localhost:8001/cli-oidc-redirect",
+		ClientId:       "mock-client-id",
+		TokenGrantType: "urn:ietf:params:oauth:grant-type:token-exchange",
+		TokenGrantParams: map[string]string{
+			"subject_token_type": "urn:example:authorization-code",
+			"redirect_uri":       "",
+		},
+		TokenExtraParams: map[string]string{"grant_type": "password"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "urn:ietf:params:oauth:grant-type:token-exchange", receivedForm.Get("grant_type"))
+	assert.Equal(t, "urn:example:authorization-code", receivedForm.Get("subject_token_type"))
+	assert.Equal(t, "mock-auth-code", receivedForm.Get("code"))
+	assert.False(t, receivedForm.Has("redirect_uri"))
+}
+
+func TestTokenResponseAcceptsExpiresInFormats(t *testing.T) {
+	t.Parallel()
+	for body, expected := range map[string]int{
+		`{"access_token":"mock-access-token","expires_in":3600}`:   3600,
+		`{"access_token":"mock-access-token","expires_in":"3600"}`: 3600,
+		`{"access_token":"mock-access-token"}`:                     0,
+	} {
+		var tokens tokenResponse
+		assert.NoError(t, json.Unmarshal([]byte(body), &tokens), body)
+		assert.Equal(t, expected, newLoginResult(&tokens).expiration, body)
+	}
+	var tokens tokenResponse
+	assert.Error(t, json.Unmarshal([]byte(`{"expires_in":"an hour"}`), &tokens))
+}
+
+func TestOIDCGetTokensForwardsRawTokenResponse(t *testing.T) {
+	t.Parallel()
+	mockOIDCServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"access_token":"mock-access-token","expires_in":600,"session_state":"mock-session-state"}`))
+	}))
+	defer mockOIDCServer.Close()
+
+	tokens, err := oidcGetTokens(http.DefaultClient, "mock-auth-code", OIDCConfig{BaseURI: mockOIDCServer.URL})
+	assert.NoError(t, err)
+	context := NewContext(OIDCConfig{})
+	context.ForwardRawResponse = true
+	eventData, err := json.Marshal(context.newTokensEvent(newLoginResult(tokens)))
+	assert.NoError(t, err)
+	var event struct {
+		RawResponse struct {
+			SessionState string `json:"session_state"`
+		} `json:"raw_response"`
+	}
+	assert.NoError(t, json.Unmarshal(eventData, &event))
+	assert.Equal(t, "mock-session-state", event.RawResponse.SessionState)
+}
+
+func TestNewTokensEventOmitsRawTokenResponseByDefault(t *testing.T) {
+	t.Parallel()
+	result := newLoginResult(&tokenResponse{AccessToken: "mock-access-token", raw: json.RawMessage(`{"id_token":"mock-id-token"}`)})
+	eventData, err := json.Marshal(NewContext(OIDCConfig{}).newTokensEvent(result))
+	assert.NoError(t, err)
+	assert.NotContains(t, string(eventData), "raw_response")
+	assert.NotContains(t, string(eventData), "mock-id-token")
+}
+
+func TestOIDCGetTokensReturnsOAuthErrorOnFailedResponse(t *testing.T) {
+	t.Parallel()
+	mockOIDCServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"error":"invalid_grant","error_description":"Code not valid"}`))
+	}))
+	defer mockOIDCServer.Close()
+	tokens, err := oidcGetTokens(http.DefaultClient, "mock-auth-code", OIDCConfig{
+		BaseURI:      mockOIDCServer.URL,
+		RedirectURI:  "http://localhost:8001/cli-oidc-redirect",
+		ClientId:     "mock-client-id",
+		ClientSecret: "mock-client-secret",
+	})
+	assert.Nil(t, tokens)
+	assert.ErrorContains(t, err, "invalid_grant")
+	assert.ErrorContains(t, err, "Code not valid")
+	assert.ErrorContains(t, err, "400")
+}
+
+func TestOIDCRedirectHandlerRejectsReplayedRedirect(t *testing.T) {
+	t.Parallel()
+	oidcConfig := OIDCConfig{
+		BaseURI:          "http://localhost:8000/mock-idp",
+		RedirectURI:      "http://localhost:8001/cli-oidc-redirect",
+		AuthorizationURI: "http://localhost:8000/mock-idp/auth",
+		ClientId:         "mock-client-id",
+		ClientSecret:     "mock-client-secret",
+	}
+	mockOIDCServer := createMockOIDCServer("mock-auth-code", oidcConfig.ClientId, oidcConfig.ClientSecret, oidcConfig.RedirectURI)
+	defer mockOIDCServer.Close()
+	oidcConfig.BaseURI = mockOIDCServer.URL
+
+	transport := &recordingTransport{}
+	context := NewContext(oidcConfig)
+	context.HTTPClient = &http.Client{Transport: transport}
+	server := httptest.NewServer(OIDCRedirectHandler(context))
+	defer server.Close()
+	// nobody waits for the login result, so the session stays in context
+	_, err := context.createLogin("12345678", context.config, "", context.LoginTimeout)
+	assert.NoError(t, err)
+
+	res, err := http.Get(fmt.Sprint(server.URL, "?state=12345678&code=mock-auth-code"))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	res, err = http.Get(fmt.Sprint(server.URL, "?state=12345678&code=mock-auth-code"))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusConflict, res.StatusCode)
+	assert.Len(t, transport.requests(), 1)
+}
+
+func TestOIDCRedirectHandlerWarnsAboutRedirectPathMismatch(t *testing.T) {
+	t.Parallel()
+	oidcConfig := OIDCConfig{
+		BaseURI:          "http://localhost:8000/mock-idp",
+		RedirectURI:      "http://localhost:8001/cli-oidc-redirect",
+		AuthorizationURI: "http://localhost:8000/mock-idp/auth",
+		ClientId:         "mock-client-id",
+		ClientSecret:     "mock-client-secret",
+	}
+	mockOIDCServer := createMockOIDCServer("mock-auth-code", oidcConfig.ClientId, oidcConfig.ClientSecret, oidcConfig.RedirectURI)
+	defer mockOIDCServer.Close()
+	oidcConfig.BaseURI = mockOIDCServer.URL
+	logs := &logRecorder{}
+	context := NewContext(oidcConfig)
+	context.Logger = slog.New(slog.NewJSONHandler(logs, nil))
+	mux := http.NewServeMux()
+	mux.Handle("/cli-logged-in", OIDCRedirectHandler(context))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	for _, reqId := range []string{"12345678", "87654321"} {
+		startLogin(context, reqId)
+		_, err := http.Get(fmt.Sprint(server.URL, "/cli-logged-in?code=mock-auth-code&state=", reqId))
+		assert.NoError(t, err)
+	}
+	warnings := []string{}
+	for _, record := range logs.records() {
+		if msg := fmt.Sprint(record["msg"]); strings.HasPrefix(msg, "Token exchange will probably fail") {
+			warnings = append(warnings, msg)
+		}
+	}
+	// warning is logged only once
+	if assert.Len(t, warnings, 1) {
+		assert.Contains(t, warnings[0], "received request on path '/cli-logged-in'")
+		assert.Contains(t, warnings[0], "is '/cli-oidc-redirect'")
+	}
+}
+
+func TestCheckRedirectPath(t *testing.T) {
+	t.Parallel()
+	config := OIDCConfig{RedirectURI: "http://localhost:8001/cli-oidc-redirect"}
+	assert.NoError(t, checkRedirectPath(config, "/cli-oidc-redirect"))
+	assert.NoError(t, checkRedirectPath(config, "/cli-oidc-redirect/"))
+	assert.Error(t, checkRedirectPath(config, "/"))
+	assert.Error(t, checkRedirectPath(config, "/cli-logged-in"))
+}
+
+func TestOIDCRedirectHandlerUsesContextHTTPClient(t *testing.T) {
+	t.Parallel()
+	oidcConfig := OIDCConfig{
+		BaseURI:          "http://localhost:8000/mock-idp",
+		RedirectURI:      "http://localhost:8001/cli-oidc-redirect",
+		AuthorizationURI: "http://localhost:8000/mock-idp/auth",
+		ClientId:         "mock-client-id",
+		ClientSecret:     "mock-client-secret",
+	}
+	mockOIDCServer := createMockOIDCServer("mock-auth-code", oidcConfig.ClientId, oidcConfig.ClientSecret, oidcConfig.RedirectURI)
+	defer mockOIDCServer.Close()
+	oidcConfig.BaseURI = mockOIDCServer.URL
+
+	transport := &recordingTransport{}
+	context := NewContext(oidcConfig)
+	context.HTTPClient = &http.Client{Transport: transport}
+	server := httptest.NewServer(OIDCRedirectHandler(context))
+	defer server.Close()
+	startLogin(context, "12345678")
+
+	res, err := http.Get(fmt.Sprint(server.URL, "?state=12345678&code=mock-auth-code"))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, []string{fmt.Sprint(http.MethodPost, " ", mockOIDCServer.URL, "/token")}, transport.requests())
+}
+
+func TestOIDCRedirectHandlerDerivesExpirationFromIDToken(t *testing.T) {
+	t.Parallel()
+	idTokenClaims := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"exp":%d}`, time.Now().Add(time.Hour).Unix())))
+	mockOIDCServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(fmt.Sprintf(`{
+			"access_token":"mock-access-token",
+			"refresh_token":"mock-refresh-token",
+			"id_token":"eyJhbGciOiJub25lIn0.%s."
+		}`, idTokenClaims)))
+	}))
+	defer mockOIDCServer.Close()
+	context := NewContext(OIDCConfig{
+		BaseURI:      mockOIDCServer.URL,
+		RedirectURI:  "http://localhost:8001/cli-oidc-redirect",
+		ClientId:     "mock-client-id",
+		ClientSecret: "mock-client-secret",
+	})
+	server := httptest.NewServer(OIDCRedirectHandler(context))
+	defer server.Close()
+	results := make(chan *loginResult, 1)
+	go context.initiateLogin("12345678", func(loginResult *loginResult) { results <- loginResult })
+	for !context.hasLogin("12345678") {
+		time.Sleep(time.Millisecond)
+	}
+
+	res, err := http.Get(fmt.Sprint(server.URL, "?state=12345678&code=mock-auth-code"))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	result := <-results
+	assert.NoError(t, result.err)
+	assert.InDelta(t, 3600, result.expiration, 5)
+}
+
+func TestOIDCRedirectHandlerValidatesIDTokenNonce(t *testing.T) {
+	t.Parallel()
+	for nonceClaim, expectedStatus := range map[string]int{"mock-nonce": http.StatusOK, "other-nonce": http.StatusBadRequest} {
+		idTokenClaims := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"nonce":"%s"}`, nonceClaim)))
+		mockOIDCServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(fmt.Sprintf(`{
+				"access_token":"mock-access-token",
+				"refresh_token":"mock-refresh-token",
+				"id_token":"eyJhbGciOiJub25lIn0.%s.",
+				"expires_in": 3600
+			}`, idTokenClaims)))
+		}))
+		context := NewContext(OIDCConfig{
+			BaseURI:       mockOIDCServer.URL,
+			RedirectURI:   "http://localhost:8001/cli-oidc-redirect",
+			ClientId:      "mock-client-id",
+			ClientSecret:  "mock-client-secret",
+			ValidateNonce: true,
+		})
+		server := httptest.NewServer(OIDCRedirectHandler(context))
+		session, err := context.createLogin("12345678", context.config, "mock-nonce", context.LoginTimeout)
+		assert.NoError(t, err)
+		results := make(chan *loginResult, 1)
+		go context.waitForLogin("12345678", session, func(loginResult *loginResult) { results <- loginResult })
+
+		res, err := http.Get(fmt.Sprint(server.URL, "?state=12345678&code=mock-auth-code"))
+		assert.NoError(t, err)
+		assert.Equal(t, expectedStatus, res.StatusCode)
+		if result := <-results; expectedStatus == http.StatusOK {
+			assert.NoError(t, result.err)
+			assert.Equal(t, "mock-access-token", result.accessToken)
+		} else {
+			assert.Error(t, result.err)
+			assert.Empty(t, result.accessToken)
+		}
+		server.Close()
+		mockOIDCServer.Close()
+	}
+}
+
+// Records requests sent through it and sends them using http.DefaultTransport.
+type recordingTransport struct {
+	mutex    sync.Mutex
+	recorded []string
+}
+
+func (transport *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	transport.mutex.Lock()
+	transport.recorded = append(transport.recorded, fmt.Sprint(req.Method, " ", req.URL))
+	transport.mutex.Unlock()
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func (transport *recordingTransport) requests() []string {
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+	return transport.recorded
+}
+
+// Starts login for request id in the background and waits until it is registered in context.
+func startLogin(context *Context, reqId string) {
+	go context.initiateLogin(reqId, func(loginResult *loginResult) {})
+	for !context.hasLogin(reqId) {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func createMockOIDCServer(expectedAuthCode, expectedClientId, expectedClientSecret, expectedRedirectURI string) *httptest.Server {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
 		_ = r.ParseForm()
@@ -138,5 +814,5 @@ func createMockOIDCServer(expectedAuthCode, expectedClientId, expectedClientSecr
 			"expires_in": 3600
 		}`))
 	})
-	return *httptest.NewServer(mux)
+	return httptest.NewServer(mux)
 }
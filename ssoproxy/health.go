@@ -0,0 +1,85 @@
+package ssoproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// How long a result of IdP reachability check is reused by HealthHandler.
+const idpHealthCacheDuration = 30 * time.Second
+
+type healthResponse struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Cached result of the last IdP reachability check.
+type idpHealth struct {
+	mutex     sync.Mutex
+	checkedAt time.Time
+	err       error
+}
+
+// Handles health checks of the proxy, e.g. from a load balancer. Responds with 200 and
+// {"status": "ok"} while the proxy accepts logins. When the proxy is shutting down, or
+// Context.HealthCheckIdP is enabled and the IdP token endpoint is not reachable, responds
+// with 503 and {"status": "unavailable", "error": "..."}.
+// The IdP is contacted at most once per 30 seconds, the result is cached in between.
+func HealthHandler(ctx *Context) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, fmt.Sprintf("HTTP method %s is not allowed", r.Method), http.StatusMethodNotAllowed)
+			return
+		}
+		err := ctx.checkHealth()
+		response := healthResponse{Status: "ok"}
+		statusCode := http.StatusOK
+		if err != nil {
+			ctx.Logger.Warn(fmt.Sprintf("Health check failed: %v", err))
+			response = healthResponse{Status: "unavailable", Error: err.Error()}
+			statusCode = http.StatusServiceUnavailable
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(statusCode)
+		_ = json.NewEncoder(w).Encode(response)
+	})
+}
+
+// Returns error if the proxy can't serve logins.
+func (ctx *Context) checkHealth() error {
+	ctx.requestsMutex.RLock()
+	shuttingDown := ctx.shuttingDown
+	ctx.requestsMutex.RUnlock()
+	if shuttingDown {
+		return errors.New("proxy is shutting down")
+	}
+	if !ctx.HealthCheckIdP {
+		return nil
+	}
+	ctx.idpHealth.mutex.Lock()
+	defer ctx.idpHealth.mutex.Unlock()
+	if time.Since(ctx.idpHealth.checkedAt) > idpHealthCacheDuration {
+		ctx.idpHealth.err = checkIdPReachable(ctx.httpClient(), ctx.config.tokenEndpoint())
+		ctx.idpHealth.checkedAt = time.Now()
+	}
+	return ctx.idpHealth.err
+}
+
+// Checks that IdP endpoint responds, any HTTP response means the IdP is reachable,
+// because the endpoint is requested without parameters it expects.
+func checkIdPReachable(client *http.Client, uri string) error {
+	res, err := client.Get(uri)
+	if err != nil {
+		return errors.Join(errors.New("IdP token endpoint is not reachable"), err)
+	}
+	res.Body.Close()
+	if res.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("IdP token endpoint responded with status %d", res.StatusCode)
+	}
+	return nil
+}
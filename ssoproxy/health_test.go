@@ -0,0 +1,75 @@
+package ssoproxy
+
+import (
+	stdcontext "context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthHandlerReportsHealthyProxy(t *testing.T) {
+	t.Parallel()
+	idpRequests := atomic.Int32{}
+	mockOIDCServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		idpRequests.Add(1)
+		http.Error(w, `{"error":"invalid_request"}`, http.StatusBadRequest)
+	}))
+	defer mockOIDCServer.Close()
+	context := NewContext(OIDCConfig{BaseURI: mockOIDCServer.URL, ClientId: "mock-client-id"})
+	context.HealthCheckIdP = true
+	server := httptest.NewServer(HealthHandler(context))
+	defer server.Close()
+
+	for i := 0; i < 2; i++ {
+		res, err := http.Get(server.URL)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		var body healthResponse
+		assert.NoError(t, json.NewDecoder(res.Body).Decode(&body))
+		assert.Equal(t, healthResponse{Status: "ok"}, body)
+		res.Body.Close()
+	}
+	// result of IdP check is cached
+	assert.Equal(t, int32(1), idpRequests.Load())
+}
+
+func TestHealthHandlerReportsUnreachableIdP(t *testing.T) {
+	t.Parallel()
+	mockOIDCServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	mockOIDCServer.Close()
+	context := NewContext(OIDCConfig{BaseURI: mockOIDCServer.URL, ClientId: "mock-client-id"})
+	server := httptest.NewServer(HealthHandler(context))
+	defer server.Close()
+
+	// IdP is not checked by default
+	res, err := http.Get(server.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	context.HealthCheckIdP = true
+	res, err = http.Get(server.URL)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+	var body healthResponse
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&body))
+	assert.Equal(t, "unavailable", body.Status)
+	assert.Contains(t, body.Error, "not reachable")
+}
+
+func TestHealthHandlerReportsShutdown(t *testing.T) {
+	t.Parallel()
+	context := NewContext(OIDCConfig{ClientId: "mock-client-id"})
+	server := httptest.NewServer(HealthHandler(context))
+	defer server.Close()
+	assert.NoError(t, context.Shutdown(stdcontext.Background()))
+
+	res, err := http.Get(server.URL)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+}
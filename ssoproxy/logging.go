@@ -0,0 +1,87 @@
+package ssoproxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// Returns middleware logging method, path, response status and duration of every handled request with logger,
+// e.g. mux wrapped with LoggingMiddleware(slog.Default())(mux). Query parameters are never logged,
+// because they contain authorization codes and states.
+func LoggingMiddleware(logger *slog.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(recorder, r)
+			logger.Info(
+				"Handled HTTP request",
+				"method", r.Method,
+				"path", r.URL.Path,
+				"status", recorder.status,
+				"duration", time.Since(start),
+			)
+		})
+	}
+}
+
+// Response writer recording status code of response, it stays a http.Flusher for login event streams.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (recorder *statusRecorder) WriteHeader(statusCode int) {
+	if !recorder.wroteHeader {
+		recorder.status = statusCode
+		recorder.wroteHeader = true
+	}
+	recorder.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (recorder *statusRecorder) Write(data []byte) (int, error) {
+	recorder.wroteHeader = true
+	return recorder.ResponseWriter.Write(data)
+}
+
+func (recorder *statusRecorder) Flush() {
+	recorder.wroteHeader = true
+	if flusher, ok := recorder.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Returns wrapped response writer, so http.ResponseController can reach it.
+func (recorder *statusRecorder) Unwrap() http.ResponseWriter {
+	return recorder.ResponseWriter
+}
+
+// JSON token fields and "code" query parameters whose values are redacted in logs
+var secretJSONFieldPattern = regexp.MustCompile(`("(?:access_token|refresh_token|id_token)"\s*:\s*")([^"]*)(")`)
+var secretQueryParamPattern = regexp.MustCompile(`([?&]code=)([^&\s"']*)()`)
+
+// Returns data with values of tokens and authorization codes replaced by a short hash if Context.RedactSecrets
+// is enabled, so logs can still tell whether two values are the same without revealing them.
+func (ctx *Context) redactSecrets(data string) string {
+	if !ctx.RedactSecrets {
+		return data
+	}
+	for _, pattern := range []*regexp.Regexp{secretJSONFieldPattern, secretQueryParamPattern} {
+		data = pattern.ReplaceAllStringFunc(data, func(match string) string {
+			groups := pattern.FindStringSubmatch(match)
+			return groups[1] + redactedValue(groups[2]) + groups[3]
+		})
+	}
+	return data
+}
+
+// Returns placeholder of a redacted secret with prefix of its SHA-256 hash.
+func redactedValue(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return "[redacted sha256:" + hex.EncodeToString(hash[:4]) + "]"
+}
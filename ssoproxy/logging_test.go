@@ -0,0 +1,110 @@
+package ssoproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoggingMiddlewareLogsHandledRequest(t *testing.T) {
+	t.Parallel()
+	context := NewContext(OIDCConfig{ClientId: "mock-client-id"})
+	var logs bytes.Buffer
+	handler := LoggingMiddleware(slog.New(slog.NewJSONHandler(&logs, nil)))(OIDCRedirectHandler(context))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/cli-logged-in?state=12345678&code=secret-auth-code", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	var record map[string]any
+	assert.NoError(t, json.Unmarshal(logs.Bytes(), &record))
+	assert.Equal(t, "Handled HTTP request", record["msg"])
+	assert.Equal(t, http.MethodGet, record["method"])
+	assert.Equal(t, "/cli-logged-in", record["path"])
+	assert.Equal(t, float64(http.StatusBadRequest), record["status"])
+	assert.Contains(t, record, "duration")
+	assert.NotContains(t, logs.String(), "secret-auth-code")
+}
+
+func TestLoggingMiddlewareKeepsLoginStreamFlushable(t *testing.T) {
+	t.Parallel()
+	context := NewContext(OIDCConfig{
+		BaseURI:          "http://localhost:8000/mock-idp",
+		RedirectURI:      "http://localhost:8001/cli-oidc-redirect",
+		AuthorizationURI: "http://localhost:8000/mock-idp/auth",
+		ClientId:         "client-id",
+	})
+	var logs bytes.Buffer
+	server := httptest.NewServer(LoggingMiddleware(slog.New(slog.NewJSONHandler(&logs, nil)))(OIDCLoginHandler(context)))
+	defer server.Close()
+	res, err := http.Get(server.URL)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+
+	authURI := receiveAuthURI(t, res.Body)
+	assert.NotEmpty(t, authURI.Query().Get("state"))
+	context.Close()
+}
+
+func TestOIDCLoginHandlerRedactsSecretsInDebugLogs(t *testing.T) {
+	t.Parallel()
+	for _, redactSecrets := range []bool{true, false} {
+		context := NewContext(OIDCConfig{
+			BaseURI:          "http://localhost:8000/mock-idp",
+			RedirectURI:      "http://localhost:8001/cli-oidc-redirect",
+			AuthorizationURI: "http://localhost:8000/mock-idp/auth",
+			ClientId:         "client-id",
+		})
+		var logs bytes.Buffer
+		context.Logger = slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+		context.RedactSecrets = redactSecrets
+		// raw token endpoint response contains ID token
+		context.ForwardRawResponse = true
+		server := httptest.NewServer(OIDCLoginHandler(context))
+
+		res, err := http.Get(server.URL)
+		assert.NoError(t, err)
+		_ = consumeSSEFromHTTPEventStream(res.Body, func(event, data string) error {
+			if event == eventAuthURI {
+				authURI, err := url.Parse(data)
+				assert.NoError(t, err)
+				_ = context.onLoginSuccess(authURI.Query().Get("state"), &tokenResponse{
+					AccessToken:  "secret-access-token",
+					RefreshToken: "secret-refresh-token",
+					IDToken:      "secret-id-token",
+					raw:          json.RawMessage(`{"access_token":"secret-access-token","id_token":"secret-id-token"}`),
+				})
+			}
+			return nil
+		})
+		res.Body.Close()
+		server.Close()
+
+		assert.Contains(t, logs.String(), "Sending SSE event 'logged-in'")
+		for _, secret := range []string{"secret-access-token", "secret-refresh-token", "secret-id-token"} {
+			if redactSecrets {
+				assert.NotContains(t, logs.String(), secret)
+			} else {
+				assert.Contains(t, logs.String(), secret)
+			}
+		}
+	}
+}
+
+func TestRedactSecrets(t *testing.T) {
+	t.Parallel()
+	context := NewContext(OIDCConfig{})
+	redacted := context.redactSecrets(`{"access_token": "secret-access-token","code":"timeout"} https://cli.example.com/cb?state=abc&code=secret-code&x=1`)
+	assert.NotContains(t, redacted, "secret-access-token")
+	assert.NotContains(t, redacted, "secret-code")
+	assert.Contains(t, redacted, `"code":"timeout"`, "error codes are not secrets")
+	assert.Contains(t, redacted, "state=abc&code=[redacted sha256:")
+	assert.Equal(t, redactedValue("secret-code"), redactedValue("secret-code"), "same secrets can be correlated")
+	assert.NotEqual(t, redactedValue("secret-code"), redactedValue("other-secret-code"))
+}
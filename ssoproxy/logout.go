@@ -0,0 +1,107 @@
+package ssoproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+)
+
+type logoutRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// Handles logout of an application. Accepts POST request with user's refresh token in
+// "refresh_token" form field or JSON body {"refresh_token": "..."} and revokes it at the IdP
+// using proxy's client credentials, so applications don't need client secret to log out.
+//
+// The token is revoked at OIDCConfig.RevocationURI (RFC 7009). Without it the session is ended
+// at OIDCConfig.EndSessionURI only if OIDCConfig.KeycloakEndSessionLogout is enabled, because only
+// Keycloak accepts refresh token there, otherwise 501 Not Implemented is returned. Responds with 204 No Content after successful logout,
+// 400 if the token is missing or rejected by the IdP and 502 if the IdP request failed.
+// Query parameter "provider" selects IdP configuration from Context.Providers like in OIDCLoginHandler.
+func OIDCLogoutHandler(ctx *Context) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		statusCode, err := func(r *http.Request) (int, error) {
+			if r.Method != http.MethodPost {
+				return http.StatusMethodNotAllowed, fmt.Errorf("HTTP method %s is not allowed", r.Method)
+			}
+			refreshToken, err := logoutRefreshToken(r)
+			if err != nil {
+				return http.StatusBadRequest, err
+			}
+			config, ok := ctx.providerConfig(r.URL.Query().Get(providerParam))
+			if !ok {
+				return http.StatusBadRequest, fmt.Errorf("unknown provider '%s'", r.URL.Query().Get(providerParam))
+			}
+			var form url.Values
+			var logoutURI string
+			if config.RevocationURI != "" {
+				logoutURI = config.RevocationURI
+				form = url.Values{"token": {refreshToken}, "token_type_hint": {"refresh_token"}}
+			} else if config.KeycloakEndSessionLogout && config.EndSessionURI != "" {
+				logoutURI = config.EndSessionURI
+				form = url.Values{"refresh_token": {refreshToken}}
+			} else {
+				return http.StatusNotImplemented, errors.New("revocation URI is not configured")
+			}
+			return oidcLogoutRequest(ctx.httpClient(), logoutURI, form, config)
+		}(r)
+
+		if err != nil {
+			if statusCode >= http.StatusInternalServerError {
+				ctx.Logger.Error(fmt.Sprintf("OIDC logout ended with error (status: %d): %v", statusCode, err))
+				http.Error(w, "An error was encountered while serving the request", statusCode)
+			} else {
+				ctx.Logger.Warn(fmt.Sprintf("OIDC logout ended with error (status: %d): %v", statusCode, err))
+				http.Error(w, err.Error(), statusCode)
+			}
+			return
+		}
+		ctx.Logger.Info("Successfully logged out user")
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// Reads refresh token from logout request body, JSON is used if Content-Type is application/json, form otherwise.
+func logoutRefreshToken(r *http.Request) (string, error) {
+	var refreshToken string
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/json" {
+		var body logoutRequest
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			return "", errors.New("logout request body is not a valid JSON")
+		}
+		refreshToken = body.RefreshToken
+	} else {
+		if err := r.ParseForm(); err != nil {
+			return "", errors.New("logout request body is not a valid form")
+		}
+		refreshToken = r.PostForm.Get("refresh_token")
+	}
+	if refreshToken == "" {
+		return "", errors.New("logout request parameter 'refresh_token' was expected, but is missing")
+	}
+	return refreshToken, nil
+}
+
+// Sends a logout request with given form to OIDC provider and maps its response to handler's status code.
+func oidcLogoutRequest(client *http.Client, logoutURI string, form url.Values, config OIDCConfig) (int, error) {
+	req, err := newClientAuthRequest(logoutURI, form, config)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return http.StatusBadGateway, errors.Join(errors.New("failed to execute IdP logout request"), err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 200 && res.StatusCode <= 299 {
+		return http.StatusNoContent, nil
+	} else if res.StatusCode == http.StatusBadRequest {
+		// IdP rejected the token itself, e.g. because it is invalid or was issued to another client
+		return http.StatusBadRequest, tokenEndpointError(res)
+	}
+	return http.StatusBadGateway, tokenEndpointError(res)
+}
@@ -0,0 +1,159 @@
+package ssoproxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOIDCLogoutHandlerRevokesRefreshToken(t *testing.T) {
+	t.Parallel()
+	mockOIDCServer := createMockLogoutServer("mock-client-id", "mock-client-secret")
+	defer mockOIDCServer.Close()
+	context := NewContext(OIDCConfig{
+		BaseURI:       mockOIDCServer.URL,
+		ClientId:      "mock-client-id",
+		ClientSecret:  "mock-client-secret",
+		RevocationURI: fmt.Sprint(mockOIDCServer.URL, "/revoke"),
+		EndSessionURI: fmt.Sprint(mockOIDCServer.URL, "/logout"),
+	})
+	server := httptest.NewServer(OIDCLogoutHandler(context))
+	defer server.Close()
+
+	res, err := http.PostForm(server.URL, url.Values{"refresh_token": {"mock-refresh-token"}})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+
+	res, err = http.Post(server.URL, "application/json", strings.NewReader(`{"refresh_token":"mock-refresh-token"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+}
+
+func TestOIDCLogoutHandlerEndsKeycloakSessionWithoutRevocationURI(t *testing.T) {
+	t.Parallel()
+	mockOIDCServer := createMockLogoutServer("mock-client-id", "mock-client-secret")
+	defer mockOIDCServer.Close()
+	context := NewContext(OIDCConfig{
+		BaseURI:                  mockOIDCServer.URL,
+		ClientId:                 "mock-client-id",
+		ClientSecret:             "mock-client-secret",
+		EndSessionURI:            fmt.Sprint(mockOIDCServer.URL, "/logout"),
+		KeycloakEndSessionLogout: true,
+		TokenAuthMethod:          TokenAuthMethodBasic,
+	})
+	server := httptest.NewServer(OIDCLogoutHandler(context))
+	defer server.Close()
+
+	res, err := http.PostForm(server.URL, url.Values{"refresh_token": {"mock-refresh-token"}})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+}
+
+func TestOIDCLogoutHandlerMapsErrors(t *testing.T) {
+	t.Parallel()
+	mockOIDCServer := createMockLogoutServer("mock-client-id", "mock-client-secret")
+	defer mockOIDCServer.Close()
+	tests := []struct {
+		name         string
+		config       OIDCConfig
+		method       string
+		refreshToken string
+		statusCode   int
+	}{
+		{
+			name:         "method not allowed",
+			config:       OIDCConfig{RevocationURI: fmt.Sprint(mockOIDCServer.URL, "/revoke")},
+			method:       http.MethodGet,
+			refreshToken: "mock-refresh-token",
+			statusCode:   http.StatusMethodNotAllowed,
+		},
+		{
+			name:       "missing refresh token",
+			config:     OIDCConfig{RevocationURI: fmt.Sprint(mockOIDCServer.URL, "/revoke")},
+			method:     http.MethodPost,
+			statusCode: http.StatusBadRequest,
+		},
+		{
+			name:         "token rejected by IdP",
+			config:       OIDCConfig{RevocationURI: fmt.Sprint(mockOIDCServer.URL, "/revoke"), ClientId: "mock-client-id", ClientSecret: "mock-client-secret"},
+			method:       http.MethodPost,
+			refreshToken: "invalid-refresh-token",
+			statusCode:   http.StatusBadRequest,
+		},
+		{
+			name:         "invalid client credentials",
+			config:       OIDCConfig{RevocationURI: fmt.Sprint(mockOIDCServer.URL, "/revoke"), ClientId: "mock-client-id", ClientSecret: "invalid"},
+			method:       http.MethodPost,
+			refreshToken: "mock-refresh-token",
+			statusCode:   http.StatusBadGateway,
+		},
+		{
+			name:         "no logout endpoint",
+			config:       OIDCConfig{},
+			method:       http.MethodPost,
+			refreshToken: "mock-refresh-token",
+			statusCode:   http.StatusNotImplemented,
+		},
+		{
+			// RP-Initiated Logout is a browser redirect, only Keycloak accepts refresh token at end session endpoint
+			name:         "end session endpoint without Keycloak logout",
+			config:       OIDCConfig{EndSessionURI: fmt.Sprint(mockOIDCServer.URL, "/logout"), ClientId: "mock-client-id", ClientSecret: "mock-client-secret"},
+			method:       http.MethodPost,
+			refreshToken: "mock-refresh-token",
+			statusCode:   http.StatusNotImplemented,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(OIDCLogoutHandler(NewContext(test.config)))
+			defer server.Close()
+			req, _ := http.NewRequest(test.method, server.URL, strings.NewReader(url.Values{"refresh_token": {test.refreshToken}}.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			res, err := http.DefaultClient.Do(req)
+			assert.NoError(t, err)
+			assert.Equal(t, test.statusCode, res.StatusCode)
+		})
+	}
+}
+
+func createMockLogoutServer(expectedClientId, expectedClientSecret string) *httptest.Server {
+	validClient := func(r *http.Request) bool {
+		clientId, clientSecret, ok := r.BasicAuth()
+		if ok {
+			clientId, _ = url.QueryUnescape(clientId)
+			clientSecret, _ = url.QueryUnescape(clientSecret)
+		} else {
+			clientId, clientSecret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+		}
+		return clientId == expectedClientId && clientSecret == expectedClientSecret
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/revoke", func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		if !validClient(r) {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"error":"invalid_client"}`))
+		} else if r.PostForm.Get("token") != "mock-refresh-token" || r.PostForm.Get("token_type_hint") != "refresh_token" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error":"invalid_request"}`))
+		}
+	})
+	mux.HandleFunc("/logout", func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		if !validClient(r) {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"error":"invalid_client"}`))
+		} else if r.PostForm.Get("refresh_token") != "mock-refresh-token" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error":"invalid_grant"}`))
+		} else {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	})
+	return httptest.NewServer(mux)
+}
@@ -0,0 +1,30 @@
+package ssoproxy
+
+import "time"
+
+// Records metrics of logins handled by the proxy, e.g. as Prometheus counters and histograms.
+// Methods are called concurrently from HTTP handlers, so implementations must be safe for concurrent use.
+type MetricsRecorder interface {
+	// Called after a login session was created
+	IncLoginInitiated()
+	// Called after login result with tokens was received
+	IncLoginSucceeded()
+	// Called after a login failed, reason is LoginFailedReasonTimeout or LoginFailedReasonError
+	IncLoginFailed(reason string)
+	// Called with time from login initiation until its successful login result was received
+	ObserveLoginDuration(d time.Duration)
+}
+
+// User did not log in within Context.LoginTimeout.
+const LoginFailedReasonTimeout = "timeout"
+
+// IdP returned an error or tokens could not be retrieved.
+const LoginFailedReasonError = "error"
+
+// MetricsRecorder that records nothing, used by default.
+type NoopMetricsRecorder struct{}
+
+func (NoopMetricsRecorder) IncLoginInitiated()                   {}
+func (NoopMetricsRecorder) IncLoginSucceeded()                   {}
+func (NoopMetricsRecorder) IncLoginFailed(reason string)         {}
+func (NoopMetricsRecorder) ObserveLoginDuration(d time.Duration) {}
@@ -0,0 +1,80 @@
+package ssoproxy
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOIDCLoginHandlerRecordsMetrics(t *testing.T) {
+	t.Parallel()
+	context := NewContext(OIDCConfig{
+		BaseURI:          "http://localhost:8000/mock-idp",
+		RedirectURI:      "http://localhost:8001/cli-oidc-redirect",
+		AuthorizationURI: "http://localhost:8000/mock-idp/auth",
+		ClientId:         "client-id",
+		ClientSecret:     "client-secret",
+	})
+	context.LoginTimeout = 100 * time.Millisecond
+	metrics := &fakeMetricsRecorder{}
+	context.Metrics = metrics
+	server := httptest.NewServer(OIDCLoginHandler(context))
+	defer server.Close()
+
+	login := func(finishLogin func(reqId string)) {
+		res, err := http.Get(server.URL)
+		assert.NoError(t, err)
+		defer res.Body.Close()
+		finishLogin(receiveAuthURI(t, res.Body).Query().Get("state"))
+		_ = consumeSSEFromHTTPEventStream(res.Body, func(event, data string) error { return nil })
+	}
+	login(func(reqId string) {
+		_ = context.onLoginSuccess(reqId, &tokenResponse{AccessToken: "mock-access-token", RefreshToken: "mock-refresh-token", ExpiresIn: 600})
+	})
+	login(func(reqId string) { context.onLoginError(reqId, errors.New("mock login error")) })
+	login(func(reqId string) {}) // times out
+
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	assert.Equal(t, 3, metrics.initiated)
+	assert.Equal(t, 1, metrics.succeeded)
+	assert.Equal(t, []string{LoginFailedReasonError, LoginFailedReasonTimeout}, metrics.failed)
+	assert.Len(t, metrics.durations, 1)
+}
+
+type fakeMetricsRecorder struct {
+	mutex     sync.Mutex
+	initiated int
+	succeeded int
+	failed    []string
+	durations []time.Duration
+}
+
+func (recorder *fakeMetricsRecorder) IncLoginInitiated() {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	recorder.initiated++
+}
+
+func (recorder *fakeMetricsRecorder) IncLoginSucceeded() {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	recorder.succeeded++
+}
+
+func (recorder *fakeMetricsRecorder) IncLoginFailed(reason string) {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	recorder.failed = append(recorder.failed, reason)
+}
+
+func (recorder *fakeMetricsRecorder) ObserveLoginDuration(d time.Duration) {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	recorder.durations = append(recorder.durations, d)
+}
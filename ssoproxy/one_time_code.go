@@ -0,0 +1,147 @@
+package ssoproxy
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// How long tokens of a finished login can be fetched with its one-time code.
+const oneTimeCodeLifetime = time.Minute
+
+// form field of token request with one-time code shown to the user after login
+const oneTimeCodeParam = "code"
+
+// query parameter of SuccessRedirectURI with one-time code of the login
+const oneTimeCodeRedirectParam = "one_time_code"
+
+type oneTimeCodeLoginResponse struct {
+	LoginURI string `json:"login_uri"`
+}
+
+// Handles login process from an application that can't hold a connection open while the user logs in.
+// Starts a login like OIDCLoginHandler, supporting the same query parameters except "token-stream",
+// and responds with JSON `{"login_uri": "https://some-sso.com/auth"}`.
+// After a successful login OIDCRedirectHandler shows the user a one-time code instead of sending tokens
+// to the client, or adds it to Context.SuccessRedirectURI as query parameter "one_time_code" if set.
+// The user enters the code in the application, which exchanges it for tokens at OIDCTokenHandler.
+// Errors are sent as JSON `{"code": "...", "message": "..."}` like "error" events of OIDCLoginHandler.
+// OIDCRedirectHandler must be used with this handler.
+func OIDCLoginOneTimeCodeHandler(ctx *Context) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if handleCORS(w, r, ctx) {
+			return
+		}
+		// one-time code is not sent to IdP, only the user sees it after login
+		oneTimeCode, err := generateReqId(ctx.ReqIdLength)
+		if err != nil {
+			ctx.Logger.Error(fmt.Sprintf("Failed to generate one-time code: %v", err))
+			sendJSONError(w, ctx, http.StatusInternalServerError, ErrorCodeInternalError, "Failed to generate random one-time code")
+			return
+		}
+		reqId, authURI, session, ok := startDetachedLogin(w, r, ctx)
+		if !ok {
+			return
+		}
+		ctx.requestsMutex.Lock()
+		session.oneTimeCode = oneTimeCode
+		ctx.oneTimeCodes[oneTimeCode] = &polledLogin{reqId: reqId}
+		ctx.requestsMutex.Unlock()
+		go func() {
+			defer ctx.activeLogins.Done()
+			ctx.waitForLogin(reqId, session, func(loginResult *loginResult) {
+				if loginResult.err != nil {
+					ctx.Logger.Warn(fmt.Sprintf("OIDC login failed: %v", loginResult.err), reqIdLogArg, reqId)
+					ctx.loginFailed(reqId, loginResult.err)
+				} else {
+					ctx.Logger.Info("Received login result from OIDC redirect handler, waiting for client to exchange one-time code", reqIdLogArg, reqId)
+				}
+				ctx.requestsMutex.Lock()
+				if loginResult.err != nil {
+					// user saw the failure in browser, there are no tokens to exchange
+					delete(ctx.oneTimeCodes, oneTimeCode)
+				} else if login, contains := ctx.oneTimeCodes[oneTimeCode]; contains {
+					login.result = loginResult
+					login.endedAt = time.Now()
+				}
+				ctx.requestsMutex.Unlock()
+			})
+		}()
+
+		ctx.Logger.Info("Sending OIDC authorization URI to client", reqIdLogArg, reqId)
+		sendJSON(w, ctx, http.StatusOK, oneTimeCodeLoginResponse{LoginURI: authURI})
+	})
+}
+
+// Handles exchange of one-time codes of logins started by OIDCLoginOneTimeCodeHandler for tokens.
+// The code is read from form field "code" of a POST request.
+//
+// Responses:
+//
+//	200 `{"access_token": "access", "refresh_token": "refresh", "expiration": 3600}` // same as "logged-in" event of OIDCLoginHandler
+//	4xx `{"code": "invalid_request", "message": "Error description"}` // code is one of ErrorCode* constants
+//
+// A one-time code can be exchanged only once and expires a minute after the login finished,
+// unknown, used and expired codes are rejected with status 404. Exchanges count towards Context.LoginRateLimit,
+// so codes can't be guessed by flooding the proxy, clients exceeding it are rejected with status 429.
+func OIDCTokenHandler(ctx *Context) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if handleCORS(w, r, ctx) {
+			return
+		}
+		if r.Method != http.MethodPost {
+			sendJSONError(w, ctx, http.StatusMethodNotAllowed, ErrorCodeInvalidRequest, fmt.Sprintf("HTTP method %s is not allowed", r.Method))
+			return
+		}
+		if !ctx.allowLogin(r) {
+			ctx.Logger.Warn("Rejected one-time code exchange exceeding rate limit", "client-ip", ctx.clientIP(r))
+			sendJSONError(w, ctx, http.StatusTooManyRequests, ErrorCodeRateLimited, "Too many logins, try again later")
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			sendJSONError(w, ctx, http.StatusBadRequest, ErrorCodeInvalidRequest, "Invalid form")
+			return
+		}
+		oneTimeCode := r.PostForm.Get(oneTimeCodeParam)
+
+		ctx.requestsMutex.Lock()
+		ctx.removeExpiredOneTimeCodes()
+		login, contains := ctx.oneTimeCodes[oneTimeCode]
+		// codes of pending logins are not shown to anyone yet, so they are not redeemable
+		contains = contains && login.result != nil
+		if contains {
+			delete(ctx.oneTimeCodes, oneTimeCode)
+		}
+		ctx.requestsMutex.Unlock()
+
+		if !contains {
+			ctx.Logger.Warn("Login of one-time code not found, the code was already used, expired or is invalid")
+			sendJSONError(w, ctx, http.StatusNotFound, ErrorCodeInvalidRequest, "Unknown one-time code, it was already used or expired")
+			return
+		}
+		ctx.Logger.Info("Sending tokens of exchanged one-time code to client", reqIdLogArg, login.reqId)
+		sendJSON(w, ctx, http.StatusOK, ctx.newTokensEvent(login.result))
+		ctx.loginCompleted(login.reqId, login.result)
+	})
+}
+
+// Returns one-time code of login session for request id, empty if the login was not started by
+// OIDCLoginOneTimeCodeHandler or there is no such session.
+func (ctx *Context) loginOneTimeCode(reqId string) string {
+	ctx.requestsMutex.RLock()
+	defer ctx.requestsMutex.RUnlock()
+	if session, contains := ctx.requests[reqId]; contains {
+		return session.oneTimeCode
+	}
+	return ""
+}
+
+// Removes tokens of one-time codes that were not exchanged within oneTimeCodeLifetime, requestsMutex must be locked.
+func (ctx *Context) removeExpiredOneTimeCodes() {
+	for oneTimeCode, login := range ctx.oneTimeCodes {
+		if login.result != nil && time.Since(login.endedAt) > oneTimeCodeLifetime {
+			ctx.Logger.Warn("Discarding tokens of one-time code that was not exchanged by client", reqIdLogArg, login.reqId)
+			delete(ctx.oneTimeCodes, oneTimeCode)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package ssoproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOIDCTokenHandlerExchangesOneTimeCodeOnce(t *testing.T) {
+	t.Parallel()
+	context, servers := createOneTimeCodeServers(t)
+
+	oneTimeCode := loginWithOneTimeCode(t, context, servers)
+	res, err := http.PostForm(servers.token.URL, url.Values{"code": {oneTimeCode}})
+	require.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	var tokens tokensEvent
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&tokens))
+	assert.Equal(t, "mock-access-token", tokens.AccessToken)
+
+	// the code is single-use
+	res, err = http.PostForm(servers.token.URL, url.Values{"code": {oneTimeCode}})
+	require.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+	var event errorEvent
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&event))
+	assert.Equal(t, ErrorCodeInvalidRequest, event.Code)
+}
+
+func TestOIDCTokenHandlerRejectsExpiredOneTimeCode(t *testing.T) {
+	t.Parallel()
+	context, servers := createOneTimeCodeServers(t)
+
+	oneTimeCode := loginWithOneTimeCode(t, context, servers)
+	context.requestsMutex.Lock()
+	context.oneTimeCodes[oneTimeCode].endedAt = time.Now().Add(-oneTimeCodeLifetime - time.Second)
+	context.requestsMutex.Unlock()
+	res, err := http.PostForm(servers.token.URL, url.Values{"code": {oneTimeCode}})
+	require.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+	assert.Empty(t, context.oneTimeCodes)
+}
+
+func TestOIDCTokenHandlerRejectsCodeOfPendingLogin(t *testing.T) {
+	t.Parallel()
+	context, servers := createOneTimeCodeServers(t)
+	res, err := http.Get(servers.login.URL)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	context.requestsMutex.RLock()
+	pendingCodes := []string{}
+	for oneTimeCode := range context.oneTimeCodes {
+		pendingCodes = append(pendingCodes, oneTimeCode)
+	}
+	context.requestsMutex.RUnlock()
+	require.Len(t, pendingCodes, 1)
+	res, err = http.PostForm(servers.token.URL, url.Values{"code": {pendingCodes[0]}})
+	require.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+
+	res, err = http.Get(servers.token.URL + "?code=" + pendingCodes[0])
+	require.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, res.StatusCode)
+}
+
+func TestOIDCTokenHandlerRejectsExchangesOverRateLimit(t *testing.T) {
+	t.Parallel()
+	context, servers := createOneTimeCodeServers(t)
+	context.LoginRateLimit = 1
+
+	res, err := http.PostForm(servers.token.URL, url.Values{"code": {"12345678"}})
+	require.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+
+	res, err = http.PostForm(servers.token.URL, url.Values{"code": {"87654321"}})
+	require.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusTooManyRequests, res.StatusCode)
+	var event errorEvent
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&event))
+	assert.Equal(t, ErrorCodeRateLimited, event.Code)
+}
+
+func TestEndedLoginRemovesExpiredDetachedLoginResults(t *testing.T) {
+	t.Parallel()
+	context, servers := createOneTimeCodeServers(t)
+	oneTimeCode := loginWithOneTimeCode(t, context, servers)
+	context.requestsMutex.Lock()
+	context.oneTimeCodes[oneTimeCode].endedAt = time.Now().Add(-oneTimeCodeLifetime - time.Second)
+	context.polledLogins["expired-poll-token"] = &polledLogin{
+		reqId:   "12345678",
+		result:  &loginResult{accessToken: "mock-access-token"},
+		endedAt: time.Now().Add(-pollResultRetention - time.Second),
+	}
+	context.requestsMutex.Unlock()
+
+	// expired results are removed when another login ends, even if their clients never try to fetch them
+	loginWithOneTimeCode(t, context, servers)
+	assert.Eventually(t, func() bool {
+		context.requestsMutex.RLock()
+		defer context.requestsMutex.RUnlock()
+		_, codeKept := context.oneTimeCodes[oneTimeCode]
+		_, pollKept := context.polledLogins["expired-poll-token"]
+		return !codeKept && !pollKept
+	}, time.Second, time.Millisecond)
+}
+
+func TestOIDCRedirectHandlerAddsOneTimeCodeToSuccessRedirect(t *testing.T) {
+	t.Parallel()
+	context, servers := createOneTimeCodeServers(t)
+	context.SuccessRedirectURI = "http://localhost:8001/logged-in"
+	loginURI := startOneTimeCodeLogin(t, servers.login.URL)
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	res, err := client.Get(fmt.Sprintf("%s?state=%s&code=mock-auth-code", servers.redirect.URL, receivedState(t, loginURI)))
+	require.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusPermanentRedirect, res.StatusCode)
+	location, err := url.Parse(res.Header.Get("Location"))
+	require.NoError(t, err)
+	oneTimeCode := location.Query().Get("one_time_code")
+	assert.NotEmpty(t, oneTimeCode)
+	assert.NotEqual(t, receivedState(t, loginURI), oneTimeCode)
+}
+
+type oneTimeCodeServers struct {
+	login, redirect, token *httptest.Server
+}
+
+// Creates context with mock IdP and servers of one-time code login, redirect and token handlers.
+func createOneTimeCodeServers(t *testing.T) (*Context, oneTimeCodeServers) {
+	oidcConfig := OIDCConfig{
+		RedirectURI:      "http://localhost:8001/cli-oidc-redirect",
+		AuthorizationURI: "http://localhost:8000/mock-idp/auth",
+		ClientId:         "mock-client-id",
+		ClientSecret:     "mock-client-secret",
+	}
+	mockOIDCServer := createMockOIDCServer("mock-auth-code", oidcConfig.ClientId, oidcConfig.ClientSecret, oidcConfig.RedirectURI)
+	t.Cleanup(mockOIDCServer.Close)
+	oidcConfig.BaseURI = mockOIDCServer.URL
+	context := NewContext(oidcConfig)
+	t.Cleanup(context.Close)
+	servers := oneTimeCodeServers{
+		login:    httptest.NewServer(OIDCLoginOneTimeCodeHandler(context)),
+		redirect: httptest.NewServer(OIDCRedirectHandler(context)),
+		token:    httptest.NewServer(OIDCTokenHandler(context)),
+	}
+	t.Cleanup(servers.login.Close)
+	t.Cleanup(servers.redirect.Close)
+	t.Cleanup(servers.token.Close)
+	return context, servers
+}
+
+// Starts a one-time code login and returns its login URI.
+func startOneTimeCodeLogin(t *testing.T, loginURI string) string {
+	res, err := http.Get(loginURI)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	var login oneTimeCodeLoginResponse
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&login))
+	return login.LoginURI
+}
+
+// Logs in with a one-time code login and returns the one-time code shown to the user by redirect handler.
+func loginWithOneTimeCode(t *testing.T, context *Context, servers oneTimeCodeServers) string {
+	loginURI := startOneTimeCodeLogin(t, servers.login.URL)
+	res, err := http.Get(fmt.Sprintf("%s?state=%s&code=mock-auth-code", servers.redirect.URL, receivedState(t, loginURI)))
+	require.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	_, oneTimeCode, found := strings.Cut(strings.TrimSpace(string(body)), "one-time code in your application: ")
+	require.True(t, found, string(body))
+
+	// tokens are stored under the code after the login handler received the result
+	require.Eventually(t, func() bool {
+		context.requestsMutex.RLock()
+		defer context.requestsMutex.RUnlock()
+		login, contains := context.oneTimeCodes[oneTimeCode]
+		return contains && login.result != nil
+	}, time.Second, time.Millisecond)
+	return oneTimeCode
+}
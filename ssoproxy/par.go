@@ -0,0 +1,49 @@
+package ssoproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// Response of pushed authorization request endpoint (RFC 9126).
+type parResponse struct {
+	RequestURI string `json:"request_uri"`
+	ExpiresIn  int    `json:"expires_in"`
+}
+
+// Pushes authorization request params to PAR endpoint of config authenticated with client credentials
+// and returns "request_uri" referencing them, which replaces the params in authorization URI.
+func pushAuthorizationRequest(client *http.Client, params url.Values, config OIDCConfig) (string, error) {
+	form := url.Values{}
+	for param, values := range params {
+		form[param] = values
+	}
+	if !form.Has("redirect_uri") {
+		form.Set("redirect_uri", config.RedirectURI)
+	}
+	if !form.Has("response_type") {
+		form.Set("response_type", "code")
+	}
+	req, err := newClientAuthRequest(config.PARURI, form, config)
+	if err != nil {
+		return "", err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return "", errors.Join(errors.New("failed to execute pushed authorization request"), err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusCreated && res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("pushed authorization request failed: %w", tokenEndpointError(res))
+	}
+	var parRes parResponse
+	if err := json.NewDecoder(res.Body).Decode(&parRes); err != nil {
+		return "", errors.Join(errors.New("received pushed authorization response in invalid format"), err)
+	} else if parRes.RequestURI == "" {
+		return "", errors.New("pushed authorization response does not contain 'request_uri'")
+	}
+	return parRes.RequestURI, nil
+}
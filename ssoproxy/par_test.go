@@ -0,0 +1,117 @@
+package ssoproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOIDCLoginHandlerPushesAuthorizationRequest(t *testing.T) {
+	t.Parallel()
+	pushedParams := make(chan url.Values, 1)
+	mockIdP := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.NoError(t, r.ParseForm())
+		pushedParams <- r.PostForm
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(parResponse{RequestURI: "urn:ietf:params:oauth:request_uri:mock", ExpiresIn: 60})
+	}))
+	defer mockIdP.Close()
+	context := NewContext(OIDCConfig{
+		BaseURI:          "http://localhost:8000/mock-idp",
+		RedirectURI:      "http://localhost:8001/cli-oidc-redirect",
+		AuthorizationURI: "http://localhost:8000/mock-idp/auth?client_id=client-id",
+		ClientId:         "client-id",
+		ClientSecret:     "client-secret",
+		Scopes:           []string{"profile"},
+		PARURI:           fmt.Sprintf("%s/par", mockIdP.URL),
+	})
+	context.LoginTimeout = 10 * time.Millisecond
+	server := httptest.NewServer(OIDCLoginHandler(context))
+	defer server.Close()
+	res, err := http.Get(server.URL)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+
+	authURI := receiveAuthURI(t, res.Body)
+	assert.Equal(t, "/mock-idp/auth", authURI.Path)
+	assert.Equal(t, url.Values{
+		"client_id":   {"client-id"},
+		"request_uri": {"urn:ietf:params:oauth:request_uri:mock"},
+	}, authURI.Query())
+	params := <-pushedParams
+	assert.NotEmpty(t, params.Get("state"))
+	assert.Equal(t, "openid profile", params.Get("scope"))
+	assert.Equal(t, "client-id", params.Get("client_id"))
+	assert.Equal(t, "client-secret", params.Get("client_secret"))
+	assert.Equal(t, "http://localhost:8001/cli-oidc-redirect", params.Get("redirect_uri"))
+	assert.Equal(t, "code", params.Get("response_type"))
+}
+
+func TestOIDCLoginHandlerFailsIfPushedAuthorizationRequestFails(t *testing.T) {
+	t.Parallel()
+	mockIdP := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"error":"invalid_request","error_description":"redirect_uri is not registered"}`))
+	}))
+	defer mockIdP.Close()
+	context := NewContext(OIDCConfig{
+		BaseURI:          "http://localhost:8000/mock-idp",
+		RedirectURI:      "http://localhost:8001/cli-oidc-redirect",
+		AuthorizationURI: "http://localhost:8000/mock-idp/auth",
+		ClientId:         "client-id",
+		PARURI:           fmt.Sprintf("%s/par", mockIdP.URL),
+	})
+	server := httptest.NewServer(OIDCLoginHandler(context))
+	defer server.Close()
+	res, err := http.Get(server.URL)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(body), fmt.Sprintf("event: %s\n", eventError)))
+	assert.Contains(t, string(body), ErrorCodeIdPError)
+	assert.Equal(t, 0, context.PendingLogins())
+	assert.Equal(t, 1, context.Stats().Failed)
+}
+
+func TestOIDCLoginHandlerDoesNotPushAuthorizationRequestOfRejectedLogin(t *testing.T) {
+	t.Parallel()
+	pushedRequests := atomic.Int32{}
+	mockIdP := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pushedRequests.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(parResponse{RequestURI: "urn:ietf:params:oauth:request_uri:mock", ExpiresIn: 60})
+	}))
+	defer mockIdP.Close()
+	context := NewContext(OIDCConfig{
+		BaseURI:          "http://localhost:8000/mock-idp",
+		RedirectURI:      "http://localhost:8001/cli-oidc-redirect",
+		AuthorizationURI: "http://localhost:8000/mock-idp/auth",
+		ClientId:         "client-id",
+		PARURI:           fmt.Sprintf("%s/par", mockIdP.URL),
+	})
+	// logins are rejected after shutdown started
+	context.Close()
+	server := httptest.NewServer(OIDCLoginHandler(context))
+	defer server.Close()
+	res, err := http.Get(server.URL)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+
+	assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+	assert.Equal(t, int32(0), pushedRequests.Load())
+}
@@ -0,0 +1,221 @@
+package ssoproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// How long a result of a polled login is kept for the client after the login ended.
+const pollResultRetention = time.Minute
+
+// form or query parameter of poll request with poll token received from OIDCLoginPollHandler
+const pollTokenParam = "poll_token"
+
+// Status of a polled login that is waiting for user to log in.
+const pollStatusPending = "pending"
+
+type pollLoginResponse struct {
+	LoginURI  string `json:"login_uri"`
+	PollToken string `json:"poll_token"`
+}
+
+type pollPendingResponse struct {
+	Status string `json:"status"`
+}
+
+// Login started by OIDCLoginPollHandler, the client polls OIDCPollHandler for its result.
+type polledLogin struct {
+	reqId string
+	// nil while the login is pending
+	result  *loginResult
+	endedAt time.Time
+}
+
+// Handles login process from an application that can't consume Server-Sent Events.
+// Starts a login like OIDCLoginHandler, supporting the same query parameters except "token-stream",
+// and responds with JSON `{"login_uri": "https://some-sso.com/auth", "poll_token": "..."}`.
+// The client shows login URI to the user and polls OIDCPollHandler with the poll token until
+// the login completes, similarly to OAuth 2.0 Device Authorization Grant.
+// Errors are sent as JSON `{"code": "...", "message": "..."}` like "error" events of OIDCLoginHandler.
+// OIDCRedirectHandler must be used with this handler.
+func OIDCLoginPollHandler(ctx *Context) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if handleCORS(w, r, ctx) {
+			return
+		}
+		// poll token is not sent to IdP, so only the client that started the login can poll its result
+		pollToken, err := generateReqId(ctx.ReqIdLength)
+		if err != nil {
+			ctx.Logger.Error(fmt.Sprintf("Failed to generate poll token: %v", err))
+			sendJSONError(w, ctx, http.StatusInternalServerError, ErrorCodeInternalError, "Failed to generate random poll token")
+			return
+		}
+		reqId, authURI, session, ok := startDetachedLogin(w, r, ctx)
+		if !ok {
+			return
+		}
+		ctx.requestsMutex.Lock()
+		ctx.polledLogins[pollToken] = &polledLogin{reqId: reqId}
+		ctx.requestsMutex.Unlock()
+		go func() {
+			defer ctx.activeLogins.Done()
+			ctx.waitForLogin(reqId, session, func(loginResult *loginResult) {
+				ctx.Logger.Info("Received login result from OIDC redirect handler, waiting for client to poll it", reqIdLogArg, reqId)
+				if loginResult.err != nil {
+					ctx.Logger.Warn(fmt.Sprintf("OIDC login failed: %v", loginResult.err), reqIdLogArg, reqId)
+					ctx.loginFailed(reqId, loginResult.err)
+				}
+				ctx.requestsMutex.Lock()
+				if login, contains := ctx.polledLogins[pollToken]; contains {
+					login.result = loginResult
+					login.endedAt = time.Now()
+				}
+				ctx.requestsMutex.Unlock()
+			})
+		}()
+
+		ctx.Logger.Info("Sending OIDC authorization URI and poll token to client", reqIdLogArg, reqId)
+		sendJSON(w, ctx, http.StatusOK, pollLoginResponse{LoginURI: authURI, PollToken: pollToken})
+	})
+}
+
+// Creates a login whose result is not sent on the login request, e.g. because the client polls it,
+// errors are sent as JSON responses. Context.activeLogins.Done must be called after the login finished.
+// Reports false if the login was not created and an error was already sent to the client.
+func startDetachedLogin(w http.ResponseWriter, r *http.Request, ctx *Context) (reqId, authURI string, session *loginSession, ok bool) {
+	if !ctx.allowLogin(r) {
+		ctx.Logger.Warn("Rejected login exceeding rate limit", "client-ip", ctx.clientIP(r))
+		sendJSONError(w, ctx, http.StatusTooManyRequests, ErrorCodeRateLimited, "Too many logins, try again later")
+		return "", "", nil, false
+	}
+	reqId, err := ctx.newReqId()
+	if err != nil {
+		ctx.Logger.Error(fmt.Sprintf("Failed to generate request id: %v", err))
+		sendJSONError(w, ctx, http.StatusInternalServerError, ErrorCodeInternalError, "Failed to generate random request id")
+		return "", "", nil, false
+	}
+	config, ok := ctx.providerConfig(r.URL.Query().Get(providerParam))
+	if !ok {
+		ctx.Logger.Warn(fmt.Sprintf("Rejected login of unknown provider '%s'", r.URL.Query().Get(providerParam)), reqIdLogArg, reqId)
+		sendJSONError(w, ctx, http.StatusBadRequest, ErrorCodeInvalidRequest, "Unknown provider")
+		return "", "", nil, false
+	}
+	if config, err = ctx.selectRedirectURI(r, config, reqId); err != nil {
+		sendJSONError(w, ctx, http.StatusBadRequest, ErrorCodeInvalidRequest, err.Error())
+		return "", "", nil, false
+	}
+	timeout := ctx.requestedLoginTimeout(r.URL.Query().Get(loginTimeoutParam))
+	authURI, nonce, err := ctx.authorizationURI(r, config, reqId)
+	if err != nil {
+		statusCode := http.StatusInternalServerError
+		if loginErrorCode(err) == ErrorCodeInvalidRequest {
+			statusCode = http.StatusBadRequest
+		}
+		sendJSONError(w, ctx, statusCode, loginErrorCode(err), err.Error())
+		return "", "", nil, false
+	}
+
+	session, err = ctx.createLogin(reqId, config, nonce, timeout)
+	if errors.Is(err, errDuplicateReqId) {
+		ctx.Logger.Error(fmt.Sprintf("Rejected login: %v", err), reqIdLogArg, reqId)
+		sendJSONError(w, ctx, http.StatusInternalServerError, ErrorCodeInternalError, "Failed to generate unique request id")
+		return "", "", nil, false
+	} else if err != nil {
+		ctx.Logger.Warn(fmt.Sprintf("Rejected login: %v", err), reqIdLogArg, reqId)
+		if errors.Is(err, errShuttingDown) {
+			sendJSONError(w, ctx, http.StatusServiceUnavailable, ErrorCodeUnavailable, "Proxy is shutting down, try again later")
+		} else {
+			sendJSONError(w, ctx, http.StatusServiceUnavailable, ErrorCodeUnavailable, "Too many pending logins, try again later")
+		}
+		return "", "", nil, false
+	}
+	if authURI, err = ctx.pushedAuthorizationURI(authURI, config, reqId); err != nil {
+		ctx.abortLogin(reqId, err)
+		ctx.activeLogins.Done()
+		sendJSONError(w, ctx, http.StatusInternalServerError, loginErrorCode(err), err.Error())
+		return "", "", nil, false
+	}
+	return reqId, authURI, session, true
+}
+
+// Handles polling of logins started by OIDCLoginPollHandler. The poll token is read from "poll_token"
+// query parameter or form field of a POST request.
+//
+// Responses:
+//
+//	202 `{"status": "pending"}` // user has not logged in yet, poll again later
+//	200 `{"access_token": "access", "refresh_token": "refresh", "expiration": 3600}` // same as "logged-in" event of OIDCLoginHandler
+//	4xx/5xx `{"code": "timeout", "message": "Error description"}` // login failed, code is one of ErrorCode* constants
+//
+// The result of a finished login is returned only once and is discarded if it is not polled within a minute,
+// unknown poll tokens are rejected with status 404.
+func OIDCPollHandler(ctx *Context) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if handleCORS(w, r, ctx) {
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodPost {
+			sendJSONError(w, ctx, http.StatusMethodNotAllowed, ErrorCodeInvalidRequest, fmt.Sprintf("HTTP method %s is not allowed", r.Method))
+			return
+		}
+		pollToken := r.URL.Query().Get(pollTokenParam)
+		if r.Method == http.MethodPost {
+			if err := r.ParseForm(); err == nil && r.PostForm.Has(pollTokenParam) {
+				pollToken = r.PostForm.Get(pollTokenParam)
+			}
+		}
+
+		ctx.requestsMutex.Lock()
+		ctx.removeExpiredPolledLogins()
+		login, contains := ctx.polledLogins[pollToken]
+		if contains && login.result != nil {
+			delete(ctx.polledLogins, pollToken)
+		}
+		ctx.requestsMutex.Unlock()
+
+		if !contains {
+			ctx.Logger.Warn("Polled login not found, it was already polled, expired or the poll token is invalid")
+			sendJSONError(w, ctx, http.StatusNotFound, ErrorCodeInvalidRequest, "Unknown poll token, the login result was already received or expired")
+		} else if login.result == nil {
+			sendJSON(w, ctx, http.StatusAccepted, pollPendingResponse{Status: pollStatusPending})
+		} else if login.result.err != nil {
+			statusCode := http.StatusBadRequest
+			if loginErrorCode(login.result.err) == ErrorCodeUnavailable {
+				statusCode = http.StatusServiceUnavailable
+			}
+			sendJSONError(w, ctx, statusCode, loginErrorCode(login.result.err), fmt.Sprintf("OIDC login failed, reason: %v", login.result.err))
+		} else {
+			ctx.Logger.Info("Sending successful login result to client", reqIdLogArg, login.reqId)
+			sendJSON(w, ctx, http.StatusOK, ctx.newTokensEvent(login.result))
+			ctx.loginCompleted(login.reqId, login.result)
+		}
+	})
+}
+
+// Removes results of polled logins that were not polled within pollResultRetention, requestsMutex must be locked.
+func (ctx *Context) removeExpiredPolledLogins() {
+	for pollToken, login := range ctx.polledLogins {
+		if login.result != nil && time.Since(login.endedAt) > pollResultRetention {
+			ctx.Logger.Warn("Discarding login result that was not polled by client", reqIdLogArg, login.reqId)
+			delete(ctx.polledLogins, pollToken)
+		}
+	}
+}
+
+// Writes value as JSON response with status code.
+func sendJSON(w http.ResponseWriter, ctx *Context, statusCode int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		ctx.Logger.Error(fmt.Sprintf("Could not write JSON response: %v", err))
+	}
+}
+
+// Writes error code and message as JSON response with status code, the body has the same format as "error" login event.
+func sendJSONError(w http.ResponseWriter, ctx *Context, statusCode int, code, message string) {
+	sendJSON(w, ctx, statusCode, errorEvent{Code: code, Message: message})
+}
@@ -0,0 +1,134 @@
+package ssoproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOIDCPollHandlerReturnsPendingAndCompletedLogin(t *testing.T) {
+	t.Parallel()
+	context := NewContext(OIDCConfig{
+		BaseURI:          "http://localhost:8000/mock-idp",
+		RedirectURI:      "http://localhost:8001/cli-oidc-redirect",
+		AuthorizationURI: "http://localhost:8000/mock-idp/auth",
+		ClientId:         "client-id",
+		ClientSecret:     "client-secret",
+	})
+	loginServer := httptest.NewServer(OIDCLoginPollHandler(context))
+	defer loginServer.Close()
+	pollServer := httptest.NewServer(OIDCPollHandler(context))
+	defer pollServer.Close()
+
+	login := startPolledLogin(t, loginServer.URL)
+	res, err := http.PostForm(pollServer.URL, url.Values{"poll_token": {login.PollToken}})
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusAccepted, res.StatusCode)
+	var pending pollPendingResponse
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&pending))
+	assert.Equal(t, pollStatusPending, pending.Status)
+
+	// mock a redirect from IdP
+	assert.NoError(t, context.onLoginSuccess(receivedState(t, login.LoginURI), &tokenResponse{
+		AccessToken:  "mock-access-token",
+		RefreshToken: "mock-refresh-token",
+		ExpiresIn:    600,
+	}))
+	res = pollUntilDone(t, pollServer.URL+"?poll_token="+login.PollToken)
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	var tokens tokensEvent
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&tokens))
+	assert.Equal(t, "mock-access-token", tokens.AccessToken)
+	assert.Equal(t, "mock-refresh-token", tokens.RefreshToken)
+	assert.Equal(t, 600, tokens.Expiration)
+
+	// the result is returned only once
+	res, err = http.Get(pollServer.URL + "?poll_token=" + login.PollToken)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+}
+
+func TestOIDCPollHandlerReturnsFailedLogin(t *testing.T) {
+	t.Parallel()
+	context := NewContext(OIDCConfig{
+		BaseURI:          "http://localhost:8000/mock-idp",
+		RedirectURI:      "http://localhost:8001/cli-oidc-redirect",
+		AuthorizationURI: "http://localhost:8000/mock-idp/auth",
+		ClientId:         "client-id",
+	})
+	loginServer := httptest.NewServer(OIDCLoginPollHandler(context))
+	defer loginServer.Close()
+	pollServer := httptest.NewServer(OIDCPollHandler(context))
+	defer pollServer.Close()
+
+	login := startPolledLogin(t, loginServer.URL)
+	context.onLoginError(receivedState(t, login.LoginURI), newLoginError(ErrorCodeIdPError, errors.New("IdP returned error 'access_denied'")))
+	res := pollUntilDone(t, pollServer.URL+"?poll_token="+login.PollToken)
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	var event errorEvent
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&event))
+	assert.Equal(t, ErrorCodeIdPError, event.Code)
+	assert.Contains(t, event.Message, "access_denied")
+
+	res, err := http.Get(pollServer.URL + "?poll_token=unknown")
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+}
+
+func TestOIDCLoginPollHandlerRejectsUnknownProvider(t *testing.T) {
+	t.Parallel()
+	context := NewContext(OIDCConfig{
+		BaseURI:          "http://localhost:8000/mock-idp",
+		RedirectURI:      "http://localhost:8001/cli-oidc-redirect",
+		AuthorizationURI: "http://localhost:8000/mock-idp/auth",
+		ClientId:         "client-id",
+	})
+	server := httptest.NewServer(OIDCLoginPollHandler(context))
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "?provider=unknown")
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	var event errorEvent
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&event))
+	assert.Equal(t, ErrorCodeInvalidRequest, event.Code)
+	assert.Empty(t, context.polledLogins)
+}
+
+// Starts a polled login and returns login URI and poll token.
+func startPolledLogin(t *testing.T, loginURI string) pollLoginResponse {
+	res, err := http.Get(loginURI)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	var login pollLoginResponse
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&login))
+	assert.NotEmpty(t, login.PollToken)
+	assert.NotEqual(t, receivedState(t, login.LoginURI), login.PollToken)
+	return login
+}
+
+// Polls uri until the login is not pending anymore and returns the response.
+func pollUntilDone(t *testing.T, uri string) *http.Response {
+	for {
+		res, err := http.Get(uri)
+		assert.NoError(t, err)
+		if res.StatusCode != http.StatusAccepted {
+			return res
+		}
+		res.Body.Close()
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,79 @@
+package ssoproxy
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Period in which Context.LoginRateLimit logins are allowed from one client IP.
+const loginRatePeriod = time.Minute
+
+// Token buckets of client IPs limiting their login rate.
+type loginRateLimiter struct {
+	mutex   sync.Mutex
+	buckets map[string]*tokenBucket
+	// buckets that were refilled to full capacity are removed at most once per period
+	sweptAt time.Time
+}
+
+// Token bucket of a single client, each login takes one token.
+type tokenBucket struct {
+	tokens     float64
+	refilledAt time.Time
+}
+
+// Takes a login token of client IP from its bucket refilled with limit tokens per minute, the bucket holds
+// at most limit tokens. Returns false if the client has no tokens left and its login must be rejected.
+func (limiter *loginRateLimiter) allow(clientIP string, limit int, now time.Time) bool {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	capacity := float64(limit)
+	refillRate := capacity / float64(loginRatePeriod)
+	if now.Sub(limiter.sweptAt) >= loginRatePeriod {
+		for ip, bucket := range limiter.buckets {
+			if bucket.tokens+float64(now.Sub(bucket.refilledAt))*refillRate >= capacity {
+				delete(limiter.buckets, ip)
+			}
+		}
+		limiter.sweptAt = now
+	}
+	bucket, found := limiter.buckets[clientIP]
+	if !found {
+		bucket = &tokenBucket{tokens: capacity, refilledAt: now}
+		limiter.buckets[clientIP] = bucket
+	}
+	bucket.tokens = min(capacity, bucket.tokens+float64(now.Sub(bucket.refilledAt))*refillRate)
+	bucket.refilledAt = now
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// Returns false if Context.LoginRateLimit is set and client of login request r exceeded it.
+func (ctx *Context) allowLogin(r *http.Request) bool {
+	if ctx.LoginRateLimit <= 0 {
+		return true
+	}
+	return ctx.loginRateLimiter.allow(ctx.clientIP(r), ctx.LoginRateLimit, time.Now())
+}
+
+// Returns IP of client that sent request r. If Context.TrustForwardedFor is enabled, the last address
+// of X-Forwarded-For header is used, which was added by the trusted reverse proxy.
+func (ctx *Context) clientIP(r *http.Request) string {
+	if ctx.TrustForwardedFor {
+		forwardedFor := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+		if ip := strings.TrimSpace(forwardedFor[len(forwardedFor)-1]); ip != "" {
+			return ip
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
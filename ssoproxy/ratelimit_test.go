@@ -0,0 +1,108 @@
+package ssoproxy
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOIDCLoginHandlerAllowsLoginsUnderRateLimit(t *testing.T) {
+	t.Parallel()
+	context := NewContext(OIDCConfig{
+		BaseURI:          "http://localhost:8000/mock-idp",
+		RedirectURI:      "http://localhost:8001/cli-oidc-redirect",
+		AuthorizationURI: "http://localhost:8000/mock-idp/auth",
+		ClientId:         "client-id",
+		ClientSecret:     "client-secret",
+	})
+	context.LoginRateLimit = 3
+	server := httptest.NewServer(OIDCLoginHandler(context))
+	defer server.Close()
+
+	for i := 0; i < context.LoginRateLimit; i++ {
+		res, err := http.Get(server.URL)
+		assert.NoError(t, err)
+		defer res.Body.Close()
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		reqId := receiveAuthURI(t, res.Body).Query().Get("state")
+		defer context.onLoginError(reqId, errors.New("test finished"))
+	}
+}
+
+func TestOIDCLoginHandlerRejectsLoginsOverRateLimit(t *testing.T) {
+	t.Parallel()
+	context := NewContext(OIDCConfig{
+		BaseURI:          "http://localhost:8000/mock-idp",
+		RedirectURI:      "http://localhost:8001/cli-oidc-redirect",
+		AuthorizationURI: "http://localhost:8000/mock-idp/auth",
+		ClientId:         "client-id",
+		ClientSecret:     "client-secret",
+	})
+	context.LoginRateLimit = 1
+	server := httptest.NewServer(OIDCLoginHandler(context))
+	defer server.Close()
+
+	res, err := http.Get(server.URL)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	reqId := receiveAuthURI(t, res.Body).Query().Get("state")
+	defer context.onLoginError(reqId, errors.New("test finished"))
+
+	res, err = http.Get(server.URL)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusTooManyRequests, res.StatusCode)
+	events := map[string]string{}
+	_ = consumeSSEFromHTTPEventStream(res.Body, func(event, data string) error {
+		events[event] = data
+		return nil
+	})
+	assert.Contains(t, events[eventError], ErrorCodeRateLimited)
+	assert.NotContains(t, events, eventAuthURI)
+}
+
+func TestLoginRateLimiterRefillsTokens(t *testing.T) {
+	t.Parallel()
+	limiter := &loginRateLimiter{buckets: make(map[string]*tokenBucket)}
+	now := time.Now()
+
+	assert.True(t, limiter.allow("10.0.0.1", 2, now))
+	assert.True(t, limiter.allow("10.0.0.1", 2, now))
+	assert.False(t, limiter.allow("10.0.0.1", 2, now))
+	assert.True(t, limiter.allow("10.0.0.2", 2, now), "other client has its own bucket")
+
+	assert.True(t, limiter.allow("10.0.0.1", 2, now.Add(loginRatePeriod/2)))
+	assert.False(t, limiter.allow("10.0.0.1", 2, now.Add(loginRatePeriod/2)))
+}
+
+func TestLoginRateLimiterRemovesFullBuckets(t *testing.T) {
+	t.Parallel()
+	limiter := &loginRateLimiter{buckets: make(map[string]*tokenBucket)}
+	now := time.Now()
+
+	assert.True(t, limiter.allow("10.0.0.1", 1, now))
+	assert.True(t, limiter.allow("10.0.0.2", 1, now.Add(2*loginRatePeriod)))
+	assert.NotContains(t, limiter.buckets, "10.0.0.1")
+	assert.Contains(t, limiter.buckets, "10.0.0.2")
+}
+
+func TestClientIP(t *testing.T) {
+	t.Parallel()
+	context := NewContext(OIDCConfig{})
+	r := httptest.NewRequest(http.MethodGet, "/cli-login", nil)
+	r.RemoteAddr = "192.0.2.1:51234"
+	r.Header.Add("X-Forwarded-For", "203.0.113.7, 198.51.100.3")
+
+	assert.Equal(t, "192.0.2.1", context.clientIP(r), "X-Forwarded-For is ignored by default")
+
+	context.TrustForwardedFor = true
+	assert.Equal(t, "198.51.100.3", context.clientIP(r))
+
+	r.Header.Del("X-Forwarded-For")
+	assert.Equal(t, "192.0.2.1", context.clientIP(r))
+}
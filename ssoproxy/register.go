@@ -0,0 +1,51 @@
+package ssoproxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+)
+
+// Mounts OIDCLoginHandler at loginPath and OIDCRedirectHandler at path of OIDCConfig.RedirectURI,
+// so the redirect handler always serves the URI the IdP redirects to. Paths of OIDCConfig.AllowedRedirectURIs
+// and redirect paths of Context.Providers are mounted as well. If Context.PathPrefix is set, it is stripped from redirect paths,
+// because the reverse proxy strips it from requests, loginPath is mounted as is.
+// Returns error if a redirect URI is invalid, is not under the prefix or collides with loginPath.
+func RegisterHandlers(mux *http.ServeMux, ctx *Context, loginPath string) error {
+	redirectPaths := []string{}
+	configs := []OIDCConfig{ctx.config}
+	for _, config := range ctx.Providers {
+		configs = append(configs, config)
+	}
+	redirectURIs := []string{}
+	for _, config := range configs {
+		redirectURIs = append(redirectURIs, config.RedirectURI)
+		redirectURIs = append(redirectURIs, config.AllowedRedirectURIs...)
+	}
+	for _, uri := range redirectURIs {
+		redirectURI, err := url.Parse(uri)
+		if err != nil {
+			return errors.Join(fmt.Errorf("invalid redirect URI '%s'", uri), err)
+		}
+		redirectPath, ok := ctx.internalPath(redirectURI.Path)
+		if !ok {
+			return fmt.Errorf("redirect URI path '%s' is not under path prefix '%s'", redirectURI.Path, ctx.PathPrefix)
+		} else if redirectPath == "" {
+			redirectPath = "/"
+		}
+		if redirectPath == loginPath {
+			return fmt.Errorf("redirect URI path '%s' is the same as login path", redirectPath)
+		}
+		if !slices.Contains(redirectPaths, redirectPath) {
+			redirectPaths = append(redirectPaths, redirectPath)
+		}
+	}
+	mux.Handle(loginPath, OIDCLoginHandler(ctx))
+	redirectHandler := OIDCRedirectHandler(ctx)
+	for _, redirectPath := range redirectPaths {
+		mux.Handle(redirectPath, redirectHandler)
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package ssoproxy
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegisterHandlersMountsLoginAndRedirect(t *testing.T) {
+	t.Parallel()
+	context := NewContext(OIDCConfig{
+		BaseURI:          "http://localhost:8000/mock-idp",
+		RedirectURI:      "http://localhost:8001/oidc/cli-logged-in",
+		AuthorizationURI: "http://localhost:8000/mock-idp/auth",
+		ClientId:         "mock-client-id",
+	})
+	context.LoginTimeout = 10 * time.Millisecond
+	mux := http.NewServeMux()
+	require.NoError(t, RegisterHandlers(mux, context, "/cli-login"))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	res, err := http.Get(fmt.Sprint(server.URL, "/cli-login"))
+	require.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+	receiveAuthURI(t, res.Body)
+
+	// redirect handler rejects redirect without state
+	res, err = http.Get(fmt.Sprint(server.URL, "/oidc/cli-logged-in?code=mock-auth-code"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	res, err = http.Get(fmt.Sprint(server.URL, "/cli-logged-in"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+}
+
+func TestRegisterHandlersRejectsCollidingPaths(t *testing.T) {
+	t.Parallel()
+	context := NewContext(OIDCConfig{RedirectURI: "http://localhost:8001/cli-login", ClientId: "mock-client-id"})
+	assert.Error(t, RegisterHandlers(http.NewServeMux(), context, "/cli-login"))
+}
+
+func TestRegisterHandlersServesLoginUnderPathPrefix(t *testing.T) {
+	t.Parallel()
+	oidcConfig := OIDCConfig{
+		RedirectURI:      "http://localhost:8001/sso/cli-logged-in",
+		AuthorizationURI: "http://localhost:8000/mock-idp/auth",
+		ClientId:         "mock-client-id",
+		ClientSecret:     "mock-client-secret",
+	}
+	mockOIDCServer := createMockOIDCServer("mock-auth-code", oidcConfig.ClientId, oidcConfig.ClientSecret, oidcConfig.RedirectURI)
+	defer mockOIDCServer.Close()
+	oidcConfig.BaseURI = mockOIDCServer.URL
+	logs := &logRecorder{}
+	context := NewContext(oidcConfig)
+	context.Logger = slog.New(slog.NewJSONHandler(logs, nil))
+	context.PathPrefix = "/sso"
+	context.SuccessRedirectURI = "/logged-in"
+	mux := http.NewServeMux()
+	require.NoError(t, RegisterHandlers(mux, context, "/cli-login"))
+	// reverse proxy exposing the proxy under /sso strips the prefix
+	server := httptest.NewServer(http.StripPrefix("/sso", mux))
+	defer server.Close()
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	res, err := http.Get(fmt.Sprint(server.URL, "/sso/cli-login"))
+	require.NoError(t, err)
+	defer res.Body.Close()
+	events := []string{}
+	_ = consumeSSEFromHTTPEventStream(res.Body, func(event, data string) error {
+		events = append(events, event)
+		if event == eventAuthURI {
+			redirectRes, err := client.Get(fmt.Sprint(server.URL, "/sso/cli-logged-in?code=mock-auth-code&state=", receivedState(t, data)))
+			require.NoError(t, err)
+			assert.Equal(t, "/sso/logged-in", redirectRes.Header.Get("Location"))
+		}
+		return nil
+	})
+	assert.Equal(t, []string{eventAuthURI, eventLoggedIn}, events)
+	for _, record := range logs.records() {
+		assert.NotContains(t, record["msg"], "Token exchange will probably fail")
+	}
+}
+
+func TestRegisterHandlersRejectsRedirectURIOutsidePathPrefix(t *testing.T) {
+	t.Parallel()
+	context := NewContext(OIDCConfig{RedirectURI: "http://localhost:8001/cli-logged-in", ClientId: "mock-client-id"})
+	context.PathPrefix = "/sso"
+	assert.ErrorContains(t, RegisterHandlers(http.NewServeMux(), context, "/cli-login"), "is not under path prefix")
+}
+
+func TestRegisterHandlersMountsAllowedRedirectURIs(t *testing.T) {
+	t.Parallel()
+	context := NewContext(OIDCConfig{
+		RedirectURI:         "http://localhost:8001/cli-logged-in",
+		AllowedRedirectURIs: []string{"https://cli.example.com/oidc/cli-logged-in"},
+		ClientId:            "mock-client-id",
+	})
+	mux := http.NewServeMux()
+	require.NoError(t, RegisterHandlers(mux, context, "/cli-login"))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	// redirect handler rejects redirect without state
+	res, err := http.Get(fmt.Sprint(server.URL, "/oidc/cli-logged-in?code=mock-auth-code"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+}
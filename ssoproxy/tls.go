@@ -0,0 +1,33 @@
+package ssoproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"sync"
+)
+
+// Creates HTTP client trusting certificates in caCertPEM in addition to system roots, e.g. a CA of internal IdP.
+// Returns http.DefaultClient if caCertPEM is empty.
+func newCAHTTPClient(caCertPEM []byte) (*http.Client, error) {
+	if len(caCertPEM) == 0 {
+		return http.DefaultClient, nil
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(caCertPEM) {
+		return nil, errors.New("no valid PEM certificate found")
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	return &http.Client{Transport: transport}, nil
+}
+
+// HTTP client of Context created once from Context.CACertPEM.
+type caHTTPClient struct {
+	once   *sync.Once
+	client *http.Client
+}
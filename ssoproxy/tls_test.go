@@ -0,0 +1,60 @@
+package ssoproxy
+
+import (
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOIDCRedirectHandlerTrustsCACertPEM(t *testing.T) {
+	t.Parallel()
+	oidcConfig := OIDCConfig{
+		RedirectURI:      "http://localhost:8001/cli-oidc-redirect",
+		AuthorizationURI: "http://localhost:8000/mock-idp/auth",
+		ClientId:         "mock-client-id",
+		ClientSecret:     "mock-client-secret",
+	}
+	mockOIDCServer := createMockOIDCServer("mock-auth-code", oidcConfig.ClientId, oidcConfig.ClientSecret, oidcConfig.RedirectURI)
+	defer mockOIDCServer.Close()
+	// same IdP served over TLS with a self-signed certificate
+	tlsServer := httptest.NewTLSServer(mockOIDCServer.Config.Handler)
+	defer tlsServer.Close()
+	oidcConfig.BaseURI = tlsServer.URL
+	caCertPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tlsServer.Certificate().Raw})
+
+	for _, test := range []struct {
+		caCertPEM  []byte
+		statusCode int
+	}{
+		{nil, http.StatusInternalServerError},
+		{caCertPEM, http.StatusOK},
+	} {
+		context := NewContext(oidcConfig)
+		context.CACertPEM = test.caCertPEM
+		server := httptest.NewServer(OIDCRedirectHandler(context))
+		startLogin(context, "12345678")
+
+		res, err := http.Get(fmt.Sprint(server.URL, "?state=12345678&code=mock-auth-code"))
+		require.NoError(t, err)
+		assert.Equal(t, test.statusCode, res.StatusCode)
+		server.Close()
+	}
+}
+
+func TestContextHTTPClientPrefersHTTPClient(t *testing.T) {
+	t.Parallel()
+	context := NewContext(OIDCConfig{})
+	assert.Same(t, http.DefaultClient, context.httpClient())
+
+	context.CACertPEM = []byte("not a certificate")
+	assert.Same(t, http.DefaultClient, context.httpClient(), "invalid CA is ignored")
+
+	client := &http.Client{}
+	context.HTTPClient = client
+	assert.Same(t, client, context.httpClient())
+}
@@ -0,0 +1,69 @@
+package ssoproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Keeps login stream open and refreshes tokens before they expire until the client disconnects
+// or the refresh fails. Each refreshed token set is sent to the client as "oidc-tokens" event.
+// Events have no SSE id, a login can't be resumed after its result was sent.
+func streamRefreshedTokens(
+	w http.ResponseWriter,
+	r *http.Request,
+	ctx *Context,
+	config OIDCConfig,
+	reqId string,
+	tokens *loginResult,
+) {
+	ctx.Logger.Info("Keeping login stream open for token refresh", reqIdLogArg, reqId)
+	for {
+		if tokens.refreshToken == "" || tokens.expiration <= 0 {
+			ctx.Logger.Warn("Can't refresh tokens without refresh token or access token expiration", reqIdLogArg, reqId)
+			sendErrorEvent(w, ctx, "", ErrorCodeExpiredSession, "Tokens can't be refreshed, refresh token or expiration is missing")
+			return
+		}
+		select {
+		case <-time.After(refreshDelay(time.Duration(tokens.expiration)*time.Second, ctx.TokenRefreshLeeway)):
+		case <-r.Context().Done():
+			ctx.Logger.Info("Client closed token stream", reqIdLogArg, reqId)
+			return
+		case <-ctx.shutdown:
+			ctx.Logger.Info("Closing token stream, proxy is shutting down", reqIdLogArg, reqId)
+			sendErrorEvent(w, ctx, "", ErrorCodeUnavailable, "Proxy is shutting down")
+			return
+		}
+
+		tokenRes, err := oidcTokenRequest(ctx.httpClient(), url.Values{
+			"refresh_token": {tokens.refreshToken},
+			"grant_type":    {"refresh_token"},
+		}, config)
+		if err != nil {
+			ctx.Logger.Warn(fmt.Sprintf("Failed to refresh tokens: %v", err), reqIdLogArg, reqId)
+			sendErrorEvent(w, ctx, "", ErrorCodeExpiredSession, "Failed to refresh tokens")
+			return
+		}
+		if tokenRes.RefreshToken == "" { // IdP may not rotate refresh tokens
+			tokenRes.RefreshToken = tokens.refreshToken
+		}
+		ctx.deriveUnknownExpiration(reqId, tokenRes)
+		tokens = newLoginResult(tokenRes)
+		eventData, err := json.Marshal(ctx.newTokensEvent(tokens))
+		if err != nil {
+			ctx.Logger.Error(fmt.Sprintf("Could not marshal refreshed tokens event to JSON: %v", err), reqIdLogArg, reqId)
+			sendErrorEvent(w, ctx, "", ErrorCodeInternalError, "Failed to generate token event")
+			return
+		}
+		ctx.Logger.Info("Sending refreshed tokens to client", reqIdLogArg, reqId)
+		sendSSEEvent(w, ctx, "", string(eventData), eventTokensRefreshed)
+	}
+}
+
+// Returns how long to wait before refreshing tokens that expire after expiration,
+// tokens are refreshed leeway before expiration, but never sooner than in half of their lifetime.
+func refreshDelay(expiration, leeway time.Duration) time.Duration {
+	return max(expiration-leeway, expiration/2)
+}
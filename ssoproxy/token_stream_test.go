@@ -0,0 +1,107 @@
+package ssoproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOIDCLoginHandlerStreamsRefreshedTokens(t *testing.T) {
+	t.Parallel()
+	refreshCount := atomic.Int32{}
+	mockOIDCServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		if r.Form.Get("grant_type") != "refresh_token" {
+			http.Error(w, "Invalid grant_type", http.StatusBadRequest)
+			return
+		}
+		count := refreshCount.Add(1)
+		if r.Form.Get("refresh_token") != fmt.Sprintf("mock-refresh-token-%d", count-1) {
+			http.Error(w, "Invalid refresh_token", http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, `{"access_token":"mock-access-token-%[1]d","refresh_token":"mock-refresh-token-%[1]d","expires_in":1}`, count)
+	}))
+	defer mockOIDCServer.Close()
+	context := NewContext(OIDCConfig{
+		BaseURI:          mockOIDCServer.URL,
+		RedirectURI:      "http://localhost:8001/cli-oidc-redirect",
+		AuthorizationURI: "http://localhost:8000/mock-idp/auth",
+		ClientId:         "client-id",
+		ClientSecret:     "client-secret",
+	})
+	context.TokenStream = true
+	server := httptest.NewServer(OIDCLoginHandler(context))
+	defer server.Close()
+	res, err := http.Get(fmt.Sprint(server.URL, "?token-stream=true"))
+	assert.NoError(t, err)
+	defer res.Body.Close()
+
+	refreshedTokens := []tokensEvent{}
+	_ = consumeSSEFromHTTPEventStream(
+		res.Body,
+		func(event, data string) error {
+			if event == eventAuthURI {
+				reqId := receivedState(t, data)
+				_ = context.onLoginSuccess(reqId, &tokenResponse{AccessToken: "mock-access-token-0", RefreshToken: "mock-refresh-token-0", ExpiresIn: 1})
+			} else if event == eventTokensRefreshed {
+				var tokens tokensEvent
+				assert.NoError(t, json.Unmarshal([]byte(data), &tokens))
+				refreshedTokens = append(refreshedTokens, tokens)
+				if len(refreshedTokens) == 2 {
+					return fmt.Errorf("received enough refreshed tokens")
+				}
+			} else if event != eventLoggedIn {
+				t.Errorf("Received unexpected event type '%s' with data '%s'", event, data)
+			}
+			return nil
+		},
+	)
+	assert.Equal(t, []tokensEvent{
+		{AccessToken: "mock-access-token-1", RefreshToken: "mock-refresh-token-1", Expiration: 1},
+		{AccessToken: "mock-access-token-2", RefreshToken: "mock-refresh-token-2", Expiration: 1},
+	}, refreshedTokens)
+}
+
+func TestOIDCLoginHandlerWontStreamTokensByDefault(t *testing.T) {
+	t.Parallel()
+	context := NewContext(OIDCConfig{
+		BaseURI:          "http://localhost:8000/mock-idp",
+		RedirectURI:      "http://localhost:8001/cli-oidc-redirect",
+		AuthorizationURI: "http://localhost:8000/mock-idp/auth",
+		ClientId:         "client-id",
+		ClientSecret:     "client-secret",
+	})
+	server := httptest.NewServer(OIDCLoginHandler(context))
+	defer server.Close()
+	res, err := http.Get(fmt.Sprint(server.URL, "?token-stream=true"))
+	assert.NoError(t, err)
+	defer res.Body.Close()
+
+	events := []string{}
+	err = consumeSSEFromHTTPEventStream(
+		res.Body,
+		func(event, data string) error {
+			if event == eventAuthURI {
+				_ = context.onLoginSuccess(receivedState(t, data), &tokenResponse{AccessToken: "mock-access-token", RefreshToken: "mock-refresh-token", ExpiresIn: 1})
+			}
+			events = append(events, event)
+			return nil
+		},
+	)
+	// stream is closed after login
+	assert.NoError(t, err)
+	assert.Equal(t, []string{eventAuthURI, eventLoggedIn}, events)
+}
+
+func TestRefreshDelay(t *testing.T) {
+	t.Parallel()
+	assert.Equal(t, 270*time.Second, refreshDelay(300*time.Second, 30*time.Second))
+	assert.Equal(t, 500*time.Millisecond, refreshDelay(time.Second, 30*time.Second))
+}
@@ -0,0 +1,58 @@
+package ssotest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/mlosinsky/clisso/ssoclient"
+	"github.com/mlosinsky/clisso/ssoproxy"
+)
+
+// Client credentials of the proxy created by RunProxyLogin.
+const MockClientId = "mock-client-id"
+const MockClientSecret = "mock-client-secret"
+
+// Logs in at proxy's OIDCLoginHandler served on proxyLoginURI using ssoclient.LoginWithSSOProxyContext
+// like a CLI would. User's browser is simulated by requesting the received login URI and following
+// redirects, so a login against an IdP created by CreateMockOIDCServer completes without user interaction.
+// If the login URI can't be requested, the login is cancelled and the error is returned.
+func LoginThroughProxy(proxyLoginURI string) (*ssoclient.LoginResult, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var browserErr error
+	result, err := ssoclient.LoginWithSSOProxyContext(ctx, proxyLoginURI, func(loginURI string) {
+		res, err := http.Get(loginURI)
+		if err != nil {
+			browserErr = errors.Join(errors.New("failed to open login URI"), err)
+			cancel()
+			return
+		}
+		res.Body.Close()
+		if res.StatusCode >= http.StatusBadRequest {
+			browserErr = fmt.Errorf("login URI responded with status %d", res.StatusCode)
+			cancel()
+		}
+	})
+	if browserErr != nil {
+		return nil, browserErr
+	}
+	return result, err
+}
+
+// Runs a whole login in-process: creates a mock IdP with CreateMockOIDCServer and a proxy with CreateSSOProxy,
+// logs in with LoginThroughProxy and closes both servers. The proxy context can be configured by configure
+// before the login starts, configure can be nil.
+func RunProxyLogin(configure func(ctx *ssoproxy.Context)) (*ssoclient.LoginResult, error) {
+	oidcServer := CreateMockOIDCServer(MockClientId, MockClientSecret)
+	defer oidcServer.Close()
+	proxy, proxyContext := CreateSSOProxy(oidcServer.URL, MockClientId, MockClientSecret)
+	defer proxy.Close()
+	// ends a login left pending by a failed login, so the proxy server can be closed
+	defer proxyContext.Close()
+	if configure != nil {
+		configure(proxyContext)
+	}
+	return LoginThroughProxy(fmt.Sprint(proxy.URL, LoginPath))
+}
@@ -0,0 +1,37 @@
+package ssotest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mlosinsky/clisso/ssoproxy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunProxyLogin(t *testing.T) {
+	t.Parallel()
+	result, err := RunProxyLogin(func(ctx *ssoproxy.Context) {
+		ctx.LoginTimeout = 10 * time.Second
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, MockAccessToken, result.AccessToken)
+	assert.Equal(t, MockRefreshToken, result.RefreshToken)
+	assert.Equal(t, MockExpiresIn, result.Expiration)
+}
+
+func TestLoginThroughProxyFailsOnUnreachableLoginURI(t *testing.T) {
+	t.Parallel()
+	oidcServer := CreateMockOIDCServer(MockClientId, MockClientSecret)
+	defer oidcServer.Close()
+	proxy, proxyContext := CreateSSOProxy(oidcServer.URL, MockClientId, MockClientSecret)
+	defer proxy.Close()
+	defer proxyContext.Close()
+	// login URI pointing to unreachable IdP
+	oidcServer.Close()
+
+	start := time.Now()
+	result, err := LoginThroughProxy(proxy.URL + LoginPath)
+	assert.Nil(t, result)
+	assert.ErrorContains(t, err, "failed to open login URI")
+	assert.Less(t, time.Since(start), time.Second)
+}
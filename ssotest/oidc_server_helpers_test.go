@@ -0,0 +1,70 @@
+package ssotest
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+)
+
+// Values issued by the mock OIDC server.
+const MockAuthCode = "mock-auth-code"
+const MockAccessToken = "mock-access-token"
+const MockRefreshToken = "mock-refresh-token"
+const MockExpiresIn = 3600
+
+// Creates a mock OIDC Identity Provider that implements authorization code flow.
+//
+// The server exposes 2 endpoints:
+//
+//	"/auth" // logs the user in immediately and redirects to redirect_uri with code and state
+//	"/token" // exchanges the issued authorization code for mock tokens
+//
+// Both endpoints validate client credentials and the token endpoint also checks
+// that redirect_uri matches the one used on the authorization request.
+func CreateMockOIDCServer(clientId, clientSecret string) *httptest.Server {
+	// redirect URIs used on authorization requests, token requests must use one of them
+	authorizedRedirectURIs := sync.Map{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/auth", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Get("client_id") != clientId {
+			http.Error(w, fmt.Sprintf("Invalid client_id %s, expected %s", query.Get("client_id"), clientId), http.StatusBadRequest)
+			return
+		}
+		redirectURI, err := url.Parse(query.Get("redirect_uri"))
+		if err != nil || !redirectURI.IsAbs() {
+			http.Error(w, fmt.Sprintf("Invalid redirect_uri %s", query.Get("redirect_uri")), http.StatusBadRequest)
+			return
+		}
+		authorizedRedirectURIs.Store(redirectURI.String(), true)
+		redirectQuery := redirectURI.Query()
+		redirectQuery.Set("code", MockAuthCode)
+		redirectQuery.Set("state", query.Get("state"))
+		redirectURI.RawQuery = redirectQuery.Encode()
+		http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		if _, authorized := authorizedRedirectURIs.Load(r.Form.Get("redirect_uri")); !authorized {
+			http.Error(w, fmt.Sprintf("Invalid redirect_uri %s", r.Form.Get("redirect_uri")), http.StatusBadRequest)
+		} else if r.Form.Get("grant_type") != "authorization_code" {
+			http.Error(w, fmt.Sprintf("Invalid grant_type: %s", r.Form.Get("grant_type")), http.StatusBadRequest)
+		} else if r.Form.Get("code") != MockAuthCode {
+			http.Error(w, fmt.Sprintf("Invalid code %s, expected %s", r.Form.Get("code"), MockAuthCode), http.StatusBadRequest)
+		} else if r.Form.Get("client_id") != clientId {
+			http.Error(w, fmt.Sprintf("Invalid client_id %s, expected %s", r.Form.Get("client_id"), clientId), http.StatusBadRequest)
+		} else if r.Form.Get("client_secret") != clientSecret {
+			http.Error(w, "Invalid client_secret", http.StatusBadRequest)
+		} else {
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{
+				"access_token": "%s",
+				"refresh_token": "%s",
+				"expires_in": %d
+			}`, MockAccessToken, MockRefreshToken, MockExpiresIn)
+		}
+	})
+	return httptest.NewServer(mux)
+}
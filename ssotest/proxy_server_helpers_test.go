@@ -0,0 +1,38 @@
+package ssotest
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+
+	"github.com/mlosinsky/clisso/ssoproxy"
+)
+
+// Paths on which handlers of the proxy created by CreateSSOProxy are served.
+const LoginPath = "/cli-login"
+const RedirectPath = "/cli-logged-in"
+
+// Creates an in-process proxy serving OIDCLoginHandler on LoginPath and OIDCRedirectHandler on RedirectPath.
+// The proxy is configured against an IdP created by CreateMockOIDCServer with given client credentials.
+// The returned context can be used to further configure the proxy before a login is started.
+func CreateSSOProxy(oidcServerURL, clientId, clientSecret string) (*httptest.Server, *ssoproxy.Context) {
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	redirectURI := fmt.Sprint(server.URL, RedirectPath)
+	context := ssoproxy.NewContext(ssoproxy.OIDCConfig{
+		BaseURI:     oidcServerURL,
+		RedirectURI: redirectURI,
+		AuthorizationURI: fmt.Sprintf(
+			"%s/auth?response_type=code&scope=openid&client_id=%s&redirect_uri=%s",
+			oidcServerURL,
+			url.QueryEscape(clientId),
+			url.QueryEscape(redirectURI),
+		),
+		ClientId:     clientId,
+		ClientSecret: clientSecret,
+	})
+	mux.Handle(LoginPath, ssoproxy.OIDCLoginHandler(context))
+	mux.Handle(RedirectPath, ssoproxy.OIDCRedirectHandler(context))
+	return server, context
+}
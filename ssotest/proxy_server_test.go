@@ -0,0 +1,50 @@
+package ssotest
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/mlosinsky/clisso/ssoclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxyLoginInProcess(t *testing.T) {
+	t.Parallel()
+	oidcServer := CreateMockOIDCServer("mock-client-id", "mock-client-secret")
+	defer oidcServer.Close()
+	proxy, _ := CreateSSOProxy(oidcServer.URL, "mock-client-id", "mock-client-secret")
+	defer proxy.Close()
+
+	result, err := ssoclient.LoginWithSSOProxy(fmt.Sprint(proxy.URL, LoginPath), func(loginURI string) {
+		// log in as user, the mock IdP redirects back to the proxy
+		res, err := http.Get(loginURI)
+		require.NoError(t, err)
+		res.Body.Close()
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, MockAccessToken, result.AccessToken)
+	assert.Equal(t, MockRefreshToken, result.RefreshToken)
+	assert.Equal(t, MockExpiresIn, result.Expiration)
+}
+
+func TestProxyLoginOverRateLimitInProcess(t *testing.T) {
+	t.Parallel()
+	oidcServer := CreateMockOIDCServer(MockClientId, MockClientSecret)
+	defer oidcServer.Close()
+	proxy, proxyContext := CreateSSOProxy(oidcServer.URL, MockClientId, MockClientSecret)
+	defer proxy.Close()
+	proxyContext.LoginRateLimit = 1
+
+	_, err := LoginThroughProxy(fmt.Sprint(proxy.URL, LoginPath))
+	require.NoError(t, err)
+
+	_, err = LoginThroughProxy(fmt.Sprint(proxy.URL, LoginPath))
+	var loginErr *ssoclient.LoginError
+	require.ErrorAs(t, err, &loginErr)
+	assert.Equal(t, ssoclient.ErrorCategoryProxy, loginErr.Category)
+	assert.Equal(t, ssoclient.ErrorCodeRateLimited, loginErr.Code)
+	assert.Equal(t, http.StatusTooManyRequests, loginErr.StatusCode)
+}